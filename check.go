@@ -0,0 +1,21 @@
+package main
+
+import "github.com/dchenk/crop-replace/cropreplace"
+
+// The exit codes of a run in check mode, besides 0 when no crop reference needs to be replaced.
+const (
+	exitCheckIssues = 1 // some crop references need to be replaced
+	exitCheckFailed = 2 // the run failed, so it's not known whether any crop references need to be replaced
+)
+
+// checkExitCode returns the exit code of a run in check mode that made the counts in st and ended with runErr.
+func checkExitCode(st *cropreplace.Report, runErr error) int {
+	switch {
+	case runErr != nil:
+		return exitCheckFailed
+	case st.Replacements > 0 || st.MetaChanged > 0:
+		return exitCheckIssues
+	default:
+		return 0
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/dchenk/crop-replace/cropreplace"
+)
+
+func TestCheckExitCode(t *testing.T) {
+	cases := []struct {
+		st     cropreplace.Report
+		runErr error
+		code   int
+	}{
+		{cropreplace.Report{Scanned: 10}, nil, 0},
+		{cropreplace.Report{Scanned: 10, Missing: 2}, nil, 0},
+		{cropreplace.Report{Scanned: 10, Changed: 1, Replacements: 3}, nil, exitCheckIssues},
+		{cropreplace.Report{Scanned: 10, MetaScanned: 4, MetaChanged: 1}, nil, exitCheckIssues},
+		{cropreplace.Report{Scanned: 3}, errors.New("connection lost"), exitCheckFailed},
+		{cropreplace.Report{Scanned: 3, Changed: 1, Replacements: 1}, errors.New("connection lost"), exitCheckFailed},
+	}
+	for i, tc := range cases {
+		t.Run("case_"+strconv.Itoa(i), func(t *testing.T) {
+			if code := checkExitCode(&tc.st, tc.runErr); code != tc.code {
+				t.Errorf("got exit code %d but expected %d", code, tc.code)
+			}
+		})
+	}
+}
+
+// TestCheckMainExitCode runs main in check mode in a child process, which is given the arguments in the
+// CROP_REPLACE_ARGS environment variable.
+func TestCheckMainExitCode(t *testing.T) {
+	if args := os.Getenv("CROP_REPLACE_ARGS"); args != "" {
+		os.Args = append([]string{"crop-replace"}, strings.Fields(args)...)
+		main()
+		return
+	}
+
+	// Nothing listens on port 1, so the database cannot be queried.
+	required := "-check -bucket b -dbhost 127.0.0.1 -dbport 1 -dbname n -dbuser u -dbpass p -dbprefix wp_ " +
+		"-guidprefix https://example.com/uploads/ -nobucketprefix"
+	cases := []struct {
+		args string
+		code int
+	}{
+		{"-check", exitCheckFailed},
+		{required + " -batchsize 0", exitCheckFailed},
+		{required + " -backend ftp", exitCheckFailed},
+		{required + " -checkpoint checkpoint -maxchanges 5", exitCheckFailed},
+		{required, exitCheckFailed},
+	}
+	for i, tc := range cases {
+		t.Run("case_"+strconv.Itoa(i), func(t *testing.T) {
+			cmd := exec.Command(os.Args[0], "-test.run=^TestCheckMainExitCode$")
+			cmd.Env = append(os.Environ(), "CROP_REPLACE_ARGS="+tc.args)
+			var code int
+			if err := cmd.Run(); err != nil {
+				exitErr, ok := err.(*exec.ExitError)
+				if !ok {
+					t.Fatal(err)
+				}
+				code = exitErr.ExitCode()
+			}
+			if code != tc.code {
+				t.Errorf("got exit code %d but expected %d", code, tc.code)
+			}
+		})
+	}
+}
@@ -0,0 +1,124 @@
+package cropreplace
+
+import (
+	"bytes"
+	"context"
+	"path"
+	"strconv"
+
+	"cloud.google.com/go/storage"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+	"google.golang.org/api/option"
+)
+
+// An objectWriter uploads objects to a storage bucket.
+type objectWriter interface {
+	// Put creates or replaces the object with the given name, giving it the data as its content.
+	Put(ctx context.Context, name string, data []byte) error
+}
+
+// newObjectWriter creates an objectWriter for the named bucket on the given backend. Unlike for listing, the
+// requests are authenticated: with the default credentials on GCS or the usual AWS credential chain on S3.
+func (r *runner) newObjectWriter(backend, bucketName string) (objectWriter, error) {
+	httpClient, err := storageHTTPClient(r.cfg.HTTPProxy)
+	if err != nil {
+		return nil, err
+	}
+	if backend == backendS3 {
+		config := &aws.Config{Region: aws.String(r.cfg.Region)}
+		if httpClient != nil {
+			config.HTTPClient = httpClient
+		}
+		sess, err := session.NewSession(config)
+		if err != nil {
+			return nil, err
+		}
+		return &s3Writer{client: s3.New(sess), bucket: bucketName}, nil
+	}
+	ctx := context.Background()
+	opts := []option.ClientOption{option.WithScopes(storage.ScopeReadWrite)}
+	if httpClient != nil {
+		// The authenticated client must itself send its requests through the proxy.
+		authClient, err := google.DefaultClient(context.WithValue(ctx, oauth2.HTTPClient, httpClient),
+			storage.ScopeReadWrite)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, option.WithHTTPClient(authClient))
+	}
+	client, err := storage.NewClient(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &gcsWriter{handle: client.Bucket(bucketName)}, nil
+}
+
+// A gcsWriter uploads objects to a Google Cloud Storage bucket.
+type gcsWriter struct {
+	handle *storage.BucketHandle
+}
+
+func (g *gcsWriter) Put(ctx context.Context, name string, data []byte) error {
+	w := g.handle.Object(name).NewWriter(ctx)
+	w.ContentType = auditContentType
+	if _, err := w.Write(data); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+// An s3Putter is the part of the S3 API used by an s3Writer.
+type s3Putter interface {
+	PutObjectWithContext(aws.Context, *s3.PutObjectInput, ...request.Option) (*s3.PutObjectOutput, error)
+}
+
+// An s3Writer uploads objects to an Amazon S3 bucket.
+type s3Writer struct {
+	client s3Putter
+	bucket string
+}
+
+func (s *s3Writer) Put(ctx context.Context, name string, data []byte) error {
+	_, err := s.client.PutObjectWithContext(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(s.bucket),
+		Key:         aws.String(name),
+		Body:        bytes.NewReader(data),
+		ContentType: aws.String(auditContentType),
+	})
+	return err
+}
+
+// auditContentType is the content type of the objects uploaded for an audit trail.
+const auditContentType = "text/html; charset=utf-8"
+
+// auditPost uploads each column of the post p that u changes from before and after it is changed. The content
+// column is uploaded as the objects {prefix}/{postID}/before.html and {prefix}/{postID}/after.html, and each
+// extra column as {prefix}/{postID}/{column}/before.html and {prefix}/{postID}/{column}/after.html. If prefix is
+// empty, the object names begin with the post ID.
+func (r *runner) auditPost(ctx context.Context, w objectWriter, prefix string, p *post, u *columnUpdate) error {
+	postDir := path.Join(prefix, strconv.FormatInt(p.ID, 10))
+	for i, column := range u.columns {
+		dir, before := postDir, p.content
+		if column != r.cfg.ContentColumn {
+			dir = path.Join(postDir, column)
+			for j := range r.postColumns {
+				if r.postColumns[j] == column {
+					before = p.extra[j]
+				}
+			}
+		}
+		if err := w.Put(ctx, dir+"/before.html", []byte(before)); err != nil {
+			return err
+		}
+		if err := w.Put(ctx, dir+"/after.html", []byte(u.values[i].(string))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
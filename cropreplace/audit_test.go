@@ -0,0 +1,143 @@
+package cropreplace
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strconv"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// A memWriter is an objectWriter keeping the objects put in memory. If fail is set, every put fails; otherwise, if
+// failName is set, putting the object with that name fails.
+type memWriter struct {
+	objects  map[string]string
+	fail     bool
+	failName string
+}
+
+func (m *memWriter) Put(_ context.Context, name string, data []byte) error {
+	if m.fail || name == m.failName {
+		return errors.New("upload failed")
+	}
+	m.objects[name] = string(data)
+	return nil
+}
+
+func TestAuditPost(t *testing.T) {
+	r := newRunner(DefaultConfig())
+	r.postColumns = []string{"post_excerpt"}
+
+	p := &post{ID: 12, content: "old", extra: []string{"old excerpt"}}
+	cases := []struct {
+		prefix  string
+		columns []string
+		want    map[string]string
+	}{
+		{"", []string{"post_content"}, map[string]string{"12/before.html": "old", "12/after.html": "new"}},
+		{"audit/2018", []string{"post_content"},
+			map[string]string{"audit/2018/12/before.html": "old", "audit/2018/12/after.html": "new"}},
+		{"audit/", []string{"post_content"},
+			map[string]string{"audit/12/before.html": "old", "audit/12/after.html": "new"}},
+		{"audit", []string{"post_excerpt"}, map[string]string{
+			"audit/12/post_excerpt/before.html": "old excerpt", "audit/12/post_excerpt/after.html": "new",
+		}},
+		{"", []string{"post_content", "post_excerpt"}, map[string]string{
+			"12/before.html": "old", "12/after.html": "new",
+			"12/post_excerpt/before.html": "old excerpt", "12/post_excerpt/after.html": "new",
+		}},
+	}
+	for i, tc := range cases {
+		t.Run("case_"+strconv.Itoa(i), func(t *testing.T) {
+			var u columnUpdate
+			for _, column := range tc.columns {
+				u.set(column, "new")
+			}
+			w := &memWriter{objects: make(map[string]string)}
+			if err := r.auditPost(context.Background(), w, tc.prefix, p, &u); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(w.objects, tc.want) {
+				t.Errorf("got objects %v but expected %v", w.objects, tc.want)
+			}
+		})
+	}
+}
+
+func TestReplaceImageCropsAudit(t *testing.T) {
+	r := newRunner(DefaultConfig())
+	atts := []attachment{
+		{fileName: "/2018/bcd.png", ext: ".png"},
+	}
+	posts := []fakePost{
+		{ID: 1, postType: "post", content: "<img src='/2018/bcd-30x15.png'>"},
+		{ID: 2, postType: "post", content: "no images"},
+	}
+	const updated = "<img src='/2018/bcd.png'>"
+	cases := []struct {
+		fail, cont bool
+		content    string
+		unaudited  int
+	}{
+		{false, false, updated, 0},
+		{true, false, posts[0].content, 1},
+		{true, true, updated, 0},
+	}
+	for i, tc := range cases {
+		t.Run("case_"+strconv.Itoa(i), func(t *testing.T) {
+			db, fdb := newFakeDB(t, posts...)
+			defer db.Close()
+			defer func(orig bool) { r.cfg.AuditContinue = orig }(r.cfg.AuditContinue)
+			r.cfg.AuditContinue = tc.cont
+
+			w := &memWriter{objects: make(map[string]string), fail: tc.fail}
+			st := newReport()
+			err := r.replaceImageCrops(context.Background(), sqlDB{db}, []string{"post"}, r.newFileIndex(atts), w, nil, st)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := fdb.content(1); got != tc.content {
+				t.Errorf("got content %q but expected %q", got, tc.content)
+			}
+			if st.Unaudited != tc.unaudited {
+				t.Errorf("got %d posts unaudited but expected %d", st.Unaudited, tc.unaudited)
+			}
+			if !tc.fail {
+				want := map[string]string{"1/before.html": posts[0].content, "1/after.html": updated}
+				if !reflect.DeepEqual(w.objects, want) {
+					t.Errorf("got objects %v but expected %v", w.objects, want)
+				}
+			}
+		})
+	}
+}
+
+// A recordingS3 is an s3Putter recording the objects put.
+type recordingS3 struct {
+	inputs []*s3.PutObjectInput
+}
+
+func (r *recordingS3) PutObjectWithContext(_ aws.Context, in *s3.PutObjectInput, _ ...request.Option) (*s3.PutObjectOutput, error) {
+	r.inputs = append(r.inputs, in)
+	return &s3.PutObjectOutput{}, nil
+}
+
+func TestS3Writer(t *testing.T) {
+	client := &recordingS3{}
+	w := &s3Writer{client: client, bucket: "audit"}
+	if err := w.Put(context.Background(), "1/before.html", []byte("old")); err != nil {
+		t.Fatal(err)
+	}
+	if len(client.inputs) != 1 {
+		t.Fatalf("got %d puts but expected 1", len(client.inputs))
+	}
+	in := client.inputs[0]
+	if aws.StringValue(in.Bucket) != "audit" || aws.StringValue(in.Key) != "1/before.html" ||
+		aws.StringValue(in.ContentType) != auditContentType {
+		t.Errorf("got put input %v", in)
+	}
+}
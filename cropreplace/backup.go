@@ -0,0 +1,239 @@
+package cropreplace
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+// A backupRow holds the original values of the columns of a post that are changed, as written to the backup file.
+type backupRow struct {
+	ID      int64             `json:"ID"`
+	Content *string           `json:"post_content,omitempty"` // the content, if it is changed
+	Extra   map[string]string `json:"extra,omitempty"`        // the extra columns changed, keyed by name
+}
+
+// A backupFile is a file to which the original values of the posts changed in a transaction are appended as JSON,
+// one post per line. The rows are kept until the transaction is about to be committed, so that no rows are written
+// for the posts of a transaction that is rolled back.
+type backupFile struct {
+	f    *os.File
+	rows []backupRow // the rows of the posts changed, not yet written
+	size int64       // the size of the file before the rows were last written
+
+	contentColumn string   // the ContentColumn
+	extraColumns  []string // the extra columns of the posts
+}
+
+// openBackup opens the backup file at path, creating it if it does not exist.
+func (r *runner) openBackup(path string) (*backupFile, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &backupFile{f: f, contentColumn: r.cfg.ContentColumn, extraColumns: r.postColumns}, nil
+}
+
+// add keeps the original values of the columns of p about to be changed, to be written with write.
+func (b *backupFile) add(p *post, columns []string) {
+	row := backupRow{ID: p.ID}
+	if containsString(columns, b.contentColumn) {
+		content := p.content
+		row.Content = &content
+	}
+	for j, column := range b.extraColumns {
+		if containsString(columns, column) {
+			if row.Extra == nil {
+				row.Extra = make(map[string]string)
+			}
+			row.Extra[column] = p.extra[j]
+		}
+	}
+	b.rows = append(b.rows, row)
+}
+
+// write appends the rows kept to the file and syncs it, so that they are on the disk before the transaction is
+// committed. If the rows cannot all be written, those written are removed again.
+func (b *backupFile) write() error {
+	info, err := b.f.Stat()
+	if err != nil {
+		return err
+	}
+	b.size = info.Size()
+	rows := b.rows
+	b.rows = nil
+	buf := bufio.NewWriter(b.f)
+	for i := range rows {
+		line, err := json.Marshal(&rows[i])
+		if err != nil {
+			return err
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+	if err = buf.Flush(); err == nil {
+		err = b.f.Sync()
+	}
+	if err != nil {
+		b.undo()
+	}
+	return err
+}
+
+// undo removes the rows last written, as is done when the transaction for which they were written is not committed.
+func (b *backupFile) undo() error {
+	return b.f.Truncate(b.size)
+}
+
+// close closes the file. It may be called more than once.
+func (b *backupFile) close() error {
+	if b.f == nil {
+		return nil
+	}
+	f := b.f
+	b.f = nil
+	return f.Close()
+}
+
+// restoreBackup sets the columns of each post listed in the backup file at path back to the values backed up, in a
+// single transaction. If a post is listed more than once, as it is when backups of several runs are appended to the
+// same file, the value first backed up is restored to each column. Only the columns backed up are restored, and only
+// those whose values differ from the ones backed up are updated. Posts that no longer exist are reported and skipped.
+// If DryRun is set, the transaction is rolled back.
+func (r *runner) restoreBackup(ctx context.Context, db *sql.DB, path string) error {
+	rows, err := r.readBackup(path)
+	if err != nil {
+		return err
+	}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("could not begin transaction; %v", err)
+	}
+	update := updateStmts{run: r, tx: tx}
+	rollback := func() {
+		update.close()
+		if err := tx.Rollback(); err != nil {
+			r.printErr("rolling back after failure", err)
+		}
+	}
+	for _, row := range mergeBackupRows(rows) {
+		columns, values := row.columns(r.cfg.ContentColumn)
+		current, err := r.queryColumns(tx, row.ID, columns)
+		if err == sql.ErrNoRows {
+			r.printErr(fmt.Sprintf("not restoring post %d", row.ID), errors.New("the post no longer exists"))
+			continue
+		} else if err != nil {
+			rollback()
+			return fmt.Errorf("could not check for post %d; %v", row.ID, err)
+		}
+		var u columnUpdate
+		for j, column := range columns {
+			if !current[j].Valid || current[j].String != values[j] {
+				u.set(column, values[j])
+			}
+		}
+		if len(u.columns) == 0 {
+			r.logWith(levelInfo, logFields{"post_id": row.ID}, "Post %d already has the values backed up", row.ID)
+			continue
+		}
+		if r.cfg.DryRun {
+			r.logWith(levelInfo, logFields{"post_id": row.ID}, "Would restore %d", row.ID)
+			continue
+		}
+		r.logWith(levelInfo, logFields{"post_id": row.ID}, "Restoring %d", row.ID)
+		if err := update.exec(&u, row.ID); err != nil {
+			rollback()
+			return err
+		}
+	}
+	update.close()
+	if r.cfg.DryRun {
+		r.logInfo("Dry run, so rolling back without modifying the database.")
+		return tx.Rollback()
+	}
+	r.logInfo("Committing database modifications.")
+	return tx.Commit()
+}
+
+// columns returns the names of the columns backed up in the row, the content column (named contentColumn) first,
+// with their values.
+func (row *backupRow) columns(contentColumn string) (columns, values []string) {
+	if row.Content != nil {
+		columns, values = append(columns, contentColumn), append(values, *row.Content)
+	}
+	for _, column := range sortedKeys(row.Extra) {
+		columns, values = append(columns, column), append(values, row.Extra[column])
+	}
+	return columns, values
+}
+
+// mergeBackupRows merges the rows backing up the same post into one, in the order in which the posts are first
+// listed, keeping for each column the value first backed up.
+func mergeBackupRows(rows []backupRow) []backupRow {
+	index := make(map[int64]int, len(rows))
+	var merged []backupRow
+	for _, row := range rows {
+		i, ok := index[row.ID]
+		if !ok {
+			i = len(merged)
+			index[row.ID] = i
+			merged = append(merged, backupRow{ID: row.ID})
+		}
+		m := &merged[i]
+		if m.Content == nil {
+			m.Content = row.Content
+		}
+		for column, value := range row.Extra {
+			if _, ok := m.Extra[column]; !ok {
+				if m.Extra == nil {
+					m.Extra = make(map[string]string)
+				}
+				m.Extra[column] = value
+			}
+		}
+	}
+	return merged
+}
+
+// readBackup reads the rows of the backup file at path, checking that the names of the extra columns are valid.
+func (r *runner) readBackup(path string) ([]backupRow, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var rows []backupRow
+	dec := json.NewDecoder(f)
+	for {
+		var row backupRow
+		if err := dec.Decode(&row); err == io.EOF {
+			return rows, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("could not read backup row %d; %v", len(rows)+1, err)
+		}
+		if row.ID < 1 {
+			return nil, fmt.Errorf("backup row %d has the invalid ID %d", len(rows)+1, row.ID)
+		}
+		if _, err := r.parseColumns(strings.Join(sortedKeys(row.Extra), ",")); err != nil {
+			return nil, fmt.Errorf("backup row %d is invalid; %v", len(rows)+1, err)
+		}
+		rows = append(rows, row)
+	}
+}
+
+// sortedKeys returns the keys of m in order.
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
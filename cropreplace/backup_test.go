@@ -0,0 +1,252 @@
+package cropreplace
+
+import (
+	"bufio"
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func TestReplaceImageCropsBackup(t *testing.T) {
+	r := newRunner(DefaultConfig())
+	r.postColumns = []string{"post_excerpt"}
+
+	dir, err := ioutil.TempDir("", "crop-replace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	r.cfg.Backup = filepath.Join(dir, "backup.jsonl")
+
+	atts := []attachment{
+		{
+			fileName: "/2018/bcd.png", ext: ".png",
+			crops: []crop{
+				{"200x180", 200, 180, ""},
+			},
+		},
+	}
+	const (
+		broken = "<img src='/2018/bcd-210x195.png'>"
+		fixed  = "<img src='/2018/bcd-200x180.png'>"
+	)
+	db, _ := newFakeDB(t,
+		fakePost{ID: 1, postType: "post", content: broken, extra: map[string]string{"post_excerpt": "text"}},
+		fakePost{ID: 2, postType: "post", content: fixed, extra: map[string]string{"post_excerpt": fixed}},
+		fakePost{ID: 3, postType: "post", content: "text", extra: map[string]string{"post_excerpt": broken}},
+	)
+	defer db.Close()
+
+	err = r.replaceImageCrops(context.Background(), sqlDB{db}, []string{"post"}, r.newFileIndex(atts), nil, nil,
+		newReport())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(r.cfg.Backup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var rows []backupRow
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		var row backupRow
+		if err := json.Unmarshal(sc.Bytes(), &row); err != nil {
+			t.Fatal(err)
+		}
+		rows = append(rows, row)
+	}
+	if err := sc.Err(); err != nil {
+		t.Fatal(err)
+	}
+	content := broken
+	want := []backupRow{
+		{ID: 1, Content: &content},
+		{ID: 3, Extra: map[string]string{"post_excerpt": broken}},
+	}
+	if !reflect.DeepEqual(rows, want) {
+		t.Errorf("got backup rows %+v but expected %+v", rows, want)
+	}
+}
+
+func TestReplaceImageCropsBackupRolledBack(t *testing.T) {
+	r := newRunner(DefaultConfig())
+	dir, err := ioutil.TempDir("", "crop-replace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	r.cfg.Backup = filepath.Join(dir, "backup.jsonl")
+	r.cfg.MaxChanges = 1
+
+	atts := []attachment{
+		{
+			fileName: "/2018/bcd.png", ext: ".png",
+			crops: []crop{
+				{"200x180", 200, 180, ""},
+			},
+		},
+	}
+	const broken = "<img src='/2018/bcd-210x195.png'>"
+	db, _ := newFakeDB(t,
+		fakePost{ID: 1, postType: "post", content: broken},
+		fakePost{ID: 2, postType: "post", content: broken},
+	)
+	defer db.Close()
+
+	err = r.replaceImageCrops(context.Background(), sqlDB{db}, []string{"post"}, r.newFileIndex(atts), nil, nil,
+		newReport())
+	if err == nil {
+		t.Fatal("expected an error for too many changes")
+	}
+	data, err := ioutil.ReadFile(r.cfg.Backup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) > 0 {
+		t.Errorf("got backup rows %q for posts not changed", data)
+	}
+}
+
+func TestRestoreBackup(t *testing.T) {
+	r := newRunner(DefaultConfig())
+	r.postColumns = []string{"post_excerpt"}
+
+	dir, err := ioutil.TempDir("", "crop-replace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	r.cfg.Backup = filepath.Join(dir, "backup.jsonl")
+
+	atts := []attachment{
+		{
+			fileName: "/2018/bcd.png", ext: ".png",
+			crops: []crop{
+				{"200x180", 200, 180, ""},
+			},
+		},
+	}
+	const (
+		broken = "<img src='/2018/bcd-210x195.png'>"
+		fixed  = "<img src='/2018/bcd-200x180.png'>"
+	)
+	posts := []fakePost{
+		{ID: 1, postType: "post", content: broken, extra: map[string]string{"post_excerpt": broken}},
+		{ID: 2, postType: "post", content: fixed, extra: map[string]string{"post_excerpt": "text"}},
+		{ID: 3, postType: "post", content: broken, extra: map[string]string{"post_excerpt": "text"}},
+		{ID: 4, postType: "post", content: "text", extra: map[string]string{"post_excerpt": broken}},
+	}
+	db, fdb := newFakeDB(t, posts...)
+	defer db.Close()
+
+	// The backups of two runs are appended, the second after post 1 is edited by hand.
+	err = r.replaceImageCrops(context.Background(), sqlDB{db}, []string{"post"}, r.newFileIndex(atts), nil, nil,
+		newReport())
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := fdb.posts[1]
+	p.content = broken + "edited"
+	fdb.posts[1] = p
+	err = r.replaceImageCrops(context.Background(), sqlDB{db}, []string{"post"}, r.newFileIndex(atts), nil, nil,
+		newReport())
+	if err != nil {
+		t.Fatal(err)
+	}
+	delete(fdb.posts, 3)
+
+	if err := r.restoreBackup(context.Background(), db, r.cfg.Backup); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []fakePost{posts[0], posts[1], posts[3]} {
+		if got := fdb.content(p.ID); got != p.content {
+			t.Errorf("got content %q for post %d but expected %q", got, p.ID, p.content)
+		}
+		if got := fdb.value(p.ID, "post_excerpt"); got != p.extra["post_excerpt"] {
+			t.Errorf("got excerpt %q for post %d but expected %q", got, p.ID, p.extra["post_excerpt"])
+		}
+	}
+	if _, ok := fdb.posts[3]; ok {
+		t.Error("post 3 was restored after it was deleted")
+	}
+}
+
+func TestRestoreBackupUnchanged(t *testing.T) {
+	r := newRunner(DefaultConfig())
+	dir, err := ioutil.TempDir("", "crop-replace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "backup.jsonl")
+	data := `{"ID": 1, "post_content": "a", "extra": {"post_excerpt": "b"}}
+{"ID": 2, "extra": {"post_excerpt": "b"}}
+{"ID": 2, "post_content": "c", "extra": {"post_excerpt": "d"}}
+{"ID": 1, "post_content": "e"}
+`
+	if err := ioutil.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	// Post 1 already holds the values backed up, and post 2 only its content.
+	db, fdb := newFakeDB(t,
+		fakePost{ID: 1, postType: "post", content: "a", extra: map[string]string{"post_excerpt": "b"}},
+		fakePost{ID: 2, postType: "post", content: "c", extra: map[string]string{"post_excerpt": "x"}},
+	)
+	defer db.Close()
+
+	if err := r.restoreBackup(context.Background(), db, path); err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		ID      int64
+		content string
+		excerpt string
+	}{
+		{1, "a", "b"},
+		{2, "c", "b"},
+	}
+	for _, tc := range cases {
+		if got := fdb.content(tc.ID); got != tc.content {
+			t.Errorf("got content %q for post %d but expected %q", got, tc.ID, tc.content)
+		}
+		if got := fdb.value(tc.ID, "post_excerpt"); got != tc.excerpt {
+			t.Errorf("got excerpt %q for post %d but expected %q", got, tc.ID, tc.excerpt)
+		}
+	}
+	want := []fakeExec{{"UPDATE `" + r.tableName() + "` SET post_excerpt = ? WHERE ID = ?", []driver.Value{"b", int64(2)}}}
+	if !reflect.DeepEqual(fdb.updates, want) {
+		t.Errorf("got updates %+v but expected %+v", fdb.updates, want)
+	}
+}
+
+func TestReadBackupInvalid(t *testing.T) {
+	r := newRunner(DefaultConfig())
+	dir, err := ioutil.TempDir("", "crop-replace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for i, data := range []string{
+		`{"ID": 1, "post_content": "a"`,
+		`{"ID": 0, "post_content": "a"}`,
+		`{"ID": 1, "post_content": "a", "extra": {"post_excerpt = 'x', post_title": "b"}}`,
+	} {
+		t.Run("case_"+strconv.Itoa(i), func(t *testing.T) {
+			path := filepath.Join(dir, "backup.jsonl")
+			if err := ioutil.WriteFile(path, []byte(data), 0600); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := r.readBackup(path); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
@@ -0,0 +1,28 @@
+package cropreplace
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrBudgetExhausted is returned by Run and replaceImageCrops when they stop early, after committing the updates
+// made, because the MaxRuntime budget is exhausted.
+var ErrBudgetExhausted = errors.New("the maxruntime budget is exhausted")
+
+// timeNow returns the current time. Tests may replace it.
+var timeNow = time.Now
+
+// budgetDeadline returns the deadline of a run started at start with the given budget. A twentieth of the
+// budget, but no more than a minute, is left for committing the updates.
+func budgetDeadline(start time.Time, budget time.Duration) time.Time {
+	reserve := budget / 20
+	if reserve > time.Minute {
+		reserve = time.Minute
+	}
+	return start.Add(budget - reserve)
+}
+
+// budgetExhausted says whether the deadline of the run has passed.
+func (r *runner) budgetExhausted() bool {
+	return !r.runDeadline.IsZero() && !timeNow().Before(r.runDeadline)
+}
@@ -0,0 +1,70 @@
+package cropreplace
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestBudgetDeadline(t *testing.T) {
+	start := time.Date(2018, 11, 5, 2, 0, 0, 0, time.UTC)
+	if got, want := budgetDeadline(start, 10*time.Minute), start.Add(570*time.Second); !got.Equal(want) {
+		t.Errorf("got %v but expected %v", got, want)
+	}
+	if got, want := budgetDeadline(start, 2*time.Hour), start.Add(119*time.Minute); !got.Equal(want) {
+		t.Errorf("got %v but expected %v", got, want)
+	}
+}
+
+func TestReplaceImageCropsBudgetExhausted(t *testing.T) {
+	r := newRunner(DefaultConfig())
+	defer func(orig func() time.Time) { timeNow = orig }(timeNow)
+	r.cfg.ScanMeta = true
+
+	// Each check of the time is a minute later, so the budget is exhausted before the third post is scanned.
+	start := time.Date(2018, 11, 5, 2, 0, 0, 0, time.UTC)
+	now := start
+	timeNow = func() time.Time {
+		now = now.Add(time.Minute)
+		return now
+	}
+	r.runDeadline = start.Add(150 * time.Second)
+
+	atts := []attachment{
+		{
+			fileName: "/2018/bcd.png", ext: ".png",
+			crops: []crop{
+				{"200x180", 200, 180, ""},
+			},
+		},
+	}
+	const (
+		broken = "<img src='/2018/bcd-210x195.png'>"
+		fixed  = "<img src='/2018/bcd-200x180.png'>"
+	)
+	db, fdb := newFakeDB(t,
+		fakePost{ID: 1, postType: "post", content: broken},
+		fakePost{ID: 2, postType: "post", content: broken},
+		fakePost{ID: 3, postType: "post", content: broken},
+	)
+	defer db.Close()
+	fdb.addMeta(fakeMeta{ID: 1, postID: 1, value: broken})
+
+	st := newReport()
+	err := r.replaceImageCrops(context.Background(), sqlDB{db}, []string{"post"}, r.newFileIndex(atts), nil, nil, st)
+	if err != ErrBudgetExhausted {
+		t.Fatalf("got error %v but expected %v", err, ErrBudgetExhausted)
+	}
+	for id, want := range map[int64]string{1: fixed, 2: fixed, 3: broken} {
+		if got := fdb.content(id); got != want {
+			t.Errorf("got content %q for post %d but expected %q", got, id, want)
+		}
+	}
+	if fdb.commits != 1 || fdb.rollbacks != 0 {
+		t.Errorf("got %d commits and %d rollbacks but expected 1 and 0", fdb.commits, fdb.rollbacks)
+	}
+	if st.Scanned != 2 || st.Changed != 2 || st.MetaScanned != 0 {
+		t.Errorf("got %d scanned, %d changed, and %d meta scanned but expected 2, 2, and 0",
+			st.Scanned, st.Changed, st.MetaScanned)
+	}
+}
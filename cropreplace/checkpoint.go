@@ -0,0 +1,219 @@
+package cropreplace
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// randomCheckpointHeader is the first line of a checkpoint file written by a run in random order, which is followed
+// by the ID of each post committed on a line of its own.
+const randomCheckpointHeader = "random"
+
+// readCheckpoint returns the post ID recorded in the checkpoint file at path, or 0 if there is no file.
+func readCheckpoint(path string) (int64, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	text := strings.TrimSpace(string(data))
+	if strings.HasPrefix(text, randomCheckpointHeader) {
+		return 0, fmt.Errorf("the checkpoint file %s was written by a run in random order", path)
+	}
+	id, err := strconv.ParseInt(text, 10, 64)
+	if err != nil || id < 0 {
+		return 0, fmt.Errorf("the checkpoint file %s does not hold a post ID", path)
+	}
+	return id, nil
+}
+
+// writeCheckpoint records the post ID in the checkpoint file at path.
+func writeCheckpoint(path string, id int64) error {
+	return writeFile(path, []byte(strconv.FormatInt(id, 10)+"\n"))
+}
+
+// readCheckpointSet returns the set of the post IDs recorded in the checkpoint file at path by a run in random
+// order, which is empty if there is no file.
+func readCheckpointSet(path string) (map[int64]bool, error) {
+	done := make(map[int64]bool)
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return done, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	lines := strings.Fields(string(data))
+	if len(lines) == 0 || lines[0] != randomCheckpointHeader {
+		return nil, fmt.Errorf("the checkpoint file %s was not written by a run in random order", path)
+	}
+	for _, line := range lines[1:] {
+		id, err := strconv.ParseInt(line, 10, 64)
+		if err != nil || id < 1 {
+			return nil, fmt.Errorf("the checkpoint file %s holds %q, which is not a post ID", path, line)
+		}
+		done[id] = true
+	}
+	return done, nil
+}
+
+// writeCheckpointSet records the set of post IDs in the checkpoint file at path, in order.
+func writeCheckpointSet(path string, done map[int64]bool) error {
+	ids := make([]int64, 0, len(done))
+	for id := range done {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	var b strings.Builder
+	b.WriteString(randomCheckpointHeader + "\n")
+	for _, id := range ids {
+		b.WriteString(strconv.FormatInt(id, 10) + "\n")
+	}
+	return writeFile(path, []byte(b.String()))
+}
+
+// replaceInChunks runs replaceImageCrops on chunks of up to the checkpointevery number of posts, in order of ID,
+// committing each chunk in its own transaction. It starts after the post ID recorded in the checkpoint file and, after
+// committing each chunk, records there the highest ID of the posts in it, so that a run that fails or is stopped can be
+// resumed. If a post in a chunk could not be audited, the run stops after the chunk, and the ID recorded is below that
+// of the post, so that it's transformed again on resume. On a dry run, the file is read but not written. If ScanOrder
+// is random, the chunks are chosen by replaceInRandomChunks instead.
+func (r *runner) replaceInChunks(ctx context.Context, db beginner, postTypes []string, files *fileIndex,
+	audit objectWriter, sign signFunc, st *Report) error {
+	if r.cfg.ScanOrder == scanRandom {
+		return r.replaceInRandomChunks(ctx, db, postTypes, files, audit, sign, st)
+	}
+	defer func(orig int64, origChunk int, origHeld []int64) {
+		r.resumeAfter, r.chunkPosts, r.heldPosts = orig, origChunk, origHeld
+	}(r.resumeAfter, r.chunkPosts, r.heldPosts)
+	var err error
+	if r.resumeAfter, err = readCheckpoint(r.cfg.Checkpoint); err != nil {
+		return err
+	}
+	if r.resumeAfter > 0 {
+		r.logInfo("Resuming after the post with ID %d.", r.resumeAfter)
+	}
+	r.chunkPosts = r.cfg.CheckpointEvery
+	for {
+		scanned := st.Scanned
+		r.heldPosts = nil
+		err := r.replaceImageCrops(ctx, db, postTypes, files, audit, sign, st)
+		if err != nil && err != ErrBudgetExhausted {
+			return err
+		}
+		done := st.LastID // every post up to it is committed or deliberately left unchanged
+		if len(r.heldPosts) > 0 {
+			done = r.heldPosts[0] - 1
+		}
+		if st.Scanned > scanned && done > r.resumeAfter {
+			r.resumeAfter = done
+			if !r.cfg.DryRun {
+				if err := writeCheckpoint(r.cfg.Checkpoint, r.resumeAfter); err != nil {
+					return fmt.Errorf("writing the checkpoint file; %v", err)
+				}
+				r.logInfo("Committed the posts up to ID %d.", r.resumeAfter)
+			}
+		}
+		if len(r.heldPosts) > 0 {
+			return fmt.Errorf("stopped at the post with ID %d, which could not be uploaded to the audit bucket; "+
+				"run the program again to resume from it", r.heldPosts[0])
+		}
+		if err != nil || st.Scanned-scanned < r.chunkPosts {
+			return err
+		}
+	}
+}
+
+// replaceInRandomChunks is replaceInChunks for a run in random order. Since posts with lower IDs may be left for
+// later, no single ID tells how far such a run got, so the checkpoint file records the ID of every post committed
+// instead. The file grows with the number of posts committed and is rewritten after each chunk, which is the price
+// of resuming in random order. The posts not yet recorded are shuffled and split into chunks, each transformed by
+// replaceImageCrops as the only postIDs. The posts that could not be audited are not recorded, and the run stops
+// after their chunk.
+func (r *runner) replaceInRandomChunks(ctx context.Context, db beginner, postTypes []string, files *fileIndex,
+	audit objectWriter, sign signFunc, st *Report) error {
+	defer func(origIDs, origScanned, origHeld []int64) {
+		r.postIDs, r.scannedPosts, r.heldPosts = origIDs, origScanned, origHeld
+	}(r.postIDs, r.scannedPosts, r.heldPosts)
+	done, err := readCheckpointSet(r.cfg.Checkpoint)
+	if err != nil {
+		return err
+	}
+	if len(done) > 0 {
+		r.logInfo("Resuming after the %d posts already committed.", len(done))
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("could not begin transaction; %v", err)
+	}
+	ids, err := r.queryPostIDs(tx, postTypes)
+	tx.Rollback()
+	if err != nil {
+		return err
+	}
+	left := remainingPosts(ids, done)
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+	rnd.Shuffle(len(left), func(i, j int) { left[i], left[j] = left[j], left[i] })
+	for len(left) > 0 {
+		n := r.cfg.CheckpointEvery
+		if n > len(left) {
+			n = len(left)
+		}
+		r.postIDs, left = left[:n], left[n:]
+		r.scannedPosts, r.heldPosts = []int64{}, nil
+		err := r.replaceImageCrops(ctx, db, postTypes, files, audit, sign, st)
+		if err != nil && err != ErrBudgetExhausted {
+			return err
+		}
+		before := len(done)
+		for _, id := range r.scannedPosts {
+			if !containsID(r.heldPosts, id) {
+				done[id] = true
+			}
+		}
+		if len(done) > before && !r.cfg.DryRun {
+			if err := writeCheckpointSet(r.cfg.Checkpoint, done); err != nil {
+				return fmt.Errorf("writing the checkpoint file; %v", err)
+			}
+			r.logInfo("Committed %d posts in all.", len(done))
+		}
+		if len(r.heldPosts) > 0 {
+			return fmt.Errorf("stopped after the chunk with the post with ID %d, which could not be uploaded to the "+
+				"audit bucket; run the program again to resume", r.heldPosts[0])
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// remainingPosts returns the IDs that are not in the done set, in their order.
+func remainingPosts(ids []int64, done map[int64]bool) []int64 {
+	var left []int64
+	for _, id := range ids {
+		if !done[id] {
+			left = append(left, id)
+		}
+	}
+	return left
+}
+
+// containsID says whether ids contains the ID.
+func containsID(ids []int64, id int64) bool {
+	for _, v := range ids {
+		if v == id {
+			return true
+		}
+	}
+	return false
+}
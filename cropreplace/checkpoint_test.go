@@ -0,0 +1,338 @@
+package cropreplace
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func TestReadCheckpoint(t *testing.T) {
+	dir, err := ioutil.TempDir("", "crop-replace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cases := []struct {
+		data string // the contents of the file, which is not written if empty
+		id   int64
+		ok   bool
+	}{
+		{"", 0, true},
+		{"42\n", 42, true},
+		{" 7 ", 7, true},
+		{"0", 0, true},
+		{"-3", 0, false},
+		{"abc", 0, false},
+	}
+	for i, tc := range cases {
+		t.Run("case_"+strconv.Itoa(i), func(t *testing.T) {
+			path := filepath.Join(dir, "checkpoint"+strconv.Itoa(i))
+			if tc.data != "" {
+				if err := ioutil.WriteFile(path, []byte(tc.data), 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			id, err := readCheckpoint(path)
+			if tc.ok != (err == nil) {
+				t.Fatalf("got error %v but expected ok to be %v", err, tc.ok)
+			}
+			if id != tc.id {
+				t.Errorf("got ID %d but expected %d", id, tc.id)
+			}
+		})
+	}
+}
+
+func TestReplaceInChunks(t *testing.T) {
+	r := newRunner(DefaultConfig())
+	dir, err := ioutil.TempDir("", "crop-replace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	r.cfg.Checkpoint = filepath.Join(dir, "checkpoint")
+	r.cfg.CheckpointEvery = 2
+
+	atts := []attachment{
+		{
+			fileName: "/2018/bcd.png", ext: ".png",
+			crops: []crop{
+				{"200x180", 200, 180, ""},
+			},
+		},
+	}
+	const (
+		broken = "<img src='/2018/bcd-210x195.png'>"
+		fixed  = "<img src='/2018/bcd-200x180.png'>"
+	)
+	var posts []fakePost
+	for id := int64(1); id <= 5; id++ {
+		posts = append(posts, fakePost{ID: id, postType: "post", content: broken})
+	}
+	db, fdb := newFakeDB(t, posts...)
+	defer db.Close()
+
+	// The run is resumed after the posts up to ID 2, as if an earlier run had committed them but not fixed them.
+	if err := writeCheckpoint(r.cfg.Checkpoint, 2); err != nil {
+		t.Fatal(err)
+	}
+	st := newReport()
+	err = r.replaceInChunks(context.Background(), sqlDB{db}, []string{"post"}, r.newFileIndex(atts), nil, nil, st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for id, want := range map[int64]string{1: broken, 2: broken, 3: fixed, 4: fixed, 5: fixed} {
+		if got := fdb.content(id); got != want {
+			t.Errorf("got content %q for post %d but expected %q", got, id, want)
+		}
+	}
+	if st.Scanned != 3 || st.Changed != 3 {
+		t.Errorf("got %d scanned and %d changed but expected 3 and 3", st.Scanned, st.Changed)
+	}
+	// The chunks are posts 3 and 4 and then post 5, which is the last since the chunk is not full.
+	if fdb.commits != 2 {
+		t.Errorf("got %d commits but expected 2", fdb.commits)
+	}
+	if id, err := readCheckpoint(r.cfg.Checkpoint); err != nil || id != 5 {
+		t.Errorf("got checkpoint %d (error %v) but expected 5", id, err)
+	}
+	if r.resumeAfter != 0 || r.chunkPosts != 0 {
+		t.Errorf("got resumeAfter %d and chunkPosts %d after the run but expected 0 and 0", r.resumeAfter, r.chunkPosts)
+	}
+
+	// Resuming again finds nothing more to do.
+	st = newReport()
+	err = r.replaceInChunks(context.Background(), sqlDB{db}, []string{"post"}, r.newFileIndex(atts), nil, nil, st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Scanned != 0 {
+		t.Errorf("got %d scanned on resuming a finished run but expected 0", st.Scanned)
+	}
+}
+
+func TestReplaceInChunksUnaudited(t *testing.T) {
+	r := newRunner(DefaultConfig())
+	dir, err := ioutil.TempDir("", "crop-replace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	r.cfg.Checkpoint = filepath.Join(dir, "checkpoint")
+	r.cfg.CheckpointEvery = 2
+
+	atts := []attachment{{fileName: "/2018/bcd.png", ext: ".png", crops: []crop{{"200x180", 200, 180, ""}}}}
+	const (
+		broken = "<img src='/2018/bcd-210x195.png'>"
+		fixed  = "<img src='/2018/bcd-200x180.png'>"
+	)
+	var posts []fakePost
+	for id := int64(1); id <= 5; id++ {
+		posts = append(posts, fakePost{ID: id, postType: "post", content: broken})
+	}
+	db, fdb := newFakeDB(t, posts...)
+	defer db.Close()
+
+	// Post 3 cannot be audited, so the run stops after its chunk without moving the checkpoint past it.
+	audit := &memWriter{objects: make(map[string]string), failName: "3/before.html"}
+	st := newReport()
+	err = r.replaceInChunks(context.Background(), sqlDB{db}, []string{"post"}, r.newFileIndex(atts), audit, nil, st)
+	if err == nil {
+		t.Error("got no error for a post that could not be audited")
+	}
+	for id, want := range map[int64]string{1: fixed, 2: fixed, 3: broken, 4: fixed, 5: broken} {
+		if got := fdb.content(id); got != want {
+			t.Errorf("got content %q for post %d but expected %q", got, id, want)
+		}
+	}
+	if id, err := readCheckpoint(r.cfg.Checkpoint); err != nil || id != 2 {
+		t.Errorf("got checkpoint %d (error %v) but expected 2", id, err)
+	}
+
+	// On resume, post 3 is transformed.
+	audit.failName = ""
+	st = newReport()
+	err = r.replaceInChunks(context.Background(), sqlDB{db}, []string{"post"}, r.newFileIndex(atts), audit, nil, st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for id := int64(1); id <= 5; id++ {
+		if got := fdb.content(id); got != fixed {
+			t.Errorf("got content %q for post %d after resuming but expected %q", got, id, fixed)
+		}
+	}
+	if st.Scanned != 3 || st.Changed != 2 {
+		t.Errorf("got %d scanned and %d changed on resuming but expected 3 and 2", st.Scanned, st.Changed)
+	}
+	if id, err := readCheckpoint(r.cfg.Checkpoint); err != nil || id != 5 {
+		t.Errorf("got checkpoint %d (error %v) but expected 5", id, err)
+	}
+}
+
+func TestReadCheckpointSet(t *testing.T) {
+	dir, err := ioutil.TempDir("", "crop-replace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cases := []struct {
+		data string // the contents of the file, which is not written if empty
+		done map[int64]bool
+		ok   bool
+	}{
+		{"", map[int64]bool{}, true},
+		{"random\n", map[int64]bool{}, true},
+		{"random\n3\n12\n7\n", map[int64]bool{3: true, 7: true, 12: true}, true},
+		{"42\n", nil, false},
+		{"random\n3\nabc\n", nil, false},
+		{"random\n0\n", nil, false},
+	}
+	for i, tc := range cases {
+		t.Run("case_"+strconv.Itoa(i), func(t *testing.T) {
+			path := filepath.Join(dir, "checkpoint"+strconv.Itoa(i))
+			if tc.data != "" {
+				if err := ioutil.WriteFile(path, []byte(tc.data), 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			done, err := readCheckpointSet(path)
+			if tc.ok != (err == nil) {
+				t.Fatalf("got error %v but expected ok to be %v", err, tc.ok)
+			}
+			if !reflect.DeepEqual(done, tc.done) {
+				t.Errorf("got the set %v but expected %v", done, tc.done)
+			}
+		})
+	}
+
+	// The set is written in order, and a run in ID order does not take the file for its own.
+	path := filepath.Join(dir, "written")
+	if err := writeCheckpointSet(path, map[int64]bool{12: true, 3: true}); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := ioutil.ReadFile(path); err != nil || string(data) != "random\n3\n12\n" {
+		t.Errorf("got the file %q (error %v) but expected %q", data, err, "random\n3\n12\n")
+	}
+	if _, err := readCheckpoint(path); err == nil {
+		t.Error("got no error reading a checkpoint written in random order as a single ID")
+	}
+}
+
+func TestReplaceInRandomChunks(t *testing.T) {
+	r := newRunner(DefaultConfig())
+	dir, err := ioutil.TempDir("", "crop-replace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	r.cfg.Checkpoint = filepath.Join(dir, "checkpoint")
+	r.cfg.CheckpointEvery = 2
+	r.cfg.ScanOrder = scanRandom
+
+	atts := []attachment{{fileName: "/2018/bcd.png", ext: ".png", crops: []crop{{"200x180", 200, 180, ""}}}}
+	const (
+		broken = "<img src='/2018/bcd-210x195.png'>"
+		fixed  = "<img src='/2018/bcd-200x180.png'>"
+	)
+	var posts []fakePost
+	for id := int64(1); id <= 5; id++ {
+		posts = append(posts, fakePost{ID: id, postType: "post", content: broken})
+	}
+	db, fdb := newFakeDB(t, posts...)
+	defer db.Close()
+
+	// The run is resumed without posts 2 and 4, as if an earlier run had committed them but not fixed them.
+	if err := writeCheckpointSet(r.cfg.Checkpoint, map[int64]bool{2: true, 4: true}); err != nil {
+		t.Fatal(err)
+	}
+	st := newReport()
+	err = r.replaceInChunks(context.Background(), sqlDB{db}, []string{"post"}, r.newFileIndex(atts), nil, nil, st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for id, want := range map[int64]string{1: fixed, 2: broken, 3: fixed, 4: broken, 5: fixed} {
+		if got := fdb.content(id); got != want {
+			t.Errorf("got content %q for post %d but expected %q", got, id, want)
+		}
+	}
+	if st.Scanned != 3 || st.Changed != 3 {
+		t.Errorf("got %d scanned and %d changed but expected 3 and 3", st.Scanned, st.Changed)
+	}
+	// The three posts left are committed in chunks of two and one.
+	if fdb.commits != 2 {
+		t.Errorf("got %d commits but expected 2", fdb.commits)
+	}
+	want := map[int64]bool{1: true, 2: true, 3: true, 4: true, 5: true}
+	if done, err := readCheckpointSet(r.cfg.Checkpoint); err != nil || !reflect.DeepEqual(done, want) {
+		t.Errorf("got checkpoint %v (error %v) but expected %v", done, err, want)
+	}
+	if r.postIDs != nil || r.scannedPosts != nil {
+		t.Errorf("got postIDs %v and scannedPosts %v after the run but expected nil", r.postIDs, r.scannedPosts)
+	}
+
+	// Resuming again finds nothing more to do.
+	st = newReport()
+	err = r.replaceInChunks(context.Background(), sqlDB{db}, []string{"post"}, r.newFileIndex(atts), nil, nil, st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Scanned != 0 {
+		t.Errorf("got %d scanned on resuming a finished run but expected 0", st.Scanned)
+	}
+}
+
+func TestReplaceInRandomChunksUnaudited(t *testing.T) {
+	r := newRunner(DefaultConfig())
+	dir, err := ioutil.TempDir("", "crop-replace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	r.cfg.Checkpoint = filepath.Join(dir, "checkpoint")
+	r.cfg.CheckpointEvery = 5
+	r.cfg.ScanOrder = scanRandom
+
+	atts := []attachment{{fileName: "/2018/bcd.png", ext: ".png", crops: []crop{{"200x180", 200, 180, ""}}}}
+	const (
+		broken = "<img src='/2018/bcd-210x195.png'>"
+		fixed  = "<img src='/2018/bcd-200x180.png'>"
+	)
+	var posts []fakePost
+	for id := int64(1); id <= 5; id++ {
+		posts = append(posts, fakePost{ID: id, postType: "post", content: broken})
+	}
+	db, fdb := newFakeDB(t, posts...)
+	defer db.Close()
+
+	// Post 3 cannot be audited, so it's left out of the checkpoint while the rest of its chunk is recorded.
+	audit := &memWriter{objects: make(map[string]string), failName: "3/before.html"}
+	st := newReport()
+	err = r.replaceInChunks(context.Background(), sqlDB{db}, []string{"post"}, r.newFileIndex(atts), audit, nil, st)
+	if err == nil {
+		t.Error("got no error for a post that could not be audited")
+	}
+	want := map[int64]bool{1: true, 2: true, 4: true, 5: true}
+	if done, err := readCheckpointSet(r.cfg.Checkpoint); err != nil || !reflect.DeepEqual(done, want) {
+		t.Errorf("got checkpoint %v (error %v) but expected %v", done, err, want)
+	}
+
+	// On resume, only post 3 is transformed.
+	audit.failName = ""
+	st = newReport()
+	err = r.replaceInChunks(context.Background(), sqlDB{db}, []string{"post"}, r.newFileIndex(atts), audit, nil, st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for id := int64(1); id <= 5; id++ {
+		if got := fdb.content(id); got != fixed {
+			t.Errorf("got content %q for post %d after resuming but expected %q", got, id, fixed)
+		}
+	}
+	if st.Scanned != 1 || st.Changed != 1 {
+		t.Errorf("got %d scanned and %d changed on resuming but expected 1 and 1", st.Scanned, st.Changed)
+	}
+}
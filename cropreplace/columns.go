@@ -0,0 +1,263 @@
+package cropreplace
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+// parseColumns parses a comma-separated list of extra columns of the posts table.
+func (r *runner) parseColumns(s string) ([]string, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var columns []string
+	for _, column := range strings.Split(s, ",") {
+		column = strings.TrimSpace(column)
+		if !isIdentifier(column) {
+			return nil, fmt.Errorf("%q is not a valid column name", column)
+		}
+		if column == r.cfg.ContentColumn || column == "id" {
+			return nil, fmt.Errorf("the column %s cannot be an extra column", column)
+		}
+		if !containsString(columns, column) {
+			columns = append(columns, column)
+		}
+	}
+	return columns, nil
+}
+
+// isIdentifier says whether s is a name that may be used for a table or column as it is: only lowercase
+// letters, digits, and underscores.
+func isIdentifier(s string) bool {
+	return s != "" && strings.Trim(s, "abcdefghijklmnopqrstuvwxyz0123456789_") == ""
+}
+
+// A columnUpdate holds the new values of the columns of a post that are changed.
+type columnUpdate struct {
+	columns []string
+	values  []interface{}
+	size    int // the total length of the values
+}
+
+// set adds the column with its new value to the update.
+func (u *columnUpdate) set(column, value string) {
+	u.columns = append(u.columns, column)
+	u.values = append(u.values, value)
+	u.size += len(value)
+}
+
+// replaceExtraColumns adds to u the extra columns of p whose crops are replaced, returning the replacements
+// made in all of them.
+func (r *runner) replaceExtraColumns(u *columnUpdate, p *post, files *fileIndex, sign signFunc) ([]replacement, error) {
+	var all []replacement
+	for j, column := range r.postColumns {
+		reps, err := r.findSignedReplacements(p.extra[j], files, sign)
+		if err != nil {
+			return nil, err
+		}
+		got := r.applyReplacements(p.extra[j], reps)
+		if countChanges(reps) > 0 {
+			u.set(column, got)
+		}
+		for i := range reps {
+			reps[i].column = column
+		}
+		all = append(all, reps...)
+	}
+	return all, nil
+}
+
+// An updateStmts prepares, within a transaction, the statements updating the posts table that set each
+// combination of columns, keeping them for reuse. If batchSize is greater than 1, the updates added are made
+// together in batches of up to that many posts.
+type updateStmts struct {
+	run   *runner // the run whose posts are updated
+	tx    execer
+	stmts map[string]*sql.Stmt
+
+	batchSize   int
+	maxPacket   int64 // the max_allowed_packet that a batch must fit in, if not 0
+	pending     []pendingUpdate
+	pendingSize int // the total size of the pending updates
+	pendingArgs int // the number of placeholders that the pending updates take in a batch
+}
+
+// maxPlaceholders is the most placeholders that MySQL allows in a prepared statement, which a batch must not exceed.
+const maxPlaceholders = 65535
+
+// A pendingUpdate is an update of a post waiting to be made with the rest of its batch.
+type pendingUpdate struct {
+	postID int64
+	u      columnUpdate
+}
+
+// add sets the columns in u of the post with the given ID, either right away or, if batching, when the batch
+// is full or would otherwise not fit in a packet or exceed maxPlaceholders. The pending updates must be made with
+// flush.
+func (us *updateStmts) add(u *columnUpdate, postID int64) error {
+	if us.batchSize <= 1 {
+		return us.exec(u, postID)
+	}
+	args := 2*len(u.columns) + 1 // a WHEN and a THEN for each column, and the ID in the IN list
+	if len(us.pending) > 0 && (packetTooLarge(us.pendingSize+u.size, us.maxPacket) ||
+		us.pendingArgs+args > maxPlaceholders) {
+		if err := us.flush(); err != nil {
+			return err
+		}
+	}
+	us.pending = append(us.pending, pendingUpdate{postID, *u})
+	us.pendingSize += u.size
+	us.pendingArgs += args
+	if len(us.pending) >= us.batchSize {
+		return us.flush()
+	}
+	return nil
+}
+
+// flush makes the pending updates with a single statement that sets each column with a CASE on the post ID,
+// checking that exactly one row is affected per post. If not, the posts not updated are found by their columns.
+func (us *updateStmts) flush() error {
+	batch := us.pending
+	us.pending, us.pendingSize, us.pendingArgs = nil, 0, 0
+	switch len(batch) {
+	case 0:
+		return nil
+	case 1:
+		return us.exec(&batch[0].u, batch[0].postID)
+	}
+	var columns []string // every column set, in the order first seen
+	for i := range batch {
+		for _, column := range batch[i].u.columns {
+			if !containsString(columns, column) {
+				columns = append(columns, column)
+			}
+		}
+	}
+	var args []interface{}
+	set := make([]string, len(columns))
+	for c, column := range columns {
+		var b strings.Builder
+		b.WriteString(column + " = CASE ID")
+		for i := range batch {
+			u := &batch[i].u
+			for j := range u.columns {
+				if u.columns[j] == column {
+					b.WriteString(" WHEN ? THEN ?")
+					args = append(args, batch[i].postID, u.values[j])
+				}
+			}
+		}
+		b.WriteString(" ELSE " + column + " END")
+		set[c] = b.String()
+	}
+	ids := make([]int64, len(batch))
+	for i := range batch {
+		ids[i] = batch[i].postID
+		args = append(args, batch[i].postID)
+	}
+	query := fmt.Sprintf("UPDATE `%s` SET %s WHERE ID IN (?%s)", us.run.tableName(), strings.Join(set, ", "),
+		strings.Repeat(", ?", len(batch)-1))
+	if us.run.dumpStatement != nil {
+		us.run.dumpStatement(query, args)
+	}
+	res, err := us.tx.Exec(query, args...)
+	if err != nil {
+		return fmt.Errorf("could not update rows %v; %v", ids, err)
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("could not check for rows affected; %v", err)
+	}
+	if affected != int64(len(batch)) {
+		failed, err := us.notUpdated(batch)
+		if err != nil {
+			return fmt.Errorf("after updating rows %v results say %d rows affected, and checking them failed; %v",
+				ids, affected, err)
+		}
+		return fmt.Errorf("after updating rows %v results say %d rows affected; rows %v were not updated", ids,
+			affected, failed)
+	}
+	return nil
+}
+
+// notUpdated returns the IDs of the posts in batch whose columns do not hold the values that the batch sets, which
+// are the posts that it did not update.
+func (us *updateStmts) notUpdated(batch []pendingUpdate) ([]int64, error) {
+	var ids []int64
+	for i := range batch {
+		u := &batch[i].u
+		values, err := us.run.queryColumns(us.tx, batch[i].postID, u.columns)
+		if err == sql.ErrNoRows {
+			ids = append(ids, batch[i].postID)
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		for j := range values {
+			if !values[j].Valid || values[j].String != u.values[j] {
+				ids = append(ids, batch[i].postID)
+				break
+			}
+		}
+	}
+	return ids, nil
+}
+
+// queryColumns returns the values of the columns of the post with the given ID, or sql.ErrNoRows if there is no
+// such post.
+func (r *runner) queryColumns(q queryer, postID int64, columns []string) ([]sql.NullString, error) {
+	values := make([]sql.NullString, len(columns))
+	dest := make([]interface{}, len(columns))
+	for j := range values {
+		dest[j] = &values[j]
+	}
+	query := fmt.Sprintf("SELECT %s FROM `%s` WHERE ID = ?", strings.Join(columns, ", "), r.tableName())
+	if err := q.QueryRow(query, postID).Scan(dest...); err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+// exec sets the columns in u of the post with the given ID, checking that exactly one row is affected.
+func (us *updateStmts) exec(u *columnUpdate, postID int64) error {
+	set := strings.Join(u.columns, " = ?, ") + " = ?"
+	query := fmt.Sprintf("UPDATE `%s` SET %s WHERE ID = ?", us.run.tableName(), set)
+	stmt, ok := us.stmts[set]
+	if !ok {
+		var err error
+		stmt, err = us.tx.Prepare(query)
+		if err != nil {
+			return fmt.Errorf("could not prepare update statement; %v", err)
+		}
+		if us.stmts == nil {
+			us.stmts = make(map[string]*sql.Stmt)
+		}
+		us.stmts[set] = stmt
+	}
+	args := append(u.values, postID)
+	if us.run.dumpStatement != nil {
+		us.run.dumpStatement(query, args)
+	}
+	res, err := stmt.Exec(args...)
+	if err != nil {
+		return fmt.Errorf("could not update row %d; %v", postID, err)
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("could not check for rows affected; %v", err)
+	}
+	if affected != 1 {
+		return fmt.Errorf("after update results say %d rows affected", affected)
+	}
+	return nil
+}
+
+// close closes the prepared statements.
+func (us *updateStmts) close() {
+	for _, stmt := range us.stmts {
+		if err := stmt.Close(); err != nil {
+			us.run.printErr("closing prepared statement", err)
+		}
+	}
+}
@@ -0,0 +1,409 @@
+package cropreplace
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestParseColumns(t *testing.T) {
+	r := newRunner(DefaultConfig())
+	cases := []struct {
+		s       string
+		columns []string
+		ok      bool
+	}{
+		{"", nil, true},
+		{"post_excerpt", []string{"post_excerpt"}, true},
+		{"post_excerpt, post_content_filtered", []string{"post_excerpt", "post_content_filtered"}, true},
+		{"post_excerpt,post_excerpt", []string{"post_excerpt"}, true},
+		{"post_content", nil, false},
+		{"post_excerpt,", nil, false},
+		{"post_excerpt = ''", nil, false},
+		{"`post_excerpt`", nil, false},
+	}
+	for i, tc := range cases {
+		t.Run("case_"+strconv.Itoa(i), func(t *testing.T) {
+			columns, err := r.parseColumns(tc.s)
+			if tc.ok != (err == nil) {
+				t.Fatalf("got error %v but expected ok to be %v", err, tc.ok)
+			}
+			if !reflect.DeepEqual(columns, tc.columns) {
+				t.Errorf("got columns %q but expected %q", columns, tc.columns)
+			}
+		})
+	}
+}
+
+func TestReplaceImageCropsExtraColumns(t *testing.T) {
+	r := newRunner(DefaultConfig())
+	r.postColumns = []string{"post_excerpt"}
+
+	atts := []attachment{
+		{
+			fileName: "/2018/bcd.png", ext: ".png",
+			crops: []crop{
+				{"200x180", 200, 180, ""},
+			},
+		},
+	}
+	const (
+		broken = "<img src='/2018/bcd-210x195.png'>"
+		fixed  = "<img src='/2018/bcd-200x180.png'>"
+	)
+	db, fdb := newFakeDB(t,
+		fakePost{ID: 1, postType: "post", content: broken, extra: map[string]string{"post_excerpt": broken}},
+		fakePost{ID: 2, postType: "post", content: broken, extra: map[string]string{"post_excerpt": "text"}},
+		fakePost{ID: 3, postType: "post", content: "text", extra: map[string]string{"post_excerpt": broken}},
+		fakePost{ID: 4, postType: "post", content: fixed, extra: map[string]string{"post_excerpt": fixed}},
+	)
+	defer db.Close()
+
+	st := newReport()
+	err := r.replaceImageCrops(context.Background(), sqlDB{db}, []string{"post"}, r.newFileIndex(atts), nil, nil, st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []struct {
+		content, excerpt string
+	}{
+		{fixed, fixed},
+		{fixed, "text"},
+		{"text", fixed},
+		{fixed, fixed},
+	}
+	for i, w := range want {
+		id := int64(i + 1)
+		if got := fdb.content(id); got != w.content {
+			t.Errorf("got content %q for post %d but expected %q", got, id, w.content)
+		}
+		if got := fdb.value(id, "post_excerpt"); got != w.excerpt {
+			t.Errorf("got excerpt %q for post %d but expected %q", got, id, w.excerpt)
+		}
+	}
+	if st.Changed != 3 || st.Replacements != 4 {
+		t.Errorf("got %d changed and %d replacements but expected 3 and 4", st.Changed, st.Replacements)
+	}
+
+	// Each post is updated with a single statement setting only the columns changed.
+	sets := make(map[int64]string)
+	for _, u := range fdb.updates {
+		id := u.args[len(u.args)-1].(int64)
+		if _, ok := sets[id]; ok {
+			t.Errorf("post %d was updated more than once", id)
+		}
+		sets[id] = u.query[strings.Index(u.query, " SET ")+5 : strings.Index(u.query, " WHERE ")]
+	}
+	wantSets := map[int64]string{
+		1: "post_content = ?, post_excerpt = ?",
+		2: "post_content = ?",
+		3: "post_excerpt = ?",
+	}
+	if !reflect.DeepEqual(sets, wantSets) {
+		t.Errorf("got updates %v but expected %v", sets, wantSets)
+	}
+}
+
+func TestReplaceImageCropsBatches(t *testing.T) {
+	r := newRunner(DefaultConfig())
+	r.postColumns = []string{"post_excerpt"}
+
+	atts := []attachment{
+		{
+			fileName: "/2018/bcd.png", ext: ".png",
+			crops: []crop{
+				{"200x180", 200, 180, ""},
+			},
+		},
+	}
+	const (
+		broken = "<img src='/2018/bcd-210x195.png'>"
+		fixed  = "<img src='/2018/bcd-200x180.png'>"
+	)
+	posts := []fakePost{
+		{ID: 1, postType: "post", content: broken, extra: map[string]string{"post_excerpt": broken}},
+		{ID: 2, postType: "post", content: broken, extra: map[string]string{"post_excerpt": "text"}},
+		{ID: 3, postType: "post", content: "text", extra: map[string]string{"post_excerpt": broken}},
+		{ID: 4, postType: "post", content: fixed, extra: map[string]string{"post_excerpt": fixed}},
+		{ID: 5, postType: "post", content: broken + " " + broken, extra: map[string]string{"post_excerpt": ""}},
+	}
+	cases := []struct {
+		batchSize int
+		maxPacket int64
+		updates   int // the number of UPDATE statements executed
+	}{
+		{1, 0, 4},
+		{2, 0, 2},
+		{3, 0, 2},
+		{10, 0, 1},
+		{10, packetOverhead + 2*int64(len(broken)), 3},
+	}
+	for i, tc := range cases {
+		t.Run("case_"+strconv.Itoa(i), func(t *testing.T) {
+			// Each test case gets copies of the posts, since the fake database changes them in place.
+			copies := make([]fakePost, len(posts))
+			for j, p := range posts {
+				copies[j] = fakePost{ID: p.ID, postType: p.postType, content: p.content,
+					extra: map[string]string{"post_excerpt": p.extra["post_excerpt"]}}
+			}
+			db, fdb := newFakeDB(t, copies...)
+			defer db.Close()
+			fdb.maxPacket = tc.maxPacket
+			r.cfg.BatchSize = tc.batchSize
+
+			err := r.replaceImageCrops(context.Background(), sqlDB{db}, []string{"post"}, r.newFileIndex(atts), nil, nil,
+				newReport())
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, p := range posts {
+				want := r.replaceCrops(p.content, atts, tolerance{35, 100})
+				if got := fdb.content(p.ID); got != want {
+					t.Errorf("got content %q for post %d but expected %q", got, p.ID, want)
+				}
+				want = r.replaceCrops(p.extra["post_excerpt"], atts, tolerance{35, 100})
+				if got := fdb.value(p.ID, "post_excerpt"); got != want {
+					t.Errorf("got excerpt %q for post %d but expected %q", got, p.ID, want)
+				}
+			}
+			if len(fdb.updates) != tc.updates {
+				t.Errorf("got %d updates but expected %d", len(fdb.updates), tc.updates)
+			}
+		})
+	}
+}
+
+func TestSelectedColumns(t *testing.T) {
+	r := newRunner(DefaultConfig())
+	cases := []struct {
+		content  string
+		extra    string
+		selected string
+	}{
+		{"post_content", "", "ID, post_content"},
+		{"post_content", "post_excerpt", "ID, post_content, post_excerpt"},
+		{"body", "post_content,post_excerpt", "ID, body, post_content, post_excerpt"},
+	}
+	for i, tc := range cases {
+		t.Run("case_"+strconv.Itoa(i), func(t *testing.T) {
+			r.cfg.ContentColumn = tc.content
+			var err error
+			if r.postColumns, err = r.parseColumns(tc.extra); err != nil {
+				t.Fatal(err)
+			}
+			if got := r.selectedColumns(); got != tc.selected {
+				t.Errorf("got %q but expected %q", got, tc.selected)
+			}
+			if _, err := r.parseColumns(tc.content); err == nil {
+				t.Errorf("the content column %s was accepted as an extra column", tc.content)
+			}
+		})
+	}
+}
+
+// A recordingExecer is an execer that records the statements executed with Exec before executing them.
+type recordingExecer struct {
+	execer
+	execs []fakeExec
+}
+
+func (r *recordingExecer) Exec(query string, args ...interface{}) (sql.Result, error) {
+	values := make([]driver.Value, len(args))
+	for i, arg := range args {
+		values[i] = arg
+	}
+	r.execs = append(r.execs, fakeExec{query, values})
+	return r.execer.Exec(query, args...)
+}
+
+// A countingBeginner is a beginner that counts the transactions begun. If commitErr is not nil, the transactions
+// begun fail to commit with it.
+type countingBeginner struct {
+	beginner
+	begun     int
+	commitErr error
+}
+
+func (c *countingBeginner) Begin() (txer, error) {
+	c.begun++
+	tx, err := c.beginner.Begin()
+	if err != nil || c.commitErr == nil {
+		return tx, err
+	}
+	return failingTx{tx, c.commitErr}, nil
+}
+
+// A failingTx is a txer that rolls back when committed, returning err.
+type failingTx struct {
+	txer
+	err error
+}
+
+func (f failingTx) Commit() error {
+	if err := f.txer.Rollback(); err != nil {
+		return err
+	}
+	return f.err
+}
+
+func TestReplaceImageCropsUpdates(t *testing.T) {
+	r := newRunner(DefaultConfig())
+	atts := []attachment{
+		{
+			fileName: "/2018/bcd.png", ext: ".png",
+			crops: []crop{
+				{"200x180", 200, 180, ""},
+			},
+		},
+	}
+	db, fdb := newFakeDB(t,
+		fakePost{ID: 1, postType: "post", content: "<img src='/2018/bcd-210x195.png'>"},
+		fakePost{ID: 2, postType: "post", content: "<img src='/2018/bcd-200x180.png'>"},
+		fakePost{ID: 3, postType: "post", content: "<img src='/2018/bcd-205x185.png'>"},
+	)
+	defer db.Close()
+	begin := &countingBeginner{beginner: sqlDB{db}}
+
+	err := r.replaceImageCrops(context.Background(), begin, []string{"post"}, r.newFileIndex(atts), nil, nil, newReport())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if begin.begun != 1 || fdb.commits != 1 {
+		t.Errorf("began %d transactions and committed %d; expected one of each", begin.begun, fdb.commits)
+	}
+	query := "UPDATE `" + r.tableName() + "` SET post_content = ? WHERE ID = ?"
+	expected := []fakeExec{
+		{query, []driver.Value{"<img src='/2018/bcd-200x180.png'>", int64(1)}},
+		{query, []driver.Value{"<img src='/2018/bcd-200x180.png'>", int64(3)}},
+	}
+	if !reflect.DeepEqual(fdb.updates, expected) {
+		t.Errorf("got updates %v; expected %v", fdb.updates, expected)
+	}
+}
+
+func TestReplaceImageCropsCommitError(t *testing.T) {
+	r := newRunner(DefaultConfig())
+	atts := []attachment{{fileName: "/2018/bcd.png", ext: ".png", crops: []crop{{"200x180", 200, 180, ""}}}}
+	db, fdb := newFakeDB(t, fakePost{ID: 1, postType: "post", content: "<img src='/2018/bcd-210x195.png'>"})
+	defer db.Close()
+	commitErr := errors.New("connection lost")
+	begin := &countingBeginner{beginner: sqlDB{db}, commitErr: commitErr}
+
+	err := r.replaceImageCrops(context.Background(), begin, []string{"post"}, r.newFileIndex(atts), nil, nil, newReport())
+	if err != commitErr {
+		t.Errorf("got error %v; expected %v", err, commitErr)
+	}
+	if fdb.commits != 0 || fdb.rollbacks != 1 {
+		t.Errorf("committed %d transactions and rolled back %d", fdb.commits, fdb.rollbacks)
+	}
+}
+
+func TestUpdateStmtsBatchExec(t *testing.T) {
+	r := newRunner(DefaultConfig())
+	db, fdb := newFakeDB(t,
+		fakePost{ID: 1, postType: "post", content: "a"},
+		fakePost{ID: 2, postType: "post", content: "b"},
+	)
+	defer db.Close()
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := &recordingExecer{execer: tx}
+	update := updateStmts{run: r, tx: rec, batchSize: 2}
+	for _, p := range []struct {
+		id      int64
+		content string
+	}{{1, "c"}, {2, "d"}} {
+		var u columnUpdate
+		u.set("post_content", p.content)
+		if err := update.add(&u, p.id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := update.flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	query := "UPDATE `" + r.tableName() + "` SET post_content = CASE ID WHEN ? THEN ? WHEN ? THEN ? ELSE post_content " +
+		"END WHERE ID IN (?, ?)"
+	expected := []fakeExec{{query, []driver.Value{int64(1), "c", int64(2), "d", int64(1), int64(2)}}}
+	if !reflect.DeepEqual(rec.execs, expected) {
+		t.Errorf("got statements %v; expected %v", rec.execs, expected)
+	}
+	if fdb.content(1) != "c" || fdb.content(2) != "d" {
+		t.Errorf("got contents %q and %q; expected %q and %q", fdb.content(1), fdb.content(2), "c", "d")
+	}
+}
+
+func TestUpdateStmtsBatchNotUpdated(t *testing.T) {
+	db, _ := newFakeDB(t,
+		fakePost{ID: 1, postType: "post", content: "a"},
+		fakePost{ID: 2, postType: "post", content: "b"},
+	)
+	defer db.Close()
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	update := updateStmts{run: newRunner(DefaultConfig()), tx: tx, batchSize: 10}
+	// Post 2 already has the content set, so it's not counted as affected but needs no update, while post 3 does
+	// not exist.
+	for _, p := range []struct {
+		id      int64
+		content string
+	}{{1, "c"}, {2, "b"}, {3, "d"}} {
+		var u columnUpdate
+		u.set("post_content", p.content)
+		if err := update.add(&u, p.id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = update.flush()
+	if want := "rows [3] were not updated"; err == nil || !strings.Contains(err.Error(), want) {
+		t.Errorf("got error %v but expected one saying %q", err, want)
+	}
+}
+
+func TestUpdateStmtsBatchPlaceholders(t *testing.T) {
+	// Each post takes three placeholders, so that only so many fit in a batch.
+	perBatch := maxPlaceholders / 3
+	posts := make([]fakePost, perBatch+2)
+	for i := range posts {
+		posts[i] = fakePost{ID: int64(i + 1), postType: "post", content: "a"}
+	}
+	db, fdb := newFakeDB(t, posts...)
+	defer db.Close()
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	update := updateStmts{run: newRunner(DefaultConfig()), tx: tx, batchSize: 2 * perBatch}
+	for _, p := range posts {
+		var u columnUpdate
+		u.set("post_content", "b")
+		if err := update.add(&u, p.ID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := update.flush(); err != nil {
+		t.Fatal(err)
+	}
+	if len(fdb.updates) != 2 {
+		t.Fatalf("got %d updates but expected 2", len(fdb.updates))
+	}
+	for i, n := range []int{maxPlaceholders, 6} {
+		if args := len(fdb.updates[i].args); args != n {
+			t.Errorf("got %d placeholders in update %d but expected %d", args, i, n)
+		}
+	}
+}
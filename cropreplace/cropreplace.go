@@ -0,0 +1,2831 @@
+// Package cropreplace loops over each post and replaces occurrences of cropped media attachment URLs that do not
+// exist with URLs of (similar) crops that exist in the GCS or S3 bucket being used. Run does so with the settings
+// of a Config, which the crop-replace command sets with its flags.
+//
+// The content and extra columns of the posts are taken as text (or HTML), in which crops are found wherever they are
+// referenced, including in the JSON attributes of blocks. Meta values, which are transformed if ScanMeta is set, may
+// also be serialized by PHP, in which case the lengths of the strings changed are corrected.
+//
+// Before you run this tool, you must first make sure that the "guid" column for all "attachment" posts
+// begins the same way--with a site address.
+package cropreplace
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/ttacon/chalk"
+)
+
+// A Config holds the settings of a run. Each field but DB and Out is set by the command line flag of the same name in
+// lowercase, whose help is the comment on the field. Settings that are lists, such as PostType, are comma-separated.
+type Config struct {
+	// an open database to use instead of connecting to one with DSN or the other DB fields; it's left open
+	DB *sql.DB
+
+	// where the messages and errors of the run are printed; if nil, they're printed to standard output
+	Out io.Writer
+
+	Bucket  string // the bucket name
+	Backend string // the storage service hosting the bucket: gcs or s3
+	Region  string // the region of the bucket (for S3)
+
+	HTTPProxy string // the URL of an HTTP proxy to send storage requests through
+
+	// the JSON key file of a service account to read a private GCS bucket with (by default, objects must be public)
+	Credentials string
+
+	LocalDir string // a directory holding a copy of the bucket's objects to use instead of the bucket
+	// a file, which may be gzipped, listing the names of the bucket's objects one per line to use instead of the
+	// bucket
+	ListingFile string
+
+	// instead of listing the crops of every attachment up front, check for each crop in the bucket when a reference to
+	// it is first found; since only the crops referenced are known, a missing crop is replaced with another one only
+	// if that one is referenced too
+	LazyCheck bool
+
+	// before listing the crops of every attachment, check that the files of some attachments are in the bucket, and
+	// stop if none are
+	Precheck bool
+
+	DBHost   string // the database host, which may have a port that overrides dbport
+	DBPort   int    // the database port
+	DBName   string // the database name
+	DBUser   string // the database user
+	DBPass   string // the database password
+	DBPrefix string // the WP database table prefix
+	BlogID   int    // the ID of the site of a multisite network whose posts to transform
+
+	TableSuffix   string // the name of the posts table after the table prefix
+	ContentColumn string // the column of the posts table holding the content
+
+	// a file holding the database password, used if dbpass is not set; if neither is set, the password is taken from
+	// the DB_PASSWORD environment variable
+	DBPassFile string
+
+	// the character set of the database connection, or empty to use the server's default; other connection parameters
+	// may be set with dsn
+	DBCharset string
+
+	// a data source name for the MySQL driver, used as it is instead of the other db flags except dbprefix and blogid,
+	// for connection parameters that have no flag of their own
+	DSN string
+
+	DBMaxOpen int // the most connections to the database open at once, or 0 for no limit
+	DBMaxIdle int // the most idle connections to the database kept open
+	// the longest a connection to the database is reused, or 0 to reuse connections indefinitely
+	DBConnLifetime time.Duration
+
+	DBTLS string // whether to use TLS for the database connection: false, true, skip-verify, or preferred
+	DBCA  string // a PEM file with the CA certificates to verify the database server with (implies -dbtls=true)
+
+	// the start of each 'guid' in the attachments, with a trailing slash; a comma-separated list is tried in order,
+	// and the first prefix is the one that content links to files with
+	GUIDPrefix string
+	// another start, with a trailing slash, that the 'guid' of legacy attachments may have instead of guidprefix
+	AltGUIDPrefix  string
+	BucketPrefix   string // the prefix that all objects in the bucket have, without a trailing slash
+	NoBucketPrefix bool   // if true, then no bucket prefix is expected
+
+	// stop if the guid of any attachment does not have a guid prefix, instead of skipping the attachment
+	StrictGUID bool
+
+	// another host, such as a CDN, that content may link to attachments at, which replaces the host of the guid
+	// prefixes
+	ContentHost string
+
+	// how the name of each object after the bucket prefix is made from the file name in the guid, such as
+	// {year}/{month}/{name}, with the placeholders {year}, {month}, {dir}, {name}, and {path} (by default, the file
+	// name is used as it is)
+	ObjectTemplate string
+
+	// list all objects under the bucket prefix at once and keep their names in memory instead of listing the objects
+	// of each attachment
+	ListAll bool
+
+	MaxRetries int // the number of times to retry listing objects after a transient error
+	// how long to wait before the first retry of a listing, after which the wait doubles with each retry
+	RetryBase time.Duration
+
+	Concurrency int // the maximum number of attachments whose objects are listed at once
+
+	// the start of the post_mime_type of the attachments whose crops are replaced (empty means all attachments)
+	MimeFilter string
+
+	// a comma-separated list of glob patterns, such as /2018/*/*.png or photo-*.jpg, matching the file names of the
+	// only attachments whose crops are replaced; a pattern without a slash is matched against the base name
+	IncludeFiles string
+	// a comma-separated list of glob patterns like those of includefiles matching the file names of attachments to
+	// leave alone; exclusion wins over inclusion
+	ExcludeFiles string
+
+	AttachmentLimit int // the maximum number of attachments to load, in order of ID (0 means no limit)
+
+	PostType   string // a comma-separated list of the post_type values to transform
+	PostStatus string // a comma-separated list of the post_status values to transform
+	ScanOrder  string // the order in which posts are updated: id or random
+
+	Since string // an RFC 3339 time, such as 2018-11-05T00:00:00Z; posts dated before it are left alone
+	Until string // an RFC 3339 time; posts dated after it are left alone
+	// compare the since and until times in UTC with post_date_gmt rather than as written with post_date, which
+	// holds the site's local time
+	UseGMT bool
+
+	IDs string // a comma-separated list of the IDs of the only posts to transform
+
+	// a SQL LIKE pattern, such as %-___x___.%, that the content or an extra column of posts must match to be scanned,
+	// which can save a lot of time on sites with many posts without images; crops referenced in some way that the
+	// pattern does not anticipate are missed, though, so it's best to keep the pattern broad
+	ContentLike string
+
+	WidthTolerance float64 // the maximum tolerated difference in width between replaced images
+	// the maximum tolerated difference in height between replaced images (100 means no limit)
+	HeightTolerance float64
+
+	// which crop within the tolerances to use in place of a missing one: closest, larger (the closest at least as
+	// wide), or smaller (the closest at most as wide)
+	Prefer string
+
+	// the width of a missing crop below which it's left alone, rather than replaced with the un-cropped image or the
+	// placeholder, if no crop is within the tolerances
+	MinReplaceWidth int
+	// leave alone each missing crop for which no crop is within the tolerances, rather than replacing it with the
+	// un-cropped image, and list it in the report
+	NoFallback bool
+
+	// the most crop references that may be replaced in a run, beyond which the transaction is rolled back and nothing
+	// is changed (0 means no limit)
+	MaxChanges int
+
+	// dimensions, such as 300x200, of a crop to which every crop reference is rewritten, even one to a crop that
+	// exists, if the attachment has a crop of that size
+	Canonical string
+
+	// the URL of an image to use in place of a missing crop for which no crop is within the tolerances, instead of the
+	// un-cropped image
+	Placeholder string
+
+	// a comma-separated list of extensions, such as .webp,.avif, of other variants of each crop in the bucket
+	ExtraVariants string
+
+	// the character between the file name and the dimensions of each crop, either - (as in photo-600x400.jpg) or _ (as
+	// in photo_600x400.jpg)
+	CropSeparator string
+
+	// take a reference with a single dimension, such as photo-150.jpg, for a square crop, such as photo-150x150.jpg
+	SquareShorthand bool
+
+	// take a third number following the dimensions, such as 80 in photo-600x340x80.jpg, for a quality of the crop,
+	// which is ignored when crops are matched
+	ThreePart bool
+
+	// collapse crop references with duplicated dimensions, such as photo-300x200-300x200.jpg, to a single crop
+	FixDupeDims bool
+
+	// print how many posts have been scanned and updated after every this many posts (0 means never)
+	ProgressEvery int
+
+	Verbose bool // verbose mode, printing each replacement made
+	Quiet   bool // print only warnings, errors, and the summary of the run
+
+	// the format of the messages printed: text or json, which writes each message as a JSON object on a line of its
+	// own
+	LogFormat string
+
+	Explain       bool // print how each crop reference in a sample of posts is handled
+	ExplainSample int  // the maximum number of posts with crop references to explain
+
+	// print for each post changed the parts of its content around each change, with the text replaced marked as
+	// [-old-]{+new+}
+	ShowDiff bool
+
+	BatchSize int // the number of posts to update together with each UPDATE statement
+
+	DryRun bool // print the changes that would be made without modifying the database
+
+	// like dryrun, but the command exits with the code 1 if any crop reference needs to be replaced, or 2 if the run
+	// fails
+	Check bool
+
+	// skip posts whose updated content would exceed the server's max_allowed_packet instead of failing
+	SkipOversizedPackets bool
+
+	WarnNoCrops bool // warn about each attachment whose file is in the bucket but that has no crops there
+
+	MissingOut string // a file to write a CSV list of the attachments whose file is missing from the bucket to
+
+	Inventory string // a file to write a CSV list of the crops in the bucket of each attachment to
+
+	// a file of rules, one per line, each giving the dimensions of missing crops, such as 300x300 or 150x*, and the
+	// dimensions of the crop to use instead or full for the un-cropped image
+	Rules string
+
+	// a file recording the highest ID of the posts committed, which are committed in chunks, so that a run can be
+	// resumed after that ID with the same file; with scanorder random, the file records the ID of every post committed
+	Checkpoint      string
+	CheckpointEvery int // the number of posts committed in each chunk with checkpoint
+
+	Report string // a file to write a JSON report of the replacements made in each post to
+
+	// instead of replacing crops, set the posts in this backup file, written with the backup argument, back to the
+	// values backed up
+	Restore string
+
+	Backup string // a file to append the original values of the columns changed in each post to, before they're committed
+
+	// a bucket on the same backend to upload the content of each changed post to, before and after the change
+	AuditBucket   string
+	AuditPrefix   string // the prefix of the names of the objects in the audit bucket
+	AuditContinue bool   // update posts even if their content could not be uploaded to the audit bucket
+
+	Verify bool // report what would be needed to fix each post without modifying the database
+
+	// a comma-separated list of other columns of the posts table, such as post_excerpt, to replace crops in
+	ExtraColumns string
+
+	SignURLs   bool          // replace crop references with signed URLs to the objects chosen (GCS only)
+	SignKey    string        // the JSON key file of the service account to sign URLs with
+	SignExpiry time.Duration // how long after the run signed URLs expire
+
+	// instead of modifying the database, write a JSON map of missing crop URLs to replacement URLs to this file
+	EdgeMap string
+
+	ScanMeta bool // also replace crops in the meta values of the posts transformed
+
+	StatsOut string // a file to write the counts and metadata of the run to as JSON
+
+	// how long the run may take before it's cancelled and the transaction is rolled back (0 means no limit)
+	Timeout time.Duration
+
+	// how long the run may take, after which the posts updated are committed and Run returns ErrBudgetExhausted so
+	// it can be run again (0 means no limit); the command exits with the code 3
+	MaxRuntime time.Duration
+
+	DumpSQL bool // print each UPDATE statement with its arguments, long values truncated, just before it's executed
+}
+
+// DefaultConfig returns the Config with the defaults of the command line flags, which a Config to run should start
+// from rather than from the zero Config.
+func DefaultConfig() Config {
+	return Config{
+		Backend:         backendGCS,
+		Precheck:        true,
+		DBPort:          3306,
+		BlogID:          1,
+		TableSuffix:     "posts",
+		ContentColumn:   "post_content",
+		DBCharset:       "utf8mb4",
+		DBMaxIdle:       2,
+		DBConnLifetime:  15 * time.Minute,
+		DBTLS:           dbTLSFalse,
+		MaxRetries:      3,
+		RetryBase:       500 * time.Millisecond,
+		Concurrency:     8,
+		MimeFilter:      "image/",
+		PostType:        "post",
+		PostStatus:      "publish",
+		ScanOrder:       scanID,
+		WidthTolerance:  35.0,
+		HeightTolerance: 100.0,
+		Prefer:          preferClosest,
+		CropSeparator:   "-",
+		ProgressEvery:   1000,
+		LogFormat:       logFormatText,
+		ExplainSample:   20,
+		BatchSize:       1,
+		CheckpointEvery: 1000,
+		SignExpiry:      7 * 24 * time.Hour,
+	}
+}
+
+// Run replaces the crop references in the posts of the database as set by c and returns the counts of the run. If a
+// setting that's required is missing, it returns ErrMissingConfig, and if a setting is invalid, an error wrapping
+// ErrInvalidConfig. If the run stops early because MaxRuntime passes, the posts updated are committed and it returns
+// ErrBudgetExhausted, after which it can be run again to continue. Runs with their own Config may take place at the
+// same time.
+func Run(ctx context.Context, c Config) (Report, error) {
+	st := newReport()
+	err := newRunner(c).run(ctx, st)
+	return *st, err
+}
+
+// A runner holds the settings of a run along with what's derived from them and what the run keeps track of as it
+// goes, so that each run has its own.
+type runner struct {
+	cfg Config    // the settings of the run
+	out io.Writer // where messages and errors are printed
+
+	// variantExts holds the extensions parsed from ExtraVariants.
+	variantExts []string
+
+	// canonicalCrop holds the dimensions parsed from Canonical, or nil if it's not set.
+	canonicalCrop *crop
+
+	// dateSince and dateUntil, parsed from Since and Until, bound the dates of the posts transformed. Either may be
+	// the zero time, which leaves the range open on that side.
+	dateSince, dateUntil time.Time
+
+	// postIDs holds the IDs, parsed from IDs, of the only posts to transform. If it's empty, posts with any ID are
+	// transformed.
+	postIDs []int64
+
+	// postStatuses holds the statuses parsed from PostStatus that the posts transformed must have. If it's empty,
+	// posts with any status are transformed.
+	postStatuses []string
+
+	// postColumns holds the extra columns of the posts table, parsed from ExtraColumns, in which crops are replaced
+	// along with the content column.
+	postColumns []string
+
+	// includePatterns and excludePatterns hold the patterns parsed from IncludeFiles and ExcludeFiles.
+	includePatterns, excludePatterns []string
+
+	// cropRules holds the rules read from the file named by Rules.
+	cropRules []cropRule
+
+	// lazy is the lazyChecker used if LazyCheck is set.
+	lazy *lazyChecker
+
+	// dumpStatement, if not nil, is called with each UPDATE statement and its bound arguments just before the
+	// statement is executed. It's set by DumpSQL.
+	dumpStatement func(query string, args []interface{})
+
+	// runDeadline is the time after which no more posts are scanned, or the zero time if the run has no budget.
+	runDeadline time.Time
+
+	// resumeAfter, if not 0, is the ID of the post after which posts are transformed; the posts with IDs up to it are
+	// left alone.
+	resumeAfter int64
+
+	// chunkPosts, if not 0, is the most posts that replaceImageCrops transforms, in order of ID.
+	chunkPosts int
+
+	// heldPosts holds the IDs, in the order scanned, of the posts that replaceImageCrops left unchanged because their
+	// content could not be uploaded to the audit bucket. A checkpoint must not pass them, so that the posts are
+	// transformed on resume.
+	heldPosts []int64
+
+	// scannedPosts, if not nil, collects the IDs of the posts that replaceImageCrops scans, which the checkpoint of a
+	// run in random order records.
+	scannedPosts []int64
+}
+
+// newRunner returns a runner for a run with the settings c.
+func newRunner(c Config) *runner {
+	out := c.Out
+	if out == nil {
+		out = os.Stdout
+	}
+	return &runner{cfg: c, out: out}
+}
+
+// run does what Run does with the settings in r.cfg, adding the counts of the run to st.
+func (r *runner) run(ctx context.Context, st *Report) (runErr error) {
+	pass, err := dbPassword(r.cfg.DBPass, r.cfg.DBPassFile)
+	if err != nil {
+		return r.invalidConfig("reading the database password file", err)
+	}
+	r.cfg.DBPass = pass
+
+	switch {
+	case r.cfg.Bucket == "" && r.cfg.LocalDir == "" && r.cfg.ListingFile == "",
+		r.cfg.DB == nil && r.cfg.DSN == "" &&
+			(r.cfg.DBHost == "" || r.cfg.DBName == "" || r.cfg.DBUser == "" || r.cfg.DBPass == ""),
+		r.cfg.DBPrefix == "", r.cfg.GUIDPrefix == "", r.cfg.BucketPrefix == "" && !r.cfg.NoBucketPrefix:
+		got := map[string]string{
+			"bucket":       r.cfg.Bucket,
+			"dbhost":       r.cfg.DBHost,
+			"dbname":       r.cfg.DBName,
+			"dbuser":       r.cfg.DBUser,
+			"dbpass":       r.cfg.DBPass,
+			"dbprefix":     r.cfg.DBPrefix,
+			"guidprefix":   r.cfg.GUIDPrefix,
+			"bucketprefix": r.cfg.BucketPrefix,
+		}
+		if r.cfg.LogFormat == logFormatJSON {
+			fields := logFields{"nobucketprefix": r.cfg.NoBucketPrefix}
+			for k, v := range got {
+				fields[k] = v
+			}
+			r.logWith(levelError, fields, "All command line arguments must be set.")
+		} else {
+			fmt.Fprintln(r.out, chalk.Red.Color("All command line arguments must be set."))
+			fmt.Fprintln(r.out, "Currently got:")
+			for k, v := range got {
+				fmt.Fprintf(r.out, "\t%v %q\n", k, v)
+			}
+			fmt.Fprintf(r.out, "\t%v %v\n", "nobucketprefix", r.cfg.NoBucketPrefix)
+		}
+		return ErrMissingConfig
+	}
+
+	for _, prefix := range r.guidPrefixes() {
+		if !strings.HasSuffix(prefix, "/") {
+			return r.invalidf("The given guidprefix argument %q does not have a trailing slash, which "+
+				"indicates that it might not be what it should be", prefix)
+		}
+	}
+
+	if r.cfg.AltGUIDPrefix != "" && !strings.HasSuffix(r.cfg.AltGUIDPrefix, "/") {
+		return r.invalidf("The given altguidprefix argument %q does not have a trailing slash", r.cfg.AltGUIDPrefix)
+	}
+
+	if r.cfg.MaxChanges < 0 {
+		return r.invalidf("The maxchanges argument must not be negative but got %d", r.cfg.MaxChanges)
+	}
+
+	if r.cfg.MinReplaceWidth < 0 {
+		return r.invalidf("The minreplacewidth argument must not be negative but got %d", r.cfg.MinReplaceWidth)
+	}
+
+	if r.cfg.Placeholder != "" {
+		if u, err := url.Parse(r.cfg.Placeholder); err != nil || u.Host == "" {
+			return r.invalidf("The placeholder argument %q is not an absolute URL", r.cfg.Placeholder)
+		}
+	}
+
+	if r.cfg.LocalDir != "" && r.cfg.ListingFile != "" {
+		return r.invalidf("The localdir and listingfile arguments cannot both be set")
+	}
+
+	if r.cfg.DBPort < 1 || r.cfg.DBPort > 65535 {
+		return r.invalidf("The given dbport argument %d is not a valid port number", r.cfg.DBPort)
+	}
+
+	if r.cfg.BlogID < 1 {
+		return r.invalidf("The blogid argument must be at least 1 but got %d", r.cfg.BlogID)
+	}
+
+	if r.cfg.DBMaxOpen < 0 || r.cfg.DBMaxIdle < 0 || r.cfg.DBConnLifetime < 0 {
+		return r.invalidf("The dbmaxopen, dbmaxidle, and dbconnlifetime arguments must not be negative")
+	}
+
+	if r.cfg.DSN != "" && (r.cfg.DBTLS != dbTLSFalse || r.cfg.DBCA != "") {
+		return r.invalidf("The dsn argument cannot be combined with dbtls or dbca; set the tls parameter in the DSN " +
+			"instead")
+	}
+
+	tlsConfig, err := dbTLSConfig(r.cfg.DBTLS, r.cfg.DBCA)
+	if err != nil {
+		return r.invalidConfig("setting up TLS for the database connection", err)
+	}
+
+	if strings.HasSuffix(r.cfg.BucketPrefix, "/") {
+		return r.invalidf("The given bucketprefix argument %q has a trailing slash but it must not", r.cfg.BucketPrefix)
+	}
+
+	if r.cfg.ObjectTemplate != "" {
+		if err := validateObjectTemplate(r.cfg.ObjectTemplate); err != nil {
+			return r.invalidConfig(fmt.Sprintf("The objecttemplate argument %q is invalid", r.cfg.ObjectTemplate), err)
+		}
+	}
+
+	switch r.cfg.Backend {
+	case backendGCS, backendS3:
+	default:
+		return r.invalidf("The backend argument must be either %s or %s", backendGCS, backendS3)
+	}
+
+	if r.cfg.WidthTolerance < 0 || r.cfg.WidthTolerance > 100 {
+		return r.invalidf("The widthtolerance argument must be between 0 and 100 but got %v", r.cfg.WidthTolerance)
+	}
+
+	if r.cfg.HeightTolerance < 0 || r.cfg.HeightTolerance > 100 {
+		return r.invalidf("The heighttolerance argument must be between 0 and 100 but got %v", r.cfg.HeightTolerance)
+	}
+
+	if r.cfg.SignURLs &&
+		(r.cfg.Backend != backendGCS || r.cfg.Bucket == "" || r.cfg.SignKey == "" || r.cfg.SignExpiry <= 0) {
+		return r.invalidf("The signurls argument requires the gcs backend, a bucket, a signkey, and a positive " +
+			"signexpiry")
+	}
+
+	if !isIdentifier(r.cfg.TableSuffix) || !isIdentifier(r.cfg.ContentColumn) {
+		return r.invalidf("The tablesuffix %q and contentcolumn %q arguments must be names of only lowercase "+
+			"letters, digits, and underscores", r.cfg.TableSuffix, r.cfg.ContentColumn)
+	}
+
+	if r.postColumns, err = r.parseColumns(r.cfg.ExtraColumns); err != nil {
+		return r.invalidConfig("The extracolumns argument is invalid", err)
+	}
+
+	if r.cfg.Canonical != "" {
+		if r.canonicalCrop, err = parseDimensions(r.cfg.Canonical); err != nil {
+			return r.invalidConfig("The canonical argument is invalid", err)
+		}
+	}
+
+	if r.cfg.Rules != "" {
+		if r.cropRules, err = readRules(r.cfg.Rules); err != nil {
+			return r.invalidConfig("The rules file is invalid", err)
+		}
+	}
+
+	if r.includePatterns, err = parsePatterns(r.cfg.IncludeFiles); err != nil {
+		return r.invalidConfig("The includefiles argument is invalid", err)
+	}
+	if r.excludePatterns, err = parsePatterns(r.cfg.ExcludeFiles); err != nil {
+		return r.invalidConfig("The excludefiles argument is invalid", err)
+	}
+
+	if r.variantExts, err = parseExtensions(r.cfg.ExtraVariants); err != nil {
+		return r.invalidConfig("The extravariants argument is invalid", err)
+	}
+
+	if r.cfg.Concurrency < 1 {
+		return r.invalidf("The concurrency argument must be at least 1 but got %d", r.cfg.Concurrency)
+	}
+
+	if r.cfg.BatchSize < 1 {
+		return r.invalidf("The batchsize argument must be at least 1 but got %d", r.cfg.BatchSize)
+	}
+
+	if r.cfg.ProgressEvery < 0 {
+		return r.invalidf("The progressevery argument must not be negative but got %d", r.cfg.ProgressEvery)
+	}
+
+	if r.cfg.MaxRetries < 0 || r.cfg.RetryBase < 0 {
+		return r.invalidf("The maxretries and retrybase arguments must not be negative")
+	}
+
+	if r.cfg.AttachmentLimit < 0 {
+		return r.invalidf("The attachmentlimit argument must not be negative but got %d", r.cfg.AttachmentLimit)
+	}
+
+	switch r.cfg.ScanOrder {
+	case scanID, scanRandom:
+	default:
+		return r.invalidf("The scanorder argument must be either %s or %s", scanID, scanRandom)
+	}
+
+	if r.cfg.CropSeparator != "-" && r.cfg.CropSeparator != "_" {
+		return r.invalidf("The cropseparator argument must be - or _ but got %q", r.cfg.CropSeparator)
+	}
+
+	switch r.cfg.Prefer {
+	case preferClosest, preferLarger, preferSmaller:
+	default:
+		return r.invalidf("The prefer argument must be %s, %s, or %s", preferClosest, preferLarger, preferSmaller)
+	}
+
+	postTypes, err := parsePostTypes(r.cfg.PostType)
+	if err != nil {
+		return r.invalidConfig(fmt.Sprintf("The posttype argument %q is invalid", r.cfg.PostType), err)
+	}
+
+	if r.postStatuses, err = parsePostStatuses(r.cfg.PostStatus); err != nil {
+		return r.invalidConfig(fmt.Sprintf("The poststatus argument %q is invalid", r.cfg.PostStatus), err)
+	}
+
+	if r.postIDs, err = parsePostIDs(r.cfg.IDs); err != nil {
+		return r.invalidConfig("The ids argument is invalid", err)
+	}
+
+	if r.dateSince, r.dateUntil, err = parseTimeRange(r.cfg.Since, r.cfg.Until); err != nil {
+		return r.invalidConfig("The since and until arguments are invalid", err)
+	}
+
+	if r.cfg.LogFormat != logFormatText && r.cfg.LogFormat != logFormatJSON {
+		return r.invalidf("The logformat argument must be either %s or %s", logFormatText, logFormatJSON)
+	}
+
+	if r.cfg.Verbose && r.cfg.Quiet {
+		return r.invalidf("The verbose and quiet arguments cannot both be set")
+	}
+
+	if r.cfg.Timeout < 0 {
+		return r.invalidf("The timeout argument must not be negative but got %v", r.cfg.Timeout)
+	}
+
+	if r.cfg.Check {
+		if r.cfg.Restore != "" || r.cfg.EdgeMap != "" || r.cfg.Verify {
+			return r.invalidf("The check argument cannot be given with restore, edgemap, or verify")
+		}
+		r.cfg.DryRun = true
+	}
+
+	if r.cfg.LazyCheck && (r.cfg.Verify || r.cfg.MissingOut != "" || r.cfg.Inventory != "" || r.cfg.WarnNoCrops) {
+		return r.invalidf("The lazycheck argument cannot be given with verify, missingout, inventory, or warnnocrops")
+	}
+
+	if r.cfg.Checkpoint != "" {
+		if r.cfg.CheckpointEvery < 1 {
+			return r.invalidf("The checkpointevery argument must be at least 1 but got %d", r.cfg.CheckpointEvery)
+		}
+		// The chunks committed before maxchanges is exceeded could not be rolled back.
+		if r.cfg.ScanMeta || r.cfg.Report != "" || r.cfg.MaxChanges > 0 {
+			return r.invalidf("The checkpoint argument cannot be given with scanmeta, report, or maxchanges")
+		}
+	}
+
+	if r.cfg.MaxRuntime < 0 {
+		return r.invalidf("The maxruntime argument must not be negative but got %v", r.cfg.MaxRuntime)
+	}
+	if r.cfg.MaxRuntime > 0 {
+		r.runDeadline = budgetDeadline(time.Now(), r.cfg.MaxRuntime)
+	}
+
+	// The context is cancelled when the timeout passes, after which no more storage requests are made and the
+	// transaction is rolled back.
+	if r.cfg.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.cfg.Timeout)
+		defer cancel()
+	}
+
+	if r.cfg.StatsOut != "" {
+		meta := runMetadata{Started: time.Now(), Backend: r.cfg.Backend, Bucket: r.cfg.Bucket, PostType: r.cfg.PostType}
+		defer func() {
+			meta.Finished = time.Now()
+			meta.Duration = meta.Finished.Sub(meta.Started).Seconds()
+			if runErr != nil && runErr != ErrBudgetExhausted {
+				meta.Error = runErr.Error()
+			}
+			if err := writeStats(r.cfg.StatsOut, meta, st); err != nil {
+				r.printErr("writing the stats file", err)
+			}
+		}()
+	}
+
+	db := r.cfg.DB
+	if db == nil {
+		if r.cfg.DSN != "" {
+			db, err = r.openDSN("mysql", r.cfg.DSN)
+		} else {
+			db, err = r.makeConn(r.cfg.DBHost, r.cfg.DBPort, r.cfg.DBName, r.cfg.DBUser, r.cfg.DBPass, tlsConfig)
+		}
+		if err != nil {
+			r.printErr("connecting to database", err)
+			return err
+		}
+		defer db.Close()
+	}
+
+	if r.cfg.Restore != "" {
+		if err := r.restoreBackup(ctx, db, r.cfg.Restore); err != nil {
+			r.printErr("restoring the backup", err)
+			return err
+		}
+		return nil
+	}
+
+	attachments, err := r.getAttachments(db, st)
+	if err != nil {
+		r.printErr("getting the attachments", err)
+		return err
+	}
+	if len(r.includePatterns) > 0 || len(r.excludePatterns) > 0 {
+		n := len(attachments)
+		attachments = filterAttachments(attachments, r.includePatterns, r.excludePatterns)
+		r.logInfo("Kept %d of %d attachments matching the includefiles and excludefiles arguments.", len(attachments), n)
+	}
+	if len(attachments) == 0 {
+		r.logInfo("There aren't any attachments to sync up.")
+		return nil
+	}
+	r.logInfo("Retrieved %d attachment posts.", len(attachments))
+
+	store, err := r.newObjectStore(r.cfg.Backend, r.cfg.Bucket)
+	if err != nil {
+		r.printErr("creating a storage client", err)
+		return err
+	}
+	if r.cfg.MaxRetries > 0 {
+		store = &retryingStore{store: store, maxRetries: r.cfg.MaxRetries, base: r.cfg.RetryBase, logWith: r.logWith}
+	}
+	if r.cfg.ListAll {
+		r.logInfo("Listing all objects in the bucket.")
+		if store, err = newListedStore(ctx, store, r.cfg.BucketPrefix); err != nil {
+			r.printErr("listing the objects in the bucket", err)
+			return err
+		}
+	}
+
+	if r.cfg.Precheck {
+		if err := r.precheckObjects(ctx, store, attachments, precheckSample); err != nil {
+			r.printErr("checking that the files of the attachments are in the bucket", err)
+			return err
+		}
+	}
+
+	if r.cfg.LazyCheck {
+		r.logInfo("Checking for crops in the bucket as references to them are found.")
+		r.lazy = r.newLazyChecker(ctx, store)
+	} else if err := r.checkStorageObjects(ctx, store, attachments); err != nil {
+		r.printErr("could not check for storage objects", err)
+		return err
+	}
+	st.Missing = countMissing(attachments)
+	if r.cfg.WarnNoCrops {
+		st.NoCrops = countNoCrops(attachments)
+	}
+	if r.cfg.MissingOut != "" {
+		if err := r.writeMissing(r.cfg.MissingOut, attachments); err != nil {
+			r.printErr("writing the list of missing attachments", err)
+			return err
+		}
+	}
+	if r.cfg.Inventory != "" {
+		if err := writeInventory(r.cfg.Inventory, attachments); err != nil {
+			r.printErr("writing the inventory of crops", err)
+			return err
+		}
+	}
+
+	if !r.cfg.LazyCheck {
+		r.logInfo("Finished listing crop variants in bucket.")
+	}
+	files := r.newFileIndex(attachments)
+
+	if r.cfg.Verify {
+		if err := r.verifyCrops(db, postTypes, files); err != nil {
+			r.printErr("verifying crops", err)
+			return err
+		}
+		return nil
+	}
+
+	if r.cfg.EdgeMap != "" {
+		if err := r.writeEdgeMap(db, postTypes, files, r.cfg.EdgeMap); err != nil {
+			r.printErr("writing the edge map", err)
+			return err
+		}
+		return nil
+	}
+
+	var sign signFunc
+	if r.cfg.SignURLs {
+		if sign, err = newSigner(r.cfg.SignKey, r.cfg.Bucket, r.cfg.SignExpiry); err != nil {
+			r.printErr("setting up URL signing", err)
+			return err
+		}
+		r.logWarn("The signed URLs written expire at %s, after which the images will be broken unless this program "+
+			"is run again.", time.Now().Add(r.cfg.SignExpiry).Format(time.RFC1123))
+	}
+
+	var audit objectWriter
+	if r.cfg.AuditBucket != "" && !r.cfg.DryRun {
+		if audit, err = r.newObjectWriter(r.cfg.Backend, r.cfg.AuditBucket); err != nil {
+			r.printErr("creating a storage client for the audit bucket", err)
+			return err
+		}
+	}
+
+	if r.cfg.DumpSQL {
+		r.dumpStatement = r.printStatement
+	}
+
+	if r.cfg.Checkpoint != "" {
+		err = r.replaceInChunks(ctx, sqlDB{db}, postTypes, files, audit, sign, st)
+	} else {
+		err = r.replaceImageCrops(ctx, sqlDB{db}, postTypes, files, audit, sign, st)
+	}
+	if err == ErrBudgetExhausted {
+		r.logWarn("Stopped early because the maxruntime budget is exhausted; run the program again to continue.")
+	} else if err != nil {
+		r.printErr("replacing images", err)
+	}
+	r.logWith(levelNotice, nil, "%s", st.summary(r.cfg.DryRun))
+	return err
+}
+
+// ErrMissingConfig is returned by Run if a setting that's required is missing.
+var ErrMissingConfig = errors.New("missing required settings")
+
+// ErrInvalidConfig is wrapped by the error returned by Run if a setting is invalid.
+var ErrInvalidConfig = errors.New("invalid settings")
+
+// invalidConfig logs the message saying which setting is invalid along with err, which says why, and returns an
+// error wrapping ErrInvalidConfig.
+func (r *runner) invalidConfig(msg string, err error) error {
+	r.printErr(msg, err)
+	return fmt.Errorf("%s; %v; %w", msg, err, ErrInvalidConfig)
+}
+
+// invalidf is invalidConfig with a message formatted from format and args that says why the setting is invalid.
+func (r *runner) invalidf(format string, args ...interface{}) error {
+	msg := fmt.Sprintf(format, args...)
+	r.printErr(msg, ErrInvalidConfig)
+	return fmt.Errorf("%s; %w", msg, ErrInvalidConfig)
+}
+
+// An attachment contains the fields retrieved for our purposes for each post representing an attachment
+// along with a list of all of its cropped variants contained in the storage bucket.
+type attachment struct {
+	ID       int64
+	fileName string
+	ext      string
+	crops    []crop
+	missing  bool // whether the un-cropped file itself is missing from the bucket
+
+	// refPrefix, if not empty, is the text that must precede fileName in a reference to the file. It is set
+	// for legacy attachments, whose short fileName would otherwise match references to other files.
+	refPrefix string
+
+	// guidPrefix is the one of the guidPrefixes, without its trailing slash, that fileName follows in the guid
+	// of the attachment, if it's not a legacy attachment.
+	guidPrefix string
+
+	// lookalikes holds the file names of other attachments that are named like crops of this one, as
+	// /photo-1920x1080.jpg is like a crop of /photo.jpg (see findLookalikes).
+	lookalikes []string
+}
+
+// urlPrefix returns the URL prefix that the file name of the attachment follows in its guid: its refPrefix or its
+// guidPrefix, if it has either, or else def.
+func (a *attachment) urlPrefix(def string) string {
+	switch {
+	case a.refPrefix != "":
+		return a.refPrefix
+	case a.guidPrefix != "":
+		return a.guidPrefix
+	default:
+		return def
+	}
+}
+
+// cropExt returns the extension of the crop c of the attachment.
+func (a *attachment) cropExt(c *crop) string {
+	if c.ext != "" {
+		return c.ext
+	}
+	return a.ext
+}
+
+// cropName returns the end of the name of the crop of the attachment at index i of its crops, such as
+// "600x340.jpg", which follows the name of the attachment without its extension and a dash.
+func (a *attachment) cropName(i int) string {
+	return a.crops[i].str + a.cropExt(&a.crops[i])
+}
+
+type crop struct {
+	str           string // str contains the dimensions in the form "600x600" or "600x340", with any density: "600x340@2x"
+	width, height uint64
+
+	// ext is the extension of the crop if it is one of the extra variant extensions, such as ".webp" or
+	// ".jpg.webp", or if it differs in case from that of its attachment; it is empty if the crop has the
+	// extension of its attachment.
+	ext string
+}
+
+// getAttachments retrieves all of the attachment posts from the database table specified whose MIME type starts with
+// MimeFilter, counting in st those that are skipped. If StrictGUID is set, an attachment whose guid does not have a
+// guid prefix is an error.
+func (r *runner) getAttachments(db queryer, st *Report) ([]attachment, error) {
+	var attachmentsCount int64
+	if err := db.QueryRow(fmt.Sprintf("SELECT COUNT(*) FROM `%s` WHERE post_type = 'attachment'", r.tableName())).
+		Scan(&attachmentsCount); err != nil {
+		return nil, fmt.Errorf("could not count attachment rows; %v", err)
+	}
+	if attachmentsCount == 0 {
+		return nil, nil
+	}
+	if r.cfg.AttachmentLimit > 0 && attachmentsCount > int64(r.cfg.AttachmentLimit) {
+		attachmentsCount = int64(r.cfg.AttachmentLimit)
+	}
+
+	attachments := make([]attachment, 0, attachmentsCount)
+
+	rows, err := db.Query(r.attachmentsQuery(r.cfg.AttachmentLimit))
+	if err != nil {
+		return nil, fmt.Errorf("could not get attachment rows; %v", err)
+	}
+	defer rows.Close()
+	var loaded int
+	var lastID int64
+	for rows.Next() {
+		var att attachment
+		var guid, mime string
+		if err := rows.Scan(&att.ID, &guid, &mime); err != nil {
+			return nil, fmt.Errorf("could not scan an attachment row; %v", err)
+		}
+		loaded++
+		lastID = att.ID
+
+		if !hasPrefixFold(mime, r.cfg.MimeFilter) {
+			r.logVerbose("Skipping the attachment with ID %d, whose MIME type is %q", att.ID, mime)
+			st.Skipped++
+			continue
+		}
+
+		var ok bool
+		att.fileName, att.guidPrefix, att.refPrefix, ok = splitGUID(guid, r.guidPrefixes(), r.cfg.AltGUIDPrefix)
+		if !ok && r.cfg.StrictGUID {
+			return nil, fmt.Errorf("unexpected value for the 'guid' column; the row with ID %d has the guid %q "+
+				"but all attachments must have the same prefix", att.ID, guid)
+		}
+		if !ok {
+			r.logWith(levelWarn, logFields{"attachment_id": att.ID, "guid": guid}, "Skipping the attachment with ID "+
+				"%d, whose guid %q does not have the guid prefix", att.ID, guid)
+			st.Skipped++
+			continue
+		}
+
+		// Extract the extension, including the leading dot. Its case is kept as it is, since it's part of the file
+		// name, but extensions are compared regardless of case. Object names always have forward slashes, so a
+		// backslash is an ordinary character of a name, as it is to path but not to filepath on Windows.
+		att.ext = path.Ext(att.fileName)
+		if att.ext == "" {
+			// If there is no extension, it's not likely that we're dealing with an image.
+			r.logWith(levelInfo, logFields{"file": att.fileName}, "Skipping file without extension: %v", att.fileName)
+			st.Skipped++
+			continue
+		}
+
+		if r.cfg.ObjectTemplate != "" {
+			if _, err := expandObjectTemplate(r.cfg.ObjectTemplate, att.fileName); err != nil {
+				r.printErr(fmt.Sprintf("Skipping the attachment with ID %d", att.ID), err)
+				st.Skipped++
+				continue
+			}
+		}
+
+		attachments = append(attachments, att)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("could not loop over attachment rows; %v", err)
+	}
+	r.findLookalikes(attachments)
+
+	if r.cfg.AttachmentLimit > 0 && loaded == r.cfg.AttachmentLimit {
+		r.logInfo("Loaded only the first %d attachments because of the attachmentlimit argument; the highest "+
+			"attachment ID loaded is %d.", loaded, lastID)
+	}
+
+	return attachments, nil
+}
+
+// findLookalikes sets the lookalikes of each of the atts. An attachment whose name ends with dimensions, such as
+// /photo-1920x1080.jpg, is neither a reference to a crop of nor a crop in the bucket of the attachment whose
+// name it has without them, /photo.jpg.
+func (r *runner) findLookalikes(atts []attachment) {
+	byName := make(map[string][]int) // the indexes of the attachments, keyed by the file name without extension
+	for i := range atts {
+		a := &atts[i]
+		trimmed := a.fileName[:len(a.fileName)-len(a.ext)]
+		byName[trimmed] = append(byName[trimmed], i)
+	}
+	for i := range atts {
+		a := &atts[i]
+		trimmed := a.fileName[:len(a.fileName)-len(a.ext)]
+		sep := strings.LastIndex(trimmed, r.cfg.CropSeparator)
+		if sep == -1 {
+			continue
+		}
+		if c := r.getCropVariant(trimmed[sep:]+a.ext, a.ext); c == nil || len(c.str)+1 != len(trimmed)-sep {
+			continue
+		}
+		for _, j := range byName[trimmed[:sep]] {
+			atts[j].lookalikes = append(atts[j].lookalikes, a.fileName)
+		}
+	}
+}
+
+// guidPrefixes returns the prefixes listed in GUIDPrefix, separated by commas.
+func (r *runner) guidPrefixes() []string {
+	prefixes := strings.Split(r.cfg.GUIDPrefix, ",")
+	for i := range prefixes {
+		prefixes[i] = strings.TrimSpace(prefixes[i])
+	}
+	return prefixes
+}
+
+// primaryGUIDPrefix returns the first of the guidPrefixes, which is the prefix of the URLs of files in content.
+func (r *runner) primaryGUIDPrefix() string {
+	return r.guidPrefixes()[0]
+}
+
+// splitGUID returns the file name in guid, which is what follows the first of guidPrefixes that guid starts with
+// or else altPrefix, with a leading slash. All prefixes must have a trailing slash, and altPrefix may be empty.
+// The guid prefix that guid has is returned without its trailing slash as guidPrefix. If guid has only altPrefix,
+// that prefix without its trailing slash is returned as refPrefix. If guid has none of the prefixes, ok is false.
+func splitGUID(guid string, guidPrefixes []string, altPrefix string) (fileName, guidPrefix, refPrefix string,
+	ok bool) {
+	for _, prefix := range guidPrefixes {
+		if strings.HasPrefix(guid, prefix) {
+			return guid[len(prefix)-1:], prefix[:len(prefix)-1], "", true
+		}
+	}
+	if altPrefix != "" && strings.HasPrefix(guid, altPrefix) {
+		return guid[len(altPrefix)-1:], "", altPrefix[:len(altPrefix)-1], true
+	}
+	return "", "", "", false
+}
+
+// urlPrefixBefore returns the length of the URL prefix at the end of before, or -1 if before does not end with
+// it. If prefix has the scheme http or https, the prefix may also be written with the other scheme or without a
+// scheme, as in "//example.com", since content may link to the same file in any of those ways.
+func urlPrefixBefore(before, prefix string) int {
+	if strings.HasSuffix(before, prefix) {
+		return len(prefix)
+	}
+	i := strings.Index(prefix, "//")
+	if i == -1 {
+		return -1
+	}
+	if scheme := strings.ToLower(prefix[:i]); scheme != "http:" && scheme != "https:" {
+		return -1
+	}
+	relative := prefix[i:]
+	if !strings.HasSuffix(before, relative) {
+		return -1
+	}
+	rest := before[:len(before)-len(relative)]
+	for _, scheme := range []string{"http:", "https:"} {
+		if len(rest) >= len(scheme) && strings.EqualFold(rest[len(rest)-len(scheme):], scheme) {
+			return len(scheme) + len(relative)
+		}
+	}
+	return len(relative)
+}
+
+// contentPrefixBefore is like urlPrefixBefore but, if ContentHost is set, also accepts the prefix with its host
+// replaced by that host.
+func (r *runner) contentPrefixBefore(before, prefix string) int {
+	n := urlPrefixBefore(before, prefix)
+	if n == -1 && r.cfg.ContentHost != "" {
+		if p := replaceHost(prefix, r.cfg.ContentHost); p != "" {
+			n = urlPrefixBefore(before, p)
+		}
+	}
+	return n
+}
+
+// replaceHost returns the URL prefix, such as "https://example.com/uploads", with its host replaced by host, or
+// "" if prefix has no host.
+func replaceHost(prefix, host string) string {
+	i := strings.Index(prefix, "//")
+	if i == -1 {
+		return ""
+	}
+	start := i + 2
+	end := strings.IndexByte(prefix[start:], '/')
+	if end == -1 {
+		return prefix[:start] + host
+	}
+	return prefix[:start] + host + prefix[start+end:]
+}
+
+// attachmentsQuery returns the query selecting the ID, guid, and MIME type of the attachments in order of ID, at most
+// limit of them if limit is greater than 0.
+func (r *runner) attachmentsQuery(limit int) string {
+	query := fmt.Sprintf("SELECT ID, guid, post_mime_type from `%s` WHERE post_type = 'attachment' ORDER BY ID",
+		r.tableName())
+	if limit > 0 {
+		query += fmt.Sprintf(" LIMIT %d", limit)
+	}
+	return query
+}
+
+// checkStorageObjects checks to make sure that all attachments have a corresponding file in the bucket and populates
+// the crops field of each attachment element. The objects of up to the number of attachments given by Concurrency are
+// listed at once. If listing fails, the error for the first such attachment is returned. No more attachments are
+// checked once ctx is done.
+func (r *runner) checkStorageObjects(ctx context.Context, store objectStore, atts []attachment) error {
+	workers := r.cfg.Concurrency
+	if workers > len(atts) {
+		workers = len(atts)
+	}
+	errs := make([]error, len(atts))
+	var failed int32 // set when listing has failed, so that no more attachments are checked
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				if atomic.LoadInt32(&failed) != 0 {
+					continue
+				}
+				// Each attachment is modified by only one worker.
+				if errs[i] = ctx.Err(); errs[i] == nil {
+					errs[i] = r.checkStorageObject(ctx, store, &atts[i])
+				}
+				if errs[i] != nil {
+					atomic.StoreInt32(&failed, 1)
+				}
+			}
+		}()
+	}
+	for i := range atts {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+
+	// The files missing are reported in order, up to the first attachment for which listing failed.
+	for i := range atts {
+		if errs[i] != nil {
+			return errs[i]
+		}
+		if atts[i].missing {
+			r.printErr(fmt.Sprintf("there is no file named %v", r.objectName(atts[i].fileName)), errMissingFile)
+		} else if r.cfg.WarnNoCrops && len(atts[i].crops) == 0 {
+			r.logWith(levelWarn, logFields{"attachment_id": atts[i].ID}, "Attachment %d has no crops of %s in the "+
+				"bucket, so every crop referenced falls back to the un-cropped image", atts[i].ID, atts[i].fileName)
+		}
+	}
+	return nil
+}
+
+// checkStorageObject lists the objects whose names begin with the name of att without its extension, marking
+// att as missing if its file is not there and populating its crops field.
+func (r *runner) checkStorageObject(ctx context.Context, store objectStore, att *attachment) error {
+	if att.ext == "" {
+		return nil // Must be checked already, so this is just in case.
+	}
+
+	fileName := r.objectName(att.fileName)
+
+	// Trim out the extension.
+	prefix := fileName[:len(fileName)-len(att.ext)]
+
+	names, err := store.ListWithPrefix(ctx, prefix)
+	if err != nil {
+		return err
+	}
+
+	lookalikes := make([]string, len(att.lookalikes))
+	for i, l := range att.lookalikes {
+		lookalikes[i] = r.objectName(l)
+	}
+
+	var exists bool
+	for _, name := range names {
+		if fileName == name {
+			exists = true
+			continue
+		}
+		if containsString(lookalikes, name) {
+			continue
+		}
+
+		rest := strings.TrimPrefix(name, prefix)
+		for _, ext := range cropExtensions(att.ext, r.variantExts) {
+			// The name must end with the extension, so "-600x340.jpg.webp" is not taken for a ".jpg" crop.
+			dimensions := r.getCropVariant(rest, ext)
+			if dimensions != nil && len(rest) == len(dimensions.str)+1+len(ext) {
+				if actual := rest[len(rest)-len(ext):]; actual != att.ext {
+					dimensions.ext = actual
+				}
+				att.crops = append(att.crops, *dimensions)
+				break
+			}
+		}
+	}
+
+	att.missing = !exists
+	return nil
+}
+
+// countMissing returns the number of attachments whose file is missing from the bucket.
+func countMissing(atts []attachment) (n int) {
+	for i := range atts {
+		if atts[i].missing {
+			n++
+		}
+	}
+	return
+}
+
+// countNoCrops returns the number of attachments whose file is in the bucket but that have no crops there.
+func countNoCrops(atts []attachment) (n int) {
+	for i := range atts {
+		if !atts[i].missing && len(atts[i].crops) == 0 {
+			n++
+		}
+	}
+	return
+}
+
+var errMissingFile = errors.New("missing file for an attachment")
+
+// getCropVariant says whether the object with the name ending in fileNameEnd is a variant crop of an object whose name
+// without .ext has been trimmed out of fileNameEnd. If the file name gives a crop variant, this function returns the
+// dimensions of the crop, but otherwise it returns nil. The dimensions may be followed by a pixel density, as in
+// "-600x340@2x.jpg", and, if ThreePart is set, the height may be followed by a quality, as in "-600x340x80.jpg". The
+// extension is matched regardless of case, so "-600x340.JPG" is a variant for the ext ".jpg".
+func (r *runner) getCropVariant(fileNameEnd, ext string) *crop {
+	n := r.dimensionsLen(fileNameEnd)
+	if n == 0 {
+		return nil
+	}
+	dims, rest := fileNameEnd[1:n], fileNameEnd[n:]
+	density := densityLen(rest)
+	if !hasPrefixFold(rest[density:], ext) {
+		// If the string does not have this prefix, then it cannot be a variant crop.
+		// It could have some other extension, or it could have something else in its name following
+		// whatever wxh string it has after fileNameEnd.
+		return nil
+	}
+	x := strings.IndexByte(dims, 'x')
+	w, h := dims[:x], dims[x+1:]
+	if q := strings.IndexByte(h, 'x'); q != -1 {
+		h = h[:q] // The quality is kept only in str.
+	}
+	width, err := strconv.ParseUint(w, 10, 64)
+	if err != nil {
+		r.logWarn("Expecting to be able to parse a number out of %q; %v", w, err)
+		return nil
+	}
+	height, err := strconv.ParseUint(h, 10, 64)
+	if err != nil {
+		r.logWarn("Expecting to be able to parse a number out of %q; %v", h, err)
+		return nil
+	}
+	return &crop{str: dims + rest[:density], width: width, height: height}
+}
+
+// hasPrefixFold says whether s begins with prefix, ignoring case.
+func hasPrefixFold(s, prefix string) bool {
+	return len(s) >= len(prefix) && strings.EqualFold(s[:len(prefix)], prefix)
+}
+
+// densityLen returns the length of the pixel density, such as "@2x", at the start of s, or 0 if s does not
+// start with a density.
+func densityLen(s string) int {
+	if s == "" || s[0] != '@' {
+		return 0
+	}
+	d := digitsLen(s[1:])
+	if d == 0 || len(s) <= 1+d || s[1+d] != 'x' {
+		return 0
+	}
+	return 2 + d
+}
+
+// quality returns the third number of the dimensions of the crop, as in "600x340x80", or 0 if it has none.
+func (c *crop) quality() uint64 {
+	s := c.str
+	if at := strings.IndexByte(s, '@'); at != -1 {
+		s = s[:at]
+	}
+	q := strings.LastIndexByte(s, 'x')
+	if q == -1 || strings.IndexByte(s, 'x') == q {
+		return 0
+	}
+	quality, err := strconv.ParseUint(s[q+1:], 10, 64)
+	if err != nil {
+		return 0
+	}
+	return quality
+}
+
+// density returns the pixel density of the crop, which is 1 unless its dimensions are followed by one.
+func (c *crop) density() uint64 {
+	at := strings.IndexByte(c.str, '@')
+	if at == -1 {
+		return 1
+	}
+	d, err := strconv.ParseUint(c.str[at+1:len(c.str)-1], 10, 64)
+	if err != nil {
+		return 1
+	}
+	return d
+}
+
+// replaceImageCrops loops through each post with one of the postTypes and replaces occurrences of usage of each
+// non-existent image crop with an existing variant of the image, both in the content and in the extra columns of
+// postColumns, which are updated together with a single UPDATE per post. The posts scanned and changed and the
+// replacements made are counted in st. If DryRun is set, the changes are only printed, and the transaction is rolled
+// back. If Backup is set, the original columns of each post changed are appended to the backup file, which is synced
+// before the transaction is committed, and from which the rows are removed again if the commit fails. If Report is set,
+// a report of the replacements made in each post is written once the transaction ends. If audit is not nil, the content
+// of each post from before and after it is changed is uploaded with it before the post is updated, and the post is left
+// unchanged if the upload fails unless AuditContinue is set. If ScanMeta is set, the meta values of the posts are
+// transformed in the same transaction. If sign is not nil, crop references are replaced with signed URLs. If ctx is
+// done before the transaction is committed, the transaction is rolled back and the error of ctx returned. So is it
+// rolled back, with an error, if more replacements are found than MaxChanges allows.
+func (r *runner) replaceImageCrops(ctx context.Context, db beginner, postTypes []string, files *fileIndex,
+	audit objectWriter, sign signFunc, st *Report) error {
+	update := updateStmts{run: r}
+	changed, replacements, metaChanged := st.Changed, st.Replacements, st.MetaChanged
+	rollback := func(tx txer) {
+		update.close()
+		if err := tx.Rollback(); err != nil {
+			r.printErr("rolling back after failure", err)
+		}
+		st.rollBack(changed, replacements, metaChanged)
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("could not begin transaction; %v", err)
+	}
+	maxPacket, err := queryMaxAllowedPacket(tx)
+	if err != nil {
+		r.printErr("checking max_allowed_packet, so the size of updates is not checked", err)
+	}
+	posts, err := r.queryPosts(tx, postTypes)
+	if err != nil {
+		rollback(tx)
+		return err
+	}
+	if r.cfg.ScanOrder == scanRandom {
+		shufflePosts(posts, rand.New(rand.NewSource(time.Now().UnixNano())))
+	}
+	update.tx = tx
+	update.batchSize, update.maxPacket = r.cfg.BatchSize, maxPacket
+	var backup *backupFile
+	if r.cfg.Backup != "" && !r.cfg.DryRun {
+		if backup, err = r.openBackup(r.cfg.Backup); err != nil {
+			rollback(tx)
+			return fmt.Errorf("could not open the backup file; %v", err)
+		}
+		defer backup.close()
+	}
+	var explained int
+	reports := []PostReport{} // not nil, so that an empty report is written as []
+	var stopped bool
+	for i := range posts {
+		if err := ctx.Err(); err != nil {
+			rollback(tx)
+			return err
+		}
+		if r.budgetExhausted() {
+			stopped = true
+			msg := fmt.Sprintf("Stopping after scanning %d of %d posts because the maxruntime budget is exhausted.",
+				i, len(posts))
+			if i > 0 {
+				msg += fmt.Sprintf(" The last post scanned has ID %d.", posts[i-1].ID)
+			}
+			r.logWarn("%s", msg)
+			break
+		}
+		if r.cfg.ProgressEvery > 0 && i > 0 && i%r.cfg.ProgressEvery == 0 {
+			r.logWith(levelInfo, logFields{"scanned": st.Scanned, "changed": st.Changed}, "%s",
+				st.progress(len(posts), r.cfg.DryRun))
+		}
+		st.LastID = posts[i].ID
+		reps, err := r.findSignedReplacements(posts[i].content, files, sign)
+		if err != nil {
+			rollback(tx)
+			return err
+		}
+		got := r.applyReplacements(posts[i].content, reps)
+		if r.cfg.Explain && explained < r.cfg.ExplainSample && len(reps) > 0 {
+			r.explainPost(r.out, posts[i].ID, reps, r.flagTolerance())
+			explained++
+		}
+		var u columnUpdate
+		if countChanges(reps) > 0 {
+			u.set(r.cfg.ContentColumn, got)
+		}
+		extraReps, err := r.replaceExtraColumns(&u, &posts[i], files, sign)
+		if err != nil {
+			rollback(tx)
+			return err
+		}
+		reps = append(reps, extraReps...)
+		st.Scanned++
+		if r.scannedPosts != nil {
+			r.scannedPosts = append(r.scannedPosts, posts[i].ID)
+		}
+		st.countReplacements(reps)
+		if err := r.checkMaxChanges(st); err != nil {
+			rollback(tx)
+			return err
+		}
+		if len(u.columns) > 0 {
+			if packetTooLarge(u.size, maxPacket) {
+				r.printErr(fmt.Sprintf("the updated columns of post %d are %d bytes, which with the rest of the UPDATE "+
+					"exceeds the max_allowed_packet of %d bytes", posts[i].ID, u.size, maxPacket), errPacketTooLarge)
+				if r.cfg.SkipOversizedPackets {
+					st.Oversized++
+					continue
+				}
+			}
+			if audit != nil {
+				err := r.auditPost(ctx, audit, r.cfg.AuditPrefix, &posts[i], &u)
+				if err != nil {
+					r.printErr(fmt.Sprintf("uploading the content of post %d to the audit bucket", posts[i].ID), err)
+					if !r.cfg.AuditContinue {
+						st.Unaudited++
+						r.heldPosts = append(r.heldPosts, posts[i].ID)
+						continue
+					}
+				}
+			}
+			st.Changed++
+			if r.cfg.Report != "" {
+				reports = append(reports, newPostReport(posts[i].ID, reps))
+			}
+			if r.cfg.ShowDiff {
+				r.printPostDiff(r.out, posts[i].ID, posts[i].content, reps)
+			}
+			if r.cfg.DryRun {
+				r.logWouldUpdate(logFields{"post_id": posts[i].ID}, reps, "Would update %d", posts[i].ID)
+				continue
+			}
+			r.logWith(levelInfo, logFields{"post_id": posts[i].ID}, "Updating %d", posts[i].ID)
+			if backup != nil {
+				backup.add(&posts[i], u.columns)
+			}
+			if err := update.add(&u, posts[i].ID); err != nil {
+				rollback(tx)
+				return err
+			}
+		} else if r.cfg.Report != "" && hasKind(reps, kindKept) {
+			// The references kept are reported even though the post is not changed.
+			reports = append(reports, newPostReport(posts[i].ID, reps))
+		}
+	}
+	if err := update.flush(); err != nil {
+		rollback(tx)
+		return err
+	}
+	if r.cfg.ScanMeta && !stopped {
+		if err := r.replaceMetaCrops(ctx, tx, postTypes, files, maxPacket, sign, st); err != nil {
+			rollback(tx)
+			return err
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		rollback(tx)
+		return err
+	}
+	// What's backed up must be on the disk before the updates are committed.
+	if backup != nil {
+		if err := backup.write(); err != nil {
+			rollback(tx)
+			return fmt.Errorf("could not write to the backup file; %v", err)
+		}
+	}
+	if r.cfg.DryRun {
+		r.logInfo("Dry run, so rolling back without modifying the database.")
+		err = tx.Rollback()
+	} else {
+		r.logInfo("Committing database modifications.")
+		if err = tx.Commit(); err != nil {
+			st.rollBack(changed, replacements, metaChanged)
+			if backup != nil {
+				if err := backup.undo(); err != nil {
+					r.printErr("removing the backup of the posts not changed", err)
+				}
+			}
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if r.cfg.Report != "" {
+		if err := writeReport(r.cfg.Report, reports); err != nil {
+			return fmt.Errorf("writing the report; %v", err)
+		}
+	}
+	if stopped {
+		return ErrBudgetExhausted
+	}
+	return nil
+}
+
+var errPacketTooLarge = errors.New("update too large for the server")
+
+// checkMaxChanges returns an error if more replacements are counted in st than MaxChanges allows.
+func (r *runner) checkMaxChanges(st *Report) error {
+	if r.cfg.MaxChanges > 0 && st.Replacements > r.cfg.MaxChanges {
+		return fmt.Errorf("found more than the %d replacements allowed by the maxchanges argument, so nothing is "+
+			"changed; check the tolerances or raise the limit", r.cfg.MaxChanges)
+	}
+	return nil
+}
+
+// packetOverhead is a generous allowance for the bytes of an UPDATE packet besides the new content itself.
+const packetOverhead = 1024
+
+// queryMaxAllowedPacket returns the max_allowed_packet setting of the server, which is the largest statement
+// that may be sent to it, or 0 if the server does not report it.
+func queryMaxAllowedPacket(q queryer) (int64, error) {
+	var name string
+	var size int64
+	err := q.QueryRow("SHOW VARIABLES LIKE 'max_allowed_packet'").Scan(&name, &size)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return size, err
+}
+
+// packetTooLarge says whether an UPDATE setting values totalling size bytes would exceed the max_allowed_packet
+// of maxPacket bytes. If maxPacket is 0, the limit is not known and false is returned.
+func packetTooLarge(size int, maxPacket int64) bool {
+	return maxPacket > 0 && int64(size+packetOverhead) > maxPacket
+}
+
+// printReplacementDiff writes to w each crop reference changed by the replacements, as removed and added lines.
+func printReplacementDiff(w io.Writer, reps []replacement) {
+	for i := range reps {
+		rep := &reps[i]
+		if rep.kind == kindClose || rep.kind == kindFallback || rep.kind == kindDuplicate {
+			fmt.Fprintf(w, "\t- %s%s\n\t+ %s%s\n", rep.old, rep.oldSuffix, rep.new, rep.newSuffix)
+		}
+	}
+}
+
+// A post contains the fields retrieved for each post whose content is transformed.
+type post struct {
+	ID      int64
+	content string
+	extra   []string // the values of the extra columns, in the order of postColumns
+}
+
+// The orders in which posts may be processed. Updating in ID order concentrates writes at one end of the
+// clustered index, which under replication can hot-spot the pages holding the newest posts; random order
+// spreads the writes across the table at the cost of less local I/O. Note that a random order cannot be
+// resumed from a single high-water mark ID, since lower IDs may not have been processed yet, so its checkpoint
+// records the set of the IDs processed.
+const (
+	scanID     = "id"
+	scanRandom = "random"
+)
+
+// shufflePosts puts posts in a random order.
+func shufflePosts(posts []post, rnd *rand.Rand) {
+	rnd.Shuffle(len(posts), func(i, j int) {
+		posts[i], posts[j] = posts[j], posts[i]
+	})
+}
+
+// A queryer can run queries; both *sql.DB and *sql.Tx are queryers.
+type queryer interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// An execer can run queries and statements; both *sql.DB and *sql.Tx are execers.
+type execer interface {
+	queryer
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Prepare(query string) (*sql.Stmt, error)
+}
+
+// selectedColumns returns the list of the columns of the posts table that queryPosts selects: the ID, the content
+// column, and the postColumns.
+func (r *runner) selectedColumns() string {
+	selected := "ID, " + r.cfg.ContentColumn
+	for _, column := range r.postColumns {
+		selected += ", " + column
+	}
+	return selected
+}
+
+// A txer is a transaction that can be committed or rolled back; *sql.Tx is a txer.
+type txer interface {
+	execer
+	Commit() error
+	Rollback() error
+}
+
+// A beginner can begin transactions; a *sql.DB made an sqlDB is a beginner.
+type beginner interface {
+	Begin() (txer, error)
+}
+
+// An sqlDB is a *sql.DB that begins transactions as txers.
+type sqlDB struct {
+	*sql.DB
+}
+
+func (db sqlDB) Begin() (txer, error) {
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	return tx, nil
+}
+
+// queryPosts retrieves the ID, content, and extra columns of each post with one of the given post types and one of the
+// postStatuses. If ContentLike is set, only the posts whose content or one of whose extra columns matches that LIKE
+// pattern are retrieved.
+func (r *runner) queryPosts(q queryer, postTypes []string) ([]post, error) {
+	where, args := r.scanWhere(postTypes)
+	var count int64
+	if err := q.QueryRow(fmt.Sprintf("SELECT COUNT(*) FROM `%s` WHERE %s", r.tableName(), where), args...).
+		Scan(&count); err != nil {
+		return nil, fmt.Errorf("counting rows; %v", err)
+	}
+	posts := make([]post, 0, count)
+	query := fmt.Sprintf("SELECT %s FROM `%s` WHERE %s ORDER BY ID", r.selectedColumns(), r.tableName(), where)
+	if r.chunkPosts > 0 {
+		query += " LIMIT ?"
+		args = append(args, r.chunkPosts)
+		if count > int64(r.chunkPosts) {
+			count = int64(r.chunkPosts)
+		}
+	}
+	rows, err := q.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("could not query for rows; %v", err)
+	}
+	defer rows.Close()
+	extra := make([]sql.NullString, len(r.postColumns))
+	for rows.Next() {
+		var p post
+		dest := []interface{}{&p.ID, &p.content}
+		for j := range extra {
+			dest = append(dest, &extra[j])
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+		if len(extra) > 0 {
+			p.extra = make([]string, len(extra))
+			for j := range extra {
+				p.extra[j] = extra[j].String
+			}
+		}
+		posts = append(posts, p)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return posts, nil
+}
+
+// queryPostIDs returns the IDs of all of the posts that queryPosts selects, in order.
+func (r *runner) queryPostIDs(q queryer, postTypes []string) ([]int64, error) {
+	where, args := r.scanWhere(postTypes)
+	rows, err := q.Query(fmt.Sprintf("SELECT ID FROM `%s` WHERE %s ORDER BY ID", r.tableName(), where), args...)
+	if err != nil {
+		return nil, fmt.Errorf("could not query for post IDs; %v", err)
+	}
+	defer rows.Close()
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// scanWhere returns the condition of postsWhere along with, if ContentLike is set, the condition that the content or
+// one of the extra columns matches that LIKE pattern.
+func (r *runner) scanWhere(postTypes []string) (string, []interface{}) {
+	where, args := r.postsWhere("", postTypes)
+	if r.cfg.ContentLike != "" {
+		likes := []string{r.cfg.ContentColumn + " LIKE ?"}
+		args = append(args, r.cfg.ContentLike)
+		for _, column := range r.postColumns {
+			likes = append(likes, column+" LIKE ?")
+			args = append(args, r.cfg.ContentLike)
+		}
+		where += " AND (" + strings.Join(likes, " OR ") + ")"
+	}
+	return where, args
+}
+
+// postsWhere returns the condition selecting the posts with one of the postTypes and, unless postStatuses is empty, one
+// of the postStatuses, with one of the postIDs if it's not empty, and dated within the range of dateSince and
+// dateUntil, along with its query arguments. The qualifier, such as "p.", precedes each column name.
+func (r *runner) postsWhere(qualifier string, postTypes []string) (string, []interface{}) {
+	in, args := inClause(postTypes)
+	where := fmt.Sprintf("%spost_type IN (%s)", qualifier, in)
+	if len(r.postStatuses) > 0 {
+		in, statusArgs := inClause(r.postStatuses)
+		where += fmt.Sprintf(" AND %spost_status IN (%s)", qualifier, in)
+		args = append(args, statusArgs...)
+	}
+	if len(r.postIDs) > 0 {
+		where += fmt.Sprintf(" AND %sID IN (%s)", qualifier, strings.Repeat(", ?", len(r.postIDs))[2:])
+		for _, id := range r.postIDs {
+			args = append(args, id)
+		}
+	}
+	// The post_date column holds the site's local time, which the database does not know the zone of, so the
+	// times are compared as written; only the GMT column can be compared with times converted to UTC.
+	column, from, to := "post_date", r.dateSince, r.dateUntil
+	if r.cfg.UseGMT {
+		column, from, to = "post_date_gmt", from.UTC(), to.UTC()
+	}
+	if !from.IsZero() {
+		where += fmt.Sprintf(" AND %s%s >= ?", qualifier, column)
+		args = append(args, from.Format(mysqlDateTime))
+	}
+	if !to.IsZero() {
+		where += fmt.Sprintf(" AND %s%s <= ?", qualifier, column)
+		args = append(args, to.Format(mysqlDateTime))
+	}
+	if r.resumeAfter > 0 {
+		where += fmt.Sprintf(" AND %sID > ?", qualifier)
+		args = append(args, r.resumeAfter)
+	}
+	return where, args
+}
+
+// parsePostIDs parses the comma-separated list of post IDs s, which may be empty, checking that each is a
+// positive integer. Repeated IDs are dropped.
+func parsePostIDs(s string) ([]int64, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var ids []int64
+	seen := make(map[int64]bool)
+	for _, field := range strings.Split(s, ",") {
+		id, err := strconv.ParseInt(strings.TrimSpace(field), 10, 64)
+		if err != nil || id < 1 {
+			return nil, fmt.Errorf("%q is not a valid post ID", field)
+		}
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+// mysqlDateTime is the layout of a MySQL DATETIME value.
+const mysqlDateTime = "2006-01-02 15:04:05"
+
+// parseTimeRange parses the RFC 3339 times since and until, either of which may be empty, checking that since
+// is not after until.
+func parseTimeRange(since, until string) (from, to time.Time, err error) {
+	if since != "" {
+		if from, err = time.Parse(time.RFC3339, since); err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("the since time is invalid; %v", err)
+		}
+	}
+	if until != "" {
+		if to, err = time.Parse(time.RFC3339, until); err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("the until time is invalid; %v", err)
+		}
+	}
+	if since != "" && until != "" && from.After(to) {
+		return time.Time{}, time.Time{}, fmt.Errorf("the since time %s is after the until time %s", since, until)
+	}
+	return from, to, nil
+}
+
+// inClause returns the placeholders for an IN clause matching any of the values, such as "?, ?", along with
+// the values as query arguments.
+func inClause(values []string) (string, []interface{}) {
+	args := make([]interface{}, len(values))
+	for i := range values {
+		args[i] = values[i]
+	}
+	return strings.Repeat(", ?", len(values))[2:], args
+}
+
+// parsePostTypes splits the comma-separated list of post types s, checking that each is valid. Repeated post
+// types are dropped.
+func parsePostTypes(s string) ([]string, error) {
+	var types []string
+	for _, t := range strings.Split(s, ",") {
+		t = strings.TrimSpace(t)
+		if err := validatePostType(t); err != nil {
+			return nil, err
+		}
+		if !containsString(types, t) {
+			types = append(types, t)
+		}
+	}
+	return types, nil
+}
+
+// maxPostTypeLen is the maximum length of a post type name that WordPress allows.
+const maxPostTypeLen = 20
+
+// parsePostStatuses splits the comma-separated list of post statuses s, checking that each is valid. Repeated
+// statuses are dropped.
+func parsePostStatuses(s string) ([]string, error) {
+	var statuses []string
+	for _, status := range strings.Split(s, ",") {
+		status = strings.TrimSpace(status)
+		if status == "" || len(status) > maxPostTypeLen ||
+			strings.Trim(status, "abcdefghijklmnopqrstuvwxyz0123456789-_") != "" {
+			return nil, fmt.Errorf("%q is not a valid post status", status)
+		}
+		if !containsString(statuses, status) {
+			statuses = append(statuses, status)
+		}
+	}
+	return statuses, nil
+}
+
+// validatePostType checks that t is a post type name that WordPress permits: from 1 to 20 lowercase letters,
+// digits, dashes, and underscores.
+func validatePostType(t string) error {
+	if t == "" {
+		return errors.New("a post type is empty")
+	}
+	if len(t) > maxPostTypeLen {
+		return fmt.Errorf("the post type %q is longer than %d characters", t, maxPostTypeLen)
+	}
+	for _, c := range t {
+		if (c < 'a' || c > 'z') && (c < '0' || c > '9') && c != '-' && c != '_' {
+			return fmt.Errorf("the post type %q contains %q, but post types may contain only lowercase letters, "+
+				"digits, dashes, and underscores", t, c)
+		}
+	}
+	return nil
+}
+
+// replaceCrops replaces, in a single pass over content, every usage of a non-existent image crop of any of
+// the files with an existing variant of the image.
+func (r *runner) replaceCrops(content string, files []attachment, tol tolerance) string {
+	got, _ := r.replaceCropsCount(content, files, tol)
+	return got
+}
+
+// replaceCropsCount is like replaceCrops but also returns the number of crop references changed.
+func (r *runner) replaceCropsCount(content string, files []attachment, tol tolerance) (string, int) {
+	reps := r.findReplacements(content, r.newFileIndex(files), tol)
+	got := r.applyReplacements(content, reps)
+	return got, countChanges(reps)
+}
+
+// countChanges returns the number of replacements in reps that change the content. The reps must have already
+// been passed to applyReplacements, which marks those that are skipped.
+func countChanges(reps []replacement) (n int) {
+	for i := range reps {
+		if kind := reps[i].kind; kind == kindClose || kind == kindFallback || kind == kindDuplicate {
+			n++
+		}
+	}
+	return
+}
+
+// hasKind says whether any of reps has the given kind.
+func hasKind(reps []replacement, kind replacementKind) bool {
+	for i := range reps {
+		if reps[i].kind == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// findReplacements returns the replacements that each of the indexed files calls for in content. Only the files
+// that the index finds candidates for are searched for, in order.
+// A crop is only ever matched to the attachment with the same extension, so references whose extension does
+// not tell apart attachments sharing a base name are left alone and reported as ambiguous.
+// References in block attributes with escaped slashes are replaced like those in the HTML of the blocks.
+func (r *runner) findReplacements(content string, files *fileIndex, tol tolerance) []replacement {
+	var reps []replacement
+	var candidates []attachment
+	for _, i := range files.candidates(content) {
+		file := &files.files[i]
+		reps = append(reps, r.replaceContentSingle(content, file, tol)...)
+		reps = append(reps, r.blockAttrReplacements(content, file, tol)...)
+		candidates = append(candidates, *file)
+	}
+	if r.logging(levelVerbose) {
+		r.logDecisions(reps)
+	}
+	for _, ref := range r.ambiguousReferences(content, candidates) {
+		r.logWith(levelWarn, logFields{"ref": ref}, "Not replacing %q, which could be a crop of any of the "+
+			"attachments with the same base name", ref)
+	}
+	return reps
+}
+
+// logDecisions prints the decisions recorded in reps that are not evident from the replacements made.
+func (r *runner) logDecisions(reps []replacement) {
+	for i := range reps {
+		rep := &reps[i]
+		switch rep.kind {
+		case kindClose:
+			if c := &rep.file.crops[rep.chosen]; c.width != rep.requested.width {
+				r.logWith(levelVerbose, logFields{"file": rep.file.fileName}, "Using width %v instead of %v for %s",
+					c.width, rep.requested.width, rep.file.fileName)
+			}
+		case kindDuplicate:
+			r.logWith(levelVerbose, logFields{"old": rep.old}, "Removing %q, which would repeat another srcset "+
+				"candidate", rep.old)
+		case kindNarrow:
+			r.logWith(levelVerbose, logFields{"old": rep.old}, "Leaving %s alone, which is narrower than %d pixels",
+				rep.old, r.cfg.MinReplaceWidth)
+		case kindKept:
+			r.logWith(levelVerbose, logFields{"old": rep.old}, "Leaving %s alone, for which no crop is close enough",
+				rep.old)
+		}
+	}
+}
+
+// ambiguousReferences returns the crop references in content to a base name that several of the files share,
+// as photo.jpg and photo.png do, but whose extension matches none of them.
+func (r *runner) ambiguousReferences(content string, files []attachment) []string {
+	exts := make(map[string][]string) // the extensions of the files, keyed by the file name without extension
+	for i := range files {
+		f := &files[i]
+		trimmed := f.fileName[:len(f.fileName)-len(f.ext)]
+		exts[trimmed] = append(exts[trimmed], f.ext)
+	}
+	var refs []string
+	for trimmed, have := range exts {
+		if len(have) < 2 {
+			continue
+		}
+		for _, indx := range stringIndexes(content, trimmed) {
+			rest := content[indx+len(trimmed):]
+			n := r.dimensionsLen(rest)
+			if n == 0 {
+				continue
+			}
+			ext := rest[n : n+extensionLen(rest[n:])]
+			if !containsFold(have, ext) {
+				refs = append(refs, trimmed+rest[:n]+ext)
+			}
+		}
+	}
+	sort.Strings(refs)
+	return refs
+}
+
+// dimensionsLen returns the length of the crop dimensions, such as "-600x340", at the start of s, or 0 if s does not
+// start with crop dimensions. The dimensions begin with the separator given by CropSeparator. If ThreePart is set, they
+// may end with a quality, as in "-600x340x80".
+func (r *runner) dimensionsLen(s string) int {
+	if s == "" || s[0] != (r.cfg.CropSeparator)[0] {
+		return 0
+	}
+	w := digitsLen(s[1:])
+	if w == 0 || len(s) <= 1+w || s[1+w] != 'x' {
+		return 0
+	}
+	h := digitsLen(s[2+w:])
+	if h == 0 {
+		return 0
+	}
+	n := 2 + w + h
+	if r.cfg.ThreePart && len(s) > n+1 && s[n] == 'x' {
+		if q := digitsLen(s[n+1:]); q > 0 {
+			n += 1 + q
+		}
+	}
+	return n
+}
+
+// digitsLen returns the number of decimal digits at the start of s.
+func digitsLen(s string) int {
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return i
+		}
+	}
+	return len(s)
+}
+
+// extensionLen returns the length of the file extension, such as ".jpg", at the start of s, or 0 if s does
+// not start with one.
+func extensionLen(s string) int {
+	if s == "" || s[0] != '.' {
+		return 0
+	}
+	n := 1
+	for ; n < len(s); n++ {
+		c := s[n]
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9') {
+			break
+		}
+	}
+	if n == 1 {
+		return 0
+	}
+	return n
+}
+
+// containsString says whether list contains s.
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// containsFold says whether list contains s, ignoring case.
+func containsFold(list []string, s string) bool {
+	for _, v := range list {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// A replacement says that the text old found in some content at the byte offset start should become new.
+// The remaining fields record how the decision was made.
+type replacement struct {
+	start    int
+	old, new string
+
+	// oldSuffix is text following old, such as a srcset width descriptor, that is to be replaced with newSuffix.
+	oldSuffix, newSuffix string
+
+	url bool // old and new are whole URLs rather than the parts of them following the URL prefix
+
+	column string // the column of the posts table in which old is found, if not the content column
+
+	kind      replacementKind
+	file      *attachment // the attachment whose crop is referenced
+	requested crop        // the crop referenced in the content
+	chosen    int         // the index in file.crops of the crop used, or -1
+}
+
+// end returns the offset just past the replaced text.
+func (r *replacement) end() int {
+	return r.start + len(r.old) + len(r.oldSuffix)
+}
+
+// newFileName returns the file name of the object that r refers to instead of the crop requested: the crop chosen
+// or, if none is, the un-cropped image, with sep as the CropSeparator. Unlike r.new, it's the name as it is in the
+// bucket, without ampersands encoded as entities.
+func (r *replacement) newFileName(sep string) string {
+	if r.chosen < 0 {
+		return r.file.fileName
+	}
+	return r.file.fileName[:len(r.file.fileName)-len(r.file.ext)] + sep + r.file.cropName(r.chosen)
+}
+
+// A replacementKind says why a crop reference was (or was not) replaced.
+type replacementKind int
+
+const (
+	kindExact     replacementKind = iota // the referenced crop exists, so old and new are the same
+	kindClose                            // a different crop within the tolerated range is used
+	kindFallback                         // there is no close crop, so the un-cropped image is used
+	kindSkipped                          // the reference overlaps another replacement and is left alone
+	kindDuplicate                        // the replaced reference would repeat another srcset candidate, so it's removed
+	kindNarrow                           // there is no close crop, but the crop is too narrow to use the un-cropped image
+	kindKept                             // there is no close crop, and NoFallback keeps the reference as it is
+)
+
+func (k replacementKind) String() string {
+	switch k {
+	case kindExact:
+		return "exact"
+	case kindClose:
+		return "close"
+	case kindFallback:
+		return "fallback"
+	case kindSkipped:
+		return "skipped"
+	case kindDuplicate:
+		return "duplicate"
+	case kindNarrow:
+		return "narrow"
+	case kindKept:
+		return "kept"
+	default:
+		return "unknown"
+	}
+}
+
+// replaceContentSingle finds in content each usage of a crop of file and returns the replacements that should be made
+// for them, which record the decisions made without logging them. References to crops that exist are returned too, with
+// the kind kindExact, as are those left alone with the kind kindNarrow, so that no other replacement may overlap them.
+// A replaced reference in a srcset that would repeat another candidate there is removed instead (see dedupeSrcsets). A
+// missing crop to which one of the cropRules applies is replaced as the rule says rather than with a crop within tol,
+// if that's possible. If Canonical is set, each reference to a crop of a file having the canonical crop is replaced
+// with it, with the kind kindClose. A file name with an ampersand is also found with the ampersand entity-encoded,
+// which is kept in the replacement. The content itself is not modified.
+func (r *runner) replaceContentSingle(content string, file *attachment, tol tolerance) []replacement {
+	var reps []replacement
+	// The name is trimmed of the trailing dot and extension.
+	for _, trimmed := range nameForms(file.fileName[:len(file.fileName)-len(file.ext)]) {
+		reps = append(reps, r.replaceNamed(content, file, trimmed, tol)...)
+	}
+	dedupeSrcsets(content, reps)
+	return reps
+}
+
+// replaceNamed returns the replacements for the references to crops of file in content that begin with trimmed,
+// the file name of file without its extension as it's written in content, for replaceContentSingle.
+func (r *runner) replaceNamed(content string, file *attachment, trimmed string, tol tolerance) []replacement {
+	lenTrimmed := len(trimmed)
+	var reps []replacement
+	for _, indx := range stringIndexes(content, trimmed) {
+		if !nameStartsAt(content, indx, trimmed) || r.contentPrefixBefore(content[:indx], file.refPrefix) == -1 {
+			continue
+		}
+		var crop *crop
+		ext := file.ext // the extension in the reference
+		for _, e := range cropExtensions(file.ext, r.variantExts) {
+			if crop = r.getCropVariant(content[indx+lenTrimmed:], e); crop != nil {
+				ext = e
+				break
+			}
+		}
+		dims := r.cfg.CropSeparator // the dimensions in the reference, with the leading separator
+		if crop == nil && r.cfg.FixDupeDims {
+			if crop = r.getDupedCropVariant(content[indx+lenTrimmed:], file.ext); crop != nil {
+				dims += crop.str + r.cfg.CropSeparator // the duplicated dimensions are collapsed
+			}
+		}
+		if crop == nil && r.cfg.SquareShorthand {
+			crop = r.getSquareVariant(content[indx+lenTrimmed:], file.ext)
+		}
+		if crop == nil {
+			continue
+		}
+		dims += crop.str
+		old := content[indx : indx+lenTrimmed+len(dims)+len(ext)] // the extension as it is written
+		if containsString(file.lookalikes, old) {
+			continue // The reference is to another attachment, named like a crop of this one.
+		}
+		if r.lazy != nil {
+			r.lazy.check(file, crop, ext)
+		}
+		// Only the crops with the extension in the reference may be used.
+		good, okDiff := r.chooseCrop(crop, file, ext, tol)
+		// A rule for a missing crop overrides the tolerances, unless it calls for a crop that's missing too.
+		var full bool
+		if rule := matchRule(r.cropRules, crop); rule != nil && !good {
+			if full = rule.full(); full {
+				okDiff = -1
+			} else if c := sizedIndex(file, ext, rule.toWidth, rule.toHeight, crop.density()); c > -1 {
+				okDiff = c
+			}
+		}
+		if c := r.canonicalIndex(file, ext); c > -1 && (crop.width != r.canonicalCrop.width ||
+			crop.height != r.canonicalCrop.height || crop.density() != 1) {
+			// Whether or not the referenced crop exists, the canonical crop is used instead.
+			good, okDiff = false, c
+		}
+		rep := replacement{
+			start:     indx,
+			old:       old,
+			file:      file,
+			requested: *crop,
+			chosen:    okDiff,
+		}
+		switch {
+		case good && rep.old != trimmed+r.cfg.CropSeparator+file.cropName(rep.chosen):
+			// The crop exists, but the reference to it must be collapsed or written as it is in the bucket, such
+			// as without zero padding or with the extension in another case, which is like using a close variant.
+			rep.kind = kindClose
+			rep.new = trimmed + r.cfg.CropSeparator + file.cropName(rep.chosen)
+		case good:
+			rep.kind = kindExact
+			rep.new = rep.old
+		case okDiff > -1:
+			rep.kind = kindClose
+			rep.new = trimmed + r.cfg.CropSeparator + file.cropName(okDiff)
+			// In a srcset, the width descriptor following the URL must describe the new crop.
+			if space, ok := widthDescriptor(content[rep.end():], crop.width); ok {
+				rep.oldSuffix = space + strconv.FormatUint(crop.width, 10) + "w"
+				rep.newSuffix = space + strconv.FormatUint(file.crops[okDiff].width, 10) + "w"
+			}
+		default:
+			// If there is no crop that's within the tolerated range, use the un-cropped variant, or the
+			// placeholder if the whole URL of the reference can be replaced with it. A crop narrower than
+			// MinReplaceWidth is not worth replacing with either, so it's left alone. If NoFallback is set, the
+			// reference is left alone in any case, unless a rule calls for the un-cropped image.
+			rep.kind = kindFallback
+			rep.new = trimmed + file.ext
+			n := 0
+			if r.cfg.Placeholder != "" && !full {
+				n = r.contentPrefixBefore(content[:indx], r.fileURLPrefix(file))
+			}
+			switch {
+			case r.cfg.NoFallback && !full:
+				rep.kind = kindKept
+				rep.new = rep.old
+			case crop.width < uint64(r.cfg.MinReplaceWidth) && !full:
+				rep.kind = kindNarrow
+				rep.new = rep.old
+			case n > 0:
+				rep.start -= n
+				rep.old = content[rep.start:indx] + rep.old
+				rep.new = r.cfg.Placeholder
+				rep.url = true
+			}
+		}
+		reps = append(reps, rep)
+	}
+	return reps
+}
+
+// canonicalIndex returns the index in file.crops of the crop with the extension ext having the dimensions of
+// canonicalCrop, or -1 if there is none.
+func (r *runner) canonicalIndex(file *attachment, ext string) int {
+	if r.canonicalCrop == nil {
+		return -1
+	}
+	return sizedIndex(file, ext, r.canonicalCrop.width, r.canonicalCrop.height, 1)
+}
+
+// sizedIndex returns the index in file.crops of the crop with the extension ext having the given dimensions
+// and pixel density, or -1 if there is none.
+func sizedIndex(file *attachment, ext string, width, height, density uint64) int {
+	for i := range file.crops {
+		c := &file.crops[i]
+		if c.width == width && c.height == height && c.density() == density && strings.EqualFold(file.cropExt(c), ext) {
+			return i
+		}
+	}
+	return -1
+}
+
+// parseDimensions parses dimensions in the form "300x200" as a crop.
+func parseDimensions(s string) (*crop, error) {
+	x := strings.IndexByte(s, 'x')
+	if x == -1 {
+		return nil, fmt.Errorf("%q is not in the form WIDTHxHEIGHT", s)
+	}
+	width, err := strconv.ParseUint(s[:x], 10, 64)
+	if err != nil || width == 0 {
+		return nil, fmt.Errorf("%q does not have a valid width", s)
+	}
+	height, err := strconv.ParseUint(s[x+1:], 10, 64)
+	if err != nil || height == 0 {
+		return nil, fmt.Errorf("%q does not have a valid height", s)
+	}
+	return &crop{str: s, width: width, height: height}, nil
+}
+
+// fileURLPrefix returns the URL prefix that the file name of the attachment follows in its guid: its refPrefix
+// or its guidPrefix, if it has either, or else the first guid prefix without its trailing slash.
+func (r *runner) fileURLPrefix(file *attachment) string {
+	return file.urlPrefix(strings.TrimSuffix(r.primaryGUIDPrefix(), "/"))
+}
+
+// nameStartsAt says whether the file name name may start at the offset i of content, so that a name is never
+// matched within a longer one: either name starts with a slash, or it's preceded by a path separator, a quote,
+// whitespace, or the start of content.
+func nameStartsAt(content string, i int, name string) bool {
+	if i == 0 || strings.HasPrefix(name, "/") {
+		return true
+	}
+	return strings.IndexByte(nameBoundaries, content[i-1]) != -1
+}
+
+// A srcsetCandidate is an image candidate string, a URL optionally followed by a descriptor, of a srcset
+// attribute found in some content at [start, end).
+type srcsetCandidate struct {
+	start, end int
+	rep        *replacement // the replacement within the candidate, if any
+}
+
+// changed says whether the candidate is changed by its replacement.
+func (c *srcsetCandidate) changed() bool {
+	return c.rep != nil && (c.rep.kind == kindClose || c.rep.kind == kindFallback)
+}
+
+// final returns the URL and the descriptor of the candidate after its replacement is made. A missing descriptor
+// is given as "1x", which it means.
+func (c *srcsetCandidate) final(content string) (url, descriptor string) {
+	s := content[c.start:c.end]
+	if r := c.rep; r != nil {
+		s = content[c.start:r.start] + r.new + r.newSuffix + content[r.end():c.end]
+	}
+	url = s
+	if n := strings.IndexAny(s, srcsetSpace); n != -1 {
+		url, descriptor = s[:n], strings.TrimLeft(s[n:], srcsetSpace)
+	}
+	if descriptor == "" {
+		descriptor = "1x"
+	}
+	return
+}
+
+// srcsetSpace lists the whitespace characters that may separate the parts of a srcset.
+const srcsetSpace = " \t\r\n\f"
+
+// dedupeSrcsets looks in each srcset attribute of content having a crop reference replaced by one of the reps
+// for candidates that would repeat the URL or the descriptor of an earlier candidate, which browsers reject.
+// Of two such candidates, the one changed by its replacement is removed (the later one if both are), so
+// references to crops that exist stay in place. A candidate is removed by making its replacement, whose kind
+// becomes kindDuplicate, delete it along with the separator before it (or after it, if it's the first).
+func dedupeSrcsets(content string, reps []replacement) {
+	done := make(map[int]bool)
+	for i := range reps {
+		start, end, ok := srcsetAt(content, reps[i].start)
+		if !ok || done[start] {
+			continue
+		}
+		done[start] = true
+		cands := srcsetCandidates(content, start, end)
+		for j := range cands {
+			c := &cands[j]
+			for k := range reps {
+				if reps[k].start >= c.start && reps[k].end() <= c.end {
+					c.rep = &reps[k]
+					break
+				}
+			}
+		}
+		var kept []int // the indexes of the candidates left in the srcset
+		for k := range cands {
+			url, desc := cands[k].final(content)
+			dup := false
+			for ki, j := range kept {
+				url2, desc2 := cands[j].final(content)
+				if url != url2 && desc != desc2 {
+					continue
+				}
+				switch {
+				case cands[k].changed():
+					removeCandidate(content, cands, k)
+					dup = true
+				case cands[j].changed():
+					removeCandidate(content, cands, j)
+					kept = append(kept[:ki], kept[ki+1:]...)
+				}
+				break
+			}
+			if !dup {
+				kept = append(kept, k)
+			}
+		}
+	}
+}
+
+// removeCandidate makes the replacement within the candidate at index k of cands delete the candidate from
+// content, along with the separator between it and the previous candidate or, if it's the first, the next one.
+func removeCandidate(content string, cands []srcsetCandidate, k int) {
+	from, to := cands[k].start, cands[k].end
+	if k > 0 {
+		from = cands[k-1].end
+	} else if len(cands) > 1 {
+		to = cands[1].start
+	}
+	rep := cands[k].rep
+	rep.start = from
+	rep.old, rep.new = content[from:to], ""
+	rep.oldSuffix, rep.newSuffix = "", ""
+	rep.kind = kindDuplicate
+}
+
+// srcsetAt returns the bounds of the value of the quoted srcset attribute in content containing the offset i.
+func srcsetAt(content string, i int) (start, end int, ok bool) {
+	attr := strings.LastIndex(content[:i], "srcset=")
+	if attr == -1 {
+		return 0, 0, false
+	}
+	start = attr + len("srcset=") + 1
+	if start > i {
+		return 0, 0, false
+	}
+	quote := content[start-1]
+	if quote != '"' && quote != '\'' || strings.IndexByte(content[start:i], quote) != -1 {
+		return 0, 0, false
+	}
+	n := strings.IndexByte(content[i:], quote)
+	if n == -1 {
+		return 0, 0, false
+	}
+	return start, i + n, true
+}
+
+// srcsetCandidates splits the srcset value content[start:end] into its candidates the way browsers do: each
+// URL runs up to whitespace, except that trailing commas end a URL without a descriptor, and each descriptor
+// runs up to a comma.
+func srcsetCandidates(content string, start, end int) []srcsetCandidate {
+	var cands []srcsetCandidate
+	for i := start; i < end; {
+		if content[i] == ',' || strings.IndexByte(srcsetSpace, content[i]) != -1 {
+			i++
+			continue
+		}
+		c := srcsetCandidate{start: i}
+		n := strings.IndexAny(content[i:end], srcsetSpace)
+		if n == -1 {
+			n = end - i
+		}
+		i += n
+		if content[i-1] == ',' {
+			c.end = c.start + len(strings.TrimRight(content[c.start:i], ","))
+		} else {
+			n = strings.IndexByte(content[i:end], ',')
+			if n == -1 {
+				n = end - i
+			}
+			c.end = i + len(strings.TrimRight(content[i:i+n], srcsetSpace))
+			i += n
+		}
+		cands = append(cands, c)
+	}
+	return cands
+}
+
+// getDupedCropVariant is like getCropVariant but for a fileNameEnd in which the crop dimensions are given twice,
+// such as "-300x200-300x200.jpg", which is left by a faulty find-and-replace. If the dimensions are not given
+// exactly twice, nil is returned.
+func (r *runner) getDupedCropVariant(fileNameEnd, ext string) *crop {
+	n := r.dimensionsLen(fileNameEnd)
+	if n == 0 {
+		return nil
+	}
+	c := r.getCropVariant(fileNameEnd[n:], ext)
+	if c == nil || fileNameEnd[:n] != r.cfg.CropSeparator+c.str {
+		return nil
+	}
+	return c
+}
+
+// minSquareShorthand is the smallest size given by a single dimension that is taken for a square crop, so that
+// the suffixes that WordPress adds to tell apart uploads with the same name, as in photo-2.jpg, are not.
+const minSquareShorthand = 32
+
+// getSquareVariant is like getCropVariant but for a fileNameEnd giving a square crop by a single dimension, as
+// "-150.jpg" does for 150x150. The str of the crop returned is that dimension. A size smaller than
+// minSquareShorthand or a four-digit number that could be a year, as in "-2023.jpg", is not taken for a crop.
+func (r *runner) getSquareVariant(fileNameEnd, ext string) *crop {
+	if fileNameEnd == "" || fileNameEnd[0] != (r.cfg.CropSeparator)[0] {
+		return nil
+	}
+	n := digitsLen(fileNameEnd[1:])
+	if n == 0 || !hasPrefixFold(fileNameEnd[1+n:], ext) {
+		return nil
+	}
+	dims := fileNameEnd[1 : 1+n]
+	size, err := strconv.ParseUint(dims, 10, 64)
+	if err != nil || size < minSquareShorthand || n == 4 && size >= 1900 && size <= 2099 {
+		return nil
+	}
+	return &crop{str: dims, width: size, height: size}
+}
+
+// cropExtensions returns the extensions that a crop of a file with the extension ext may have given the extra
+// variant extensions: each extra extension appended to ext, such as ".jpg.webp", and each extra extension alone,
+// followed by ext itself. Longer extensions come before those that they end with.
+func cropExtensions(ext string, extra []string) []string {
+	exts := make([]string, 0, 2*len(extra)+1)
+	for _, x := range extra {
+		exts = append(exts, ext+x)
+	}
+	for _, x := range extra {
+		if x != ext {
+			exts = append(exts, x)
+		}
+	}
+	return append(exts, ext)
+}
+
+// chooseCrop returns the index in the crops of file of the crop to use for the requested crop, considering only
+// the crops with the extension ext, regardless of case. If the requested crop exists, good is true. Otherwise,
+// chosen is the closest crop within the tolerance, or -1 if there is none. Crops with the same pixel density as
+// the requested crop are preferred, and only if none of them is close enough may a crop with another density be
+// used, even if it has the same dimensions.
+func (r *runner) chooseCrop(requested *crop, file *attachment, ext string, tol tolerance) (good bool, chosen int) {
+	crops := file.crops
+	density := requested.density()
+	var same, other []crop
+	var sameIndexes, otherIndexes []int
+	for i := range crops {
+		switch {
+		case !strings.EqualFold(file.cropExt(&crops[i]), ext):
+		case crops[i].density() == density:
+			same = append(same, crops[i])
+			sameIndexes = append(sameIndexes, i)
+		default:
+			other = append(other, crops[i])
+			otherIndexes = append(otherIndexes, i)
+		}
+	}
+	good, okDiff := r.findSuitableCrop(requested, same, tol)
+	switch {
+	case good:
+		return true, sameIndexes[cropIndex(same, requested)]
+	case okDiff > -1:
+		return false, sameIndexes[okDiff]
+	}
+	good, okDiff = r.findSuitableCrop(requested, other, tol)
+	switch {
+	case good:
+		return false, otherIndexes[cropIndex(other, requested)]
+	case okDiff > -1:
+		return false, otherIndexes[okDiff]
+	}
+	return false, -1
+}
+
+// parseExtensions parses a comma-separated list of file extensions, adding a leading dot to each that lacks one.
+func parseExtensions(s string) ([]string, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var exts []string
+	for _, ext := range strings.Split(s, ",") {
+		ext = strings.TrimSpace(ext)
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+		if len(ext) < 2 || strings.ContainsAny(ext[1:], "./-") {
+			return nil, fmt.Errorf("%q is not a valid file extension", ext)
+		}
+		if !containsString(exts, ext) {
+			exts = append(exts, ext)
+		}
+	}
+	return exts, nil
+}
+
+// cropIndex returns the index in crops of the crop with the same dimensions as c, or -1 if there is none. A
+// crop whose dimensions are written just as in c, with the same zero padding, is preferred.
+func cropIndex(crops []crop, c *crop) int {
+	indx := -1
+	for i := range crops {
+		if crops[i].width == c.width && crops[i].height == c.height {
+			if crops[i].str == c.str {
+				return i
+			}
+			if indx == -1 {
+				indx = i
+			}
+		}
+	}
+	return indx
+}
+
+// applyReplacements makes a single left-to-right pass over content, substituting the text of each replacement.
+// A replacement overlapping a region that has already been replaced is dropped and marked kindSkipped, so each
+// byte of the original content is edited at most once and the output of one replacement is never matched again
+// by another. When two replacements begin at the same offset, the longer one wins. The reps slice is sorted by
+// offset in place.
+func (r *runner) applyReplacements(content string, reps []replacement) string {
+	if len(reps) == 0 {
+		return content
+	}
+	sort.SliceStable(reps, func(i, j int) bool {
+		if reps[i].start != reps[j].start {
+			return reps[i].start < reps[j].start
+		}
+		return len(reps[i].old) > len(reps[j].old)
+	})
+	var b strings.Builder
+	b.Grow(len(content))
+	last := 0
+	for i := range reps {
+		rep := &reps[i]
+		if rep.start < last {
+			rep.kind = kindSkipped // Overlaps a replacement already made.
+			continue
+		}
+		if rep.old != rep.new {
+			r.logWith(levelVerbose, logFields{"old": rep.old, "new": rep.new}, "Replacing %q with %q", rep.old, rep.new)
+		}
+		b.WriteString(content[last:rep.start])
+		b.WriteString(rep.new)
+		b.WriteString(rep.newSuffix)
+		last = rep.end()
+	}
+	b.WriteString(content[last:])
+	return b.String()
+}
+
+// The preferences for which close variant to use in place of a missing crop. Larger crops are scaled down by
+// browsers without losing sharpness, while smaller ones save bandwidth.
+const (
+	preferClosest = "closest"
+	preferLarger  = "larger"
+	preferSmaller = "smaller"
+)
+
+// findSuitableCrop checks if there is a suitable crop in the bucket for the crop found in a post.
+// If the crop in the post is already in the bucket, a true is returned. If it isn't, then okDiff is an index
+// to the closest variant in the haveInBucket slice if there is a close variant; otherwise the int returned is -1.
+// A close variant is one whose width and height differ from those of inPost by no more than tol allows. If the
+// prefer flag is larger or smaller, the closest variant on that side of inPost is used if there is one.
+func (r *runner) findSuitableCrop(inPost *crop, haveInBucket []crop, tol tolerance) (good bool, okDiff int) {
+	okDiff = -1
+	type variant struct {
+		diff, hDiff float64
+		indx        int
+	}
+	var okVariants []variant
+	for i := range haveInBucket {
+		existing := &haveInBucket[i]
+		if inPost.width == existing.width && inPost.height == existing.height {
+			good = true
+			return
+		}
+		diff, hDiff := widthDiff(inPost, existing), heightDiff(inPost, existing)
+		if diff <= tol.width && tol.allowsHeight(hDiff) {
+			okVariants = append(okVariants, variant{diff: diff, hDiff: hDiff, indx: i})
+		}
+	}
+	// At this point, good == false and okDiff = -1.
+	if r.cfg.Prefer != preferClosest {
+		var preferred []variant
+		for _, v := range okVariants {
+			w := haveInBucket[v.indx].width
+			if r.cfg.Prefer == preferLarger && w >= inPost.width ||
+				r.cfg.Prefer == preferSmaller && w <= inPost.width {
+				preferred = append(preferred, v)
+			}
+		}
+		if len(preferred) > 0 {
+			okVariants = preferred
+		}
+	}
+	if len(okVariants) > 0 {
+		// Find the closest variant by width, breaking ties by height.
+		closest := okVariants[0]
+		for _, variant := range okVariants[1:] {
+			if variant.diff < closest.diff || variant.diff == closest.diff && variant.hDiff < closest.hDiff {
+				closest = variant
+			}
+		}
+		okDiff = closest.indx
+	}
+	return
+}
+
+// widthDescriptor says whether s starts with a srcset width descriptor for the given width, such as " 600w",
+// and returns the whitespace preceding the descriptor. The descriptor must be followed by the end of the
+// srcset candidate. A query string or fragment of the URL, such as "?ver=3", may precede the whitespace, in
+// which case it's returned as part of space.
+func widthDescriptor(s string, width uint64) (space string, ok bool) {
+	query := 0
+	if s != "" && (s[0] == '?' || s[0] == '#') {
+		query = strings.IndexAny(s, " \t\r\n\"'")
+		if query == -1 {
+			return "", false
+		}
+	}
+	trimmed := strings.TrimLeft(s[query:], " \t\r\n")
+	if len(trimmed) == len(s)-query {
+		return "", false
+	}
+	desc := strconv.FormatUint(width, 10) + "w"
+	if !strings.HasPrefix(trimmed, desc) {
+		return "", false
+	}
+	if rest := trimmed[len(desc):]; rest != "" && !strings.ContainsRune(",\"' \t\r\n", rune(rest[0])) {
+		return "", false
+	}
+	return s[:len(s)-len(trimmed)], true
+}
+
+// A tolerance gives the maximum differences, as percentages, between the dimensions of a crop referenced in a
+// post and those of a crop that may be used in its place.
+type tolerance struct {
+	width, height float64
+}
+
+// flagTolerance returns the tolerance set by the command line flags.
+func (r *runner) flagTolerance() tolerance {
+	return tolerance{width: r.cfg.WidthTolerance, height: r.cfg.HeightTolerance}
+}
+
+func (t tolerance) String() string {
+	return fmt.Sprintf("%.1f%% wide, %.1f%% high", t.width, t.height)
+}
+
+// allowsHeight says whether a difference in height of diff percent is tolerated. A height tolerance of 100
+// places no limit on the height, so that only the width is compared.
+func (t tolerance) allowsHeight(diff float64) bool {
+	return t.height >= 100 || diff <= t.height
+}
+
+// widthDiff returns the difference in width between the crops as a percentage of the width of inPost.
+func widthDiff(inPost, existing *crop) float64 {
+	return math.Abs(float64(inPost.width)-float64(existing.width)) / float64(inPost.width) * 100.0
+}
+
+// heightDiff returns the difference in height between the crops as a percentage of the height of inPost.
+func heightDiff(inPost, existing *crop) float64 {
+	return math.Abs(float64(inPost.height)-float64(existing.height)) / float64(inPost.height) * 100.0
+}
+
+// stringIndexes returns the indexes of s at which there is substr.
+func stringIndexes(s, substr string) (indexes []int) {
+	offset := 0
+	for {
+		i := strings.Index(s, substr)
+		if i == -1 {
+			return
+		}
+		indexes = append(indexes, offset+i)
+		move := i + len(substr)
+		offset += move
+		s = s[move:]
+	}
+}
+
+// makeConn creates a sql.DB object to use with connections to the database.
+// The tlsConfig is the name of the TLS configuration to use, as returned by dbTLSConfig. With the preferred
+// mode, the connection is made without TLS if the server does not support it.
+func (r *runner) makeConn(host string, port int, dbName, user, pass, tlsConfig string) (*sql.DB, error) {
+	config := r.dbConfig(host, port, dbName, user, pass)
+	config.TLSConfig = tlsConfig
+	db, err := sql.Open("mysql", config.FormatDSN())
+	if err != nil {
+		return nil, err
+	}
+	if r.cfg.DBTLS == dbTLSPreferred {
+		if err := db.Ping(); err == mysql.ErrNoTLS {
+			r.logWarn("The database server does not support TLS, so connecting without TLS.")
+			db.Close()
+			config.TLSConfig = dbTLSFalse
+			if db, err = sql.Open("mysql", config.FormatDSN()); err != nil {
+				return nil, err
+			}
+		}
+	}
+	r.setPool(db)
+	return db, nil
+}
+
+// openDSN opens the database with the named driver using dsn as it is, after checking that dsn is valid for the
+// MySQL driver.
+func (r *runner) openDSN(driverName, dsn string) (*sql.DB, error) {
+	if _, err := mysql.ParseDSN(dsn); err != nil {
+		return nil, fmt.Errorf("invalid dsn; %v", err)
+	}
+	db, err := sql.Open(driverName, dsn)
+	if err != nil {
+		return nil, err
+	}
+	r.setPool(db)
+	return db, nil
+}
+
+// setPool limits the connections that db keeps as DBMaxOpen, DBMaxIdle, and DBConnLifetime say.
+func (r *runner) setPool(db *sql.DB) {
+	db.SetMaxOpenConns(r.cfg.DBMaxOpen)
+	db.SetMaxIdleConns(r.cfg.DBMaxIdle)
+	db.SetConnMaxLifetime(r.cfg.DBConnLifetime)
+}
+
+// dbAddr returns the address of the database on host at port, unless host has a port already, as in
+// "db.example.com:3307" or "[::1]:3307".
+func dbAddr(host string, port int) string {
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+	if strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]") {
+		host = host[1 : len(host)-1]
+	}
+	return net.JoinHostPort(host, strconv.Itoa(port))
+}
+
+// dbConfig returns the configuration for connecting to the database on the given host and port. Times are parsed, and
+// the character set is set by DBCharset so that multibyte characters in content are not garbled by the server's
+// default.
+func (r *runner) dbConfig(host string, port int, dbName, user, pass string) *mysql.Config {
+	config := mysql.NewConfig()
+	config.Net = "tcp"
+	config.Addr = dbAddr(host, port)
+	config.DBName = dbName
+	config.User = user
+	config.Passwd = pass
+	config.ParseTime = true
+	if r.cfg.DBCharset != "" {
+		config.Params = map[string]string{"charset": r.cfg.DBCharset}
+	}
+	return config
+}
+
+// dbPassEnv is the environment variable holding the database password if neither DBPass nor DBPassFile is set.
+const dbPassEnv = "DB_PASSWORD"
+
+// dbPassword returns the database password: pass if it's not empty, or else the contents of the file at passFile
+// without a trailing newline if passFile is not empty, or else the value of the dbPassEnv environment variable.
+func dbPassword(pass, passFile string) (string, error) {
+	if pass != "" {
+		return pass, nil
+	}
+	if passFile != "" {
+		data, err := ioutil.ReadFile(passFile)
+		if err != nil {
+			return "", err
+		}
+		s := strings.TrimSuffix(string(data), "\n")
+		return strings.TrimSuffix(s, "\r"), nil
+	}
+	return os.Getenv(dbPassEnv), nil
+}
+
+// tableName returns the name of the "wp_posts" database table, or of the table named by TableSuffix.
+func (r *runner) tableName() string {
+	return r.blogTablePrefix() + r.cfg.TableSuffix
+}
+
+// metaTableName returns the name of the "wp_postmeta" database table.
+func (r *runner) metaTableName() string {
+	return r.blogTablePrefix() + "postmeta"
+}
+
+// blogTablePrefix returns the prefix of the tables of the site given by BlogID. As in WordPress, the tables of the main
+// site, with the ID 1, have just the prefix given by DBPrefix, while the tables of each other site of a multisite
+// network have it followed by the ID of the site, as in "wp_2_posts".
+func (r *runner) blogTablePrefix() string {
+	if r.cfg.BlogID > 1 {
+		return r.cfg.DBPrefix + strconv.Itoa(r.cfg.BlogID) + "_"
+	}
+	return r.cfg.DBPrefix
+}
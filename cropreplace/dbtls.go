@@ -0,0 +1,58 @@
+package cropreplace
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// The modes of TLS for the database connection that may be given with DBTLS.
+const (
+	dbTLSFalse      = "false"
+	dbTLSTrue       = "true"
+	dbTLSSkipVerify = "skip-verify"
+	dbTLSPreferred  = "preferred"
+)
+
+// dbTLSCustom is the name under which the TLS configuration with the CA given by DBCA is registered.
+const dbTLSCustom = "crop-replace-ca"
+
+// dbTLSConfig returns the value for the TLSConfig field of a mysql.Config for the TLS mode and CA file given.
+// If caFile is not empty, the certificates in it are registered as the only trusted roots and TLS is required
+// with the server's certificate verified, so the mode must be either true or false (the default).
+//
+// The driver does not support the preferred mode, so for it skip-verify is returned and makeConn falls back
+// to a connection without TLS if the server does not support TLS.
+func dbTLSConfig(mode, caFile string) (string, error) {
+	switch mode {
+	case dbTLSFalse, dbTLSTrue, dbTLSSkipVerify, dbTLSPreferred:
+	default:
+		return "", fmt.Errorf("the TLS mode must be one of %s, %s, %s, or %s but got %q",
+			dbTLSFalse, dbTLSTrue, dbTLSSkipVerify, dbTLSPreferred, mode)
+	}
+	if caFile == "" {
+		if mode == dbTLSPreferred {
+			return dbTLSSkipVerify, nil
+		}
+		return mode, nil
+	}
+	if mode != dbTLSFalse && mode != dbTLSTrue {
+		return "", fmt.Errorf("a CA file cannot be used with the TLS mode %s", mode)
+	}
+	pem, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return "", err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return "", errors.New("no certificates could be read from the CA file " + caFile)
+	}
+	if err := mysql.RegisterTLSConfig(dbTLSCustom, &tls.Config{RootCAs: pool}); err != nil {
+		return "", err
+	}
+	return dbTLSCustom, nil
+}
@@ -0,0 +1,96 @@
+package cropreplace
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+func TestDBTLSConfig(t *testing.T) {
+	r := newRunner(DefaultConfig())
+	dir, err := ioutil.TempDir("", "crop-replace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	caFile := filepath.Join(dir, "ca.pem")
+	if err := ioutil.WriteFile(caFile, selfSignedPEM(t), 0644); err != nil {
+		t.Fatal(err)
+	}
+	notPEM := filepath.Join(dir, "not.pem")
+	if err := ioutil.WriteFile(notPEM, []byte("not a certificate"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		mode, caFile string
+		name         string
+		ok           bool
+	}{
+		{dbTLSFalse, "", dbTLSFalse, true},
+		{dbTLSTrue, "", dbTLSTrue, true},
+		{dbTLSSkipVerify, "", dbTLSSkipVerify, true},
+		{dbTLSPreferred, "", dbTLSSkipVerify, true},
+		{"required", "", "", false},
+		{dbTLSFalse, caFile, dbTLSCustom, true},
+		{dbTLSTrue, caFile, dbTLSCustom, true},
+		{dbTLSSkipVerify, caFile, "", false},
+		{dbTLSTrue, filepath.Join(dir, "missing.pem"), "", false},
+		{dbTLSTrue, notPEM, "", false},
+	}
+	for i, tc := range cases {
+		t.Run("case_"+strconv.Itoa(i), func(t *testing.T) {
+			name, err := dbTLSConfig(tc.mode, tc.caFile)
+			if tc.ok != (err == nil) {
+				t.Fatalf("got error %v but expected ok to be %v", err, tc.ok)
+			}
+			if name != tc.name {
+				t.Errorf("got TLS config %q but expected %q", name, tc.name)
+			}
+			if tc.ok {
+				config := r.dbConfig("db.example.com", 3306, "wordpress", "wpuser", "secret")
+				config.TLSConfig = name
+				dsn := config.FormatDSN()
+				if parsed, err := mysql.ParseDSN(dsn); err != nil || parsed.TLSConfig != name {
+					t.Errorf("got DSN %q but expected it to have the parameter tls=%s", dsn, name)
+				}
+			}
+		})
+	}
+}
+
+// selfSignedPEM returns a PEM-encoded self-signed CA certificate.
+func selfSignedPEM(t *testing.T) []byte {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "crop-replace test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
@@ -0,0 +1,104 @@
+package cropreplace
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"unicode/utf8"
+)
+
+// diffContext is the number of bytes of content shown on each side of a change by ShowDiff.
+const diffContext = 40
+
+// diffEscaper escapes the line breaks and tabs in content so that each snippet is on a single line.
+var diffEscaper = strings.NewReplacer("\n", `\n`, "\r", `\r`, "\t", `\t`)
+
+// A diffSnippet is a part of some content around one or more changes, with each change marked as [-old-]{+new+}
+// in the text.
+type diffSnippet struct {
+	offset int // the byte offset in the original content of the first change
+	text   string
+}
+
+// diffSnippets returns the snippets of content showing the changes made by the replacements of the content
+// column among reps, with up to context bytes of the content around each change. Changes closer together than
+// twice context are shown in the same snippet. The reps must have already been passed to applyReplacements.
+func diffSnippets(content string, reps []replacement, context int) []diffSnippet {
+	var snippets []diffSnippet
+	var b strings.Builder
+	last := -1 // the end of the last change in the snippet being written, or -1 if there is none
+	for i := range reps {
+		rep := &reps[i]
+		if rep.column != "" || rep.kind != kindClose && rep.kind != kindFallback && rep.kind != kindDuplicate {
+			continue
+		}
+		if last > -1 && rep.start-last > 2*context {
+			snippets[len(snippets)-1].text = endSnippet(&b, content, last, context)
+			last = -1
+		}
+		if last == -1 {
+			from := runeStart(content, rep.start-context)
+			if from > 0 {
+				b.WriteString("...")
+			}
+			b.WriteString(diffEscaper.Replace(content[from:rep.start]))
+			snippets = append(snippets, diffSnippet{offset: rep.start})
+		} else {
+			b.WriteString(diffEscaper.Replace(content[last:rep.start]))
+		}
+		b.WriteString("[-" + diffEscaper.Replace(rep.old+rep.oldSuffix) + "-]")
+		if added := rep.new + rep.newSuffix; added != "" {
+			b.WriteString("{+" + diffEscaper.Replace(added) + "+}")
+		}
+		last = rep.end()
+	}
+	if last > -1 {
+		snippets[len(snippets)-1].text = endSnippet(&b, content, last, context)
+	}
+	return snippets
+}
+
+// endSnippet writes to b up to context bytes of content following the offset end, and returns the snippet
+// written to b, resetting b.
+func endSnippet(b *strings.Builder, content string, end, context int) string {
+	to := runeStart(content, end+context)
+	b.WriteString(diffEscaper.Replace(content[end:to]))
+	if to < len(content) {
+		b.WriteString("...")
+	}
+	s := b.String()
+	b.Reset()
+	return s
+}
+
+// runeStart returns the offset i, limited to the bounds of content, moved back to the start of a character.
+func runeStart(content string, i int) int {
+	if i <= 0 {
+		return 0
+	}
+	if i >= len(content) {
+		return len(content)
+	}
+	for i > 0 && !utf8.RuneStart(content[i]) {
+		i--
+	}
+	return i
+}
+
+// printPostDiff writes to w the snippets of the content of the post with the given ID showing the changes made
+// by the replacements. In JSON log format, they're written as the diff field of a single JSON line.
+func (r *runner) printPostDiff(w io.Writer, postID int64, content string, reps []replacement) {
+	if r.cfg.LogFormat == logFormatJSON {
+		snippets := []map[string]interface{}{}
+		for _, s := range diffSnippets(content, reps, diffContext) {
+			snippets = append(snippets, map[string]interface{}{"offset": s.offset, "text": s.text})
+		}
+		msg := fmt.Sprintf("Changes to post %d", postID)
+		writeJSONLine(w, levelInfo, logFields{"post_id": postID, "diff": snippets}, msg)
+		return
+	}
+	fmt.Fprintf(w, "Post %d:\n", postID)
+	for _, s := range diffSnippets(content, reps, diffContext) {
+		fmt.Fprintf(w, "\t@@ %d @@ %s\n", s.offset, s.text)
+	}
+}
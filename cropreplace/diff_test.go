@@ -0,0 +1,85 @@
+package cropreplace
+
+import (
+	"bytes"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestDiffSnippets(t *testing.T) {
+	r := newRunner(DefaultConfig())
+	atts := []attachment{
+		{
+			fileName: "/2018/photo.jpg", ext: ".jpg",
+			crops: []crop{
+				{"300x200", 300, 200, ""},
+			},
+		},
+	}
+	filler := strings.Repeat("x", 30)
+	cases := []struct {
+		content  string
+		snippets []diffSnippet
+	}{
+		{"nothing /2018/photo-300x200.jpg", nil},
+		{
+			`<img src="/2018/photo-310x210.jpg">`,
+			[]diffSnippet{{10, `<img src="[-/2018/photo-310x210.jpg-]{+/2018/photo-300x200.jpg+}">`}},
+		},
+		{
+			// The changes are close enough to share a snippet, and line breaks are escaped.
+			"<p>\n<img src=\"/2018/photo-310x210.jpg\">\n<img src=\"/2018/photo-1024x768.jpg\">",
+			[]diffSnippet{{14, `<p>\n<img src="[-/2018/photo-310x210.jpg-]{+/2018/photo-300x200.jpg+}">\n<img src="` +
+				`[-/2018/photo-1024x768.jpg-]{+/2018/photo.jpg+}">`}},
+		},
+		{
+			filler + filler + "/2018/photo-310x210.jpg" + filler + filler + filler + "/2018/photo-50x50.jpg",
+			[]diffSnippet{
+				{60, "..." + filler[:10] + filler + "[-/2018/photo-310x210.jpg-]{+/2018/photo-300x200.jpg+}" + filler +
+					filler[:10] + "..."},
+				{173, "..." + filler[:10] + filler + "[-/2018/photo-50x50.jpg-]{+/2018/photo.jpg+}"},
+			},
+		},
+		{
+			// The context is cut at the start of a character.
+			"ééééé/2018/photo-310x210.jpg",
+			[]diffSnippet{{10, "ééééé[-/2018/photo-310x210.jpg-]{+/2018/photo-300x200.jpg+}"}},
+		},
+		{
+			`<img srcset="/2018/photo-300x200.jpg 300w, /2018/photo-310x210.jpg 310w">`,
+			[]diffSnippet{{41, `...img srcset="/2018/photo-300x200.jpg 300w[-, /2018/photo-310x210.jpg 310w-]">`}},
+		},
+	}
+	for i, tc := range cases {
+		t.Run("case_"+strconv.Itoa(i), func(t *testing.T) {
+			reps := r.findReplacements(tc.content, r.newFileIndex(atts), tolerance{35, 100})
+			r.applyReplacements(tc.content, reps)
+			if got := diffSnippets(tc.content, reps, diffContext); !reflect.DeepEqual(got, tc.snippets) {
+				t.Errorf("got snippets\n%+v\nbut expected\n%+v", got, tc.snippets)
+			}
+		})
+	}
+}
+
+func TestPrintPostDiff(t *testing.T) {
+	r := newRunner(DefaultConfig())
+	atts := []attachment{
+		{
+			fileName: "/2018/photo.jpg", ext: ".jpg",
+			crops: []crop{
+				{"300x200", 300, 200, ""},
+			},
+		},
+	}
+	content := `<img src="/2018/photo-310x210.jpg">`
+	reps := r.findReplacements(content, r.newFileIndex(atts), tolerance{35, 100})
+	r.applyReplacements(content, reps)
+	var buf bytes.Buffer
+	r.printPostDiff(&buf, 7, content, reps)
+	want := "Post 7:\n\t@@ 10 @@ <img src=\"[-/2018/photo-310x210.jpg-]{+/2018/photo-300x200.jpg+}\">\n"
+	if buf.String() != want {
+		t.Errorf("got %q but expected %q", buf.String(), want)
+	}
+}
@@ -0,0 +1,65 @@
+package cropreplace
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// The number of bytes of each string argument that dumped statements show, which is larger in verbose mode.
+const (
+	dumpValueLen        = 200
+	dumpValueLenVerbose = 4000
+)
+
+// printStatement prints the statement as other messages are printed.
+func (r *runner) printStatement(query string, args []interface{}) {
+	limit := dumpValueLen
+	if r.cfg.Verbose {
+		limit = dumpValueLenVerbose
+	}
+	if r.cfg.LogFormat == logFormatJSON {
+		formatted := make([]string, len(args))
+		for i, arg := range args {
+			formatted[i] = formatArg(arg, limit)
+		}
+		r.logWith(levelNotice, logFields{"query": query, "args": formatted}, "SQL")
+		return
+	}
+	writeStatement(r.out, query, args, limit)
+}
+
+// writeStatement writes to w the query followed by each of its arguments, with strings quoted and truncated to
+// limit bytes.
+func writeStatement(w io.Writer, query string, args []interface{}, limit int) {
+	var b strings.Builder
+	b.WriteString("SQL: ")
+	b.WriteString(query)
+	for i, arg := range args {
+		fmt.Fprintf(&b, "\n  $%d = %s", i+1, formatArg(arg, limit))
+	}
+	b.WriteByte('\n')
+	io.WriteString(w, b.String())
+}
+
+// formatArg formats a statement argument for reading, showing no more than limit bytes of a string.
+func formatArg(arg interface{}, limit int) string {
+	s, ok := arg.(string)
+	if !ok {
+		return fmt.Sprint(arg)
+	}
+	if len(s) <= limit {
+		return strconv.Quote(s)
+	}
+	cut := limit
+	for cut > 0 && !isRuneStart(s[cut]) {
+		cut-- // don't split a UTF-8 sequence
+	}
+	return fmt.Sprintf("%s... (%d more bytes)", strconv.Quote(s[:cut]), len(s)-cut)
+}
+
+// isRuneStart says whether b is the first byte of a UTF-8 encoded rune.
+func isRuneStart(b byte) bool {
+	return b&0xC0 != 0x80
+}
@@ -0,0 +1,75 @@
+package cropreplace
+
+import (
+	"bytes"
+	"context"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestDumpStatement(t *testing.T) {
+	r := newRunner(DefaultConfig())
+	defer func(orig func(string, []interface{})) { r.dumpStatement = orig }(r.dumpStatement)
+	var dumped []int64
+	r.dumpStatement = func(query string, args []interface{}) {
+		if !strings.HasPrefix(query, "UPDATE ") {
+			t.Errorf("got query %q", query)
+		}
+		dumped = append(dumped, args[len(args)-1].(int64))
+	}
+
+	atts := []attachment{
+		{
+			fileName: "/2018/bcd.png", ext: ".png",
+			crops: []crop{
+				{"200x180", 200, 180, ""},
+			},
+		},
+	}
+	db, fdb := newFakeDB(t,
+		fakePost{ID: 1, postType: "post", content: "<img src='/2018/bcd-210x195.png'>"},
+		fakePost{ID: 2, postType: "post", content: "text"},
+		fakePost{ID: 3, postType: "post", content: "<img src='/2018/bcd-190x175.png'>"},
+	)
+	defer db.Close()
+
+	err := r.replaceImageCrops(context.Background(), sqlDB{db}, []string{"post"}, r.newFileIndex(atts), nil, nil,
+		newReport())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dumped) != len(fdb.updates) || len(dumped) != 2 || dumped[0] != 1 || dumped[1] != 3 {
+		t.Errorf("got statements dumped for posts %v but expected [1 3]", dumped)
+	}
+}
+
+func TestFormatArg(t *testing.T) {
+	cases := []struct {
+		arg   interface{}
+		limit int
+		want  string
+	}{
+		{int64(12), 5, "12"},
+		{"abc", 5, `"abc"`},
+		{"a\nb", 5, `"a\nb"`},
+		{"abcdefgh", 5, `"abcde"... (3 more bytes)`},
+		{"abcdé", 5, `"abcd"... (2 more bytes)`},
+	}
+	for i, tc := range cases {
+		t.Run("case_"+strconv.Itoa(i), func(t *testing.T) {
+			if got := formatArg(tc.arg, tc.limit); got != tc.want {
+				t.Errorf("got %s but expected %s", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestWriteStatement(t *testing.T) {
+	var b bytes.Buffer
+	writeStatement(&b, "UPDATE `wp_posts` SET post_content = ? WHERE ID = ?", []interface{}{"text", int64(3)}, 10)
+	want := "SQL: UPDATE `wp_posts` SET post_content = ? WHERE ID = ?\n  $1 = \"text\"\n  $2 = 3\n"
+	if b.String() != want {
+		t.Errorf("got %q but expected %q", b.String(), want)
+	}
+}
@@ -0,0 +1,74 @@
+package cropreplace
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+)
+
+// addEdgeMappings adds to m, for each replacement that changes a crop reference, the URL of the missing crop
+// mapped to the URL that should be served in its place. Each URL is the reference prefixed with the URL prefix of
+// the attachment, or with urlPrefix if it has none, unless the replacement is of the whole URL, as it is with a
+// placeholder.
+func addEdgeMappings(m map[string]string, reps []replacement, urlPrefix string) {
+	for i := range reps {
+		rep := &reps[i]
+		if rep.kind != kindClose && rep.kind != kindFallback {
+			continue
+		}
+		if rep.url {
+			m[rep.old] = rep.new
+			continue
+		}
+		prefix := rep.file.urlPrefix(urlPrefix)
+		m[prefix+rep.old] = prefix + rep.new
+	}
+}
+
+// writeEdgeMap writes to the file at path a JSON object mapping the URL of each missing crop referenced in the
+// posts with one of the postTypes to the URL of the image that replaceImageCrops would use instead. Such a map can
+// be loaded at a CDN edge to rewrite requests on the fly instead of rewriting the database, which is left
+// untouched. The keys are sorted.
+func (r *runner) writeEdgeMap(db queryer, postTypes []string, files *fileIndex, path string) error {
+	posts, err := r.queryPosts(db, postTypes)
+	if err != nil {
+		return err
+	}
+	// guidPrefixTrimmed is the guid prefix without the trailing slash.
+	guidPrefixTrimmed := strings.TrimSuffix(r.primaryGUIDPrefix(), "/")
+	m := make(map[string]string)
+	for i := range posts {
+		reps := r.findReplacements(posts[i].content, files, r.flagTolerance())
+		r.applyReplacements(posts[i].content, reps)
+		addEdgeMappings(m, reps, guidPrefixTrimmed)
+	}
+	if err := r.lazy.failed(); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(m, "", "\t")
+	if err != nil {
+		return err
+	}
+	if err := writeFile(path, data); err != nil {
+		return err
+	}
+	r.logWith(levelInfo, logFields{"file": path}, "Wrote %d URL mappings to %s.", len(m), path)
+	return nil
+}
+
+// writeFile writes data to the file at path, replacing any existing file, and ensures the data is flushed.
+func writeFile(path string, data []byte) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,36 @@
+package cropreplace
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestAddEdgeMappings(t *testing.T) {
+	r := newRunner(DefaultConfig())
+	const prefix = "https://example.com/uploads"
+	atts := []attachment{
+		{
+			fileName: "/2018/bcd.png", ext: ".png",
+			crops: []crop{
+				{"200x180", 200, 180, ""},
+			},
+		},
+	}
+	m := make(map[string]string)
+	for _, content := range []string{
+		`<img src="https://example.com/uploads/2018/bcd-200x180.png">`,
+		`<img srcset="https://example.com/uploads/2018/bcd-210x190.png 210w, /2018/bcd-30x20.png 30w">`,
+		`<a href="https://cdn.example.com/uploads/2018/bcd-210x190.png">`,
+	} {
+		reps := r.findReplacements(content, r.newFileIndex(atts), tolerance{35, 100})
+		r.applyReplacements(content, reps)
+		addEdgeMappings(m, reps, prefix)
+	}
+	want := map[string]string{
+		prefix + "/2018/bcd-210x190.png": prefix + "/2018/bcd-200x180.png",
+		prefix + "/2018/bcd-30x20.png":   prefix + "/2018/bcd.png",
+	}
+	if !reflect.DeepEqual(m, want) {
+		t.Errorf("got %v but expected %v", m, want)
+	}
+}
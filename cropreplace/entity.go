@@ -0,0 +1,20 @@
+package cropreplace
+
+import "strings"
+
+// ampersandEntities lists the ways an ampersand may be entity-encoded in content: WordPress encodes one in a URL
+// as &#038;, and editors commonly as &amp;.
+var ampersandEntities = []string{"&amp;", "&#038;", "&#38;"}
+
+// nameForms returns the file name name followed, if it has an ampersand, by the forms of it with its ampersands
+// encoded as each of the ampersandEntities. None of the forms is found within another.
+func nameForms(name string) []string {
+	forms := []string{name}
+	if strings.IndexByte(name, '&') == -1 {
+		return forms
+	}
+	for _, entity := range ampersandEntities {
+		forms = append(forms, strings.Replace(name, "&", entity, -1))
+	}
+	return forms
+}
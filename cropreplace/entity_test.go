@@ -0,0 +1,65 @@
+package cropreplace
+
+import (
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func TestNameForms(t *testing.T) {
+	cases := []struct {
+		name  string
+		forms []string
+	}{
+		{"/2018/photo", []string{"/2018/photo"}},
+		{"/2018/tom&jerry", []string{"/2018/tom&jerry", "/2018/tom&amp;jerry", "/2018/tom&#038;jerry", "/2018/tom&#38;jerry"}},
+	}
+	for i, tc := range cases {
+		t.Run("case_"+strconv.Itoa(i), func(t *testing.T) {
+			if got := nameForms(tc.name); !reflect.DeepEqual(got, tc.forms) {
+				t.Errorf("got %q but expected %q", got, tc.forms)
+			}
+		})
+	}
+}
+
+func TestReplaceCropsEntities(t *testing.T) {
+	r := newRunner(DefaultConfig())
+	atts := []attachment{
+		{
+			fileName: "/2018/tom&jerry.jpg", ext: ".jpg",
+			crops: []crop{
+				{"300x200", 300, 200, ""},
+			},
+		},
+		{
+			fileName: "/2018/photo.jpg", ext: ".jpg",
+			crops: []crop{
+				{"300x200", 300, 200, ""},
+			},
+		},
+	}
+	cases := []struct {
+		original string
+		desired  string
+	}{
+		{`<img src="/2018/tom&jerry-310x210.jpg">`, `<img src="/2018/tom&jerry-300x200.jpg">`},
+		{`<img src="/2018/tom&amp;jerry-310x210.jpg">`, `<img src="/2018/tom&amp;jerry-300x200.jpg">`},
+		{`<img src="/2018/tom&#038;jerry-1024x768.jpg">`, `<img src="/2018/tom&#038;jerry.jpg">`},
+		{
+			`<img src="/2018/tom&amp;jerry-310x210.jpg?resize=310%2C210&amp;ssl=1" srcset="/2018/tom&jerry-300x200.jpg 300w">`,
+			`<img src="/2018/tom&amp;jerry-300x200.jpg?resize=310%2C210&amp;ssl=1" srcset="/2018/tom&jerry-300x200.jpg 300w">`,
+		},
+		{
+			`<img src="/2018/photo-310x210.jpg?w=310&amp;h=210">`,
+			`<img src="/2018/photo-300x200.jpg?w=310&amp;h=210">`,
+		},
+	}
+	for i, tc := range cases {
+		t.Run("case_"+strconv.Itoa(i), func(t *testing.T) {
+			if got := r.replaceCrops(tc.original, atts, tolerance{35, 100}); got != tc.desired {
+				t.Errorf("got %q but expected %q", got, tc.desired)
+			}
+		})
+	}
+}
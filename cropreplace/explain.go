@@ -0,0 +1,70 @@
+package cropreplace
+
+import (
+	"fmt"
+	"io"
+)
+
+// explainPost writes to w a trace of how each crop reference in the post with the given ID was handled: the
+// dimensions requested, the attachment matched, the crops in the bucket that were considered, and which
+// variant was chosen and why. The reps must have already been passed to applyReplacements. In JSON log format,
+// each reference is explained with a JSON line of its own.
+func (r *runner) explainPost(w io.Writer, postID int64, reps []replacement, tol tolerance) {
+	if r.cfg.LogFormat == logFormatJSON {
+		for i := range reps {
+			rep := &reps[i]
+			candidates := []map[string]interface{}{}
+			for j := range rep.file.crops {
+				c := &rep.file.crops[j]
+				candidates = append(candidates, map[string]interface{}{"crop": c.str,
+					"width_diff": widthDiff(&rep.requested, c), "height_diff": heightDiff(&rep.requested, c)})
+			}
+			writeJSONLine(w, levelInfo, logFields{"post_id": postID, "old": rep.old, "offset": rep.start,
+				"requested": rep.requested.str, "attachment_id": rep.file.ID, "file": rep.file.fileName,
+				"candidates": candidates, "kind": rep.kind.String()}, explainKind(rep, tol))
+		}
+		return
+	}
+	fmt.Fprintf(w, "Post %d:\n", postID)
+	for i := range reps {
+		rep := &reps[i]
+		fmt.Fprintf(w, "\t%q at offset %d requests %s of attachment %d (%s)\n",
+			rep.old, rep.start, rep.requested.str, rep.file.ID, rep.file.fileName)
+		if len(rep.file.crops) == 0 {
+			fmt.Fprintln(w, "\t\tcandidates: none")
+		} else {
+			fmt.Fprint(w, "\t\tcandidates:")
+			for j := range rep.file.crops {
+				c := &rep.file.crops[j]
+				fmt.Fprintf(w, " %s (%.1f%% wide, %.1f%% high)", c.str, widthDiff(&rep.requested, c),
+					heightDiff(&rep.requested, c))
+			}
+			fmt.Fprintln(w)
+		}
+		fmt.Fprintf(w, "\t\t%s: %s\n", rep.kind, explainKind(rep, tol))
+	}
+}
+
+// explainKind describes in words why the replacement rep was chosen given the width tolerance.
+func explainKind(rep *replacement, tol tolerance) string {
+	switch rep.kind {
+	case kindExact:
+		return "the crop exists in the bucket"
+	case kindClose:
+		return fmt.Sprintf("using %s, the closest crop within the tolerance (%s)", rep.file.crops[rep.chosen].str, tol)
+	case kindFallback:
+		return fmt.Sprintf("no crop is within the tolerance (%s), so using %s", tol, rep.new)
+	case kindSkipped:
+		return "overlaps another replacement, so left unchanged"
+	case kindNarrow:
+		return fmt.Sprintf("no crop is within the tolerance (%s), and the crop is too narrow to use %s",
+			tol, rep.file.fileName)
+	case kindKept:
+		return fmt.Sprintf("no crop is within the tolerance (%s), and nofallback keeps it rather than using %s",
+			tol, rep.file.fileName)
+	case kindDuplicate:
+		return "would repeat another candidate in the srcset, so removed"
+	default:
+		return "unknown"
+	}
+}
@@ -0,0 +1,41 @@
+package cropreplace
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestExplainPost(t *testing.T) {
+	r := newRunner(DefaultConfig())
+	atts := []attachment{
+		{
+			ID: 7, fileName: "bcd.png", ext: ".png",
+			crops: []crop{
+				{"200x180", 200, 180, ""},
+				{"400x320", 400, 320, ""},
+			},
+		},
+	}
+	content := "bcd-200x180.png bcd-210x195.png bcd-30x15.png"
+	reps := r.findReplacements(content, r.newFileIndex(atts), tolerance{35, 100})
+	r.applyReplacements(content, reps)
+
+	var buf bytes.Buffer
+	r.explainPost(&buf, 12, reps, tolerance{35, 100})
+	got := buf.String()
+
+	for _, want := range []string{
+		"Post 12:\n",
+		`"bcd-200x180.png" at offset 0 requests 200x180 of attachment 7 (bcd.png)`,
+		"exact: the crop exists in the bucket",
+		`"bcd-210x195.png" at offset 16 requests 210x195`,
+		"candidates: 200x180 (4.8% wide, 7.7% high) 400x320 (90.5% wide, 64.1% high)",
+		"close: using 200x180",
+		"fallback: no crop is within the tolerance (35.0% wide, 100.0% high), so using bcd.png",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("explanation does not contain %q; got:\n%s", want, got)
+		}
+	}
+}
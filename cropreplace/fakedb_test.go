@@ -0,0 +1,507 @@
+package cropreplace
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func init() {
+	sql.Register("fakedb", fakeDriver{})
+}
+
+// A fakePost is a row of the posts table in a fakeDB.
+type fakePost struct {
+	ID       int64
+	postType string
+	status   string // the post_status, which is publish if empty
+	guid     string
+	mime     string // the post_mime_type
+	content  string
+	extra    map[string]string // the values of columns other than post_content
+}
+
+// A fakeMeta is a row of the postmeta table in a fakeDB.
+type fakeMeta struct {
+	ID     int64
+	postID int64
+	value  string
+}
+
+// A fakeDB is an in-memory stand-in for the posts table, reached through database/sql with the fakedb driver.
+// It understands only the statements that this program sends. Updates made in a transaction are applied only
+// when the transaction is committed.
+type fakeDB struct {
+	mu        sync.Mutex
+	maxPacket int64 // the max_allowed_packet reported, if not 0
+	posts     map[int64]fakePost
+	meta      map[int64]fakeMeta
+	updates   []fakeExec // every UPDATE executed, including those rolled back
+	queries   []fakeExec // every query run
+	commits   int
+	rollbacks int
+}
+
+// A fakeExec records a statement executed with its arguments.
+type fakeExec struct {
+	query string
+	args  []driver.Value
+}
+
+var (
+	fakeDBsMu sync.Mutex
+	fakeDBs   = make(map[string]*fakeDB)
+)
+
+// newFakeDB returns a connection to a new fakeDB holding the posts.
+func newFakeDB(t *testing.T, posts ...fakePost) (*sql.DB, *fakeDB) {
+	t.Helper()
+	fdb := &fakeDB{posts: make(map[int64]fakePost, len(posts)), meta: make(map[int64]fakeMeta)}
+	for _, p := range posts {
+		if p.extra == nil {
+			p.extra = make(map[string]string)
+		}
+		fdb.posts[p.ID] = p
+	}
+	fakeDBsMu.Lock()
+	name := fmt.Sprintf("%s-%d", t.Name(), len(fakeDBs))
+	fakeDBs[name] = fdb
+	fakeDBsMu.Unlock()
+	db, err := sql.Open("fakedb", name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db, fdb
+}
+
+// addMeta adds the meta rows to the database.
+func (f *fakeDB) addMeta(metas ...fakeMeta) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, m := range metas {
+		f.meta[m.ID] = m
+	}
+}
+
+// metaValue returns the committed value of the meta row with the given ID.
+func (f *fakeDB) metaValue(id int64) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.meta[id].value
+}
+
+// value returns the committed value of the column other than post_content of the post with the given ID.
+func (f *fakeDB) value(id int64, column string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.posts[id].extra[column]
+}
+
+// content returns the committed content of the post with the given ID.
+func (f *fakeDB) content(id int64) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.posts[id].content
+}
+
+type fakeDriver struct{}
+
+func (fakeDriver) Open(name string) (driver.Conn, error) {
+	fakeDBsMu.Lock()
+	defer fakeDBsMu.Unlock()
+	fdb, ok := fakeDBs[name]
+	if !ok {
+		return nil, fmt.Errorf("no fake database named %q", name)
+	}
+	return &fakeConn{db: fdb}, nil
+}
+
+// A fakeConn is a connection to a fakeDB. While a transaction is open, updated content is kept in pending, the
+// updated values of other columns in pendingExtra, and updated meta values in pendingMeta.
+type fakeConn struct {
+	db           *fakeDB
+	pending      map[int64]string
+	pendingExtra map[fakeCell]string
+	pendingMeta  map[int64]string
+}
+
+// A fakeCell identifies a column of a post.
+type fakeCell struct {
+	ID     int64
+	column string
+}
+
+func (c *fakeConn) Prepare(query string) (driver.Stmt, error) {
+	return &fakeStmt{conn: c, query: query}, nil
+}
+
+func (c *fakeConn) Close() error { return nil }
+
+func (c *fakeConn) Begin() (driver.Tx, error) {
+	if c.pending != nil {
+		return nil, errors.New("a transaction is already open")
+	}
+	c.pending = make(map[int64]string)
+	c.pendingExtra = make(map[fakeCell]string)
+	c.pendingMeta = make(map[int64]string)
+	return c, nil
+}
+
+func (c *fakeConn) Commit() error {
+	c.db.mu.Lock()
+	defer c.db.mu.Unlock()
+	for id, content := range c.pending {
+		p := c.db.posts[id]
+		p.content = content
+		c.db.posts[id] = p
+	}
+	for cell, value := range c.pendingExtra {
+		c.db.posts[cell.ID].extra[cell.column] = value
+	}
+	for id, value := range c.pendingMeta {
+		m := c.db.meta[id]
+		m.value = value
+		c.db.meta[id] = m
+	}
+	c.pending, c.pendingExtra, c.pendingMeta = nil, nil, nil
+	c.db.commits++
+	return nil
+}
+
+func (c *fakeConn) Rollback() error {
+	c.db.mu.Lock()
+	defer c.db.mu.Unlock()
+	c.pending, c.pendingExtra, c.pendingMeta = nil, nil, nil
+	c.db.rollbacks++
+	return nil
+}
+
+type fakeStmt struct {
+	conn  *fakeConn
+	query string
+}
+
+func (s *fakeStmt) Close() error  { return nil }
+func (s *fakeStmt) NumInput() int { return -1 }
+
+func (s *fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	db := s.conn.db
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if !strings.HasPrefix(s.query, "UPDATE ") {
+		return nil, fmt.Errorf("fakedb cannot execute %q", s.query)
+	}
+	db.updates = append(db.updates, fakeExec{query: s.query, args: args})
+	if strings.Contains(s.query, " = CASE ID ") {
+		return s.execBatch(args)
+	}
+	id := args[len(args)-1].(int64)
+	if strings.Contains(s.query, "postmeta") {
+		content := args[0].(string)
+		if _, ok := db.meta[id]; !ok {
+			return driver.RowsAffected(0), nil
+		}
+		if s.conn.pendingMeta != nil {
+			s.conn.pendingMeta[id] = content
+		} else {
+			m := db.meta[id]
+			m.value = content
+			db.meta[id] = m
+		}
+		return driver.RowsAffected(1), nil
+	}
+	if _, ok := db.posts[id]; !ok {
+		return driver.RowsAffected(0), nil
+	}
+	set := s.query[strings.Index(s.query, " SET ")+5 : strings.Index(s.query, " WHERE ")]
+	changed := false
+	for j, assignment := range strings.Split(set, ", ") {
+		column, value := strings.TrimSuffix(assignment, " = ?"), args[j].(string)
+		changed = s.conn.set(id, column, value) || changed
+	}
+	if !changed {
+		// Like MySQL, a row is not counted as affected if the update leaves its values as they were.
+		return driver.RowsAffected(0), nil
+	}
+	return driver.RowsAffected(1), nil
+}
+
+// value returns the value of the column of the post with the given ID, as seen in the open transaction.
+func (c *fakeConn) value(id int64, column string) string {
+	p := c.db.posts[id]
+	if column == "post_content" {
+		if content, ok := c.pending[id]; ok {
+			return content
+		}
+		return p.content
+	}
+	if value, ok := c.pendingExtra[fakeCell{id, column}]; ok {
+		return value
+	}
+	return p.extra[column]
+}
+
+// set sets the column of the post with the given ID to value, applying it once the open transaction, if any, is
+// committed. It reports whether the value is changed.
+func (c *fakeConn) set(id int64, column, value string) bool {
+	changed := c.value(id, column) != value
+	switch {
+	case column == "post_content" && c.pending != nil:
+		c.pending[id] = value
+	case column == "post_content":
+		p := c.db.posts[id]
+		p.content = value
+		c.db.posts[id] = p
+	case c.pendingExtra != nil:
+		c.pendingExtra[fakeCell{id, column}] = value
+	default:
+		c.db.posts[id].extra[column] = value
+	}
+	return changed
+}
+
+// fakeCaseColumn matches a column set with a CASE on the post ID by a batch update.
+var fakeCaseColumn = regexp.MustCompile(`(\w+) = CASE ID((?: WHEN \? THEN \?)+) ELSE \w+ END`)
+
+// execBatch executes an UPDATE of several posts setting each column with a CASE on the post ID.
+func (s *fakeStmt) execBatch(args []driver.Value) (driver.Result, error) {
+	db := s.conn.db
+	n := 0 // the number of args used
+	changed := make(map[int64]bool)
+	for _, m := range fakeCaseColumn.FindAllStringSubmatch(s.query, -1) {
+		for w := strings.Count(m[2], "WHEN"); w > 0; w, n = w-1, n+2 {
+			id, value := args[n].(int64), args[n+1].(string)
+			if _, ok := db.posts[id]; ok && s.conn.set(id, m[1], value) {
+				changed[id] = true
+			}
+		}
+	}
+	var affected int64
+	for _, arg := range args[n:] {
+		if changed[arg.(int64)] {
+			affected++
+		}
+	}
+	return driver.RowsAffected(affected), nil
+}
+
+func (s *fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	db := s.conn.db
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.queries = append(db.queries, fakeExec{query: s.query, args: args})
+	if s.query == "SHOW VARIABLES LIKE 'max_allowed_packet'" {
+		rows := &fakeRows{columns: []string{"Variable_name", "Value"}}
+		if db.maxPacket > 0 {
+			rows.rows = [][]driver.Value{{"max_allowed_packet", db.maxPacket}}
+		}
+		return rows, nil
+	}
+	if strings.HasSuffix(s.query, " WHERE ID = ?") {
+		columns := strings.Split(s.query[len("SELECT "):strings.Index(s.query, " FROM ")], ", ")
+		rows := &fakeRows{columns: columns}
+		if p, ok := db.posts[args[0].(int64)]; ok {
+			row := make([]driver.Value, len(columns))
+			for j, column := range columns {
+				if column == "ID" {
+					row[j] = p.ID
+				} else {
+					row[j] = s.conn.value(p.ID, column)
+				}
+			}
+			rows.rows = [][]driver.Value{row}
+		}
+		return rows, nil
+	}
+	limit := -1
+	if strings.HasSuffix(s.query, " LIMIT ?") {
+		limit = int(args[len(args)-1].(int64))
+		args = args[:len(args)-1]
+	}
+	var like *regexp.Regexp
+	likeColumns := likeColumnPattern.FindAllStringSubmatch(s.query, -1)
+	if len(likeColumns) > 0 {
+		like = likeRegexp(args[len(args)-1].(string))
+		args = args[:len(args)-len(likeColumns)]
+	}
+	var after int64 // the ID after which posts are selected
+	if strings.Contains(s.query, "ID > ?") {
+		after = args[len(args)-1].(int64)
+		args = args[:len(args)-1]
+	}
+	types, statuses, ids := splitPostArgs(s.query, args)
+	if strings.Contains(s.query, " WHERE post_type = 'attachment'") {
+		types = []driver.Value{"attachment"}
+	}
+	if strings.HasPrefix(s.query, "SELECT m.meta_id, m.meta_value ") {
+		var matching []fakeMeta
+		for _, m := range db.meta {
+			if db.posts[m.postID].matches(types, statuses) {
+				if value, ok := s.conn.pendingMeta[m.ID]; ok {
+					m.value = value
+				}
+				matching = append(matching, m)
+			}
+		}
+		sort.Slice(matching, func(i, j int) bool { return matching[i].ID < matching[j].ID })
+		rows := &fakeRows{columns: []string{"meta_id", "meta_value"}}
+		for _, m := range matching {
+			rows.rows = append(rows.rows, []driver.Value{m.ID, m.value})
+		}
+		return rows, nil
+	}
+	var matching []fakePost
+	for _, p := range db.posts {
+		if p.ID > after && p.matches(types, statuses) && (ids == nil || containsValue(ids, p.ID)) {
+			if content, ok := s.conn.pending[p.ID]; ok {
+				p.content = content
+			}
+			if like == nil || p.likes(like, likeColumns, s.conn.pendingExtra) {
+				matching = append(matching, p)
+			}
+		}
+	}
+	sort.Slice(matching, func(i, j int) bool { return matching[i].ID < matching[j].ID })
+	if limit >= 0 && len(matching) > limit {
+		matching = matching[:limit]
+	}
+	switch {
+	case strings.HasPrefix(s.query, "SELECT COUNT(*) "):
+		return &fakeRows{columns: []string{"COUNT(*)"}, rows: [][]driver.Value{{int64(len(matching))}}}, nil
+	case strings.HasPrefix(s.query, "SELECT ID FROM "):
+		rows := &fakeRows{columns: []string{"ID"}}
+		for _, p := range matching {
+			rows.rows = append(rows.rows, []driver.Value{p.ID})
+		}
+		return rows, nil
+	case strings.HasPrefix(s.query, "SELECT ID, guid, post_mime_type "):
+		rows := &fakeRows{columns: []string{"ID", "guid", "post_mime_type"}}
+		for _, p := range matching {
+			rows.rows = append(rows.rows, []driver.Value{p.ID, p.guid, p.mime})
+		}
+		return rows, nil
+	case strings.HasPrefix(s.query, "SELECT ID, post_content"):
+		columns := strings.Split(s.query[len("SELECT "):strings.Index(s.query, " FROM ")], ", ")
+		rows := &fakeRows{columns: columns}
+		for _, p := range matching {
+			row := []driver.Value{p.ID, p.content}
+			for _, column := range columns[2:] {
+				value, ok := s.conn.pendingExtra[fakeCell{p.ID, column}]
+				if !ok {
+					value = p.extra[column]
+				}
+				row = append(row, value)
+			}
+			rows.rows = append(rows.rows, row)
+		}
+		return rows, nil
+	}
+	return nil, fmt.Errorf("fakedb cannot run the query %q", s.query)
+}
+
+// splitPostArgs splits the arguments of a query selecting posts into the post types, the post statuses, and the
+// post IDs, which are nil if the query does not filter by them. Any other arguments are ignored.
+func splitPostArgs(query string, args []driver.Value) (types, statuses, ids []driver.Value) {
+	n := placeholdersIn(query, "post_type IN (")
+	types = args[:n]
+	m := placeholdersIn(query, "post_status IN (")
+	if m > 0 {
+		statuses = args[n : n+m]
+	}
+	if k := placeholdersIn(query, "ID IN ("); k > 0 {
+		ids = args[n+m : n+m+k]
+	}
+	return types, statuses, ids
+}
+
+// placeholdersIn returns the number of placeholders in the list that follows the start of an IN clause in the
+// query, or 0 if the query does not have it.
+func placeholdersIn(query, start string) int {
+	i := strings.Index(query, start)
+	if i == -1 {
+		return 0
+	}
+	return strings.Count(query[i:i+strings.IndexByte(query[i:], ')')], "?")
+}
+
+// matches says whether the post has one of the types and, unless statuses is nil, one of the statuses.
+func (p fakePost) matches(types, statuses []driver.Value) bool {
+	status := p.status
+	if status == "" {
+		status = "publish"
+	}
+	return containsValue(types, p.postType) && (statuses == nil || containsValue(statuses, status))
+}
+
+// containsValue says whether any of the values is v.
+func containsValue(values []driver.Value, v driver.Value) bool {
+	for _, value := range values {
+		if value == v {
+			return true
+		}
+	}
+	return false
+}
+
+// likeColumnPattern matches each LIKE condition in a query, capturing the column compared.
+var likeColumnPattern = regexp.MustCompile(`(\w+) LIKE \?`)
+
+// likes reports whether any of the columns captured by likeColumnPattern in the post matches like, taking the
+// pending changes to the extra columns into account.
+func (p *fakePost) likes(like *regexp.Regexp, columns [][]string, pending map[fakeCell]string) bool {
+	for _, m := range columns {
+		value := p.content
+		if m[1] != "post_content" {
+			var ok bool
+			if value, ok = pending[fakeCell{p.ID, m[1]}]; !ok {
+				value = p.extra[m[1]]
+			}
+		}
+		if like.MatchString(value) {
+			return true
+		}
+	}
+	return false
+}
+
+// likeRegexp returns a regular expression matching what the SQL LIKE pattern matches.
+func likeRegexp(pattern string) *regexp.Regexp {
+	var b strings.Builder
+	b.WriteString("(?s)^")
+	for _, c := range pattern {
+		switch c {
+		case '%':
+			b.WriteString(".*")
+		case '_':
+			b.WriteString(".")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	b.WriteString("$")
+	return regexp.MustCompile(b.String())
+}
+
+type fakeRows struct {
+	columns []string
+	rows    [][]driver.Value
+}
+
+func (r *fakeRows) Columns() []string { return r.columns }
+func (r *fakeRows) Close() error      { return nil }
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+	return nil
+}
@@ -0,0 +1,55 @@
+package cropreplace
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// parsePatterns parses the comma-separated list of glob patterns s, which may be empty, checking that each is
+// valid for path.Match.
+func parsePatterns(s string) ([]string, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var patterns []string
+	for _, p := range strings.Split(s, ",") {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			return nil, fmt.Errorf("%q has an empty pattern", s)
+		}
+		if _, err := path.Match(p, ""); err != nil {
+			return nil, fmt.Errorf("%q is not a valid pattern; %v", p, err)
+		}
+		patterns = append(patterns, p)
+	}
+	return patterns, nil
+}
+
+// matchesAny says whether fileName is matched by any of the patterns. A pattern with a slash is matched against
+// the whole file name, such as /2018/07/photo.jpg, and one without against the base name, such as photo.jpg.
+func matchesAny(patterns []string, fileName string) bool {
+	for _, p := range patterns {
+		name := fileName
+		if !strings.Contains(p, "/") {
+			name = path.Base(fileName)
+		}
+		if ok, _ := path.Match(p, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// filterAttachments returns the atts whose file names are matched by one of the include patterns, or all of them
+// if there are none, and by none of the exclude patterns. So an attachment matched by both is excluded. The
+// atts are filtered in place.
+func filterAttachments(atts []attachment, include, exclude []string) []attachment {
+	kept := atts[:0]
+	for _, att := range atts {
+		if (len(include) == 0 || matchesAny(include, att.fileName)) && !matchesAny(exclude, att.fileName) {
+			kept = append(kept, att)
+		}
+	}
+	return kept
+}
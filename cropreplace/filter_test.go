@@ -0,0 +1,65 @@
+package cropreplace
+
+import (
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func TestParsePatterns(t *testing.T) {
+	cases := []struct {
+		s        string
+		patterns []string
+		ok       bool
+	}{
+		{"", nil, true},
+		{"*.png", []string{"*.png"}, true},
+		{"/2018/*/*.png, photo-?.jpg", []string{"/2018/*/*.png", "photo-?.jpg"}, true},
+		{"*.png,", nil, false},
+		{"[a-", nil, false},
+	}
+	for i, tc := range cases {
+		t.Run("case_"+strconv.Itoa(i), func(t *testing.T) {
+			patterns, err := parsePatterns(tc.s)
+			if tc.ok != (err == nil) {
+				t.Fatalf("got error %v but expected ok to be %v", err, tc.ok)
+			}
+			if !reflect.DeepEqual(patterns, tc.patterns) {
+				t.Errorf("got %q; expected %q", patterns, tc.patterns)
+			}
+		})
+	}
+}
+
+func TestFilterAttachments(t *testing.T) {
+	names := []string{"/2018/07/photo.jpg", "/2018/08/logo.png", "/2019/01/photo.png", "/banner.jpg"}
+	cases := []struct {
+		include, exclude []string
+		kept             []string
+	}{
+		{nil, nil, names},
+		{[]string{"*.png"}, nil, []string{"/2018/08/logo.png", "/2019/01/photo.png"}},
+		{[]string{"/2018/*/*"}, nil, []string{"/2018/07/photo.jpg", "/2018/08/logo.png"}},
+		{[]string{"/2018/*"}, nil, nil},
+		{[]string{"photo.*", "banner.jpg"}, nil, []string{"/2018/07/photo.jpg", "/2019/01/photo.png", "/banner.jpg"}},
+		{nil, []string{"*.jpg"}, []string{"/2018/08/logo.png", "/2019/01/photo.png"}},
+		{[]string{"*.png"}, []string{"/2019/*/*"}, []string{"/2018/08/logo.png"}},
+		{[]string{"logo.png"}, []string{"logo.png"}, nil},
+		{[]string{"Logo.png"}, nil, nil},
+	}
+	for i, tc := range cases {
+		t.Run("case_"+strconv.Itoa(i), func(t *testing.T) {
+			atts := make([]attachment, len(names))
+			for j, name := range names {
+				atts[j] = attachment{ID: int64(j), fileName: name}
+			}
+			var kept []string
+			for _, att := range filterAttachments(atts, tc.include, tc.exclude) {
+				kept = append(kept, att.fileName)
+			}
+			if !reflect.DeepEqual(kept, tc.kept) {
+				t.Errorf("got %q; expected %q", kept, tc.kept)
+			}
+		})
+	}
+}
@@ -0,0 +1,58 @@
+package cropreplace
+
+import (
+	"regexp"
+	"strings"
+)
+
+// blockAttrs matches the comment that opens a block along with its attributes, as in
+// <!-- wp:image {"id":12,"sizeSlug":"large"} -->, capturing the attributes. Since "--" is always escaped in the
+// attributes, the comment ends at the first "-->".
+var blockAttrs = regexp.MustCompile(`<!-- wp:[a-z][a-z0-9_-]*(?:/[a-z][a-z0-9_-]*)? (\{.*?\}) /?-->`)
+
+// blockAttrReplacements returns the replacements that file calls for in the attributes of the blocks in content
+// whose slashes are escaped, as they are when the attributes are encoded by PHP. The attributes are searched
+// with their slashes unescaped, so that a crop URL in them is replaced just as it is in the HTML of the block,
+// and the text of each replacement is escaped again.
+func (r *runner) blockAttrReplacements(content string, file *attachment, tol tolerance) []replacement {
+	var reps []replacement
+	for _, m := range blockAttrs.FindAllStringSubmatchIndex(content, -1) {
+		start, attrs := m[2], content[m[2]:m[3]]
+		if !strings.Contains(attrs, `\/`) {
+			continue // The URLs in the attributes are found in content as they are.
+		}
+		unescaped, offsets := unescapeSlashes(attrs)
+		for _, rep := range r.replaceContentSingle(unescaped, file, tol) {
+			oldEnd := start + offsets[rep.start+len(rep.old)]
+			rep.oldSuffix = content[oldEnd : start+offsets[rep.end()]]
+			rep.start = start + offsets[rep.start]
+			rep.old = content[rep.start:oldEnd]
+			rep.new = strings.Replace(rep.new, "/", `\/`, -1)
+			reps = append(reps, rep)
+		}
+	}
+	return reps
+}
+
+// unescapeSlashes returns s with each escaped slash unescaped, along with the offset in s of each byte of the
+// result and, last, the length of s. Other escapes, including an escaped backslash, are left as they are.
+func unescapeSlashes(s string) (string, []int) {
+	var b strings.Builder
+	offsets := make([]int, 0, len(s)+1)
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\' && i+1 < len(s) && s[i+1] == '/':
+			offsets = append(offsets, i)
+			b.WriteByte('/')
+			i++
+		case s[i] == '\\' && i+1 < len(s):
+			offsets = append(offsets, i, i+1)
+			b.WriteString(s[i : i+2])
+			i++
+		default:
+			offsets = append(offsets, i)
+			b.WriteByte(s[i])
+		}
+	}
+	return b.String(), append(offsets, len(s))
+}
@@ -0,0 +1,91 @@
+package cropreplace
+
+import (
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func TestReplaceCropsBlockAttrs(t *testing.T) {
+	r := newRunner(DefaultConfig())
+	r.cfg.GUIDPrefix = "https://example.com/uploads/"
+
+	atts := []attachment{
+		{
+			fileName: "/2018/photo.jpg", ext: ".jpg",
+			crops: []crop{
+				{"300x200", 300, 200, ""},
+			},
+		},
+	}
+	cases := []struct {
+		placeholder string
+		original    string
+		desired     string
+	}{
+		{
+			"",
+			`<!-- wp:image {"id":12,"url":"https://example.com/uploads/2018/photo-310x210.jpg"} -->` +
+				`<img src="https://example.com/uploads/2018/photo-310x210.jpg"/><!-- /wp:image -->`,
+			`<!-- wp:image {"id":12,"url":"https://example.com/uploads/2018/photo-300x200.jpg"} -->` +
+				`<img src="https://example.com/uploads/2018/photo-300x200.jpg"/><!-- /wp:image -->`,
+		},
+		{
+			"",
+			`<!-- wp:image {"id":12,"url":"https:\/\/example.com\/uploads\/2018\/photo-310x210.jpg"} -->` +
+				`<img src="https://example.com/uploads/2018/photo-310x210.jpg"/><!-- /wp:image -->`,
+			`<!-- wp:image {"id":12,"url":"https:\/\/example.com\/uploads\/2018\/photo-300x200.jpg"} -->` +
+				`<img src="https://example.com/uploads/2018/photo-300x200.jpg"/><!-- /wp:image -->`,
+		},
+		{
+			"",
+			`<!-- wp:image {"id":12,"url":"https:\/\/example.com\/uploads\/2018\/photo-50x50.jpg"} /-->` +
+				`<img src="https://example.com/uploads/2018/photo-50x50.jpg"/>`,
+			`<!-- wp:image {"id":12,"url":"https:\/\/example.com\/uploads\/2018\/photo.jpg"} /-->` +
+				`<img src="https://example.com/uploads/2018/photo.jpg"/>`,
+		},
+		{
+			"https://example.com/placeholder.png",
+			`<!-- wp:image {"url":"https:\/\/example.com\/uploads\/2018\/photo-50x50.jpg"} -->` +
+				`<img src="https://example.com/uploads/2018/photo-50x50.jpg"/><!-- /wp:image -->`,
+			`<!-- wp:image {"url":"https:\/\/example.com\/placeholder.png"} -->` +
+				`<img src="https://example.com/placeholder.png"/><!-- /wp:image -->`,
+		},
+		{
+			// Slashes escaped outside of block attributes are left alone.
+			"",
+			`{"url":"https:\/\/example.com\/uploads\/2018\/photo-310x210.jpg"}`,
+			`{"url":"https:\/\/example.com\/uploads\/2018\/photo-310x210.jpg"}`,
+		},
+	}
+	for i, tc := range cases {
+		t.Run("case_"+strconv.Itoa(i), func(t *testing.T) {
+			r.cfg.Placeholder = tc.placeholder
+			got := r.replaceCrops(tc.original, atts, tolerance{35, 100})
+			if got != tc.desired {
+				t.Errorf("got %q but expected %q", got, tc.desired)
+			}
+		})
+	}
+}
+
+func TestUnescapeSlashes(t *testing.T) {
+	cases := []struct {
+		s         string
+		unescaped string
+		offsets   []int
+	}{
+		{`a\/b`, "a/b", []int{0, 1, 3, 4}},
+		{`a\\/b`, `a\\/b`, []int{0, 1, 2, 3, 4, 5}},
+		{`\/`, "/", []int{0, 2}},
+		{"", "", []int{0}},
+	}
+	for i, tc := range cases {
+		t.Run("case_"+strconv.Itoa(i), func(t *testing.T) {
+			unescaped, offsets := unescapeSlashes(tc.s)
+			if unescaped != tc.unescaped || !reflect.DeepEqual(offsets, tc.offsets) {
+				t.Errorf("got (%q, %v) but expected (%q, %v)", unescaped, offsets, tc.unescaped, tc.offsets)
+			}
+		})
+	}
+}
@@ -0,0 +1,66 @@
+package cropreplace
+
+import (
+	"sort"
+	"strings"
+)
+
+// A fileIndex finds the attachments whose crops some content may reference without searching the content for
+// the name of each attachment.
+type fileIndex struct {
+	files   []attachment
+	byBase  map[string][]int // the indexes of the files, keyed by base name without extension, such as "photo"
+	maxBase int              // the length of the longest base name
+	sep     byte             // the first character of the CropSeparator
+}
+
+// newFileIndex indexes the files by base name, in each of the forms it may be written in (see nameForms). Since
+// the same files are searched for in every post, they're indexed once and must not be renamed after that.
+func (r *runner) newFileIndex(files []attachment) *fileIndex {
+	x := &fileIndex{files: files, byBase: make(map[string][]int), sep: r.cfg.CropSeparator[0]}
+	for i := range files {
+		f := &files[i]
+		trimmed := f.fileName[:len(f.fileName)-len(f.ext)]
+		for _, base := range nameForms(trimmed[strings.LastIndexByte(trimmed, '/')+1:]) {
+			x.byBase[base] = append(x.byBase[base], i)
+			if len(base) > x.maxBase {
+				x.maxBase = len(base)
+			}
+		}
+	}
+	return x
+}
+
+// nameBoundaries lists the characters after which a file name may start (see nameStartsAt).
+const nameBoundaries = "/\\\"' \t\r\n"
+
+// candidates returns, in ascending order, the indexes of the files that may have crops referenced in content.
+// Every crop reference has the base name of its file, following a slash or another boundary of a name (or the
+// start of content), just before the crop separator and a digit, so only the text before each separator
+// followed by a digit needs to be looked up.
+func (x *fileIndex) candidates(content string) []int {
+	var found []int
+	seen := make(map[int]bool)
+	for i := 0; i < len(content)-1; i++ {
+		if content[i] != x.sep || content[i+1] < '0' || content[i+1] > '9' {
+			continue
+		}
+		from := i - x.maxBase
+		if from < 0 {
+			from = 0
+		}
+		for start := i - 1; start >= from-1; start-- {
+			if start >= 0 && strings.IndexByte(nameBoundaries, content[start]) == -1 {
+				continue
+			}
+			for _, j := range x.byBase[content[start+1:i]] {
+				if !seen[j] {
+					seen[j] = true
+					found = append(found, j)
+				}
+			}
+		}
+	}
+	sort.Ints(found)
+	return found
+}
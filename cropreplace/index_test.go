@@ -0,0 +1,112 @@
+package cropreplace
+
+import (
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestFileIndexCandidates(t *testing.T) {
+	r := newRunner(DefaultConfig())
+	files := []attachment{
+		{fileName: "/2018/photo.jpg", ext: ".jpg"},
+		{fileName: "/2019/photo.png", ext: ".png"},
+		{fileName: "/2018/my photo-2.jpg", ext: ".jpg"},
+		{fileName: "/2018\\logo.png", ext: ".png"},
+		{fileName: "abc.png", ext: ".png"},
+		{fileName: "/2018/photo_1.jpg", ext: ".jpg"},
+	}
+	cases := []struct {
+		separator string
+		content   string
+		want      []int
+	}{
+		{"-", "", nil},
+		{"-", "/2018/photo.jpg /2018/photo-x.jpg", nil},
+		{"-", "<img src='/2018/photo-300x200.jpg'>", []int{0, 1}},
+		{"-", "/x/photo-1.png and /y/photo-2x2.jpg", []int{0, 1}},
+		{"-", "/2018/my photo-2-300x200.jpg", []int{0, 1, 2}},
+		{"-", "/2018\\logo-300x200.png", []int{3}},
+		{"-", "abc-300x200.png", []int{4}},
+		{"-", `"abc-300x200.png" /photo-1x1.jpg`, []int{0, 1, 4}},
+		{"-", "xabc-300x200.png", nil},
+		{"-", "/2018/photo_1-300x200.jpg", []int{5}},
+		{"_", "/2018/photo_1_300x200.jpg", []int{0, 1, 5}},
+	}
+	for i, tc := range cases {
+		t.Run("case_"+strconv.Itoa(i), func(t *testing.T) {
+			r.cfg.CropSeparator = tc.separator
+			if got := r.newFileIndex(files).candidates(tc.content); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got candidates %v but expected %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestFindReplacementsIndexed(t *testing.T) {
+	r := newRunner(DefaultConfig())
+	files := manyBenchAttachments(100)
+	content := benchContent(100)
+	var want []replacement
+	for i := range files {
+		want = append(want, r.replaceContentSingle(content, &files[i], tolerance{35, 100})...)
+	}
+	got := r.findReplacements(content, r.newFileIndex(files), tolerance{35, 100})
+	if len(got) == 0 || !reflect.DeepEqual(got, want) {
+		t.Errorf("got replacements %+v but expected %+v", got, want)
+	}
+}
+
+// manyBenchAttachments returns n attachments, each with a few crops.
+func manyBenchAttachments(n int) []attachment {
+	atts := make([]attachment, n)
+	for i := range atts {
+		atts[i] = attachment{
+			ID:       int64(i),
+			fileName: "/2018/07/photo" + strconv.Itoa(i) + ".jpg",
+			ext:      ".jpg",
+			crops: []crop{
+				{"150x150", 150, 150, ""},
+				{"300x200", 300, 200, ""},
+				{"1024x683", 1024, 683, ""},
+			},
+		}
+	}
+	return atts
+}
+
+// benchContent returns post content referencing crops of a few of the n attachments of manyBenchAttachments.
+func benchContent(n int) string {
+	var b strings.Builder
+	for i := 0; i < n; i += n / 5 {
+		b.WriteString("<p>Some text about the picture.</p>\n")
+		b.WriteString(`<img src="https://example.com/uploads/2018/07/photo` + strconv.Itoa(i) + `-310x205.jpg" ` +
+			`srcset="https://example.com/uploads/2018/07/photo` + strconv.Itoa(i) + `-310x205.jpg 310w, ` +
+			`https://example.com/uploads/2018/07/photo` + strconv.Itoa(i) + `-150x150.jpg 150w">` + "\n")
+	}
+	return b.String()
+}
+
+func BenchmarkFindReplacements(b *testing.B) {
+	r := newRunner(DefaultConfig())
+	const n = 10000
+	files := manyBenchAttachments(n)
+	content := benchContent(n)
+	tol := tolerance{35, 100}
+	b.Run("nested", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			var reps []replacement
+			for j := range files {
+				reps = append(reps, r.replaceContentSingle(content, &files[j], tol)...)
+			}
+			r.applyReplacements(content, reps)
+		}
+	})
+	b.Run("indexed", func(b *testing.B) {
+		x := r.newFileIndex(files)
+		for i := 0; i < b.N; i++ {
+			r.applyReplacements(content, r.findReplacements(content, x, tol))
+		}
+	})
+}
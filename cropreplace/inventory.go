@@ -0,0 +1,31 @@
+package cropreplace
+
+import (
+	"bytes"
+	"encoding/csv"
+	"strconv"
+	"strings"
+)
+
+// writeInventory writes to the file at path, replacing any existing file, a CSV list of the crops in the bucket
+// of each attachment, giving the ID and the file name of each along with the comma-separated dimensions of its
+// crops. A crop with an extension other than that of its attachment, such as a ".webp" variant, is listed with
+// the extension following its dimensions.
+func writeInventory(path string, atts []attachment) error {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	w.Write([]string{"ID", "file_name", "crops"})
+	for i := range atts {
+		att := &atts[i]
+		crops := make([]string, len(att.crops))
+		for j := range att.crops {
+			crops[j] = att.crops[j].str + att.crops[j].ext
+		}
+		w.Write([]string{strconv.FormatInt(att.ID, 10), att.fileName, strings.Join(crops, ",")})
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return err
+	}
+	return writeFile(path, buf.Bytes())
+}
@@ -0,0 +1,49 @@
+package cropreplace
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteInventory(t *testing.T) {
+	r := newRunner(DefaultConfig())
+	r.variantExts = []string{".webp"}
+	store := memStore{
+		"media/2018/abc.png",
+		"media/2018/abc-200x180.png",
+		"media/2018/abc-600x400.png",
+		"media/2018/abc-600x400.png.webp",
+		"media/2018/rjj-600x450.jpeg",
+		"media/2019/x-y.gif",
+	}
+	atts := []attachment{
+		{ID: 4, fileName: "/2018/abc.png", ext: ".png"},
+		{ID: 7, fileName: "/2018/rjj.jpeg", ext: ".jpeg"},
+		{ID: 9, fileName: "/2019/x-y.gif", ext: ".gif"},
+	}
+	if err := checkStorageObjectsWithPrefix(t, r, "media", store, atts); err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "crop-replace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "inventory.csv")
+	if err := writeInventory(path, atts); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "ID,file_name,crops\n" +
+		"4,/2018/abc.png,\"200x180,600x400,600x400.png.webp\"\n" +
+		"7,/2018/rjj.jpeg,600x450\n" +
+		"9,/2019/x-y.gif,\n"
+	if string(got) != want {
+		t.Errorf("got\n%s\nbut expected\n%s", got, want)
+	}
+}
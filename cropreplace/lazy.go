@@ -0,0 +1,94 @@
+package cropreplace
+
+import (
+	"context"
+	"fmt"
+
+	"cloud.google.com/go/storage"
+)
+
+// An objectChecker is an objectStore that can tell whether a single object exists without listing any.
+type objectChecker interface {
+	// Exists says whether the object with the given name is in the bucket.
+	Exists(ctx context.Context, name string) (bool, error)
+}
+
+func (g *gcsStore) Exists(ctx context.Context, name string) (bool, error) {
+	_, err := g.handle.Object(name).Attrs(ctx)
+	if err == storage.ErrObjectNotExist {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// objectExists says whether the object with the given name is in store, asking for that object alone if store
+// is an objectChecker or else listing the objects whose names begin with the name.
+func objectExists(ctx context.Context, store objectStore, name string) (bool, error) {
+	if c, ok := store.(objectChecker); ok {
+		return c.Exists(ctx, name)
+	}
+	names, err := store.ListWithPrefix(ctx, name)
+	if err != nil {
+		return false, err
+	}
+	return containsString(names, name), nil
+}
+
+// A lazyChecker finds out whether a crop is in the bucket when a reference to it is first found in content,
+// instead of the crops of every attachment being listed up front. Each crop found is added to the crops of its
+// attachment, and the answer for each object is remembered so that it's asked for only once. Since only the
+// crops referenced are known, a missing crop can be replaced only with another crop that is referenced too.
+type lazyChecker struct {
+	ctx   context.Context
+	store objectStore
+	known map[string]bool // whether each object asked for exists, by name
+
+	sep        string              // the CropSeparator
+	objectName func(string) string // returns the name of the object for a file name
+	err        error               // the first error asking for an object, after which no more are asked for
+}
+
+func (r *runner) newLazyChecker(ctx context.Context, store objectStore) *lazyChecker {
+	return &lazyChecker{ctx: ctx, store: store, known: make(map[string]bool), sep: r.cfg.CropSeparator,
+		objectName: r.objectName}
+}
+
+// check adds the requested crop with the extension ext to the crops of file if it's in the bucket and file does
+// not have it already.
+func (l *lazyChecker) check(file *attachment, requested *crop, ext string) {
+	if l.err != nil {
+		return
+	}
+	for i := range file.crops {
+		if c := &file.crops[i]; c.str == requested.str && file.cropExt(c) == ext {
+			return
+		}
+	}
+	prefix := l.objectName(file.fileName)
+	name := prefix[:len(prefix)-len(file.ext)] + l.sep + requested.str + ext
+	exists, ok := l.known[name]
+	if !ok {
+		var err error
+		if exists, err = objectExists(l.ctx, l.store, name); err != nil {
+			l.err = fmt.Errorf("checking for %s in the bucket; %v", name, err)
+			return
+		}
+		l.known[name] = exists
+	}
+	if !exists {
+		return
+	}
+	c := *requested
+	if ext != file.ext {
+		c.ext = ext
+	}
+	file.crops = append(file.crops, c)
+}
+
+// failed returns the error that stopped l from checking objects, if any. It may be called on a nil lazyChecker.
+func (l *lazyChecker) failed() error {
+	if l == nil {
+		return nil
+	}
+	return l.err
+}
@@ -0,0 +1,154 @@
+package cropreplace
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"google.golang.org/api/googleapi"
+)
+
+// A probingStore is an objectChecker holding the named objects that records the name of each object it's asked
+// for. Listing fails, so that only Exists may be used.
+type probingStore struct {
+	names  map[string]bool
+	err    error // returned by Exists if not nil
+	probed []string
+}
+
+func (p *probingStore) ListWithPrefix(context.Context, string) ([]string, error) {
+	return nil, errors.New("listing is not allowed")
+}
+
+func (p *probingStore) Exists(_ context.Context, name string) (bool, error) {
+	p.probed = append(p.probed, name)
+	if p.err != nil {
+		err := p.err
+		p.err = nil
+		return false, err
+	}
+	return p.names[name], nil
+}
+
+func TestLazyCheck(t *testing.T) {
+	r := newRunner(DefaultConfig())
+	r.cfg.BucketPrefix = "media"
+
+	cases := []struct {
+		content string
+		desired string
+		probed  []string
+	}{
+		{
+			"/2018/photo-300x200.jpg /2018/photo-310x210.jpg /2018/photo-310x210.jpg /2018/photo-300x200.jpg",
+			"/2018/photo-300x200.jpg /2018/photo-300x200.jpg /2018/photo-300x200.jpg /2018/photo-300x200.jpg",
+			[]string{"media/2018/photo-300x200.jpg", "media/2018/photo-310x210.jpg"},
+		},
+		{
+			// No crop is known to be close to the missing one, so the un-cropped image is used.
+			"/2018/photo-310x210.jpg /2018/photo-300x200.jpg",
+			"/2018/photo.jpg /2018/photo-300x200.jpg",
+			[]string{"media/2018/photo-310x210.jpg", "media/2018/photo-300x200.jpg"},
+		},
+		{
+			"/2018/photo-300x200.webp /2018/photo-1024x768.jpg /2018/other-300x200.jpg",
+			"/2018/photo-300x200.webp /2018/photo.jpg /2018/other-300x200.jpg",
+			[]string{"media/2018/photo-300x200.webp", "media/2018/photo-1024x768.jpg"},
+		},
+	}
+	for i, tc := range cases {
+		t.Run("case_"+strconv.Itoa(i), func(t *testing.T) {
+			defer func(orig []string) { r.variantExts = orig }(r.variantExts)
+			r.variantExts = []string{".webp"}
+			store := &probingStore{names: map[string]bool{
+				"media/2018/photo-300x200.jpg":  true,
+				"media/2018/photo-300x200.webp": true,
+			}}
+			r.lazy = r.newLazyChecker(context.Background(), store)
+			atts := []attachment{{fileName: "/2018/photo.jpg", ext: ".jpg"}}
+			reps, err := r.findSignedReplacements(tc.content, r.newFileIndex(atts), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := r.applyReplacements(tc.content, reps); got != tc.desired {
+				t.Errorf("got %q but expected %q", got, tc.desired)
+			}
+			if !reflect.DeepEqual(store.probed, tc.probed) {
+				t.Errorf("got objects probed %q but expected %q", store.probed, tc.probed)
+			}
+		})
+	}
+}
+
+func TestLazyCheckError(t *testing.T) {
+	r := newRunner(DefaultConfig())
+	store := &probingStore{err: &googleapi.Error{Code: 403}}
+	r.lazy = r.newLazyChecker(context.Background(), store)
+	atts := []attachment{{fileName: "/2018/photo.jpg", ext: ".jpg"}}
+	if _, err := r.findSignedReplacements("/2018/photo-300x200.jpg", r.newFileIndex(atts), nil); err == nil {
+		t.Error("got no error checking for a crop")
+	}
+	// No more objects are asked for after an error.
+	_, err := r.findSignedReplacements("/2018/photo-400x300.jpg", r.newFileIndex(atts), nil)
+	if err == nil || len(store.probed) != 1 {
+		t.Errorf("got error %v after probing %q", err, store.probed)
+	}
+}
+
+func TestLazyCheckLookalike(t *testing.T) {
+	r := newRunner(DefaultConfig())
+	r.cfg.BucketPrefix = "media"
+
+	// The lookalike attachment is in the bucket under the name a crop of photo.jpg would have.
+	store := &probingStore{names: map[string]bool{"media/2018/photo-1920x1080.jpg": true}}
+	r.lazy = r.newLazyChecker(context.Background(), store)
+	atts := []attachment{
+		{fileName: "/2018/photo.jpg", ext: ".jpg"},
+		{fileName: "/2018/photo-1920x1080.jpg", ext: ".jpg"},
+	}
+	r.findLookalikes(atts)
+	content := "/2018/photo-1920x1080.jpg /2018/photo-300x200.jpg"
+	reps, err := r.findSignedReplacements(content, r.newFileIndex(atts), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, desired := r.applyReplacements(content, reps), "/2018/photo-1920x1080.jpg /2018/photo.jpg"; got != desired {
+		t.Errorf("got %q but expected %q", got, desired)
+	}
+	if desired := []string{"media/2018/photo-300x200.jpg"}; !reflect.DeepEqual(store.probed, desired) {
+		t.Errorf("got objects probed %q but expected %q", store.probed, desired)
+	}
+	if len(atts[0].crops) != 0 {
+		t.Errorf("got crops %v for the attachment with a lookalike", atts[0].crops)
+	}
+}
+
+func TestObjectExists(t *testing.T) {
+	checker := &probingStore{names: map[string]bool{"media/a.jpg": true}}
+	cases := []struct {
+		store  objectStore
+		name   string
+		exists bool
+	}{
+		{memStore{"media/a.jpg", "media/a.jpg.webp"}, "media/a.jpg", true},
+		{memStore{"media/a.jpg.webp"}, "media/a.jpg", false},
+		{checker, "media/a.jpg", true},
+		{checker, "media/b.jpg", false},
+		{&retryingStore{store: &probingStore{err: &googleapi.Error{Code: 503}, names: map[string]bool{"media/a.jpg": true}},
+			maxRetries: 1, base: time.Millisecond}, "media/a.jpg", true},
+	}
+	for i, tc := range cases {
+		t.Run("case_"+strconv.Itoa(i), func(t *testing.T) {
+			exists, err := objectExists(context.Background(), tc.store, tc.name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if exists != tc.exists {
+				t.Errorf("got %v but expected %v", exists, tc.exists)
+			}
+		})
+	}
+}
@@ -0,0 +1,131 @@
+package cropreplace
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/ttacon/chalk"
+)
+
+// The levels of the messages printed. Which are printed depends on Verbose and Quiet.
+const (
+	levelVerbose = iota // details, such as each replacement made, printed only in verbose mode
+	levelInfo           // progress, such as each post updated, not printed in quiet mode
+	levelWarn           // warnings, always printed
+	levelNotice         // the summary of the run, always printed
+	levelError          // errors, always printed
+)
+
+// levelNames holds the name of each level as written in JSON logs.
+var levelNames = [...]string{"debug", "info", "warn", "notice", "error"}
+
+// The formats that messages may be printed in, as given by LogFormat.
+const (
+	logFormatText = "text"
+	logFormatJSON = "json"
+)
+
+// logFields holds the details of a message, such as the ID of a post, which are written as their own fields
+// in JSON logs. In text logs, the message itself must give them.
+type logFields map[string]interface{}
+
+// logLevel returns the least level of the messages to print.
+func (r *runner) logLevel() int {
+	switch {
+	case r.cfg.Quiet:
+		return levelWarn
+	case r.cfg.Verbose:
+		return levelVerbose
+	default:
+		return levelInfo
+	}
+}
+
+// logging says whether messages of the given level are printed.
+func (r *runner) logging(level int) bool {
+	return level >= r.logLevel()
+}
+
+// logWith prints a message with the given level and fields if Verbose and Quiet allow it. In text format, warnings are
+// yellow and errors are red, and a newline is added to the message. In JSON format, the message is written as a single
+// object on a line of its own with the time, level, msg, and fields as keys.
+func (r *runner) logWith(level int, fields logFields, format string, args ...interface{}) {
+	if !r.logging(level) {
+		return
+	}
+	msg := fmt.Sprintf(format, args...)
+	if r.cfg.LogFormat == logFormatJSON {
+		writeJSONLine(r.out, level, fields, msg)
+		return
+	}
+	switch level {
+	case levelWarn:
+		msg = chalk.Yellow.Color(msg)
+	case levelError:
+		msg = chalk.Red.Color(msg)
+	}
+	fmt.Fprintln(r.out, msg)
+}
+
+// writeJSONLine writes to w the message msg as a single JSON object on a line of its own with the time, level,
+// msg, and fields as keys.
+func writeJSONLine(w io.Writer, level int, fields logFields, msg string) {
+	obj := make(map[string]interface{}, len(fields)+3)
+	for k, v := range fields {
+		obj[k] = v
+	}
+	obj["time"] = timeNow().Format(time.RFC3339)
+	obj["level"] = levelNames[level]
+	obj["msg"] = msg
+	line, err := json.Marshal(obj)
+	if err != nil {
+		line, _ = json.Marshal(map[string]string{"level": levelNames[levelError], "msg": err.Error()})
+	}
+	fmt.Fprintf(w, "%s\n", line)
+}
+
+// logVerbose prints a message only in verbose mode.
+func (r *runner) logVerbose(format string, args ...interface{}) {
+	r.logWith(levelVerbose, nil, format, args...)
+}
+
+// logInfo prints a message unless in quiet mode.
+func (r *runner) logInfo(format string, args ...interface{}) {
+	r.logWith(levelInfo, nil, format, args...)
+}
+
+// logWarn prints a warning.
+func (r *runner) logWarn(format string, args ...interface{}) {
+	r.logWith(levelWarn, nil, format, args...)
+}
+
+// printErr prints the message msg with the non-nil error.
+func (r *runner) printErr(msg string, err error) {
+	if r.cfg.LogFormat == logFormatJSON {
+		r.logWith(levelError, logFields{"error": err.Error()}, "%s", msg)
+		return
+	}
+	r.logWith(levelError, nil, "ERROR %v: %v", msg, err)
+}
+
+// logWouldUpdate prints a message, saying that a row would be updated, followed by the crop references changed
+// by the replacements. In text format, they are printed as a diff, and in JSON format, as the changes field.
+func (r *runner) logWouldUpdate(fields logFields, reps []replacement, format string, args ...interface{}) {
+	if r.cfg.LogFormat == logFormatJSON {
+		changes := []map[string]string{}
+		for i := range reps {
+			if rep := &reps[i]; rep.kind == kindClose || rep.kind == kindFallback || rep.kind == kindDuplicate {
+				changes = append(changes, map[string]string{"old": rep.old + rep.oldSuffix, "new": rep.new + rep.newSuffix})
+			}
+		}
+		fields["changes"] = changes
+		r.logWith(levelInfo, fields, format, args...)
+		return
+	}
+	r.logInfo(format, args...)
+	if r.logging(levelInfo) {
+		printReplacementDiff(r.out, reps)
+	}
+}
@@ -0,0 +1,170 @@
+package cropreplace
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestQuietLogging(t *testing.T) {
+	r := newRunner(DefaultConfig())
+	r.cfg.SkipOversizedPackets = true
+
+	atts := []attachment{
+		{fileName: "/2018/bcd.png", ext: ".png"},
+	}
+	small := "<img src='/2018/bcd-30x15.png'>"
+	big := small + strings.Repeat("x", 2000)
+	for _, q := range []bool{false, true} {
+		var out bytes.Buffer
+		func() {
+			defer func(orig io.Writer) { r.out = orig }(r.out)
+			r.out = &out
+			r.cfg.Quiet = q
+
+			db, fdb := newFakeDB(t,
+				fakePost{ID: 1, postType: "post", content: small},
+				fakePost{ID: 2, postType: "post", content: big},
+			)
+			defer db.Close()
+			fdb.maxPacket = 2048
+			err := r.replaceImageCrops(context.Background(), sqlDB{db}, []string{"post"}, r.newFileIndex(atts), nil, nil,
+				newReport())
+			if err != nil {
+				t.Fatal(err)
+			}
+		}()
+		if got := strings.Contains(out.String(), "Updating 1\n"); got == q {
+			t.Errorf("with quiet %v, got output %q", q, out.String())
+		}
+		if !strings.Contains(out.String(), "ERROR the updated columns of post 2") {
+			t.Errorf("with quiet %v, got no error in output %q", q, out.String())
+		}
+	}
+}
+
+func TestLogLevel(t *testing.T) {
+	r := newRunner(DefaultConfig())
+	cases := []struct {
+		verbose, quiet bool
+		level          int
+	}{
+		{false, false, levelInfo},
+		{true, false, levelVerbose},
+		{false, true, levelWarn},
+	}
+	for _, tc := range cases {
+		r.cfg.Verbose, r.cfg.Quiet = tc.verbose, tc.quiet
+		if got := r.logLevel(); got != tc.level {
+			t.Errorf("with verbose %v and quiet %v, got level %d but expected %d", tc.verbose, tc.quiet, got, tc.level)
+		}
+	}
+}
+
+func TestJSONLogging(t *testing.T) {
+	r := newRunner(DefaultConfig())
+	defer func(orig func() time.Time) { timeNow = orig }(timeNow)
+	r.cfg.LogFormat = logFormatJSON
+	timeNow = func() time.Time { return time.Date(2018, 11, 5, 2, 0, 0, 0, time.UTC) }
+
+	cases := []struct {
+		log  func()
+		want map[string]interface{}
+	}{
+		{
+			func() { r.logWith(levelInfo, logFields{"post_id": int64(12)}, "Updating %d", 12) },
+			map[string]interface{}{"time": "2018-11-05T02:00:00Z", "level": "info", "msg": "Updating 12", "post_id": 12.0},
+		},
+		{
+			func() { r.printErr("could not upload", errors.New("timed out")) },
+			map[string]interface{}{"time": "2018-11-05T02:00:00Z", "level": "error", "msg": "could not upload",
+				"error": "timed out"},
+		},
+		{
+			func() {
+				reps := []replacement{{old: "a-1x1.jpg", new: "a.jpg", kind: kindFallback}, {old: "b", new: "b", kind: kindExact}}
+				r.logWouldUpdate(logFields{"meta_id": int64(3)}, reps, "Would update meta %d", 3)
+			},
+			map[string]interface{}{"time": "2018-11-05T02:00:00Z", "level": "info", "msg": "Would update meta 3",
+				"meta_id": 3.0, "changes": []interface{}{map[string]interface{}{"old": "a-1x1.jpg", "new": "a.jpg"}}},
+		},
+	}
+	for i, tc := range cases {
+		t.Run("case_"+strconv.Itoa(i), func(t *testing.T) {
+			var out bytes.Buffer
+			r.out = &out
+			tc.log()
+			if n := strings.Count(out.String(), "\n"); n != 1 {
+				t.Fatalf("got %d lines in %q but expected 1", n, out.String())
+			}
+			var got map[string]interface{}
+			if err := json.Unmarshal(out.Bytes(), &got); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got %v but expected %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestJSONReports(t *testing.T) {
+	r := newRunner(DefaultConfig())
+	r.cfg.LogFormat = logFormatJSON
+
+	atts := []attachment{{ID: 7, fileName: "/2018/photo.jpg", ext: ".jpg", crops: []crop{{"300x200", 300, 200, ""}}}}
+	content := "<img src=\"/2018/photo-310x210.jpg\">"
+	reps := r.findReplacements(content, r.newFileIndex(atts), tolerance{35, 100})
+	r.applyReplacements(content, reps)
+
+	cases := []struct {
+		log    func(w io.Writer)
+		fields map[string]interface{}
+	}{
+		{
+			func(w io.Writer) { r.explainPost(w, 12, reps, tolerance{35, 100}) },
+			map[string]interface{}{"post_id": 12.0, "old": "/2018/photo-310x210.jpg", "offset": 10.0,
+				"requested": "310x210", "attachment_id": 7.0, "kind": "close"},
+		},
+		{
+			func(w io.Writer) { r.printPostDiff(w, 12, content, reps) },
+			map[string]interface{}{"post_id": 12.0, "msg": "Changes to post 12", "diff": []interface{}{
+				map[string]interface{}{"offset": 10.0,
+					"text": "<img src=\"[-/2018/photo-310x210.jpg-]{+/2018/photo-300x200.jpg+}\">"},
+			}},
+		},
+		{
+			func(io.Writer) {
+				r.printVerification("post", 12, &verification{closeCrop: []string{"/2018/photo-310x210.jpg"}})
+			},
+			map[string]interface{}{"post_id": 12.0, "msg": "Verified post 12",
+				"close": []interface{}{"/2018/photo-310x210.jpg"}},
+		},
+	}
+	for i, tc := range cases {
+		t.Run("case_"+strconv.Itoa(i), func(t *testing.T) {
+			var out bytes.Buffer
+			r.out = &out
+			tc.log(&out)
+			if n := strings.Count(out.String(), "\n"); n != 1 {
+				t.Fatalf("got %d lines in %q but expected 1", n, out.String())
+			}
+			var got map[string]interface{}
+			if err := json.Unmarshal(out.Bytes(), &got); err != nil {
+				t.Fatal(err)
+			}
+			for k, want := range tc.fields {
+				if !reflect.DeepEqual(got[k], want) {
+					t.Errorf("got %s %v but expected %v", k, got[k], want)
+				}
+			}
+		})
+	}
+}
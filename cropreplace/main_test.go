@@ -0,0 +1,2717 @@
+package cropreplace
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGetCropVariant(t *testing.T) {
+	r := newRunner(DefaultConfig())
+	cases := []struct {
+		fileNameEnd, ext string
+		dimensions       *crop
+	}{
+		{"-600x340.png", ".png", &crop{"600x340", 600, 340, ""}},
+		{"-1024x768.jpeg", ".jpeg", &crop{"1024x768", 1024, 768, ""}},
+		{"-600x340.png_more-stuff", ".png", &crop{"600x340", 600, 340, ""}},
+		{"-500x370.jpg'=anything-can-follow", ".jpg", &crop{"500x370", 500, 370, ""}},
+		{"-x.jpg", ".jpg", nil},
+		{"-.png", ".png", nil},
+		{"-850x1080x900.jpg", ".jpg", nil},
+		{"-850x1080.900.jpg", ".jpg", nil},
+		{"-file-other.jpeg", ".jpeg", nil},
+		{"-1024x768.jpeg", ".png", nil},
+		{"_1024x768.jpeg", ".jpeg", nil},
+		{"_something-else.jpg", ".jpg", nil},
+		{"234x424.png", ".png", nil},
+		{".jpeg", ".jpeg", nil},
+		{"-600x340@2x.jpg", ".jpg", &crop{"600x340@2x", 600, 340, ""}},
+		{"-600x340@3x.png", ".png", &crop{"600x340@3x", 600, 340, ""}},
+		{"-600x340@2x.png", ".jpg", nil},
+		{"-600x340@x.jpg", ".jpg", nil},
+		{"-600x340@2.jpg", ".jpg", nil},
+		{"-600x340@2x@2x.jpg", ".jpg", nil},
+		{"-600x340.JPG", ".jpg", &crop{"600x340", 600, 340, ""}},
+		{"-600x340@2x.Png", ".PNG", &crop{"600x340@2x", 600, 340, ""}},
+		{"-600x340.JPEG", ".jpg", nil},
+	}
+	for i, tc := range cases {
+		t.Run("case_"+strconv.Itoa(i), func(t *testing.T) {
+			got := r.getCropVariant(tc.fileNameEnd, tc.ext)
+			if got == nil && tc.dimensions != nil || got != nil && tc.dimensions == nil {
+				t.Errorf("got %v but expected %v", got, tc.dimensions)
+			}
+			if got != nil && (got.str != tc.dimensions.str ||
+				got.width != tc.dimensions.width || got.height != tc.dimensions.height) {
+				t.Errorf("got %v but expected %v", got, tc.dimensions)
+			}
+		})
+	}
+}
+
+func TestStringIndexes(t *testing.T) {
+	cases := []struct {
+		s, substr string
+		indexes   []int
+	}{
+		{"abc", "n", nil},
+		{"abc", "a", []int{0}},
+		{"abac", "a", []int{0, 2}},
+		{"aaabc", "aa", []int{0}},
+		{"aabgaa", "aa", []int{0, 4}},
+		{"rabcabcd", "abc", []int{1, 4}},
+		{"rrabcaabcd", "abc", []int{2, 6}},
+		{"rrabaabcd", "abc", []int{5}},
+		{"\tabc_deabc_dekiabc_def", "abc_de", []int{1, 7, 15}},
+	}
+	for i, tc := range cases {
+		t.Run("case_"+strconv.Itoa(i), func(t *testing.T) {
+			got := stringIndexes(tc.s, tc.substr)
+			if len(got) != len(tc.indexes) {
+				t.Fatalf("got %v but expected %v", got, tc.indexes)
+			}
+			for j := range got {
+				if got[j] != tc.indexes[j] {
+					t.Errorf("got %v but expected %v", got, tc.indexes)
+				}
+			}
+		})
+	}
+}
+
+func TestReplaceCrops(t *testing.T) {
+	r := newRunner(DefaultConfig())
+	atts := []attachment{
+		{
+			fileName: "abc.png", ext: ".png", crops: nil,
+		},
+		{
+			fileName: "bcd.png", ext: ".png",
+			crops: []crop{
+				{"200x180", 200, 180, ""},
+				{"400x320", 400, 320, ""},
+			},
+		},
+		{
+			fileName: "rjj.jpeg", ext: ".jpeg",
+			crops: []crop{
+				{"600x450", 600, 450, ""},
+			},
+		},
+		{
+			fileName: "rrrr-aa.png", ext: ".png",
+			crops: []crop{
+				{"200x180", 200, 180, ""},
+			},
+		},
+	}
+	cases := []struct {
+		original string
+		files    []attachment
+		desired  string
+		count    int
+	}{
+		{"abc.png", atts, "abc.png", 0},                                         // No replacement needed
+		{"<img src='abc.png'>", atts, "<img src='abc.png'>", 0},                 // No replacement needed
+		{"abc-400x300.png", atts, "abc.png", 1},                                 // Default to un-cropped
+		{"bcd-30x15.png", atts, "bcd.png", 1},                                   // Default to un-cropped
+		{"bcd-210x195.png", atts, "bcd-200x180.png", 1},                         // Use close variant
+		{"bcd-520x305.png", atts, "bcd-400x320.png", 1},                         // Use close variant (30% wider)
+		{"jkljk-210x195.png", atts, "jkljk-210x195.png", 0},                     // No matching attachment
+		{"HELLO WORLD bcd-210x195.png", atts, "HELLO WORLD bcd-200x180.png", 1}, // Ignore surroundings
+		{"Hi: bcd-210x195.png\tText...", atts, "Hi: bcd-200x180.png\tText...", 1},
+		{"bcd-210x195.png\tText...", atts, "bcd-200x180.png\tText...", 1},
+	}
+	for i, tc := range cases {
+		t.Run("case_"+strconv.Itoa(i), func(t *testing.T) {
+			got, n := r.replaceCropsCount(tc.original, tc.files, tolerance{35, 100})
+			if got != tc.desired {
+				t.Errorf("got\n\t%v\nbut expected\n\t%v", got, tc.desired)
+			}
+			if n != tc.count {
+				t.Errorf("got %d replacements but expected %d", n, tc.count)
+			}
+		})
+	}
+}
+
+func TestReplaceCropsNameBoundary(t *testing.T) {
+	r := newRunner(DefaultConfig())
+	atts := []attachment{
+		{
+			fileName: "photo.jpg", ext: ".jpg",
+			crops: []crop{
+				{"300x200", 300, 200, ""},
+			},
+		},
+		{
+			fileName: "/2018/abc.png", ext: ".png",
+			crops: []crop{
+				{"300x200", 300, 200, ""},
+			},
+		},
+	}
+	cases := []struct {
+		original string
+		desired  string
+	}{
+		{"photo-310x210.jpg", "photo-300x200.jpg"},
+		{"/uploads/photo-310x210.jpg", "/uploads/photo-300x200.jpg"},
+		{"<img src=\"photo-310x210.jpg\">", "<img src=\"photo-300x200.jpg\">"},
+		{"<img src='photo-310x210.jpg'>", "<img src='photo-300x200.jpg'>"},
+		{"see\tphoto-310x210.jpg", "see\tphoto-300x200.jpg"},
+		{`C:\uploads\photo-310x210.jpg`, `C:\uploads\photo-300x200.jpg`},
+		{"myphoto-310x210.jpg", "myphoto-310x210.jpg"},
+		{"/uploads/old_photo-310x210.jpg", "/uploads/old_photo-310x210.jpg"},
+		{"<img src='stock-photo-310x210.jpg'>", "<img src='stock-photo-310x210.jpg'>"},
+		{"/2018/abc-310x210.png /2018/xabc-310x210.png", "/2018/abc-300x200.png /2018/xabc-310x210.png"},
+		{"/2018/abcdef-310x210.png", "/2018/abcdef-310x210.png"},
+	}
+	for i, tc := range cases {
+		t.Run("case_"+strconv.Itoa(i), func(t *testing.T) {
+			if got := r.replaceCrops(tc.original, atts, tolerance{35, 100}); got != tc.desired {
+				t.Errorf("got %q but expected %q", got, tc.desired)
+			}
+		})
+	}
+}
+
+func TestReplaceCropsUnderscore(t *testing.T) {
+	r := newRunner(DefaultConfig())
+	r.cfg.CropSeparator = "_"
+	atts := []attachment{
+		{
+			fileName: "/2018/photo.jpg", ext: ".jpg",
+			crops: []crop{
+				{"300x200", 300, 200, ""},
+				{"600x400", 600, 400, ""},
+			},
+		},
+	}
+	cases := []struct {
+		original string
+		desired  string
+	}{
+		{"/2018/photo_310x210.jpg", "/2018/photo_300x200.jpg"},
+		{"/2018/photo_600x400.jpg", "/2018/photo_600x400.jpg"},
+		{"/2018/photo_100x50.jpg", "/2018/photo.jpg"},
+		{"/2018/photo-310x210.jpg", "/2018/photo-310x210.jpg"},
+		{"<img srcset='/2018/photo_610x410.jpg 610w, /2018/photo_300x200.jpg 300w'>",
+			"<img srcset='/2018/photo_600x400.jpg 600w, /2018/photo_300x200.jpg 300w'>"},
+	}
+	for i, tc := range cases {
+		t.Run("case_"+strconv.Itoa(i), func(t *testing.T) {
+			if got := r.replaceCrops(tc.original, atts, tolerance{35, 100}); got != tc.desired {
+				t.Errorf("got %q but expected %q", got, tc.desired)
+			}
+		})
+	}
+}
+
+func TestGetCropVariantThreePart(t *testing.T) {
+	r := newRunner(DefaultConfig())
+	r.cfg.ThreePart = true
+	cases := []struct {
+		fileNameEnd, ext string
+		dimensions       *crop
+		quality          uint64
+	}{
+		{"-600x340x80.jpg", ".jpg", &crop{"600x340x80", 600, 340, ""}, 80},
+		{"-600x340.jpg", ".jpg", &crop{"600x340", 600, 340, ""}, 0},
+		{"-600x340x80@2x.jpg", ".jpg", &crop{"600x340x80@2x", 600, 340, ""}, 80},
+		{"-600x340x.jpg", ".jpg", nil, 0},
+		{"-600x340x80x90.jpg", ".jpg", nil, 0},
+		{"-600x340x80.png", ".jpg", nil, 0},
+	}
+	for i, tc := range cases {
+		t.Run("case_"+strconv.Itoa(i), func(t *testing.T) {
+			got := r.getCropVariant(tc.fileNameEnd, tc.ext)
+			if !reflect.DeepEqual(got, tc.dimensions) {
+				t.Fatalf("got %v but expected %v", got, tc.dimensions)
+			}
+			if got != nil && got.quality() != tc.quality {
+				t.Errorf("got quality %d but expected %d", got.quality(), tc.quality)
+			}
+		})
+	}
+}
+
+func TestReplaceCropsThreePart(t *testing.T) {
+	r := newRunner(DefaultConfig())
+	atts := []attachment{
+		{
+			fileName: "/2018/photo.jpg", ext: ".jpg",
+			crops: []crop{
+				{"300x200x80", 300, 200, ""},
+				{"600x400", 600, 400, ""},
+			},
+		},
+	}
+	cases := []struct {
+		threePart bool
+		original  string
+		desired   string
+	}{
+		{false, "/2018/photo-310x210x80.jpg", "/2018/photo-310x210x80.jpg"},
+		{true, "/2018/photo-300x200x80.jpg", "/2018/photo-300x200x80.jpg"},
+		{true, "/2018/photo-300x200x90.jpg", "/2018/photo-300x200x80.jpg"},
+		{true, "/2018/photo-310x210x90.jpg", "/2018/photo-300x200x80.jpg"},
+		{true, "/2018/photo-300x200.jpg", "/2018/photo-300x200x80.jpg"},
+		{true, "/2018/photo-610x410x70.jpg", "/2018/photo-600x400.jpg"},
+		{true, "/2018/photo-100x50x80.jpg", "/2018/photo.jpg"},
+		{true, "<img srcset='/2018/photo-610x410x75.jpg 610w'>", "<img srcset='/2018/photo-600x400.jpg 600w'>"},
+	}
+	for i, tc := range cases {
+		t.Run("case_"+strconv.Itoa(i), func(t *testing.T) {
+			r.cfg.ThreePart = tc.threePart
+			if got := r.replaceCrops(tc.original, atts, tolerance{35, 100}); got != tc.desired {
+				t.Errorf("got %q but expected %q", got, tc.desired)
+			}
+		})
+	}
+}
+
+func TestReplaceCropsSquareShorthand(t *testing.T) {
+	r := newRunner(DefaultConfig())
+	atts := []attachment{
+		{
+			fileName: "/2018/photo.jpg", ext: ".jpg",
+			crops: []crop{
+				{"150x150", 150, 150, ""},
+				{"300x200", 300, 200, ""},
+			},
+		},
+	}
+	cases := []struct {
+		shorthand bool
+		original  string
+		desired   string
+	}{
+		{false, "/2018/photo-150.jpg", "/2018/photo-150.jpg"},
+		{true, "/2018/photo-150.jpg", "/2018/photo-150x150.jpg"},
+		{true, "/2018/photo-160.JPG", "/2018/photo-150x150.jpg"},
+		{true, "/2018/photo-90.jpg", "/2018/photo.jpg"},
+		{true, "/2018/photo-150x150.jpg", "/2018/photo-150x150.jpg"},
+		{true, "/2018/photo-2023.jpg", "/2018/photo-2023.jpg"}, // A year
+		{true, "/2018/photo-1999.jpg", "/2018/photo-1999.jpg"},
+		{true, "/2018/photo-2.jpg", "/2018/photo-2.jpg"}, // A suffix added to a duplicate upload
+		{true, "/2018/photo-150.png", "/2018/photo-150.png"},
+		{true, "/2018/photo-150-a.jpg", "/2018/photo-150-a.jpg"},
+	}
+	for i, tc := range cases {
+		t.Run("case_"+strconv.Itoa(i), func(t *testing.T) {
+			r.cfg.SquareShorthand = tc.shorthand
+			if got := r.replaceCrops(tc.original, atts, tolerance{35, 100}); got != tc.desired {
+				t.Errorf("got %q but expected %q", got, tc.desired)
+			}
+		})
+	}
+}
+
+func TestReplaceCropsSinglePass(t *testing.T) {
+	r := newRunner(DefaultConfig())
+	// The first attachment's fallback produces "a/photo-300x200.png", which looks like a missing crop of the
+	// second attachment. Replacing sequentially would edit the same region twice.
+	atts := []attachment{
+		{fileName: "a/photo-300x200.png", ext: ".png", crops: nil},
+		{
+			fileName: "a/photo.png", ext: ".png",
+			crops: []crop{
+				{"250x200", 250, 200, ""},
+			},
+		},
+	}
+	cases := []struct {
+		original string
+		desired  string
+		count    int
+	}{
+		{"a/photo-300x200-150x150.png", "a/photo-300x200.png", 1},
+		{"<img src='a/photo-300x200-150x150.png'>", "<img src='a/photo-300x200.png'>", 1},
+		{"a/photo-300x200-150x150.png a/photo-260x200.png", "a/photo-300x200.png a/photo-250x200.png", 2},
+		{"a/photo-260x200.png a/photo-300x200-150x150.png", "a/photo-250x200.png a/photo-300x200.png", 2},
+	}
+	for i, tc := range cases {
+		t.Run("case_"+strconv.Itoa(i), func(t *testing.T) {
+			got, n := r.replaceCropsCount(tc.original, atts, tolerance{35, 100})
+			if got != tc.desired {
+				t.Errorf("got\n\t%v\nbut expected\n\t%v", got, tc.desired)
+			}
+			if n != tc.count {
+				t.Errorf("got %d replacements but expected %d", n, tc.count)
+			}
+		})
+	}
+}
+
+func TestApplyReplacements(t *testing.T) {
+	r := newRunner(DefaultConfig())
+	cases := []struct {
+		content string
+		reps    []replacement
+		desired string
+	}{
+		{"abcdef", nil, "abcdef"},
+		{"abcdef", []replacement{{start: 1, old: "bc", new: "X"}}, "aXdef"},
+		{"abcdef", []replacement{{start: 3, old: "de", new: "Y"}, {start: 0, old: "ab", new: "X"}}, "XcYf"},
+		{"abcdef", []replacement{{start: 1, old: "bc", new: "X"}, {start: 2, old: "cd", new: "Y"}}, "aXdef"},
+		{"abcdef", []replacement{{start: 1, old: "bc", new: "X"}, {start: 1, old: "bcd", new: "Y"}}, "aYef"},
+	}
+	for i, tc := range cases {
+		t.Run("case_"+strconv.Itoa(i), func(t *testing.T) {
+			got := r.applyReplacements(tc.content, tc.reps)
+			if got != tc.desired {
+				t.Errorf("got %q but expected %q", got, tc.desired)
+			}
+		})
+	}
+}
+
+// TestApplyReplacementsOrder checks that the result does not depend on the order of the replacements, even
+// when the text of one is a prefix of that of another.
+func TestApplyReplacementsOrder(t *testing.T) {
+	r := newRunner(DefaultConfig())
+	content := "<img src='/a/photo-300x200.jpg'> <img src='/a/photo-300x200-300x200.jpg'>"
+	desired := "<img src='/a/photo-250x200.jpg'> <img src='/a/photo-250x200.jpg'>"
+	first, second := strings.Index(content, "/a/"), strings.LastIndex(content, "/a/")
+	reps := []replacement{
+		{start: first, old: "/a/photo-300x200", new: "/a/photo-250x200"},
+		{start: second, old: "/a/photo-300x200", new: "/a/photo-250x200"},
+		{start: second, old: "/a/photo-300x200-300x200", new: "/a/photo-250x200"},
+		{start: second, old: "/a/photo", new: "/b/photo"},
+	}
+	perms := [][]int{{0, 1, 2, 3}, {3, 2, 1, 0}, {1, 3, 0, 2}, {2, 0, 3, 1}, {3, 1, 2, 0}}
+	for i, perm := range perms {
+		t.Run("case_"+strconv.Itoa(i), func(t *testing.T) {
+			ordered := make([]replacement, len(perm))
+			for j, k := range perm {
+				ordered[j] = reps[k]
+			}
+			if got := r.applyReplacements(content, ordered); got != desired {
+				t.Errorf("got %q but expected %q", got, desired)
+			}
+		})
+	}
+}
+
+func TestFindSuitableCrop(t *testing.T) {
+	r := newRunner(DefaultConfig())
+	cases := []struct {
+		inPost       *crop
+		haveInBucket []crop
+		good         bool
+		okDiff       int
+	}{
+		{
+			inPost: &crop{"500x450", 500, 450, ""},
+			haveInBucket: []crop{
+				{"500x450", 500, 450, ""},
+				{"400x330", 400, 330, ""},
+			},
+			good:   true,
+			okDiff: -1,
+		},
+		{
+			inPost: &crop{"500x450", 500, 450, ""},
+			haveInBucket: []crop{
+				{"510x460", 510, 460, ""},
+				{"400x330", 400, 330, ""},
+			},
+			good:   false,
+			okDiff: 0,
+		},
+		{
+			inPost: &crop{"500x450", 500, 450, ""},
+			haveInBucket: []crop{
+				{"410x360", 410, 360, ""},
+				{"505x500", 505, 500, ""},
+			},
+			good:   false,
+			okDiff: 1,
+		},
+		{
+			inPost:       &crop{"500x450", 500, 450, ""},
+			haveInBucket: nil,
+			good:         false,
+			okDiff:       -1,
+		},
+		{
+			inPost: &crop{"500x450", 500, 450, ""},
+			haveInBucket: []crop{
+				{"420x380", 420, 380, ""},
+				{"480x430", 480, 430, ""},
+				{"560x500", 560, 500, ""},
+			},
+			good:   false,
+			okDiff: 1,
+		},
+		{
+			inPost: &crop{"500x450", 500, 450, ""},
+			haveInBucket: []crop{
+				{"480x430", 480, 430, ""},
+				{"520x460", 520, 460, ""},
+				{"520x440", 520, 440, ""},
+			},
+			good:   false,
+			okDiff: 1,
+		},
+		{
+			inPost: &crop{"500x450", 500, 450, ""},
+			haveInBucket: []crop{
+				{"520x300", 520, 300, ""},
+				{"480x400", 480, 400, ""},
+				{"520x450", 520, 450, ""},
+			},
+			good:   false,
+			okDiff: 2,
+		},
+	}
+	for i, tc := range cases {
+		t.Run("case_"+strconv.Itoa(i), func(t *testing.T) {
+			good, okDiff := r.findSuitableCrop(tc.inPost, tc.haveInBucket, tolerance{35, 100})
+			if good != tc.good {
+				t.Errorf("got %v but expected %v for the bool", good, tc.good)
+			}
+			if okDiff != tc.okDiff {
+				t.Errorf("got %v but expected %v for the int", okDiff, tc.okDiff)
+			}
+		})
+	}
+}
+
+func TestFindSuitableCropPrefer(t *testing.T) {
+	r := newRunner(DefaultConfig())
+	haveInBucket := []crop{
+		{"440x390", 440, 390, ""},
+		{"490x440", 490, 440, ""},
+		{"530x480", 530, 480, ""},
+		{"600x540", 600, 540, ""},
+		{"800x720", 800, 720, ""},
+	}
+	cases := []struct {
+		prefer string
+		inPost *crop
+		okDiff int
+	}{
+		{preferClosest, &crop{"500x450", 500, 450, ""}, 1},
+		{preferLarger, &crop{"500x450", 500, 450, ""}, 2},
+		{preferSmaller, &crop{"500x450", 500, 450, ""}, 1},
+		{preferClosest, &crop{"520x470", 520, 470, ""}, 2},
+		{preferLarger, &crop{"520x470", 520, 470, ""}, 2},
+		{preferSmaller, &crop{"520x470", 520, 470, ""}, 1},
+		{preferLarger, &crop{"700x630", 700, 630, ""}, 4},
+		{preferSmaller, &crop{"700x630", 700, 630, ""}, 3},
+		{preferLarger, &crop{"850x765", 850, 765, ""}, 4},  // None is larger.
+		{preferSmaller, &crop{"420x380", 420, 380, ""}, 0}, // None is smaller.
+		{preferLarger, &crop{"1300x1170", 1300, 1170, ""}, -1},
+	}
+	for i, tc := range cases {
+		t.Run("case_"+strconv.Itoa(i), func(t *testing.T) {
+			r.cfg.Prefer = tc.prefer
+			good, okDiff := r.findSuitableCrop(tc.inPost, haveInBucket, tolerance{35, 100})
+			if good || okDiff != tc.okDiff {
+				t.Errorf("got (%v, %d) but expected (false, %d)", good, okDiff, tc.okDiff)
+			}
+		})
+	}
+}
+
+func TestShufflePosts(t *testing.T) {
+	posts := make([]post, 50)
+	for i := range posts {
+		posts[i].ID = int64(i + 1)
+	}
+	shufflePosts(posts, rand.New(rand.NewSource(1)))
+	seen := make(map[int64]bool, len(posts))
+	var moved int
+	for i := range posts {
+		if seen[posts[i].ID] {
+			t.Fatalf("post %d appears twice", posts[i].ID)
+		}
+		seen[posts[i].ID] = true
+		if posts[i].ID != int64(i+1) {
+			moved++
+		}
+	}
+	if len(seen) != 50 {
+		t.Errorf("got %d distinct posts but expected 50", len(seen))
+	}
+	if moved == 0 {
+		t.Error("no post was moved")
+	}
+}
+
+func TestReplaceCropsPictureSources(t *testing.T) {
+	r := newRunner(DefaultConfig())
+	atts := []attachment{
+		{
+			fileName: "/2018/hero.jpg", ext: ".jpg",
+			crops: []crop{
+				{"400x200", 400, 200, ""},
+				{"800x400", 800, 400, ""},
+				{"1200x600", 1200, 600, ""},
+			},
+		},
+	}
+	original := `<picture>
+	<source media="(min-width: 1000px)" srcset="/2018/hero-1200x600.jpg 1200w, /2018/hero-1600x800.jpg 1600w">
+	<source media="(min-width: 600px)" srcset="/2018/hero-780x390.jpg 780w,/2018/hero-400x200.jpg 400w">
+	<img src="/2018/hero-400x200.jpg" alt="">
+</picture>`
+	desired := `<picture>
+	<source media="(min-width: 1000px)" srcset="/2018/hero-1200x600.jpg 1200w">
+	<source media="(min-width: 600px)" srcset="/2018/hero-800x400.jpg 800w,/2018/hero-400x200.jpg 400w">
+	<img src="/2018/hero-400x200.jpg" alt="">
+</picture>`
+	got := r.replaceCrops(original, atts, tolerance{35, 100})
+	if got != desired {
+		t.Errorf("got\n%v\nbut expected\n%v", got, desired)
+	}
+}
+
+func TestReplaceCropsSrcsetDuplicates(t *testing.T) {
+	r := newRunner(DefaultConfig())
+	atts := []attachment{
+		{
+			fileName: "/2018/image.jpg", ext: ".jpg",
+			crops: []crop{
+				{"300x200", 300, 200, ""},
+				{"600x400", 600, 400, ""},
+			},
+		},
+		{
+			fileName: "/2018/other.jpg", ext: ".jpg",
+			crops: []crop{
+				{"600x400", 600, 400, ""},
+			},
+		},
+	}
+	cases := []struct {
+		original string
+		desired  string
+		kinds    []replacementKind
+	}{
+		{ // The broken crop is removed after the valid one.
+			"<img srcset='/2018/image-600x400.jpg 600w, /2018/image-610x410.jpg 610w'>",
+			"<img srcset='/2018/image-600x400.jpg 600w'>",
+			[]replacementKind{kindExact, kindDuplicate},
+		},
+		{ // The broken crop is removed before the valid one.
+			"<img srcset=\"/2018/image-610x410.jpg 610w,\n\t/2018/image-600x400.jpg 600w, /2018/image-300x200.jpg 300w\">",
+			"<img srcset=\"/2018/image-600x400.jpg 600w, /2018/image-300x200.jpg 300w\">",
+			[]replacementKind{kindDuplicate, kindExact, kindExact},
+		},
+		{ // The descriptor of another image is repeated.
+			"<img srcset='/2018/other-600x400.jpg 600w, /2018/image-610x410.jpg 610w, /2018/image-300x200.jpg 300w'>",
+			"<img srcset='/2018/other-600x400.jpg 600w, /2018/image-300x200.jpg 300w'>",
+			[]replacementKind{kindExact, kindDuplicate, kindExact},
+		},
+		{ // Both broken crops become the same URL.
+			"<img srcset='/2018/image-590x390.jpg 1x, /2018/image-610x410.jpg 2x' src='/2018/image-610x410.jpg'>",
+			"<img srcset='/2018/image-600x400.jpg 1x' src='/2018/image-600x400.jpg'>",
+			[]replacementKind{kindClose, kindDuplicate, kindClose},
+		},
+		{ // Without a descriptor, a candidate is 1x.
+			"<img srcset='/2018/image-600x400.jpg, /2018/image-610x410.jpg 1x, /2018/image-300x200.jpg 2x'>",
+			"<img srcset='/2018/image-600x400.jpg, /2018/image-300x200.jpg 2x'>",
+			[]replacementKind{kindExact, kindDuplicate, kindExact},
+		},
+		{ // Repeated references already in the content are left alone.
+			"<img srcset='/2018/image-600x400.jpg 600w, /2018/image-600x400.jpg 600w'>",
+			"<img srcset='/2018/image-600x400.jpg 600w, /2018/image-600x400.jpg 600w'>",
+			[]replacementKind{kindExact, kindExact},
+		},
+	}
+	for i, tc := range cases {
+		t.Run("case_"+strconv.Itoa(i), func(t *testing.T) {
+			reps := r.findReplacements(tc.original, r.newFileIndex(atts), tolerance{35, 100})
+			if got := r.applyReplacements(tc.original, reps); got != tc.desired {
+				t.Errorf("got %q but expected %q", got, tc.desired)
+			}
+			var kinds []replacementKind
+			for j := range reps {
+				kinds = append(kinds, reps[j].kind)
+			}
+			if !reflect.DeepEqual(kinds, tc.kinds) {
+				t.Errorf("got kinds %v but expected %v", kinds, tc.kinds)
+			}
+		})
+	}
+}
+
+func TestSrcsetCandidates(t *testing.T) {
+	cases := []struct {
+		srcset string
+		want   []string
+	}{
+		{"a.jpg 300w, b.jpg 600w", []string{"a.jpg 300w", "b.jpg 600w"}},
+		{" a.jpg\t1x ,b.jpg 2x, ", []string{"a.jpg\t1x", "b.jpg 2x"}},
+		{"a.jpg,, b.jpg", []string{"a.jpg", "b.jpg"}},
+		{"a.jpg?w=1,2 2x", []string{"a.jpg?w=1,2 2x"}},
+		{"", nil},
+	}
+	for i, tc := range cases {
+		t.Run("case_"+strconv.Itoa(i), func(t *testing.T) {
+			var got []string
+			for _, c := range srcsetCandidates(tc.srcset, 0, len(tc.srcset)) {
+				got = append(got, tc.srcset[c.start:c.end])
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got %q but expected %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestWidthDescriptor(t *testing.T) {
+	cases := []struct {
+		s     string
+		width uint64
+		space string
+		ok    bool
+	}{
+		{" 300w, next.jpg 600w", 300, " ", true},
+		{"\n\t300w\"", 300, "\n\t", true},
+		{" 300w", 300, " ", true},
+		{" 300w", 30, "", false},
+		{" 3000w", 300, "", false},
+		{" 300words", 300, "", false},
+		{"300w", 300, "", false},
+		{" 2x", 300, "", false},
+		{"", 300, "", false},
+		{"?ver=3 300w, next.jpg 600w", 300, "?ver=3 ", true},
+		{"#top\t300w", 300, "#top\t", true},
+		{"?ver=3' 300w", 300, "", false},
+		{"?ver=3", 300, "", false},
+	}
+	for i, tc := range cases {
+		t.Run("case_"+strconv.Itoa(i), func(t *testing.T) {
+			space, ok := widthDescriptor(tc.s, tc.width)
+			if space != tc.space || ok != tc.ok {
+				t.Errorf("got (%q, %v) but expected (%q, %v)", space, ok, tc.space, tc.ok)
+			}
+		})
+	}
+}
+
+func TestReplaceCropsWidthTolerance(t *testing.T) {
+	r := newRunner(DefaultConfig())
+	atts := []attachment{
+		{
+			fileName: "bcd.png", ext: ".png",
+			crops: []crop{
+				{"200x180", 200, 180, ""},
+				{"400x320", 400, 320, ""},
+			},
+		},
+	}
+	cases := []struct {
+		original  string
+		tolerance float64
+		desired   string
+	}{
+		{"bcd-210x195.png", 35, "bcd-200x180.png"},
+		{"bcd-210x195.png", 5, "bcd-200x180.png"},
+		{"bcd-210x195.png", 4, "bcd.png"},
+		{"bcd-250x195.png", 35, "bcd-200x180.png"},
+		{"bcd-250x195.png", 10, "bcd.png"},
+		{"bcd-400x320.png", 0, "bcd-400x320.png"},
+		{"bcd-401x320.png", 0, "bcd.png"},
+		{"bcd-30x15.png", 100, "bcd.png"},
+	}
+	for i, tc := range cases {
+		t.Run("case_"+strconv.Itoa(i), func(t *testing.T) {
+			got := r.replaceCrops(tc.original, atts, tolerance{tc.tolerance, 100})
+			if got != tc.desired {
+				t.Errorf("got %q but expected %q", got, tc.desired)
+			}
+		})
+	}
+}
+
+func TestReplaceCropsSameBaseName(t *testing.T) {
+	r := newRunner(DefaultConfig())
+	atts := []attachment{
+		{
+			fileName: "/2018/photo.jpg", ext: ".jpg",
+			crops: []crop{
+				{"300x200", 300, 200, ""},
+			},
+		},
+		{
+			fileName: "/2018/photo.png", ext: ".png",
+			crops: []crop{
+				{"310x210", 310, 210, ""},
+			},
+		},
+	}
+	cases := []struct {
+		original  string
+		desired   string
+		ambiguous []string
+	}{
+		{"/2018/photo-300x200.jpg", "/2018/photo-300x200.jpg", nil},
+		{"/2018/photo-300x200.png", "/2018/photo-310x210.png", nil},
+		{"/2018/photo-310x210.jpg", "/2018/photo-300x200.jpg", nil},
+		{"/2018/photo-310x210.png /2018/photo-305x200.jpg", "/2018/photo-310x210.png /2018/photo-300x200.jpg", nil},
+		{"/2018/photo-300x200.webp", "/2018/photo-300x200.webp", []string{"/2018/photo-300x200.webp"}},
+		{"'/2018/photo-300x200'", "'/2018/photo-300x200'", []string{"/2018/photo-300x200"}},
+		{"/2018/photo-300x200. /2018/photo.gif", "/2018/photo-300x200. /2018/photo.gif", []string{"/2018/photo-300x200"}},
+	}
+	for i, tc := range cases {
+		t.Run("case_"+strconv.Itoa(i), func(t *testing.T) {
+			got := r.replaceCrops(tc.original, atts, tolerance{35, 100})
+			if got != tc.desired {
+				t.Errorf("got %q but expected %q", got, tc.desired)
+			}
+			ambiguous := r.ambiguousReferences(tc.original, atts)
+			if !reflect.DeepEqual(ambiguous, tc.ambiguous) {
+				t.Errorf("got ambiguous references %q but expected %q", ambiguous, tc.ambiguous)
+			}
+		})
+	}
+}
+
+func TestDimensionsLen(t *testing.T) {
+	r := newRunner(DefaultConfig())
+	cases := []struct {
+		s string
+		n int
+	}{
+		{"-600x340.jpg", 8},
+		{"-600x340", 8},
+		{"-1x2@2x.png", 4},
+		{"-600x.jpg", 0},
+		{"-x340.jpg", 0},
+		{"600x340.jpg", 0},
+		{"-600-340.jpg", 0},
+		{"", 0},
+	}
+	for i, tc := range cases {
+		t.Run("case_"+strconv.Itoa(i), func(t *testing.T) {
+			if got := r.dimensionsLen(tc.s); got != tc.n {
+				t.Errorf("got %d but expected %d", got, tc.n)
+			}
+		})
+	}
+}
+
+func TestFindSuitableCropHeightTolerance(t *testing.T) {
+	r := newRunner(DefaultConfig())
+	inPost := &crop{"500x450", 500, 450, ""}
+	haveInBucket := []crop{
+		{"510x150", 510, 150, ""}, // close in width but far too short
+		{"400x380", 400, 380, ""},
+	}
+	cases := []struct {
+		tol    tolerance
+		good   bool
+		okDiff int
+	}{
+		{tolerance{35, 100}, false, 0}, // width only
+		{tolerance{35, 35}, false, 1},
+		{tolerance{35, 10}, false, -1},
+		{tolerance{10, 35}, false, -1},
+		{tolerance{10, 100}, false, 0},
+		{tolerance{0, 0}, false, -1},
+	}
+	for i, tc := range cases {
+		t.Run("case_"+strconv.Itoa(i), func(t *testing.T) {
+			good, okDiff := r.findSuitableCrop(inPost, haveInBucket, tc.tol)
+			if good != tc.good || okDiff != tc.okDiff {
+				t.Errorf("got (%v, %v) but expected (%v, %v)", good, okDiff, tc.good, tc.okDiff)
+			}
+		})
+	}
+}
+
+func TestReplaceImageCropsDryRun(t *testing.T) {
+	r := newRunner(DefaultConfig())
+	atts := []attachment{
+		{
+			fileName: "/2018/bcd.png", ext: ".png",
+			crops: []crop{
+				{"200x180", 200, 180, ""},
+			},
+		},
+	}
+	posts := []fakePost{
+		{ID: 1, postType: "post", content: "<img src='/2018/bcd-210x195.png'>"},
+		{ID: 2, postType: "post", content: "<img src='/2018/bcd-200x180.png'>"},
+		{ID: 3, postType: "page", content: "<img src='/2018/bcd-30x15.png'>"},
+	}
+	for _, dry := range []bool{true, false} {
+		t.Run("dryrun_"+strconv.FormatBool(dry), func(t *testing.T) {
+			db, fdb := newFakeDB(t, posts...)
+			defer db.Close()
+			defer func(orig bool) { r.cfg.DryRun = orig }(r.cfg.DryRun)
+			r.cfg.DryRun = dry
+
+			st := newReport()
+			err := r.replaceImageCrops(context.Background(), sqlDB{db}, []string{"post"}, r.newFileIndex(atts), nil, nil, st)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if st.Scanned != 2 || st.Changed != 1 {
+				t.Errorf("got %d scanned and %d changed but expected 2 and 1", st.Scanned, st.Changed)
+			}
+			want := "<img src='/2018/bcd-200x180.png'>"
+			if dry {
+				want = posts[0].content
+				if len(fdb.updates) != 0 || fdb.commits != 0 || fdb.rollbacks != 1 {
+					t.Errorf("got %d updates, %d commits, and %d rollbacks but expected only one rollback",
+						len(fdb.updates), fdb.commits, fdb.rollbacks)
+				}
+			} else if len(fdb.updates) != 1 || fdb.commits != 1 {
+				t.Errorf("got %d updates and %d commits but expected one of each", len(fdb.updates), fdb.commits)
+			}
+			if got := fdb.content(1); got != want {
+				t.Errorf("got content %q but expected %q", got, want)
+			}
+			for _, p := range posts[1:] {
+				if got := fdb.content(p.ID); got != p.content {
+					t.Errorf("post %d was modified to %q", p.ID, got)
+				}
+			}
+		})
+	}
+}
+
+func TestReplaceImageCropsOversizedPackets(t *testing.T) {
+	r := newRunner(DefaultConfig())
+	atts := []attachment{
+		{fileName: "/2018/bcd.png", ext: ".png"},
+	}
+	small := "<img src='/2018/bcd-30x15.png'>"
+	big := small + strings.Repeat("x", 2000)
+	posts := []fakePost{
+		{ID: 1, postType: "post", content: small},
+		{ID: 2, postType: "post", content: big},
+	}
+	for _, skip := range []bool{true, false} {
+		t.Run("skip_"+strconv.FormatBool(skip), func(t *testing.T) {
+			db, fdb := newFakeDB(t, posts...)
+			defer db.Close()
+			fdb.maxPacket = 2048
+			defer func(orig bool) { r.cfg.SkipOversizedPackets = orig }(r.cfg.SkipOversizedPackets)
+			r.cfg.SkipOversizedPackets = skip
+
+			st := newReport()
+			err := r.replaceImageCrops(context.Background(), sqlDB{db}, []string{"post"}, r.newFileIndex(atts), nil, nil, st)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := fdb.content(1); got != "<img src='/2018/bcd.png'>" {
+				t.Errorf("got content %q for the small post", got)
+			}
+			updatedBig := strings.Replace(big, "bcd-30x15.png", "bcd.png", 1)
+			if skip {
+				if st.Oversized != 1 || fdb.content(2) != big {
+					t.Errorf("the oversized post was not skipped")
+				}
+			} else if st.Oversized != 0 || fdb.content(2) != updatedBig {
+				t.Errorf("the oversized post was skipped")
+			}
+		})
+	}
+}
+
+func TestPacketTooLarge(t *testing.T) {
+	cases := []struct {
+		size      int
+		maxPacket int64
+		tooLarge  bool
+	}{
+		{100, 0, false},
+		{100, 4 << 20, false},
+		{4<<20 - packetOverhead, 4 << 20, false},
+		{4<<20 - packetOverhead + 1, 4 << 20, true},
+		{5 << 20, 4 << 20, true},
+	}
+	for i, tc := range cases {
+		t.Run("case_"+strconv.Itoa(i), func(t *testing.T) {
+			if got := packetTooLarge(tc.size, tc.maxPacket); got != tc.tooLarge {
+				t.Errorf("got %v but expected %v", got, tc.tooLarge)
+			}
+		})
+	}
+}
+
+func TestReplaceCropsPreservesSurroundings(t *testing.T) {
+	r := newRunner(DefaultConfig())
+	atts := []attachment{
+		{
+			fileName: "/2018/bcd.png", ext: ".png",
+			crops: []crop{
+				{"200x180", 200, 180, ""},
+			},
+		},
+	}
+	const (
+		oldClose, newClose       = "/2018/bcd-210x195.png", "/2018/bcd-200x180.png"
+		oldFallback, newFallback = "/2018/bcd-30x15.png", "/2018/bcd.png"
+	)
+	cases := []string{
+		"\r\n<p>\r\n\t<img src=\"%s\">\r\n</p>\r\n",
+		"line one\nline two\r\n\t\t%s\t\r\n\r\n\n",
+		"\t \t%s \t%s\r",
+		"%s\r\n\r\n%s",
+		"\u00a0%s\u2028\ufeff<br />\v\f%s\r\r\r",
+		"<figure>\r\n\t<img\r\n\t\tsrc='%s'\r\n\t\tsrcset='%s 1x,\t%s 2x'\n\t/>\r\n</figure>",
+	}
+	for i, format := range cases {
+		t.Run("case_"+strconv.Itoa(i), func(t *testing.T) {
+			n := strings.Count(format, "%s")
+			olds := make([]interface{}, n)
+			news := make([]interface{}, n)
+			for j := 0; j < n; j++ {
+				if j%2 == 0 {
+					olds[j], news[j] = oldFallback, newFallback
+				} else {
+					olds[j], news[j] = oldClose, newClose
+				}
+			}
+			original := fmt.Sprintf(format, olds...)
+			desired := fmt.Sprintf(format, news...)
+			got := r.replaceCrops(original, atts, tolerance{35, 100})
+			if got != desired {
+				t.Fatalf("got\n\t%q\nbut expected\n\t%q", got, desired)
+			}
+			// Everything outside the URLs must be byte-for-byte identical.
+			if stripped, want := stripAll(got, newClose, newFallback), stripAll(original, oldClose, oldFallback); stripped != want {
+				t.Errorf("the text around the URLs changed from\n\t%q\nto\n\t%q", want, stripped)
+			}
+		})
+	}
+}
+
+// stripAll removes every occurrence of each of the strings from s.
+func stripAll(s string, strs ...string) string {
+	for _, str := range strs {
+		s = strings.Replace(s, str, "", -1)
+	}
+	return s
+}
+
+func TestOpenDSN(t *testing.T) {
+	r := newRunner(DefaultConfig())
+	// The fakedb driver connects to the database registered with the name it's given, so a connection is only
+	// made if the DSN is passed to it unchanged.
+	const dsn = "wpuser:secret@tcp(db.example.com:3306)/wordpress?charset=utf8mb4&collation=utf8mb4_unicode_ci"
+	fakeDBsMu.Lock()
+	fakeDBs[dsn] = &fakeDB{posts: make(map[int64]fakePost), meta: make(map[int64]fakeMeta)}
+	fakeDBsMu.Unlock()
+	defer func() {
+		fakeDBsMu.Lock()
+		delete(fakeDBs, dsn)
+		fakeDBsMu.Unlock()
+	}()
+
+	cases := []struct {
+		dsn string
+		ok  bool
+	}{
+		{dsn, true},
+		{"wpuser:secret@tcp(db.example.com:3306)", false},
+		{"wpuser:secret@tcp(db.example.com:3306)/wordpress?parseTime=maybe", false},
+	}
+	for i, tc := range cases {
+		t.Run("case_"+strconv.Itoa(i), func(t *testing.T) {
+			db, err := r.openDSN("fakedb", tc.dsn)
+			if (err == nil) != tc.ok {
+				t.Fatalf("got error %v but expected ok %v", err, tc.ok)
+			}
+			if err != nil {
+				return
+			}
+			defer db.Close()
+			if err := db.Ping(); err != nil {
+				t.Errorf("could not connect with the DSN; %v", err)
+			}
+		})
+	}
+}
+
+func TestSetPool(t *testing.T) {
+	r := newRunner(DefaultConfig())
+	r.cfg.DBMaxOpen, r.cfg.DBMaxIdle, r.cfg.DBConnLifetime = 3, 1, time.Millisecond
+
+	db, _ := newFakeDB(t)
+	defer db.Close()
+	r.setPool(db)
+	if n := db.Stats().MaxOpenConnections; n != 3 {
+		t.Errorf("got %d max open connections but expected 3", n)
+	}
+
+	ctx := context.Background()
+	conns := make([]*sql.Conn, 3)
+	for i := range conns {
+		conn, err := db.Conn(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conns[i] = conn
+	}
+	time.Sleep(5 * time.Millisecond)
+	for _, conn := range conns {
+		conn.Close()
+	}
+	st := db.Stats()
+	if st.Idle != 0 || st.MaxLifetimeClosed != 3 {
+		t.Errorf("got %d idle connections and %d closed for their lifetime but expected 0 and 3",
+			st.Idle, st.MaxLifetimeClosed)
+	}
+
+	r.cfg.DBConnLifetime = time.Hour
+	r.setPool(db)
+	for i := range conns {
+		conn, err := db.Conn(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conns[i] = conn
+	}
+	for _, conn := range conns {
+		conn.Close()
+	}
+	if st := db.Stats(); st.Idle != 1 || st.MaxIdleClosed != 2 {
+		t.Errorf("got %d idle connections and %d closed as extra idle ones but expected 1 and 2",
+			st.Idle, st.MaxIdleClosed)
+	}
+}
+
+func TestDBConfig(t *testing.T) {
+	r := newRunner(DefaultConfig())
+	cases := []struct {
+		host string
+		port int
+		dsn  string
+	}{
+		{"db.example.com", 3306, "wpuser:secret@tcp(db.example.com:3306)/wordpress"},
+		{"10.0.0.5", 25060, "wpuser:secret@tcp(10.0.0.5:25060)/wordpress"},
+		{"::1", 3307, "wpuser:secret@tcp([::1]:3307)/wordpress"},
+		{"[::1]", 3307, "wpuser:secret@tcp([::1]:3307)/wordpress"},
+		{"db.example.com:3310", 3306, "wpuser:secret@tcp(db.example.com:3310)/wordpress"},
+		{"[::1]:3310", 3306, "wpuser:secret@tcp([::1]:3310)/wordpress"},
+	}
+	for i, tc := range cases {
+		t.Run("case_"+strconv.Itoa(i), func(t *testing.T) {
+			dsn := r.dbConfig(tc.host, tc.port, "wordpress", "wpuser", "secret").FormatDSN()
+			if !strings.HasPrefix(dsn, tc.dsn) {
+				t.Errorf("got DSN %q but expected it to start with %q", dsn, tc.dsn)
+			}
+		})
+	}
+}
+
+func TestDBConfigParams(t *testing.T) {
+	r := newRunner(DefaultConfig())
+	cases := []struct {
+		charset string
+		params  map[string]string
+	}{
+		{"utf8mb4", map[string]string{"charset": "utf8mb4", "parseTime": "true"}},
+		{"latin1", map[string]string{"charset": "latin1", "parseTime": "true"}},
+		{"", map[string]string{"parseTime": "true"}},
+	}
+	for i, tc := range cases {
+		t.Run("case_"+strconv.Itoa(i), func(t *testing.T) {
+			r.cfg.DBCharset = tc.charset
+			dsn := r.dbConfig("db.example.com", 3306, "wordpress", "wpuser", "secret").FormatDSN()
+			q := strings.IndexByte(dsn, '?')
+			if q == -1 {
+				t.Fatalf("got DSN %q without parameters", dsn)
+			}
+			params := make(map[string]string)
+			for _, p := range strings.Split(dsn[q+1:], "&") {
+				kv := strings.SplitN(p, "=", 2)
+				params[kv[0]] = kv[1]
+			}
+			if !reflect.DeepEqual(params, tc.params) {
+				t.Errorf("got parameters %v but expected %v", params, tc.params)
+			}
+		})
+	}
+}
+
+func TestGetAttachmentsGUIDMismatch(t *testing.T) {
+	r := newRunner(DefaultConfig())
+	r.cfg.GUIDPrefix = "https://example.com/uploads/"
+
+	db, _ := newFakeDB(t,
+		fakePost{ID: 1, postType: "attachment", guid: "https://example.com/uploads/2018/a.jpg", mime: "image/jpeg"},
+		fakePost{ID: 2, postType: "attachment", guid: "http://old-host.example.net/files/b.jpg", mime: "image/jpeg"},
+		fakePost{ID: 3, postType: "attachment", guid: "https://example.com/uploads/2018/c.png", mime: "image/png"},
+		fakePost{ID: 4, postType: "post", content: "text"},
+	)
+	defer db.Close()
+
+	cases := []struct {
+		strict  bool
+		files   []string
+		skipped int
+		ok      bool
+	}{
+		{false, []string{"/2018/a.jpg", "/2018/c.png"}, 1, true},
+		{true, nil, 0, false},
+	}
+	for i, tc := range cases {
+		t.Run("case_"+strconv.Itoa(i), func(t *testing.T) {
+			r.cfg.StrictGUID = tc.strict
+			st := newReport()
+			atts, err := r.getAttachments(db, st)
+			if (err == nil) != tc.ok {
+				t.Errorf("got error %v", err)
+			}
+			var files []string
+			for _, att := range atts {
+				files = append(files, att.fileName)
+			}
+			if !reflect.DeepEqual(files, tc.files) {
+				t.Errorf("got attachments %q but expected %q", files, tc.files)
+			}
+			if st.Skipped != tc.skipped {
+				t.Errorf("got %d skipped but expected %d", st.Skipped, tc.skipped)
+			}
+		})
+	}
+}
+
+func TestGetAttachmentsDBError(t *testing.T) {
+	r := newRunner(DefaultConfig())
+	db, _ := newFakeDB(t, fakePost{ID: 1, postType: "attachment", guid: "https://example.com/a.jpg", mime: "image/jpeg"})
+	db.Close()
+	if atts, err := r.getAttachments(db, newReport()); err == nil {
+		t.Errorf("got attachments %+v and no error from a closed database", atts)
+	}
+}
+
+func TestGetAttachmentsMimeFilter(t *testing.T) {
+	r := newRunner(DefaultConfig())
+	r.cfg.GUIDPrefix = "https://example.com/uploads/"
+
+	db, _ := newFakeDB(t,
+		fakePost{ID: 1, postType: "attachment", guid: "https://example.com/uploads/a.jpg", mime: "image/jpeg"},
+		fakePost{ID: 2, postType: "attachment", guid: "https://example.com/uploads/b.pdf", mime: "application/pdf"},
+		fakePost{ID: 3, postType: "attachment", guid: "https://example.com/uploads/c.mp4", mime: "video/mp4"},
+		fakePost{ID: 4, postType: "attachment", guid: "https://example.com/uploads/d.svg", mime: "image/svg+xml"},
+		fakePost{ID: 5, postType: "attachment", guid: "https://example.com/uploads/e.PNG", mime: "IMAGE/PNG"},
+		fakePost{ID: 6, postType: "attachment", guid: "https://example.com/uploads/f.jpg", mime: ""},
+	)
+	defer db.Close()
+
+	cases := []struct {
+		filter  string
+		ids     []int64
+		skipped int
+	}{
+		{"image/", []int64{1, 4, 5}, 3},
+		{"image/svg", []int64{4}, 5},
+		{"video/", []int64{3}, 5},
+		{"", []int64{1, 2, 3, 4, 5, 6}, 0},
+	}
+	for i, tc := range cases {
+		t.Run("case_"+strconv.Itoa(i), func(t *testing.T) {
+			r.cfg.MimeFilter = tc.filter
+			st := newReport()
+			atts, err := r.getAttachments(db, st)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var ids []int64
+			for _, att := range atts {
+				ids = append(ids, att.ID)
+			}
+			if !reflect.DeepEqual(ids, tc.ids) {
+				t.Errorf("got attachments %v but expected %v", ids, tc.ids)
+			}
+			if st.Skipped != tc.skipped {
+				t.Errorf("got %d skipped but expected %d", st.Skipped, tc.skipped)
+			}
+		})
+	}
+}
+
+func TestGetAttachmentsBackslashes(t *testing.T) {
+	r := newRunner(DefaultConfig())
+	r.cfg.GUIDPrefix = "https://example.com/uploads/"
+
+	db, _ := newFakeDB(t,
+		fakePost{ID: 1, postType: "attachment", guid: `https://example.com/uploads/2018\photo.jpg`, mime: "image/jpeg"},
+		fakePost{ID: 2, postType: "attachment", guid: `https://example.com/uploads/2018\v1.2\photo`, mime: "image/jpeg"},
+		fakePost{ID: 3, postType: "attachment", guid: `https://example.com/uploads/2018/a\b.png`, mime: "image/png"},
+	)
+	defer db.Close()
+
+	const matched = "https://example.com/uploads"
+	want := []attachment{
+		{ID: 1, fileName: `/2018\photo.jpg`, ext: ".jpg", guidPrefix: matched},
+		{ID: 2, fileName: `/2018\v1.2\photo`, ext: `.2\photo`, guidPrefix: matched},
+		{ID: 3, fileName: `/2018/a\b.png`, ext: ".png", guidPrefix: matched},
+	}
+	if got, err := r.getAttachments(db, newReport()); err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v but expected %+v", got, want)
+	}
+
+	store := memStore{
+		`media/2018\photo.jpg`,
+		`media/2018\photo-300x200.jpg`,
+		`media/2018\photo-x\y-300x200.jpg`,
+		`media/2018/a\b.png`,
+		`media/2018/a\b-600x400.png`,
+	}
+	atts := []attachment{want[0], want[2]}
+	if err := checkStorageObjectsWithPrefix(t, r, "media", store, atts); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(atts[0].crops, []crop{{"300x200", 300, 200, ""}}) ||
+		!reflect.DeepEqual(atts[1].crops, []crop{{"600x400", 600, 400, ""}}) {
+		t.Errorf("got crops %v and %v", atts[0].crops, atts[1].crops)
+	}
+}
+
+func TestAttachmentsQuery(t *testing.T) {
+	r := newRunner(DefaultConfig())
+	r.cfg.DBPrefix = "wp_"
+
+	cases := []struct {
+		limit int
+		query string
+	}{
+		{0, "SELECT ID, guid, post_mime_type from `wp_posts` WHERE post_type = 'attachment' ORDER BY ID"},
+		{500, "SELECT ID, guid, post_mime_type from `wp_posts` WHERE post_type = 'attachment' ORDER BY ID LIMIT 500"},
+	}
+	for i, tc := range cases {
+		t.Run("case_"+strconv.Itoa(i), func(t *testing.T) {
+			if got := r.attachmentsQuery(tc.limit); got != tc.query {
+				t.Errorf("got query %q but expected %q", got, tc.query)
+			}
+		})
+	}
+}
+
+func TestReplaceCropsDupedDims(t *testing.T) {
+	r := newRunner(DefaultConfig())
+
+	atts := []attachment{
+		{
+			fileName: "/2018/photo.jpg", ext: ".jpg",
+			crops: []crop{
+				{"300x200", 300, 200, ""},
+				{"600x400", 600, 400, ""},
+			},
+		},
+	}
+	cases := []struct {
+		original string
+		fix      bool
+		desired  string
+	}{
+		{"/2018/photo-300x200-300x200.jpg", true, "/2018/photo-300x200.jpg"},
+		{"/2018/photo-300x200-300x200.jpg", false, "/2018/photo-300x200-300x200.jpg"},
+		{"/2018/photo-310x210-310x210.jpg", true, "/2018/photo-300x200.jpg"},
+		{"/2018/photo-50x50-50x50.jpg", true, "/2018/photo.jpg"},
+		{"/2018/photo-300x200-600x400.jpg", true, "/2018/photo-300x200-600x400.jpg"},
+		{"/2018/photo-300x200-300x200-300x200.jpg", true, "/2018/photo-300x200-300x200-300x200.jpg"},
+		{"/2018/photo-300x200.jpg /2018/photo-600x400-600x400.jpg", true, "/2018/photo-300x200.jpg /2018/photo-600x400.jpg"},
+		{"/2018/photo-310x210-310x210.jpg 310w", true, "/2018/photo-300x200.jpg 300w"},
+	}
+	for i, tc := range cases {
+		t.Run("case_"+strconv.Itoa(i), func(t *testing.T) {
+			r.cfg.FixDupeDims = tc.fix
+			got := r.replaceCrops(tc.original, atts, tolerance{35, 100})
+			if got != tc.desired {
+				t.Errorf("got %q but expected %q", got, tc.desired)
+			}
+		})
+	}
+}
+
+func TestParsePostTypes(t *testing.T) {
+	cases := []struct {
+		s     string
+		types []string
+		ok    bool
+	}{
+		{"post", []string{"post"}, true},
+		{"post,page", []string{"post", "page"}, true},
+		{"post, page ,product", []string{"post", "page", "product"}, true},
+		{"post,post,page", []string{"post", "page"}, true},
+		{"wp_block,my-type", []string{"wp_block", "my-type"}, true},
+		{"", nil, false},
+		{"post,", nil, false},
+		{"post,,page", nil, false},
+		{"Post", nil, false},
+		{"post'; DROP TABLE", nil, false},
+		{"abcdefghijklmnopqrstu", nil, false},
+	}
+	for i, tc := range cases {
+		t.Run("case_"+strconv.Itoa(i), func(t *testing.T) {
+			types, err := parsePostTypes(tc.s)
+			if tc.ok != (err == nil) {
+				t.Fatalf("got error %v but expected ok to be %v", err, tc.ok)
+			}
+			if !reflect.DeepEqual(types, tc.types) {
+				t.Errorf("got post types %q but expected %q", types, tc.types)
+			}
+		})
+	}
+}
+
+func TestQueryPostsTypes(t *testing.T) {
+	r := newRunner(DefaultConfig())
+	db, _ := newFakeDB(t,
+		fakePost{ID: 1, postType: "post", content: "a"},
+		fakePost{ID: 2, postType: "page", content: "b"},
+		fakePost{ID: 3, postType: "product", content: "c"},
+		fakePost{ID: 4, postType: "post", content: "d"},
+	)
+	defer db.Close()
+
+	cases := []struct {
+		types []string
+		ids   []int64
+	}{
+		{[]string{"post"}, []int64{1, 4}},
+		{[]string{"post", "product"}, []int64{1, 3, 4}},
+		{[]string{"page", "product", "post"}, []int64{1, 2, 3, 4}},
+		{[]string{"revision"}, nil},
+	}
+	for i, tc := range cases {
+		t.Run("case_"+strconv.Itoa(i), func(t *testing.T) {
+			posts, err := r.queryPosts(db, tc.types)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var ids []int64
+			for _, p := range posts {
+				ids = append(ids, p.ID)
+			}
+			if !reflect.DeepEqual(ids, tc.ids) {
+				t.Errorf("got post IDs %v but expected %v", ids, tc.ids)
+			}
+		})
+	}
+}
+
+func TestParsePostStatuses(t *testing.T) {
+	cases := []struct {
+		s        string
+		statuses []string
+		ok       bool
+	}{
+		{"publish", []string{"publish"}, true},
+		{"publish, private,publish", []string{"publish", "private"}, true},
+		{"auto-draft", []string{"auto-draft"}, true},
+		{"", nil, false},
+		{"publish,", nil, false},
+		{"Publish", nil, false},
+		{"publish') OR 1", nil, false},
+	}
+	for i, tc := range cases {
+		t.Run("case_"+strconv.Itoa(i), func(t *testing.T) {
+			statuses, err := parsePostStatuses(tc.s)
+			if tc.ok != (err == nil) {
+				t.Fatalf("got error %v but expected ok to be %v", err, tc.ok)
+			}
+			if !reflect.DeepEqual(statuses, tc.statuses) {
+				t.Errorf("got post statuses %q but expected %q", statuses, tc.statuses)
+			}
+		})
+	}
+}
+
+func TestPostsWhere(t *testing.T) {
+	r := newRunner(DefaultConfig())
+	cases := []struct {
+		qualifier string
+		types     []string
+		statuses  []string
+		where     string
+		args      []interface{}
+	}{
+		{"", []string{"post"}, nil, "post_type IN (?)", []interface{}{"post"}},
+		{
+			"", []string{"post", "page"}, []string{"publish"},
+			"post_type IN (?, ?) AND post_status IN (?)", []interface{}{"post", "page", "publish"},
+		},
+		{
+			"p.", []string{"post"}, []string{"publish", "private"},
+			"p.post_type IN (?) AND p.post_status IN (?, ?)", []interface{}{"post", "publish", "private"},
+		},
+	}
+	for i, tc := range cases {
+		t.Run("case_"+strconv.Itoa(i), func(t *testing.T) {
+			r.postStatuses = tc.statuses
+			where, args := r.postsWhere(tc.qualifier, tc.types)
+			if where != tc.where {
+				t.Errorf("got condition %q but expected %q", where, tc.where)
+			}
+			if !reflect.DeepEqual(args, tc.args) {
+				t.Errorf("got arguments %v but expected %v", args, tc.args)
+			}
+		})
+	}
+}
+
+func TestPostsWhereDate(t *testing.T) {
+	r := newRunner(DefaultConfig())
+	r.postStatuses = []string{"publish"}
+	cases := []struct {
+		since, until string
+		gmt          bool
+		where        string
+		args         []interface{}
+	}{
+		{"", "", false, "post_type IN (?) AND post_status IN (?)", []interface{}{"post", "publish"}},
+		{"", "", true, "post_type IN (?) AND post_status IN (?)", []interface{}{"post", "publish"}},
+		{
+			"2018-11-05T10:00:00+02:00", "", false,
+			"post_type IN (?) AND post_status IN (?) AND post_date >= ?",
+			[]interface{}{"post", "publish", "2018-11-05 10:00:00"},
+		},
+		{
+			"2018-11-05T10:00:00+02:00", "", true,
+			"post_type IN (?) AND post_status IN (?) AND post_date_gmt >= ?",
+			[]interface{}{"post", "publish", "2018-11-05 08:00:00"},
+		},
+		{
+			"", "2018-12-01T00:00:00Z", false,
+			"post_type IN (?) AND post_status IN (?) AND post_date <= ?",
+			[]interface{}{"post", "publish", "2018-12-01 00:00:00"},
+		},
+		{
+			"2018-11-05T10:00:00Z", "2018-12-01T00:00:00Z", true,
+			"post_type IN (?) AND post_status IN (?) AND post_date_gmt >= ? AND post_date_gmt <= ?",
+			[]interface{}{"post", "publish", "2018-11-05 10:00:00", "2018-12-01 00:00:00"},
+		},
+		// A time converted to UTC may cross into another day or year.
+		{
+			"2018-12-31T23:30:00-01:00", "2019-01-01T02:30:00+01:00", false,
+			"post_type IN (?) AND post_status IN (?) AND post_date >= ? AND post_date <= ?",
+			[]interface{}{"post", "publish", "2018-12-31 23:30:00", "2019-01-01 02:30:00"},
+		},
+		{
+			"2018-12-31T23:30:00-01:00", "2019-01-01T02:30:00+01:00", true,
+			"post_type IN (?) AND post_status IN (?) AND post_date_gmt >= ? AND post_date_gmt <= ?",
+			[]interface{}{"post", "publish", "2019-01-01 00:30:00", "2019-01-01 01:30:00"},
+		},
+	}
+	for i, tc := range cases {
+		t.Run("case_"+strconv.Itoa(i), func(t *testing.T) {
+			var err error
+			if r.dateSince, r.dateUntil, err = parseTimeRange(tc.since, tc.until); err != nil {
+				t.Fatal(err)
+			}
+			r.cfg.UseGMT = tc.gmt
+			where, args := r.postsWhere("", []string{"post"})
+			if where != tc.where {
+				t.Errorf("got condition %q but expected %q", where, tc.where)
+			}
+			if !reflect.DeepEqual(args, tc.args) {
+				t.Errorf("got arguments %v but expected %v", args, tc.args)
+			}
+		})
+	}
+}
+
+func TestPostsWhereIDs(t *testing.T) {
+	r := newRunner(DefaultConfig())
+	cases := []struct {
+		ids   string
+		where string
+		args  []interface{}
+	}{
+		{"", "p.post_type IN (?)", []interface{}{"post"}},
+		{"12", "p.post_type IN (?) AND p.ID IN (?)", []interface{}{"post", int64(12)}},
+		{"12, 7,12,300", "p.post_type IN (?) AND p.ID IN (?, ?, ?)", []interface{}{"post", int64(12), int64(7), int64(300)}},
+	}
+	for i, tc := range cases {
+		t.Run("case_"+strconv.Itoa(i), func(t *testing.T) {
+			var err error
+			if r.postIDs, err = parsePostIDs(tc.ids); err != nil {
+				t.Fatal(err)
+			}
+			where, args := r.postsWhere("p.", []string{"post"})
+			if where != tc.where {
+				t.Errorf("got condition %q but expected %q", where, tc.where)
+			}
+			if !reflect.DeepEqual(args, tc.args) {
+				t.Errorf("got arguments %v but expected %v", args, tc.args)
+			}
+		})
+	}
+}
+
+func TestParsePostIDs(t *testing.T) {
+	cases := []struct {
+		s   string
+		ids []int64
+		ok  bool
+	}{
+		{"", nil, true},
+		{"1", []int64{1}, true},
+		{"3, 1,3", []int64{3, 1}, true},
+		{"0", nil, false},
+		{"-4", nil, false},
+		{"1,", nil, false},
+		{"1,a", nil, false},
+		{"1.5", nil, false},
+	}
+	for i, tc := range cases {
+		t.Run("case_"+strconv.Itoa(i), func(t *testing.T) {
+			ids, err := parsePostIDs(tc.s)
+			if tc.ok != (err == nil) {
+				t.Fatalf("got error %v but expected ok to be %v", err, tc.ok)
+			}
+			if !reflect.DeepEqual(ids, tc.ids) {
+				t.Errorf("got IDs %v but expected %v", ids, tc.ids)
+			}
+		})
+	}
+}
+
+func TestParseTimeRange(t *testing.T) {
+	cases := []struct {
+		since, until string
+		ok           bool
+	}{
+		{"", "", true},
+		{"2018-11-05T10:00:00Z", "2018-11-05T10:00:00Z", true},
+		{"2018-11-05T10:00:00Z", "2018-11-05T11:00:00+02:00", false},
+		{"2018-11-05T10:00:00Z", "2018-11-04T10:00:00Z", false},
+		{"2018-11-05", "", false},
+		{"", "yesterday", false},
+	}
+	for i, tc := range cases {
+		t.Run("case_"+strconv.Itoa(i), func(t *testing.T) {
+			if _, _, err := parseTimeRange(tc.since, tc.until); tc.ok != (err == nil) {
+				t.Errorf("got error %v but expected ok to be %v", err, tc.ok)
+			}
+		})
+	}
+}
+
+func TestQueryPostsStatuses(t *testing.T) {
+	r := newRunner(DefaultConfig())
+	db, _ := newFakeDB(t,
+		fakePost{ID: 1, postType: "post", status: "publish", content: "a"},
+		fakePost{ID: 2, postType: "post", status: "draft", content: "b"},
+		fakePost{ID: 3, postType: "post", status: "auto-draft", content: "c"},
+		fakePost{ID: 4, postType: "revision", status: "inherit", content: "d"},
+		fakePost{ID: 5, postType: "post", status: "private", content: "e"},
+	)
+	defer db.Close()
+
+	cases := []struct {
+		statuses []string
+		ids      []int64
+	}{
+		{[]string{"publish"}, []int64{1}},
+		{[]string{"publish", "private"}, []int64{1, 5}},
+		{[]string{"inherit"}, nil},
+	}
+	for i, tc := range cases {
+		t.Run("case_"+strconv.Itoa(i), func(t *testing.T) {
+			r.postStatuses = tc.statuses
+			posts, err := r.queryPosts(db, []string{"post"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var ids []int64
+			for _, p := range posts {
+				ids = append(ids, p.ID)
+			}
+			if !reflect.DeepEqual(ids, tc.ids) {
+				t.Errorf("got post IDs %v but expected %v", ids, tc.ids)
+			}
+		})
+	}
+}
+
+func TestGetAttachmentsGUIDPrefixes(t *testing.T) {
+	r := newRunner(DefaultConfig())
+	r.cfg.GUIDPrefix = "https://example.com/uploads/, https://cdn.example.net/media/"
+
+	db, _ := newFakeDB(t,
+		fakePost{ID: 1, postType: "attachment", guid: "https://example.com/uploads/2018/a.jpg", mime: "image/jpeg"},
+		fakePost{ID: 2, postType: "attachment", guid: "https://cdn.example.net/media/2019/b.jpg", mime: "image/jpeg"},
+		fakePost{ID: 3, postType: "attachment", guid: "https://other.example.org/c.jpg", mime: "image/jpeg"},
+	)
+	defer db.Close()
+
+	st := newReport()
+	atts, err := r.getAttachments(db, st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var files, prefixes []string
+	for _, att := range atts {
+		files = append(files, att.fileName)
+		prefixes = append(prefixes, r.fileURLPrefix(&att))
+		if att.refPrefix != "" {
+			t.Errorf("got refPrefix %q for %q but expected none", att.refPrefix, att.fileName)
+		}
+	}
+	if expected := []string{"/2018/a.jpg", "/2019/b.jpg"}; !reflect.DeepEqual(files, expected) {
+		t.Errorf("got attachments %q but expected %q", files, expected)
+	}
+	wantPrefixes := []string{"https://example.com/uploads", "https://cdn.example.net/media"}
+	if !reflect.DeepEqual(prefixes, wantPrefixes) {
+		t.Errorf("got URL prefixes %q but expected %q", prefixes, wantPrefixes)
+	}
+	if st.Skipped != 1 {
+		t.Errorf("got %d skipped but expected 1", st.Skipped)
+	}
+	if prefix := r.primaryGUIDPrefix(); prefix != "https://example.com/uploads/" {
+		t.Errorf("got primary prefix %q", prefix)
+	}
+}
+
+func TestSplitGUID(t *testing.T) {
+	const (
+		guidPrefix = "https://example.com/wp-content/uploads/"
+		altPrefix  = "https://example.com/"
+	)
+	cases := []struct {
+		guid, altPrefix              string
+		fileName, matched, refPrefix string
+		ok                           bool
+	}{
+		{guidPrefix + "2018/photo.jpg", altPrefix, "/2018/photo.jpg", "https://example.com/wp-content/uploads", "",
+			true},
+		{guidPrefix + "2018/photo.jpg", "", "/2018/photo.jpg", "https://example.com/wp-content/uploads", "", true},
+		{altPrefix + "photo.jpg", altPrefix, "/photo.jpg", "", "https://example.com", true},
+		{altPrefix + "photo.jpg", "", "", "", "", false},
+		{"https://other.example.com/photo.jpg", altPrefix, "", "", "", false},
+	}
+	prefixes := []string{guidPrefix, "https://cdn.example.com/"}
+	for i, tc := range []struct{ guid, fileName, matched string }{
+		{guidPrefix + "2018/photo.jpg", "/2018/photo.jpg", "https://example.com/wp-content/uploads"},
+		{"https://cdn.example.com/2018/photo.jpg", "/2018/photo.jpg", "https://cdn.example.com"},
+	} {
+		t.Run("multiple_"+strconv.Itoa(i), func(t *testing.T) {
+			fileName, matched, refPrefix, ok := splitGUID(tc.guid, prefixes, altPrefix)
+			if fileName != tc.fileName || matched != tc.matched || refPrefix != "" || !ok {
+				t.Errorf("got (%q, %q, %q, %v) but expected (%q, %q, \"\", true)", fileName, matched, refPrefix, ok,
+					tc.fileName, tc.matched)
+			}
+		})
+	}
+	for i, tc := range cases {
+		t.Run("case_"+strconv.Itoa(i), func(t *testing.T) {
+			fileName, matched, refPrefix, ok := splitGUID(tc.guid, []string{guidPrefix}, tc.altPrefix)
+			if fileName != tc.fileName || matched != tc.matched || refPrefix != tc.refPrefix || ok != tc.ok {
+				t.Errorf("got (%q, %q, %q, %v) but expected (%q, %q, %q, %v)", fileName, matched, refPrefix, ok,
+					tc.fileName, tc.matched, tc.refPrefix, tc.ok)
+			}
+		})
+	}
+}
+
+func TestReplaceCropsLegacyGUIDs(t *testing.T) {
+	r := newRunner(DefaultConfig())
+	atts := []attachment{
+		{
+			fileName: "/2018/photo.jpg", ext: ".jpg",
+			crops: []crop{
+				{"300x200", 300, 200, ""},
+			},
+		},
+		{
+			fileName: "/photo.jpg", ext: ".jpg", refPrefix: "https://example.com",
+			crops: []crop{
+				{"600x400", 600, 400, ""},
+			},
+		},
+	}
+	cases := []struct {
+		original string
+		desired  string
+	}{
+		{"https://example.com/photo-610x410.jpg", "https://example.com/photo-600x400.jpg"},
+		{"https://example.com/photo-50x50.jpg", "https://example.com/photo.jpg"},
+		{"https://example.com/wp-content/uploads/2018/photo-310x210.jpg",
+			"https://example.com/wp-content/uploads/2018/photo-300x200.jpg"},
+		{"/2018/photo-310x210.jpg https://example.com/photo-610x410.jpg",
+			"/2018/photo-300x200.jpg https://example.com/photo-600x400.jpg"},
+		{"https://cdn.example.com/photo-610x410.jpg", "https://cdn.example.com/photo-610x410.jpg"},
+		{"http://example.com/photo-610x410.jpg", "http://example.com/photo-600x400.jpg"},
+		{"<img src=\"//example.com/photo-610x410.jpg\">", "<img src=\"//example.com/photo-600x400.jpg\">"},
+		{"HTTP://example.com/photo-610x410.jpg", "HTTP://example.com/photo-600x400.jpg"},
+	}
+	for i, tc := range cases {
+		t.Run("case_"+strconv.Itoa(i), func(t *testing.T) {
+			got := r.replaceCrops(tc.original, atts, tolerance{35, 100})
+			if got != tc.desired {
+				t.Errorf("got %q but expected %q", got, tc.desired)
+			}
+		})
+	}
+}
+
+func TestReplaceCropsSchemes(t *testing.T) {
+	r := newRunner(DefaultConfig())
+	atts := []attachment{
+		{
+			fileName: "/2018/photo.jpg", ext: ".jpg",
+			crops: []crop{
+				{"300x200", 300, 200, ""},
+			},
+		},
+	}
+	for i, url := range []string{
+		"https://example.com/wp-content/uploads/2018/photo-%s.jpg",
+		"http://example.com/wp-content/uploads/2018/photo-%s.jpg",
+		"//example.com/wp-content/uploads/2018/photo-%s.jpg",
+	} {
+		t.Run("case_"+strconv.Itoa(i), func(t *testing.T) {
+			original := "<img src='" + fmt.Sprintf(url, "310x210") + "'>"
+			desired := "<img src='" + fmt.Sprintf(url, "300x200") + "'>"
+			if got := r.replaceCrops(original, atts, tolerance{35, 100}); got != desired {
+				t.Errorf("got %q but expected %q", got, desired)
+			}
+		})
+	}
+}
+
+func TestReplaceCropsContentHost(t *testing.T) {
+	r := newRunner(DefaultConfig())
+	atts := []attachment{
+		{
+			fileName: "/photo.jpg", ext: ".jpg", refPrefix: "https://www.example.com",
+			crops: []crop{
+				{"600x400", 600, 400, ""},
+			},
+		},
+	}
+	cases := []struct {
+		host     string
+		original string
+		desired  string
+	}{
+		{"", "https://cdn.example.com/photo-610x410.jpg", "https://cdn.example.com/photo-610x410.jpg"},
+		{"cdn.example.com", "https://cdn.example.com/photo-610x410.jpg", "https://cdn.example.com/photo-600x400.jpg"},
+		{"cdn.example.com", "//cdn.example.com/photo-610x410.jpg", "//cdn.example.com/photo-600x400.jpg"},
+		{"cdn.example.com", "https://www.example.com/photo-610x410.jpg", "https://www.example.com/photo-600x400.jpg"},
+		{"cdn.example.com", "https://img.example.com/photo-610x410.jpg", "https://img.example.com/photo-610x410.jpg"},
+	}
+	for i, tc := range cases {
+		t.Run("case_"+strconv.Itoa(i), func(t *testing.T) {
+			r.cfg.ContentHost = tc.host
+			if got := r.replaceCrops(tc.original, atts, tolerance{35, 100}); got != tc.desired {
+				t.Errorf("got %q but expected %q", got, tc.desired)
+			}
+		})
+	}
+}
+
+func TestReplaceCropsPlaceholder(t *testing.T) {
+	r := newRunner(DefaultConfig())
+	r.cfg.GUIDPrefix = "https://example.com/wp-content/uploads/"
+	atts := []attachment{
+		{
+			fileName: "/2018/photo.jpg", ext: ".jpg",
+			crops: []crop{
+				{"600x400", 600, 400, ""},
+			},
+		},
+		{
+			fileName: "/old.png", ext: ".png", refPrefix: "https://www.example.com",
+		},
+	}
+	cases := []struct {
+		placeholder string
+		original    string
+		desired     string
+	}{
+		{ // Without a placeholder, the un-cropped image is used.
+			"",
+			"<img src='https://example.com/wp-content/uploads/2018/photo-150x150.jpg'>",
+			"<img src='https://example.com/wp-content/uploads/2018/photo.jpg'>",
+		},
+		{
+			"https://cdn.example.com/placeholder.png",
+			"<img src='https://example.com/wp-content/uploads/2018/photo-150x150.jpg'>",
+			"<img src='https://cdn.example.com/placeholder.png'>",
+		},
+		{ // A close crop is still used.
+			"https://cdn.example.com/placeholder.png",
+			"<img src='https://example.com/wp-content/uploads/2018/photo-610x410.jpg'>",
+			"<img src='https://example.com/wp-content/uploads/2018/photo-600x400.jpg'>",
+		},
+		{
+			"https://cdn.example.com/placeholder.png",
+			"<img src='//example.com/wp-content/uploads/2018/photo-150x150.jpg' srcset='http://example.com/wp-content/uploads/2018/photo-150x150.jpg 150w'>",
+			"<img src='https://cdn.example.com/placeholder.png' srcset='https://cdn.example.com/placeholder.png 150w'>",
+		},
+		{
+			"https://cdn.example.com/placeholder.png",
+			"<img src='https://www.example.com/old-300x200.png'>",
+			"<img src='https://cdn.example.com/placeholder.png'>",
+		},
+		{ // Without the URL prefix, the reference cannot be replaced with a URL.
+			"https://cdn.example.com/placeholder.png",
+			"<img src='/wp-content/uploads/2018/photo-150x150.jpg'>",
+			"<img src='/wp-content/uploads/2018/photo.jpg'>",
+		},
+	}
+	for i, tc := range cases {
+		t.Run("case_"+strconv.Itoa(i), func(t *testing.T) {
+			r.cfg.Placeholder = tc.placeholder
+			if got := r.replaceCrops(tc.original, atts, tolerance{35, 100}); got != tc.desired {
+				t.Errorf("got %q but expected %q", got, tc.desired)
+			}
+		})
+	}
+}
+
+func TestReplaceCropsMinReplaceWidth(t *testing.T) {
+	r := newRunner(DefaultConfig())
+	r.cfg.GUIDPrefix = "https://example.com/uploads/"
+	atts := []attachment{
+		{
+			fileName: "/2018/photo.jpg", ext: ".jpg",
+			crops: []crop{
+				{"40x40", 40, 40, ""},
+				{"300x200", 300, 200, ""},
+			},
+		},
+	}
+	cases := []struct {
+		minWidth    int
+		placeholder string
+		original    string
+		desired     string
+	}{
+		{0, "", "/2018/photo-10x10.jpg /2018/photo-600x400.jpg", "/2018/photo.jpg /2018/photo.jpg"},
+		{50, "", "/2018/photo-10x10.jpg /2018/photo-600x400.jpg", "/2018/photo-10x10.jpg /2018/photo.jpg"},
+		{50, "", "/2018/photo-42x42.jpg /2018/photo-310x210.jpg", "/2018/photo-40x40.jpg /2018/photo-300x200.jpg"},
+		{ // A narrow crop is left alone rather than replaced with the placeholder.
+			50, "https://example.com/blank.gif",
+			"https://example.com/uploads/2018/photo-10x10.jpg https://example.com/uploads/2018/photo-600x400.jpg",
+			"https://example.com/uploads/2018/photo-10x10.jpg https://example.com/blank.gif",
+		},
+	}
+	for i, tc := range cases {
+		t.Run("case_"+strconv.Itoa(i), func(t *testing.T) {
+			r.cfg.MinReplaceWidth = tc.minWidth
+			r.cfg.Placeholder = tc.placeholder
+			if got := r.replaceCrops(tc.original, atts, tolerance{35, 100}); got != tc.desired {
+				t.Errorf("got %q but expected %q", got, tc.desired)
+			}
+		})
+	}
+}
+
+func TestReplaceCropsNoFallback(t *testing.T) {
+	r := newRunner(DefaultConfig())
+	r.cfg.GUIDPrefix = "https://example.com/uploads/"
+	atts := []attachment{
+		{
+			fileName: "/2018/photo.jpg", ext: ".jpg",
+			crops: []crop{
+				{"300x200", 300, 200, ""},
+			},
+		},
+	}
+	cases := []struct {
+		noFallback  bool
+		placeholder string
+		original    string
+		desired     string
+	}{
+		{false, "", "/2018/photo-10x10.jpg /2018/photo-310x210.jpg", "/2018/photo.jpg /2018/photo-300x200.jpg"},
+		{true, "", "/2018/photo-10x10.jpg /2018/photo-310x210.jpg", "/2018/photo-10x10.jpg /2018/photo-300x200.jpg"},
+		{
+			false, "https://example.com/blank.gif",
+			"https://example.com/uploads/2018/photo-10x10.jpg",
+			"https://example.com/blank.gif",
+		},
+		{
+			true, "https://example.com/blank.gif",
+			"https://example.com/uploads/2018/photo-10x10.jpg",
+			"https://example.com/uploads/2018/photo-10x10.jpg",
+		},
+	}
+	for i, tc := range cases {
+		t.Run("case_"+strconv.Itoa(i), func(t *testing.T) {
+			r.cfg.NoFallback = tc.noFallback
+			r.cfg.Placeholder = tc.placeholder
+			got, n := r.replaceCropsCount(tc.original, atts, tolerance{35, 100})
+			if got != tc.desired {
+				t.Errorf("got %q but expected %q", got, tc.desired)
+			}
+			if changed := got != tc.original; changed != (n > 0) {
+				t.Errorf("got %d changes for %q", n, got)
+			}
+		})
+	}
+}
+
+func TestReplaceCropsCanonical(t *testing.T) {
+	r := newRunner(DefaultConfig())
+	atts := []attachment{
+		{
+			fileName: "/2018/photo.jpg", ext: ".jpg",
+			crops: []crop{
+				{"150x150", 150, 150, ""},
+				{"300x200", 300, 200, ""},
+				{"600x400", 600, 400, ""},
+				{"300x200", 300, 200, ".webp"},
+			},
+		},
+		{
+			fileName: "/2018/other.jpg", ext: ".jpg",
+			crops: []crop{
+				{"150x150", 150, 150, ""},
+			},
+		},
+	}
+	cases := []struct {
+		canonical string
+		original  string
+		desired   string
+	}{
+		{"", "/2018/photo-600x400.jpg /2018/photo-150x150.jpg", "/2018/photo-600x400.jpg /2018/photo-150x150.jpg"},
+		{"300x200", "/2018/photo-600x400.jpg /2018/photo-150x150.jpg", "/2018/photo-300x200.jpg /2018/photo-300x200.jpg"},
+		{"300x200", "/2018/photo-300x200.jpg", "/2018/photo-300x200.jpg"},
+		{"300x200", "/2018/photo-1000x900.jpg", "/2018/photo-300x200.jpg"},
+		{"300x200", "/2018/photo-600x400.jpg.webp", "/2018/photo-300x200.jpg.webp"},
+		{"300x200", "/2018/photo-600x400@2x.jpg", "/2018/photo-300x200.jpg"},
+		{"300x200", "/2018/other-150x150.jpg /2018/other-155x150.jpg", "/2018/other-150x150.jpg /2018/other-150x150.jpg"},
+		{"800x600", "/2018/photo-600x400.jpg", "/2018/photo-600x400.jpg"},
+		{
+			"300x200",
+			`<img srcset="/2018/photo-600x400.jpg 600w, /2018/photo-150x150.jpg 150w">`,
+			`<img srcset="/2018/photo-300x200.jpg 300w">`,
+		},
+	}
+	for i, tc := range cases {
+		t.Run("case_"+strconv.Itoa(i), func(t *testing.T) {
+			r.canonicalCrop = nil
+			if tc.canonical != "" {
+				var err error
+				if r.canonicalCrop, err = parseDimensions(tc.canonical); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if got := r.replaceCrops(tc.original, atts, tolerance{35, 100}); got != tc.desired {
+				t.Errorf("got %q but expected %q", got, tc.desired)
+			}
+		})
+	}
+}
+
+func TestFindLookalikes(t *testing.T) {
+	r := newRunner(DefaultConfig())
+	atts := []attachment{
+		{fileName: "/2018/photo.jpg", ext: ".jpg"},
+		{fileName: "/2018/photo-1920x1080.jpg", ext: ".jpg"},
+		{fileName: "/2018/photo-1920x1080-600x340.jpg", ext: ".jpg"},
+		{fileName: "/2018/photo.png", ext: ".png"},
+		{fileName: "/2018/photo-big.jpg", ext: ".jpg"},
+		{fileName: "/2018/photo-1920x1080x2.jpg", ext: ".jpg"},
+		{fileName: "/2019/photo-1920x1080.jpg", ext: ".jpg"},
+		{fileName: "/1920x1080.jpg", ext: ".jpg"},
+	}
+	r.findLookalikes(atts)
+	want := [][]string{
+		{"/2018/photo-1920x1080.jpg"},
+		{"/2018/photo-1920x1080-600x340.jpg"},
+		nil,
+		{"/2018/photo-1920x1080.jpg"},
+		nil,
+		nil,
+		nil,
+		nil,
+	}
+	for i := range atts {
+		if !reflect.DeepEqual(atts[i].lookalikes, want[i]) {
+			t.Errorf("got lookalikes %q for %s; expected %q", atts[i].lookalikes, atts[i].fileName, want[i])
+		}
+	}
+}
+
+func TestReplaceCropsLookalikes(t *testing.T) {
+	r := newRunner(DefaultConfig())
+	atts := []attachment{
+		{
+			fileName: "/2018/photo.jpg", ext: ".jpg",
+			crops: []crop{
+				{"600x340", 600, 340, ""},
+			},
+		},
+		{
+			fileName: "/2018/photo-1920x1080.jpg", ext: ".jpg",
+			crops: []crop{
+				{"600x340", 600, 340, ""},
+			},
+		},
+	}
+	r.findLookalikes(atts)
+	cases := []struct {
+		original string
+		desired  string
+	}{
+		{"/2018/photo-1920x1080.jpg", "/2018/photo-1920x1080.jpg"},
+		{"/2018/photo-1920x1080-600x340.jpg", "/2018/photo-1920x1080-600x340.jpg"},
+		{"/2018/photo-1920x1080-610x340.jpg", "/2018/photo-1920x1080-600x340.jpg"},
+		{"/2018/photo-1920x1080-100x100.jpg", "/2018/photo-1920x1080.jpg"},
+		{"/2018/photo-1900x1000.jpg", "/2018/photo.jpg"},
+		{"/2018/photo-610x340.jpg /2018/photo-1920x1080.jpg", "/2018/photo-600x340.jpg /2018/photo-1920x1080.jpg"},
+	}
+	for i, tc := range cases {
+		t.Run("case_"+strconv.Itoa(i), func(t *testing.T) {
+			if got := r.replaceCrops(tc.original, atts, tolerance{35, 100}); got != tc.desired {
+				t.Errorf("got %q but expected %q", got, tc.desired)
+			}
+		})
+	}
+}
+
+func TestParseDimensions(t *testing.T) {
+	cases := []struct {
+		s             string
+		width, height uint64
+		ok            bool
+	}{
+		{"300x200", 300, 200, true},
+		{"1x1", 1, 1, true},
+		{"300", 0, 0, false},
+		{"x200", 0, 0, false},
+		{"300x", 0, 0, false},
+		{"0x200", 0, 0, false},
+		{"300x200@2x", 0, 0, false},
+		{"-300x200", 0, 0, false},
+	}
+	for i, tc := range cases {
+		t.Run("case_"+strconv.Itoa(i), func(t *testing.T) {
+			c, err := parseDimensions(tc.s)
+			if tc.ok != (err == nil) {
+				t.Fatalf("got error %v but expected ok to be %v", err, tc.ok)
+			}
+			if err == nil && (c.width != tc.width || c.height != tc.height) {
+				t.Errorf("got %dx%d; expected %dx%d", c.width, c.height, tc.width, tc.height)
+			}
+		})
+	}
+}
+
+func TestReplaceContentSingleDecisions(t *testing.T) {
+	r := newRunner(DefaultConfig())
+	r.cfg.MinReplaceWidth = 50
+	file := &attachment{
+		fileName: "/2018/photo.jpg", ext: ".jpg",
+		crops: []crop{
+			{"300x200", 300, 200, ""},
+			{"600x400", 600, 400, ""},
+		},
+	}
+	content := "<img src='/2018/photo-300x200.jpg'> <img src='/2018/photo-310x210.jpg'> " +
+		"<img src='/2018/photo-1024x768.jpg'> <img src='/2018/photo-20x20.jpg'> " +
+		"<img srcset='/2018/photo-600x400.jpg 600w, /2018/photo-590x390.jpg 590w'>"
+	type decision struct {
+		kind      replacementKind
+		old, new  string
+		requested string
+		chosen    int
+	}
+	want := []decision{
+		{kindExact, "/2018/photo-300x200.jpg", "/2018/photo-300x200.jpg", "300x200", 0},
+		{kindClose, "/2018/photo-310x210.jpg", "/2018/photo-300x200.jpg", "310x210", 0},
+		{kindFallback, "/2018/photo-1024x768.jpg", "/2018/photo.jpg", "1024x768", -1},
+		{kindNarrow, "/2018/photo-20x20.jpg", "/2018/photo-20x20.jpg", "20x20", -1},
+		{kindExact, "/2018/photo-600x400.jpg", "/2018/photo-600x400.jpg", "600x400", 1},
+		{kindDuplicate, ", /2018/photo-590x390.jpg 590w", "", "590x390", 1},
+	}
+	reps := r.replaceContentSingle(content, file, tolerance{35, 100})
+	got := make([]decision, len(reps))
+	for i := range reps {
+		rep := &reps[i]
+		got[i] = decision{rep.kind, rep.old + rep.oldSuffix, rep.new + rep.newSuffix, rep.requested.str, rep.chosen}
+		if rep.file != file {
+			t.Errorf("replacement %d is for the attachment %v", i, rep.file)
+		}
+		if !strings.HasPrefix(content[rep.start:], rep.old) {
+			t.Errorf("replacement %d does not start at %q in the content", i, rep.old)
+		}
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got decisions\n%v\nbut expected\n%v", got, want)
+	}
+}
+
+func TestReplaceHost(t *testing.T) {
+	cases := []struct {
+		prefix, want string
+	}{
+		{"https://www.example.com/wp-content/uploads", "https://cdn.example.com/wp-content/uploads"},
+		{"https://www.example.com", "https://cdn.example.com"},
+		{"//www.example.com/uploads", "//cdn.example.com/uploads"},
+		{"/wp-content/uploads", ""},
+	}
+	for i, tc := range cases {
+		t.Run("case_"+strconv.Itoa(i), func(t *testing.T) {
+			if got := replaceHost(tc.prefix, "cdn.example.com"); got != tc.want {
+				t.Errorf("got %q but expected %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestURLPrefixBefore(t *testing.T) {
+	cases := []struct {
+		before, prefix string
+		n              int
+	}{
+		{"src='https://example.com", "https://example.com", 19},
+		{"src='http://example.com", "https://example.com", 18},
+		{"src='//example.com", "https://example.com", 13},
+		{"src='HTTPS://example.com", "http://example.com", 19},
+		{"src='https://cdn.example.com", "https://example.com", -1},
+		{"src='//example.com", "ftp://example.com", -1},
+		{"src='", "", 0},
+		{"src='/2018", "https://example.com", -1},
+	}
+	for i, tc := range cases {
+		t.Run("case_"+strconv.Itoa(i), func(t *testing.T) {
+			if n := urlPrefixBefore(tc.before, tc.prefix); n != tc.n {
+				t.Errorf("got %d but expected %d", n, tc.n)
+			}
+		})
+	}
+}
+
+func TestValidatePostType(t *testing.T) {
+	cases := []struct {
+		postType string
+		ok       bool
+	}{
+		{"post", true},
+		{"page", true},
+		{"product", true},
+		{"portfolio", true},
+		{"wp_block", true},
+		{"my-type2", true},
+		{"abcdefghijklmnopqrst", true},
+		{"abcdefghijklmnopqrstu", false},
+		{"", false},
+		{"Product", false},
+		{"my type", false},
+		{"post,page", false},
+		{"café", false},
+	}
+	for i, tc := range cases {
+		t.Run("case_"+strconv.Itoa(i), func(t *testing.T) {
+			if err := validatePostType(tc.postType); tc.ok != (err == nil) {
+				t.Errorf("got error %v for %q but expected ok to be %v", err, tc.postType, tc.ok)
+			}
+		})
+	}
+}
+
+func TestQueryPostsContentLike(t *testing.T) {
+	r := newRunner(DefaultConfig())
+	db, fdb := newFakeDB(t,
+		fakePost{ID: 1, postType: "post", content: "<img src='/2018/bcd-210x195.png'>"},
+		fakePost{ID: 2, postType: "post", content: "just text"},
+		fakePost{ID: 3, postType: "post", content: "<img src='/2018/bcd.png'>"},
+	)
+	defer db.Close()
+
+	cases := []struct {
+		pattern string
+		ids     []int64
+	}{
+		{"", []int64{1, 2, 3}},
+		{"%-___x___.%", []int64{1}},
+		{"%<img%", []int64{1, 3}},
+	}
+	for i, tc := range cases {
+		t.Run("case_"+strconv.Itoa(i), func(t *testing.T) {
+			r.cfg.ContentLike = tc.pattern
+			fdb.queries = nil
+			posts, err := r.queryPosts(db, []string{"post"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var ids []int64
+			for _, p := range posts {
+				ids = append(ids, p.ID)
+			}
+			if !reflect.DeepEqual(ids, tc.ids) {
+				t.Errorf("got post IDs %v but expected %v", ids, tc.ids)
+			}
+			for _, q := range fdb.queries {
+				hasClause := strings.Contains(q.query, "post_content LIKE ?")
+				if hasClause != (tc.pattern != "") {
+					t.Errorf("got query %q with the pattern %q", q.query, tc.pattern)
+				}
+				if tc.pattern != "" && q.args[len(q.args)-1] != tc.pattern {
+					t.Errorf("got query arguments %v but expected the pattern to be bound last", q.args)
+				}
+			}
+		})
+	}
+}
+
+func TestQueryPostsContentLikeExtraColumns(t *testing.T) {
+	r := newRunner(DefaultConfig())
+	db, fdb := newFakeDB(t,
+		fakePost{ID: 1, postType: "post", content: "just text", extra: map[string]string{"post_excerpt": "no crops"}},
+		fakePost{ID: 2, postType: "post", content: "just text",
+			extra: map[string]string{"post_excerpt": "<img src='/2018/bcd-210x195.png'>"}},
+		fakePost{ID: 3, postType: "post", content: "<img src='/2018/bcd-210x195.png'>"},
+	)
+	defer db.Close()
+	r.cfg.ContentLike = "%-___x___.%"
+	r.postColumns = []string{"post_excerpt"}
+
+	posts, err := r.queryPosts(db, []string{"post"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []int64
+	for _, p := range posts {
+		ids = append(ids, p.ID)
+	}
+	if want := []int64{2, 3}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("got post IDs %v but expected %v", ids, want)
+	}
+	for _, q := range fdb.queries {
+		if !strings.Contains(q.query, "(post_content LIKE ? OR post_excerpt LIKE ?)") {
+			t.Errorf("got query %q without the pattern matched against both columns", q.query)
+		}
+	}
+}
+
+func TestReplaceCropsExtraVariants(t *testing.T) {
+	r := newRunner(DefaultConfig())
+	r.variantExts = []string{".webp"}
+
+	atts := []attachment{
+		{
+			fileName: "/2018/photo.jpg", ext: ".jpg",
+			crops: []crop{
+				{"600x340", 600, 340, ""},
+				{"300x170", 300, 170, ".webp"},
+				{"620x350", 620, 350, ".jpg.webp"},
+			},
+		},
+	}
+	cases := []struct {
+		original string
+		desired  string
+	}{
+		{"/2018/photo-600x340.jpg", "/2018/photo-600x340.jpg"},
+		{"/2018/photo-610x345.jpg", "/2018/photo-600x340.jpg"},
+		{"/2018/photo-300x170.webp", "/2018/photo-300x170.webp"},
+		{"/2018/photo-310x175.webp", "/2018/photo-300x170.webp"},
+		{"/2018/photo-610x345.jpg.webp", "/2018/photo-620x350.jpg.webp"},
+		{"/2018/photo-300x170.jpg", "/2018/photo.jpg"},
+		{"/2018/photo-30x17.webp", "/2018/photo.jpg"},
+		{"/2018/photo-300x170.avif", "/2018/photo-300x170.avif"},
+	}
+	for i, tc := range cases {
+		t.Run("case_"+strconv.Itoa(i), func(t *testing.T) {
+			got := r.replaceCrops(tc.original, atts, tolerance{35, 100})
+			if got != tc.desired {
+				t.Errorf("got %q but expected %q", got, tc.desired)
+			}
+		})
+	}
+}
+
+func TestReplaceCropsMixedCase(t *testing.T) {
+	r := newRunner(DefaultConfig())
+	atts := []attachment{
+		{
+			fileName: "/2018/photo.JPG", ext: ".JPG",
+			crops: []crop{
+				{"600x340", 600, 340, ".jpg"},
+				{"300x170", 300, 170, ""},
+			},
+		},
+		{
+			fileName: "/2018/image.png", ext: ".png",
+			crops: []crop{{"600x340", 600, 340, ""}},
+		},
+	}
+	cases := []struct {
+		original string
+		desired  string
+	}{
+		{"/2018/photo-600x340.jpg", "/2018/photo-600x340.jpg"},
+		{"/2018/photo-600x340.JPG", "/2018/photo-600x340.jpg"},
+		{"/2018/photo-610x345.JPG", "/2018/photo-600x340.jpg"},
+		{"/2018/photo-300x170.JPG", "/2018/photo-300x170.JPG"},
+		{"/2018/photo-310x175.jpg", "/2018/photo-300x170.JPG"},
+		{"/2018/photo-30x17.jpg", "/2018/photo.JPG"},
+		{"/2018/image-600x340.PNG", "/2018/image-600x340.png"},
+		{"/2018/image-610x345.Png", "/2018/image-600x340.png"},
+	}
+	for i, tc := range cases {
+		t.Run("case_"+strconv.Itoa(i), func(t *testing.T) {
+			got := r.replaceCrops(tc.original, atts, tolerance{35, 100})
+			if got != tc.desired {
+				t.Errorf("got %q but expected %q", got, tc.desired)
+			}
+		})
+	}
+}
+
+func TestReplaceCropsShortcodes(t *testing.T) {
+	r := newRunner(DefaultConfig())
+	atts := []attachment{
+		{
+			fileName: "/2018/photo.jpg", ext: ".jpg",
+			crops: []crop{
+				{"300x200", 300, 200, ""},
+			},
+		},
+	}
+	cases := []struct {
+		original string
+		desired  string
+	}{
+		{
+			`[caption id="attachment_5" align="alignnone" width="310"]<img src="https://ex.com/2018/photo-310x205.jpg" ` +
+				`width="310" height="205" /> A caption[/caption]`,
+			`[caption id="attachment_5" align="alignnone" width="310"]<img src="https://ex.com/2018/photo-300x200.jpg" ` +
+				`width="310" height="205" /> A caption[/caption]`,
+		},
+		{
+			`[caption]<img src='/2018/photo-30x20.jpg'>[/caption]`,
+			`[caption]<img src='/2018/photo.jpg'>[/caption]`,
+		},
+		{
+			`[video poster="https://ex.com/2018/photo-310x205.jpg" src="movie.mp4"][/video]`,
+			`[video poster="https://ex.com/2018/photo-300x200.jpg" src="movie.mp4"][/video]`,
+		},
+		{
+			`[audio poster='https://ex.com/2018/photo-310x205.jpg']`,
+			`[audio poster='https://ex.com/2018/photo-300x200.jpg']`,
+		},
+		{
+			`[gallery ids="5,6" link="file"] [caption][/caption]`,
+			`[gallery ids="5,6" link="file"] [caption][/caption]`,
+		},
+	}
+	for i, tc := range cases {
+		t.Run("case_"+strconv.Itoa(i), func(t *testing.T) {
+			got := r.replaceCrops(tc.original, atts, tolerance{35, 100})
+			if got != tc.desired {
+				t.Errorf("got %q but expected %q", got, tc.desired)
+			}
+		})
+	}
+}
+
+func TestReplaceCropsQueryStrings(t *testing.T) {
+	r := newRunner(DefaultConfig())
+	atts := []attachment{
+		{
+			fileName: "/2018/image.png", ext: ".png",
+			crops: []crop{
+				{"600x340", 600, 340, ""},
+			},
+		},
+	}
+	cases := []struct {
+		original string
+		desired  string
+	}{
+		{"/2018/image-600x340.png?ver=3", "/2018/image-600x340.png?ver=3"},
+		{"/2018/image-610x345.png?ver=3", "/2018/image-600x340.png?ver=3"},
+		{"/2018/image-610x345.png#top", "/2018/image-600x340.png#top"},
+		{"/2018/image-610x345.png?ver=3&w=1#top", "/2018/image-600x340.png?ver=3&w=1#top"},
+		{"/2018/image-60x34.png?ver=3", "/2018/image.png?ver=3"},
+		{"/2018/image-60x34.png#x 60w", "/2018/image.png#x 60w"},
+		{
+			"<img srcset='/2018/image-610x345.png?v=2 610w, /2018/image-60x34.png?v=2 60w'>",
+			"<img srcset='/2018/image-600x340.png?v=2 600w, /2018/image.png?v=2 60w'>",
+		},
+	}
+	for i, tc := range cases {
+		t.Run("case_"+strconv.Itoa(i), func(t *testing.T) {
+			got := r.replaceCrops(tc.original, atts, tolerance{35, 100})
+			if got != tc.desired {
+				t.Errorf("got %q but expected %q", got, tc.desired)
+			}
+		})
+	}
+}
+
+func TestParseExtensions(t *testing.T) {
+	cases := []struct {
+		s    string
+		exts []string
+		ok   bool
+	}{
+		{"", nil, true},
+		{".webp", []string{".webp"}, true},
+		{"webp, .avif", []string{".webp", ".avif"}, true},
+		{".webp,.webp", []string{".webp"}, true},
+		{".webp,", nil, false},
+		{".jpg.webp", nil, false},
+	}
+	for i, tc := range cases {
+		t.Run("case_"+strconv.Itoa(i), func(t *testing.T) {
+			exts, err := parseExtensions(tc.s)
+			if tc.ok != (err == nil) {
+				t.Fatalf("got error %v but expected ok to be %v", err, tc.ok)
+			}
+			if !reflect.DeepEqual(exts, tc.exts) {
+				t.Errorf("got extensions %q but expected %q", exts, tc.exts)
+			}
+		})
+	}
+}
+
+func TestReplaceCropsZeroPadded(t *testing.T) {
+	r := newRunner(DefaultConfig())
+	atts := []attachment{
+		{
+			fileName: "/2018/photo.jpg", ext: ".jpg",
+			crops: []crop{
+				{"300x200", 300, 200, ""},
+				{"0600x0400", 600, 400, ""},
+			},
+		},
+	}
+	cases := []struct {
+		original string
+		desired  string
+	}{
+		{"/2018/photo-300x200.jpg", "/2018/photo-300x200.jpg"},
+		{"/2018/photo-0300x0200.jpg", "/2018/photo-300x200.jpg"},
+		{"/2018/photo-00300x200.jpg", "/2018/photo-300x200.jpg"},
+		{"/2018/photo-0310x0210.jpg", "/2018/photo-300x200.jpg"},
+		{"/2018/photo-600x400.jpg", "/2018/photo-0600x0400.jpg"},
+		{"/2018/photo-0600x0400.jpg", "/2018/photo-0600x0400.jpg"},
+		{"/2018/photo-0300x0200.jpg 300w", "/2018/photo-300x200.jpg 300w"},
+	}
+	for i, tc := range cases {
+		t.Run("case_"+strconv.Itoa(i), func(t *testing.T) {
+			got := r.replaceCrops(tc.original, atts, tolerance{35, 100})
+			if got != tc.desired {
+				t.Errorf("got %q but expected %q", got, tc.desired)
+			}
+		})
+	}
+}
+
+func TestCropIndex(t *testing.T) {
+	crops := []crop{
+		{"0300x0200", 300, 200, ""},
+		{"300x200", 300, 200, ""},
+		{"600x400", 600, 400, ""},
+	}
+	cases := []struct {
+		c    crop
+		indx int
+	}{
+		{crop{"300x200", 300, 200, ""}, 1},
+		{crop{"0300x0200", 300, 200, ""}, 0},
+		{crop{"00300x200", 300, 200, ""}, 0},
+		{crop{"0600x400", 600, 400, ""}, 2},
+		{crop{"100x100", 100, 100, ""}, -1},
+	}
+	for i, tc := range cases {
+		t.Run("case_"+strconv.Itoa(i), func(t *testing.T) {
+			if got := cropIndex(crops, &tc.c); got != tc.indx {
+				t.Errorf("got index %d but expected %d", got, tc.indx)
+			}
+		})
+	}
+}
+
+func TestReplaceCropsDensity(t *testing.T) {
+	r := newRunner(DefaultConfig())
+	atts := []attachment{
+		{
+			fileName: "/2018/photo.jpg", ext: ".jpg",
+			crops: []crop{
+				{"600x340", 600, 340, ""},
+				{"600x340@2x", 600, 340, ""},
+				{"300x170@2x", 300, 170, ""},
+			},
+		},
+		{
+			fileName: "/2018/icon.png", ext: ".png",
+			crops: []crop{
+				{"600x340", 600, 340, ""},
+			},
+		},
+	}
+	cases := []struct {
+		original string
+		desired  string
+	}{
+		{"/2018/photo-600x340@2x.jpg", "/2018/photo-600x340@2x.jpg"},
+		{"/2018/photo-600x340.jpg", "/2018/photo-600x340.jpg"},
+		{"/2018/photo-610x345@2x.jpg", "/2018/photo-600x340@2x.jpg"},
+		{"/2018/photo-310x175@2x.jpg", "/2018/photo-300x170@2x.jpg"},
+		{"/2018/photo-310x175.jpg", "/2018/photo-300x170@2x.jpg"},
+		{"/2018/photo-610x345@3x.jpg", "/2018/photo-600x340.jpg"},
+		{"/2018/photo-50x50@2x.jpg", "/2018/photo.jpg"},
+		{"/2018/icon-600x340@3x.png", "/2018/icon-600x340.png"},
+	}
+	for i, tc := range cases {
+		t.Run("case_"+strconv.Itoa(i), func(t *testing.T) {
+			got := r.replaceCrops(tc.original, atts, tolerance{35, 100})
+			if got != tc.desired {
+				t.Errorf("got %q but expected %q", got, tc.desired)
+			}
+		})
+	}
+}
+
+func TestReplaceImageCropsCancelled(t *testing.T) {
+	r := newRunner(DefaultConfig())
+	atts := []attachment{
+		{
+			fileName: "/2018/bcd.png", ext: ".png",
+			crops: []crop{
+				{"200x180", 200, 180, ""},
+			},
+		},
+	}
+	const broken = "<img src='/2018/bcd-210x195.png'>"
+	db, fdb := newFakeDB(t, fakePost{ID: 1, postType: "post", content: broken})
+	defer db.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := r.replaceImageCrops(ctx, sqlDB{db}, []string{"post"}, r.newFileIndex(atts), nil, nil, newReport())
+	if err != context.Canceled {
+		t.Fatalf("got error %v but expected %v", err, context.Canceled)
+	}
+	if got := fdb.content(1); got != broken {
+		t.Errorf("got content %q but expected it unchanged", got)
+	}
+	if fdb.commits != 0 || fdb.rollbacks != 1 || len(fdb.updates) != 0 {
+		t.Errorf("got %d commits, %d rollbacks, and %d updates but expected 0, 1, and 0",
+			fdb.commits, fdb.rollbacks, len(fdb.updates))
+	}
+}
+
+func TestDBPassword(t *testing.T) {
+	dir, err := ioutil.TempDir("", "crop-replace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	passFile := filepath.Join(dir, "pass")
+	if err := ioutil.WriteFile(passFile, []byte("from-file\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	crlfFile := filepath.Join(dir, "pass-crlf")
+	if err := ioutil.WriteFile(crlfFile, []byte("from-file\r\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if orig, ok := os.LookupEnv(dbPassEnv); ok {
+		defer os.Setenv(dbPassEnv, orig)
+	} else {
+		defer os.Unsetenv(dbPassEnv)
+	}
+
+	cases := []struct {
+		pass, passFile, env string
+		want                string
+		ok                  bool
+	}{
+		{"from-flag", passFile, "from-env", "from-flag", true},
+		{"", passFile, "from-env", "from-file", true},
+		{"", crlfFile, "", "from-file", true},
+		{"", "", "from-env", "from-env", true},
+		{"", "", "", "", true},
+		{"from-flag", filepath.Join(dir, "missing"), "", "from-flag", true},
+		{"", filepath.Join(dir, "missing"), "from-env", "", false},
+	}
+	for i, tc := range cases {
+		t.Run("case_"+strconv.Itoa(i), func(t *testing.T) {
+			os.Setenv(dbPassEnv, tc.env)
+			got, err := dbPassword(tc.pass, tc.passFile)
+			if tc.ok != (err == nil) {
+				t.Fatalf("got error %v but expected ok to be %v", err, tc.ok)
+			}
+			if got != tc.want {
+				t.Errorf("got %q; expected %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestReplaceImageCropsMaxChanges(t *testing.T) {
+	r := newRunner(DefaultConfig())
+	atts := []attachment{
+		{
+			fileName: "/2018/bcd.png", ext: ".png",
+			crops: []crop{
+				{"200x180", 200, 180, ""},
+			},
+		},
+	}
+	const (
+		broken = "<img src='/2018/bcd-210x195.png'>"
+		fixed  = "<img src='/2018/bcd-200x180.png'>"
+	)
+	cases := []struct {
+		maxChanges int
+		scanMeta   bool
+		ok         bool
+	}{
+		{0, false, true},
+		{3, false, true},
+		{100, true, true},
+		{2, false, false},
+		{1, false, false},
+		{3, true, false},
+		{4, true, true},
+	}
+	for i, tc := range cases {
+		t.Run("case_"+strconv.Itoa(i), func(t *testing.T) {
+			r.cfg.MaxChanges = tc.maxChanges
+			r.cfg.ScanMeta = tc.scanMeta
+			db, fdb := newFakeDB(t,
+				fakePost{ID: 1, postType: "post", content: broken},
+				fakePost{ID: 2, postType: "post", content: broken},
+				fakePost{ID: 3, postType: "post", content: broken},
+			)
+			defer db.Close()
+			fdb.addMeta(fakeMeta{ID: 1, postID: 1, value: broken})
+
+			err := r.replaceImageCrops(context.Background(), sqlDB{db}, []string{"post"}, r.newFileIndex(atts), nil, nil,
+				newReport())
+			if tc.ok != (err == nil) {
+				t.Fatalf("got error %v but expected ok to be %v", err, tc.ok)
+			}
+			want := fixed
+			if !tc.ok {
+				want = broken
+				if fdb.commits != 0 || fdb.rollbacks != 1 {
+					t.Errorf("got %d commits and %d rollbacks but expected 0 and 1", fdb.commits, fdb.rollbacks)
+				}
+			} else if fdb.commits != 1 || fdb.rollbacks != 0 {
+				t.Errorf("got %d commits and %d rollbacks but expected 1 and 0", fdb.commits, fdb.rollbacks)
+			}
+			for id := int64(1); id <= 3; id++ {
+				if got := fdb.content(id); got != want {
+					t.Errorf("got content %q for post %d but expected %q", got, id, want)
+				}
+			}
+		})
+	}
+}
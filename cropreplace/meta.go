@@ -0,0 +1,141 @@
+package cropreplace
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+// A meta is a row of the postmeta table.
+type meta struct {
+	ID    int64
+	value string
+}
+
+// queryMeta retrieves the ID and value of each meta row of the posts with one of the given post types and one
+// of the postStatuses.
+func (r *runner) queryMeta(q queryer, postTypes []string) ([]meta, error) {
+	where, args := r.postsWhere("p.", postTypes)
+	rows, err := q.Query(fmt.Sprintf("SELECT m.meta_id, m.meta_value FROM `%s` m JOIN `%s` p ON p.ID = m.post_id "+
+		"WHERE %s ORDER BY m.meta_id", r.metaTableName(), r.tableName(), where), args...)
+	if err != nil {
+		return nil, fmt.Errorf("could not query for meta rows; %v", err)
+	}
+	defer rows.Close()
+	var metas []meta
+	for rows.Next() {
+		var m meta
+		var value sql.NullString
+		if err := rows.Scan(&m.ID, &value); err != nil {
+			return nil, err
+		}
+		if value.Valid && value.String != "" {
+			m.value = value.String
+			metas = append(metas, m)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return metas, nil
+}
+
+// replaceMetaValue returns the meta value with its crops replaced, along with the replacements made. If the
+// value is serialized, errMalformedSerialized may be returned.
+func (r *runner) replaceMetaValue(value string, files *fileIndex, sign signFunc) (string, []replacement, error) {
+	var all []replacement
+	var signErr error
+	replace := func(s string) string {
+		reps, err := r.findSignedReplacements(s, files, sign)
+		if err != nil {
+			signErr = err
+			return s
+		}
+		all = append(all, reps...)
+		return r.applyReplacements(s, reps)
+	}
+	got := value
+	if serializedValue.MatchString(value) {
+		var err error
+		if got, err = replaceSerialized(value, replace); err != nil {
+			return value, nil, err
+		}
+	} else {
+		got = replace(value)
+	}
+	if signErr != nil {
+		return value, nil, signErr
+	}
+	return got, all, nil
+}
+
+// replaceMetaCrops replaces the crops in the meta values of the posts with one of the postTypes, within the
+// transaction tx, just as replaceImageCrops does for the content of the posts. In meta values holding
+// serialized data, the crops are replaced in each serialized string and the lengths recorded are corrected;
+// values that look serialized but are malformed are left alone.
+func (r *runner) replaceMetaCrops(ctx context.Context, tx execer, postTypes []string, files *fileIndex, maxPacket int64, sign signFunc,
+	st *Report) error {
+	metas, err := r.queryMeta(tx, postTypes)
+	if err != nil {
+		return err
+	}
+	var update *sql.Stmt
+	query := fmt.Sprintf("UPDATE `%s` SET meta_value = ? WHERE meta_id = ?", r.metaTableName())
+	if !r.cfg.DryRun {
+		update, err = tx.Prepare(query)
+		if err != nil {
+			return fmt.Errorf("could not prepare meta update statement; %v", err)
+		}
+		defer update.Close()
+	}
+	for i := range metas {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		m := &metas[i]
+		got, reps, err := r.replaceMetaValue(m.value, files, sign)
+		st.MetaScanned++
+		if err == errMalformedSerialized {
+			r.logWith(levelInfo, logFields{"meta_id": m.ID},
+				"Leaving meta %d alone because its value looks serialized but is malformed", m.ID)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		st.countReplacements(reps)
+		if err := r.checkMaxChanges(st); err != nil {
+			return err
+		}
+		if got == m.value {
+			continue
+		}
+		if packetTooLarge(len(got), maxPacket) {
+			r.printErr(fmt.Sprintf("the updated value of meta %d is %d bytes, which with the rest of the UPDATE "+
+				"exceeds the max_allowed_packet of %d bytes", m.ID, len(got), maxPacket), errPacketTooLarge)
+			if r.cfg.SkipOversizedPackets {
+				st.Oversized++
+				continue
+			}
+		}
+		st.MetaChanged++
+		if r.cfg.DryRun {
+			r.logWouldUpdate(logFields{"meta_id": m.ID}, reps, "Would update meta %d", m.ID)
+			continue
+		}
+		r.logWith(levelInfo, logFields{"meta_id": m.ID}, "Updating meta %d", m.ID)
+		if r.dumpStatement != nil {
+			r.dumpStatement(query, []interface{}{got, m.ID})
+		}
+		res, err := update.Exec(got, m.ID)
+		if err != nil {
+			return fmt.Errorf("could not update meta row %d; %v", m.ID, err)
+		}
+		if affected, err := res.RowsAffected(); err != nil {
+			return fmt.Errorf("could not check for rows affected; %v", err)
+		} else if affected != 1 {
+			return fmt.Errorf("after meta update results say %d rows affected", affected)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,131 @@
+package cropreplace
+
+import (
+	"context"
+	"strconv"
+	"testing"
+)
+
+func TestMetaTableName(t *testing.T) {
+	r := newRunner(DefaultConfig())
+	cases := []struct {
+		prefix, posts, meta string
+	}{
+		{"wp_", "wp_posts", "wp_postmeta"},
+		{"wp_3_", "wp_3_posts", "wp_3_postmeta"},
+		{"", "posts", "postmeta"},
+	}
+	for i, tc := range cases {
+		t.Run("case_"+strconv.Itoa(i), func(t *testing.T) {
+			r.cfg.DBPrefix = tc.prefix
+			if got := r.tableName(); got != tc.posts {
+				t.Errorf("got posts table %q but expected %q", got, tc.posts)
+			}
+			if got := r.metaTableName(); got != tc.meta {
+				t.Errorf("got meta table %q but expected %q", got, tc.meta)
+			}
+		})
+	}
+}
+
+func TestTableSuffix(t *testing.T) {
+	r := newRunner(DefaultConfig())
+	r.cfg.DBPrefix = "wp_"
+	cases := []struct {
+		suffix string
+		blogID int
+		posts  string
+	}{
+		{"posts", 1, "wp_posts"},
+		{"articles", 1, "wp_articles"},
+		{"articles", 3, "wp_3_articles"},
+	}
+	for i, tc := range cases {
+		t.Run("case_"+strconv.Itoa(i), func(t *testing.T) {
+			r.cfg.TableSuffix, r.cfg.BlogID = tc.suffix, tc.blogID
+			if got := r.tableName(); got != tc.posts {
+				t.Errorf("got posts table %q but expected %q", got, tc.posts)
+			}
+		})
+	}
+}
+
+func TestBlogTableNames(t *testing.T) {
+	r := newRunner(DefaultConfig())
+	r.cfg.DBPrefix = "wp_"
+	cases := []struct {
+		blogID      int
+		posts, meta string
+	}{
+		{1, "wp_posts", "wp_postmeta"},
+		{2, "wp_2_posts", "wp_2_postmeta"},
+		{5, "wp_5_posts", "wp_5_postmeta"},
+	}
+	for i, tc := range cases {
+		t.Run("case_"+strconv.Itoa(i), func(t *testing.T) {
+			r.cfg.BlogID = tc.blogID
+			if got := r.tableName(); got != tc.posts {
+				t.Errorf("got posts table %q but expected %q", got, tc.posts)
+			}
+			if got := r.metaTableName(); got != tc.meta {
+				t.Errorf("got meta table %q but expected %q", got, tc.meta)
+			}
+		})
+	}
+}
+
+func TestReplaceImageCropsScanMeta(t *testing.T) {
+	r := newRunner(DefaultConfig())
+	atts := []attachment{
+		{
+			fileName: "/2018/bcd.png", ext: ".png",
+			crops: []crop{
+				{"200x180", 200, 180, ""},
+			},
+		},
+	}
+	serialized := `a:1:{i:0;s:21:"/2018/bcd-210x195.png";}`
+	metas := []fakeMeta{
+		{ID: 10, postID: 1, value: "/2018/bcd-210x195.png"},
+		{ID: 11, postID: 1, value: "/2018/bcd-200x180.png"},
+		{ID: 12, postID: 2, value: "/2018/bcd-30x15.png"},
+		{ID: 13, postID: 1, value: serialized},
+		{ID: 14, postID: 1, value: ""},
+		{ID: 15, postID: 1, value: `a:1:{i:0;s:99:"/2018/bcd-210x195.png";}`},
+	}
+	for _, scan := range []bool{true, false} {
+		t.Run("scanmeta_"+strconv.FormatBool(scan), func(t *testing.T) {
+			db, fdb := newFakeDB(t,
+				fakePost{ID: 1, postType: "post", content: "no images"},
+				fakePost{ID: 2, postType: "page", content: "no images"},
+			)
+			defer db.Close()
+			fdb.addMeta(metas...)
+			defer func(orig bool) { r.cfg.ScanMeta = orig }(r.cfg.ScanMeta)
+			r.cfg.ScanMeta = scan
+
+			st := newReport()
+			err := r.replaceImageCrops(context.Background(), sqlDB{db}, []string{"post"}, r.newFileIndex(atts), nil, nil, st)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := map[int64]string{10: "/2018/bcd-210x195.png", 11: metas[1].value, 12: metas[2].value, 13: serialized,
+				15: metas[5].value}
+			wantScanned, wantChanged := 0, 0
+			if scan {
+				want[10] = "/2018/bcd-200x180.png"
+				want[13] = `a:1:{i:0;s:21:"/2018/bcd-200x180.png";}`
+				wantScanned, wantChanged = 4, 2
+			}
+			for id, value := range want {
+				if got := fdb.metaValue(id); got != value {
+					t.Errorf("got value %q for meta %d but expected %q", got, id, value)
+				}
+			}
+			if st.MetaScanned != wantScanned || st.MetaChanged != wantChanged {
+				t.Errorf("got %d meta scanned and %d changed but expected %d and %d",
+					st.MetaScanned, st.MetaChanged, wantScanned, wantChanged)
+			}
+		})
+	}
+}
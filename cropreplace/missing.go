@@ -0,0 +1,25 @@
+package cropreplace
+
+import (
+	"bytes"
+	"encoding/csv"
+	"strconv"
+)
+
+// writeMissing writes to the file at path, replacing any existing file, a CSV list of the attachments whose file
+// is missing from the bucket, giving the ID, the file name, and the name of the object expected of each.
+func (r *runner) writeMissing(path string, atts []attachment) error {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	w.Write([]string{"ID", "file_name", "object"})
+	for i := range atts {
+		if att := &atts[i]; att.missing {
+			w.Write([]string{strconv.FormatInt(att.ID, 10), att.fileName, r.objectName(att.fileName)})
+		}
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return err
+	}
+	return writeFile(path, buf.Bytes())
+}
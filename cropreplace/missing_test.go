@@ -0,0 +1,47 @@
+package cropreplace
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteMissing(t *testing.T) {
+	r := newRunner(DefaultConfig())
+	store := memStore{
+		"media/2018/abc.png",
+		"media/2018/abc-200x180.png",
+		"media/2018/rjj-600x450.jpeg",
+		"media/2019/x-y.gif",
+	}
+	atts := []attachment{
+		{ID: 4, fileName: "/2018/abc.png", ext: ".png"},
+		{ID: 7, fileName: "/2018/rjj.jpeg", ext: ".jpeg"},
+		{ID: 9, fileName: "/2019/x-y.gif", ext: ".gif"},
+		{ID: 12, fileName: "/2019/q,1.jpg", ext: ".jpg"},
+	}
+	if err := checkStorageObjectsWithPrefix(t, r, "media", store, atts); err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "crop-replace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "missing.csv")
+	r.cfg.BucketPrefix = "media"
+	if err := r.writeMissing(path, atts); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "ID,file_name,object\n" +
+		"7,/2018/rjj.jpeg,media/2018/rjj.jpeg\n" +
+		"12,\"/2019/q,1.jpg\",\"media/2019/q,1.jpg\"\n"
+	if string(got) != want {
+		t.Errorf("got\n%s\nbut expected\n%s", got, want)
+	}
+}
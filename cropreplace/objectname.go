@@ -0,0 +1,80 @@
+package cropreplace
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+)
+
+// The placeholders that an object template may have, each standing for a part of the file name of an
+// attachment, such as "/2018/08/photo.jpg", taken from its guid.
+const (
+	placeholderYear  = "{year}"  // the year directory, such as 2018
+	placeholderMonth = "{month}" // the month directory, such as 08
+	placeholderDir   = "{dir}"   // all of the directories, such as 2018/08
+	placeholderName  = "{name}"  // the base name, such as photo.jpg
+	placeholderPath  = "{path}"  // the directories and the base name, such as 2018/08/photo.jpg
+)
+
+// validateObjectTemplate checks that the object template t has only known placeholders and ends with {name} or
+// {path}, so that the name of each crop differs from the name of its attachment only at the end.
+func validateObjectTemplate(t string) error {
+	if !strings.HasSuffix(t, placeholderName) && !strings.HasSuffix(t, placeholderPath) {
+		return fmt.Errorf("the template must end with %s or %s", placeholderName, placeholderPath)
+	}
+	if strings.HasPrefix(t, "/") {
+		return errors.New("the template must not start with a slash")
+	}
+	for rest := t; rest != ""; {
+		open := strings.IndexByte(rest, '{')
+		if open == -1 {
+			break
+		}
+		end := strings.IndexByte(rest[open:], '}')
+		if end == -1 {
+			return errors.New("the template has an unclosed placeholder")
+		}
+		switch p := rest[open : open+end+1]; p {
+		case placeholderYear, placeholderMonth, placeholderDir, placeholderName, placeholderPath:
+		default:
+			return fmt.Errorf("the template has the unknown placeholder %s", p)
+		}
+		rest = rest[open+end+1:]
+	}
+	return nil
+}
+
+// expandObjectTemplate returns the object template t with its placeholders replaced by the parts of fileName.
+// The year and month must be the first two directories of fileName if t has their placeholders.
+func expandObjectTemplate(t, fileName string) (string, error) {
+	p := strings.TrimPrefix(fileName, "/")
+	dir, name := path.Split(p)
+	dir = strings.TrimSuffix(dir, "/")
+	dirs := strings.Split(dir, "/")
+	var year, month string
+	if len(dirs) >= 2 && len(dirs[0]) == 4 && digitsLen(dirs[0]) == 4 && len(dirs[1]) == 2 && digitsLen(dirs[1]) == 2 {
+		year, month = dirs[0], dirs[1]
+	}
+	if year == "" && (strings.Contains(t, placeholderYear) || strings.Contains(t, placeholderMonth)) {
+		return "", fmt.Errorf("the file name %s does not start with year and month directories", fileName)
+	}
+	return strings.NewReplacer(
+		placeholderYear, year,
+		placeholderMonth, month,
+		placeholderDir, dir,
+		placeholderName, name,
+		placeholderPath, p,
+	).Replace(t), nil
+}
+
+// objectName returns the name of the object in the bucket for the file with the given name, which is the bucket prefix
+// followed by either the file name or, if ObjectTemplate is set, the expanded template after a slash. The template must
+// have been checked to apply to the file name.
+func (r *runner) objectName(fileName string) string {
+	if r.cfg.ObjectTemplate == "" {
+		return r.cfg.BucketPrefix + fileName
+	}
+	name, _ := expandObjectTemplate(r.cfg.ObjectTemplate, fileName)
+	return r.cfg.BucketPrefix + "/" + name
+}
@@ -0,0 +1,79 @@
+package cropreplace
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestValidateObjectTemplate(t *testing.T) {
+	cases := []struct {
+		template string
+		ok       bool
+	}{
+		{"{name}", true},
+		{"{year}/{month}/{name}", true},
+		{"images/{dir}/{name}", true},
+		{"originals/{path}", true},
+		{"{year}-{month}-{name}", true},
+		{"{name}/{year}", false},
+		{"/{year}/{name}", false},
+		{"{day}/{name}", false},
+		{"{year/{name}", false},
+		{"{year}", false},
+	}
+	for i, tc := range cases {
+		t.Run("case_"+strconv.Itoa(i), func(t *testing.T) {
+			if err := validateObjectTemplate(tc.template); tc.ok != (err == nil) {
+				t.Errorf("got error %v but expected ok to be %v", err, tc.ok)
+			}
+		})
+	}
+}
+
+func TestExpandObjectTemplate(t *testing.T) {
+	cases := []struct {
+		template, fileName string
+		name               string
+		ok                 bool
+	}{
+		{"{year}/{month}/{name}", "/2018/08/photo.jpg", "2018/08/photo.jpg", true},
+		{"{year}/{name}", "/2018/08/photo-300x200.jpg", "2018/photo-300x200.jpg", true},
+		{"{month}-{year}/{name}", "/2018/08/photo.jpg", "08-2018/photo.jpg", true},
+		{"media/{dir}/{name}", "/sites/2/2018/08/photo.jpg", "media/sites/2/2018/08/photo.jpg", true},
+		{"{name}", "/2018/08/photo.jpg", "photo.jpg", true},
+		{"old/{path}", "/photo.jpg", "old/photo.jpg", true},
+		{"{year}/{month}/{name}", "/sites/2/photo.jpg", "", false},
+		{"{year}/{name}", "/photo.jpg", "", false},
+	}
+	for i, tc := range cases {
+		t.Run("case_"+strconv.Itoa(i), func(t *testing.T) {
+			name, err := expandObjectTemplate(tc.template, tc.fileName)
+			if tc.ok != (err == nil) {
+				t.Fatalf("got error %v but expected ok to be %v", err, tc.ok)
+			}
+			if name != tc.name {
+				t.Errorf("got %q but expected %q", name, tc.name)
+			}
+		})
+	}
+}
+
+func TestObjectName(t *testing.T) {
+	r := newRunner(DefaultConfig())
+	cases := []struct {
+		prefix, template string
+		name             string
+	}{
+		{"media", "", "media/2018/08/photo.jpg"},
+		{"", "", "/2018/08/photo.jpg"},
+		{"media", "{year}{month}/{name}", "media/201808/photo.jpg"},
+	}
+	for i, tc := range cases {
+		t.Run("case_"+strconv.Itoa(i), func(t *testing.T) {
+			r.cfg.BucketPrefix, r.cfg.ObjectTemplate = tc.prefix, tc.template
+			if got := r.objectName("/2018/08/photo.jpg"); got != tc.name {
+				t.Errorf("got %q but expected %q", got, tc.name)
+			}
+		})
+	}
+}
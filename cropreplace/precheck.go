@@ -0,0 +1,34 @@
+package cropreplace
+
+import (
+	"context"
+	"fmt"
+)
+
+// precheckSample is the most attachments whose files are looked for by precheckObjects.
+const precheckSample = 10
+
+// precheckObjects looks in store for the files of up to n of the atts, spread over them, and returns an error if none
+// of them is there, which most likely means that BucketPrefix or GUIDPrefix is wrong.
+func (r *runner) precheckObjects(ctx context.Context, store objectStore, atts []attachment, n int) error {
+	if len(atts) == 0 {
+		return nil
+	}
+	if n > len(atts) {
+		n = len(atts)
+	}
+	var tried []string
+	for i := 0; i < n; i++ {
+		name := r.objectName(atts[i*len(atts)/n].fileName)
+		names, err := store.ListWithPrefix(ctx, name)
+		if err != nil {
+			return err
+		}
+		if containsString(names, name) {
+			return nil
+		}
+		tried = append(tried, name)
+	}
+	return fmt.Errorf("none of the %d objects looked for, such as %s, is in the bucket, so the bucketprefix "+
+		"%q or the guidprefix %q is likely wrong", len(tried), tried[0], r.cfg.BucketPrefix, r.cfg.GUIDPrefix)
+}
@@ -0,0 +1,48 @@
+package cropreplace
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"testing"
+)
+
+func TestPrecheckObjects(t *testing.T) {
+	r := newRunner(DefaultConfig())
+	atts := make([]attachment, 30)
+	for i := range atts {
+		atts[i] = attachment{fileName: "/2018/photo" + strconv.Itoa(i) + ".jpg", ext: ".jpg"}
+	}
+	cases := []struct {
+		prefix string
+		store  memStore
+		n      int
+		ok     bool
+	}{
+		{"media", memStore{"media/2018/photo0.jpg"}, 10, true},
+		{"media", memStore{"media/2018/photo27.jpg"}, 10, true},
+		{"media", memStore{"media/2018/photo28.jpg"}, 10, false}, // not among those looked for
+		{"media", memStore{"media/2018/photo28.jpg"}, 30, true},
+		{"media", memStore{"media/2018/photo0-300x200.jpg", "media/2018/photo0.jpg.webp"}, 10, false},
+		{"uploads", memStore{"media/2018/photo0.jpg"}, 10, false},
+		{"", memStore{"media/2018/photo0.jpg"}, 10, false},
+		{"media", nil, 10, false},
+	}
+	for i, tc := range cases {
+		t.Run("case_"+strconv.Itoa(i), func(t *testing.T) {
+			r.cfg.BucketPrefix = tc.prefix
+			err := r.precheckObjects(context.Background(), tc.store, atts, tc.n)
+			if tc.ok != (err == nil) {
+				t.Errorf("got error %v but expected ok to be %v", err, tc.ok)
+			}
+		})
+	}
+
+	if err := r.precheckObjects(context.Background(), memStore{}, nil, 10); err != nil {
+		t.Errorf("got error %v without attachments", err)
+	}
+	errList := errors.New("listing failed")
+	if err := r.precheckObjects(context.Background(), &flakyStore{errs: []error{errList}}, atts, 10); err != errList {
+		t.Errorf("got error %v but expected %v", err, errList)
+	}
+}
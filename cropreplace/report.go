@@ -0,0 +1,62 @@
+package cropreplace
+
+import (
+	"encoding/json"
+)
+
+// A PostReport lists the replacements made in the content of a post.
+type PostReport struct {
+	PostID       int64               `json:"post_id"`
+	Replacements []ReplacementRecord `json:"replacements"`
+}
+
+// A ReplacementRecord describes a single crop reference replaced in a post, or left as it is because of the
+// nofallback flag, in which case New is the same as Old.
+type ReplacementRecord struct {
+	Old    string `json:"old"`
+	New    string `json:"new"`
+	Offset int    `json:"offset"`           // the byte offset of Old in the column as it was before the run
+	Column string `json:"column,omitempty"` // the column Old is in, if not the content column
+	Reason string `json:"reason"`           // one of the Reason constants
+}
+
+// The reasons for a replacement given in a report.
+const (
+	ReasonCloseVariant      = "close-variant"
+	ReasonUncroppedFallback = "uncropped-fallback"
+	ReasonDuplicate         = "duplicate-candidate"
+	ReasonNoFallback        = "no-fallback"
+)
+
+// newPostReport returns the report for the post with the given ID in which the replacements were made or, for
+// those of the kind kindKept, would have been made.
+func newPostReport(postID int64, reps []replacement) PostReport {
+	pr := PostReport{PostID: postID}
+	for i := range reps {
+		rep := &reps[i]
+		rec := ReplacementRecord{Old: rep.old, New: rep.new, Offset: rep.start, Column: rep.column}
+		switch rep.kind {
+		case kindClose:
+			rec.Reason = ReasonCloseVariant
+		case kindFallback:
+			rec.Reason = ReasonUncroppedFallback
+		case kindDuplicate:
+			rec.Reason = ReasonDuplicate
+		case kindKept:
+			rec.Reason = ReasonNoFallback
+		default:
+			continue
+		}
+		pr.Replacements = append(pr.Replacements, rec)
+	}
+	return pr
+}
+
+// writeReport writes the reports as a JSON array to the file at path, replacing any existing file.
+func writeReport(path string, reports []PostReport) error {
+	data, err := json.MarshalIndent(reports, "", "\t")
+	if err != nil {
+		return err
+	}
+	return writeFile(path, data)
+}
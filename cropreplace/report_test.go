@@ -0,0 +1,157 @@
+package cropreplace
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReplaceImageCropsReport(t *testing.T) {
+	r := newRunner(DefaultConfig())
+	dir, err := ioutil.TempDir("", "crop-replace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	atts := []attachment{
+		{
+			fileName: "/2018/bcd.png", ext: ".png",
+			crops: []crop{
+				{"200x180", 200, 180, ""},
+			},
+		},
+	}
+	cases := []struct {
+		name       string
+		noFallback bool
+		posts      []fakePost
+		want       []PostReport
+	}{
+		{
+			name: "changes",
+			posts: []fakePost{
+				{ID: 4, postType: "post", content: "/2018/bcd-210x195.png /2018/bcd-30x15.png /2018/bcd-200x180.png"},
+				{ID: 5, postType: "post", content: "nothing to see"},
+				{ID: 9, postType: "post", content: "/2018/bcd-30x15.png"},
+			},
+			want: []PostReport{
+				{PostID: 4, Replacements: []ReplacementRecord{
+					{Old: "/2018/bcd-210x195.png", New: "/2018/bcd-200x180.png", Reason: ReasonCloseVariant},
+					{Old: "/2018/bcd-30x15.png", New: "/2018/bcd.png", Offset: 22, Reason: ReasonUncroppedFallback},
+				}},
+				{PostID: 9, Replacements: []ReplacementRecord{
+					{Old: "/2018/bcd-30x15.png", New: "/2018/bcd.png", Reason: ReasonUncroppedFallback},
+				}},
+			},
+		},
+		{
+			name:       "nofallback",
+			noFallback: true,
+			posts: []fakePost{
+				{ID: 4, postType: "post", content: "/2018/bcd-210x195.png /2018/bcd-30x15.png"},
+				{ID: 5, postType: "post", content: "nothing to see"},
+				{ID: 9, postType: "post", content: "/2018/bcd-30x15.png"},
+			},
+			want: []PostReport{
+				{PostID: 4, Replacements: []ReplacementRecord{
+					{Old: "/2018/bcd-210x195.png", New: "/2018/bcd-200x180.png", Reason: ReasonCloseVariant},
+					{Old: "/2018/bcd-30x15.png", New: "/2018/bcd-30x15.png", Offset: 22, Reason: ReasonNoFallback},
+				}},
+				{PostID: 9, Replacements: []ReplacementRecord{
+					{Old: "/2018/bcd-30x15.png", New: "/2018/bcd-30x15.png", Reason: ReasonNoFallback},
+				}},
+			},
+		},
+		{
+			name:  "empty",
+			posts: []fakePost{{ID: 5, postType: "post", content: "nothing to see"}},
+			want:  []PostReport{},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			r.cfg.Report = filepath.Join(dir, tc.name+".json")
+			r.cfg.NoFallback = tc.noFallback
+			db, _ := newFakeDB(t, tc.posts...)
+			defer db.Close()
+			err := r.replaceImageCrops(context.Background(), sqlDB{db}, []string{"post"}, r.newFileIndex(atts), nil, nil,
+				newReport())
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, err := ioutil.ReadFile(r.cfg.Report)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(tc.want) == 0 && strings.TrimSpace(string(data)) != "[]" {
+				t.Errorf("got %q for an empty report", data)
+			}
+			var got []PostReport
+			if err := json.Unmarshal(data, &got); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got %+v but expected %+v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestReplaceImageCropsReportOffsets(t *testing.T) {
+	r := newRunner(DefaultConfig())
+	dir, err := ioutil.TempDir("", "crop-replace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	r.cfg.Report = filepath.Join(dir, "report.json")
+	r.postColumns = []string{"post_excerpt"}
+
+	atts := []attachment{
+		{
+			fileName: "/2018/bcd.png", ext: ".png",
+			crops: []crop{
+				{"200x180", 200, 180, ""},
+			},
+		},
+	}
+	content := `<img src="/2018/bcd-210x195.png"> and <img src="/2018/bcd-200x180.png" srcset="/2018/bcd-30x15.png 30w">`
+	db, _ := newFakeDB(t, fakePost{ID: 4, postType: "post", content: content,
+		extra: map[string]string{"post_excerpt": "see /2018/bcd-30x15.png"}})
+	defer db.Close()
+	err = r.replaceImageCrops(context.Background(), sqlDB{db}, []string{"post"}, r.newFileIndex(atts), nil, nil,
+		newReport())
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(r.cfg.Report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []PostReport
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatal(err)
+	}
+	want := []PostReport{
+		{PostID: 4, Replacements: []ReplacementRecord{
+			{Old: "/2018/bcd-210x195.png", New: "/2018/bcd-200x180.png", Offset: 10, Reason: ReasonCloseVariant},
+			{Old: "/2018/bcd-30x15.png", New: "/2018/bcd.png", Offset: 79, Reason: ReasonUncroppedFallback},
+			{Old: "/2018/bcd-30x15.png", New: "/2018/bcd.png", Offset: 4, Column: "post_excerpt",
+				Reason: ReasonUncroppedFallback},
+		}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v but expected %+v", got, want)
+	}
+	for _, rec := range got[0].Replacements[:2] {
+		if !strings.HasPrefix(content[rec.Offset:], rec.Old) {
+			t.Errorf("the content at offset %d is not %q", rec.Offset, rec.Old)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package cropreplace
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"google.golang.org/api/googleapi"
+)
+
+// A retryingStore lists objects with another objectStore, retrying each request that fails with a transient
+// error up to maxRetries times. The wait before each retry doubles, starting at base.
+type retryingStore struct {
+	store      objectStore
+	maxRetries int
+	base       time.Duration
+	logWith    func(level int, fields logFields, format string, args ...interface{}) // logs each retry, if not nil
+}
+
+func (r *retryingStore) ListWithPrefix(ctx context.Context, prefix string) ([]string, error) {
+	var names []string
+	err := r.retry(ctx, "Listing", prefix, func() (err error) {
+		names, err = r.store.ListWithPrefix(ctx, prefix)
+		return err
+	})
+	return names, err
+}
+
+func (r *retryingStore) Exists(ctx context.Context, name string) (bool, error) {
+	var exists bool
+	err := r.retry(ctx, "Checking for", name, func() (err error) {
+		exists, err = objectExists(ctx, r.store, name)
+		return err
+	})
+	return exists, err
+}
+
+// retry calls f until it succeeds, fails with an error that is not transient, or has been retried maxRetries
+// times, logging each retry as the action on the object or prefix named.
+func (r *retryingStore) retry(ctx context.Context, action, name string, f func() error) error {
+	wait := r.base
+	for attempt := 0; ; attempt++ {
+		err := f()
+		if err == nil || attempt == r.maxRetries || !isTransient(err) {
+			return err
+		}
+		if r.logWith != nil {
+			r.logWith(levelWarn, logFields{"prefix": name, "error": err.Error()}, "%s %q failed, retrying in %v: %v",
+				action, name, wait, err)
+		}
+		t := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		case <-t.C:
+		}
+		wait *= 2
+	}
+}
+
+// isTransient says whether err, returned by a storage request, is one that a retry of the request may not get,
+// such as a server error or a rate limit. Errors such as those for a missing bucket or permission are not.
+func isTransient(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var gErr *googleapi.Error
+	if errors.As(err, &gErr) {
+		return transientStatus(gErr.Code)
+	}
+	var awsErr awserr.RequestFailure
+	if errors.As(err, &awsErr) {
+		return transientStatus(awsErr.StatusCode())
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+	return errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// transientStatus says whether an HTTP response with the status code may succeed if the request is retried.
+func transientStatus(code int) bool {
+	return code == 429 || code >= 500
+}
@@ -0,0 +1,106 @@
+package cropreplace
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"google.golang.org/api/googleapi"
+)
+
+// A flakyStore is an objectStore whose listings fail with the errors in errs, in order, before they succeed.
+type flakyStore struct {
+	errs  []error
+	calls int
+}
+
+func (f *flakyStore) ListWithPrefix(_ context.Context, prefix string) ([]string, error) {
+	f.calls++
+	if f.calls <= len(f.errs) {
+		return nil, f.errs[f.calls-1]
+	}
+	return []string{prefix + ".jpg"}, nil
+}
+
+func TestRetryingStore(t *testing.T) {
+	unavailable := &googleapi.Error{Code: 503}
+	forbidden := &googleapi.Error{Code: 403}
+
+	cases := []struct {
+		errs       []error
+		maxRetries int
+		calls      int
+		names      []string
+		err        error
+	}{
+		{nil, 3, 1, []string{"a.jpg"}, nil},
+		{[]error{unavailable, unavailable}, 3, 3, []string{"a.jpg"}, nil},
+		{[]error{unavailable, unavailable}, 2, 3, []string{"a.jpg"}, nil},
+		{[]error{unavailable, unavailable}, 1, 2, nil, unavailable},
+		{[]error{forbidden}, 3, 1, nil, forbidden},
+		{[]error{unavailable, forbidden}, 3, 2, nil, forbidden},
+	}
+
+	for i, tc := range cases {
+		t.Run("case_"+strconv.Itoa(i), func(t *testing.T) {
+			flaky := &flakyStore{errs: tc.errs}
+			store := &retryingStore{store: flaky, maxRetries: tc.maxRetries, base: time.Millisecond}
+			names, err := store.ListWithPrefix(context.Background(), "a")
+			if err != tc.err {
+				t.Fatalf("got error %v; expected %v", err, tc.err)
+			}
+			if !reflect.DeepEqual(names, tc.names) {
+				t.Errorf("got names %q; expected %q", names, tc.names)
+			}
+			if flaky.calls != tc.calls {
+				t.Errorf("listed %d times; expected %d", flaky.calls, tc.calls)
+			}
+		})
+	}
+}
+
+func TestRetryingStoreCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	flaky := &flakyStore{errs: []error{&googleapi.Error{Code: 500}}}
+	store := &retryingStore{store: flaky, maxRetries: 3, base: time.Hour}
+	if _, err := store.ListWithPrefix(ctx, "a"); err != context.Canceled {
+		t.Errorf("got error %v; expected %v", err, context.Canceled)
+	}
+	if flaky.calls != 1 {
+		t.Errorf("listed %d times; expected 1", flaky.calls)
+	}
+}
+
+func TestIsTransient(t *testing.T) {
+	cases := []struct {
+		err       error
+		transient bool
+	}{
+		{&googleapi.Error{Code: 500}, true},
+		{&googleapi.Error{Code: 503}, true},
+		{&googleapi.Error{Code: 429}, true},
+		{&googleapi.Error{Code: 401}, false},
+		{&googleapi.Error{Code: 403}, false},
+		{&googleapi.Error{Code: 404}, false},
+		{fmt.Errorf("listing: %w", &googleapi.Error{Code: 502}), true},
+		{awserr.NewRequestFailure(awserr.New("InternalError", "internal error", nil), 500, "id"), true},
+		{awserr.NewRequestFailure(awserr.New("AccessDenied", "access denied", nil), 403, "id"), false},
+		{context.Canceled, false},
+		{context.DeadlineExceeded, false},
+		{errors.New("bucket does not exist"), false},
+	}
+
+	for i, tc := range cases {
+		t.Run("case_"+strconv.Itoa(i), func(t *testing.T) {
+			if got := isTransient(tc.err); got != tc.transient {
+				t.Errorf("got %v for %v; expected %v", got, tc.err, tc.transient)
+			}
+		})
+	}
+}
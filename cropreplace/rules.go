@@ -0,0 +1,102 @@
+package cropreplace
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// A cropRule says which crop to use in place of a missing crop with certain dimensions.
+type cropRule struct {
+	width, height     uint64 // the dimensions of the missing crops to which the rule applies, with 0 matching any
+	toWidth, toHeight uint64 // the dimensions of the crop to use instead, which are 0 to use the un-cropped image
+}
+
+// full says whether the rule calls for the un-cropped image.
+func (r *cropRule) full() bool {
+	return r.toWidth == 0
+}
+
+// ruleFull is the target of a rule that calls for the un-cropped image.
+const ruleFull = "full"
+
+// readRules reads crop rules from the file at path. Each line has the dimensions of missing crops, either of
+// which may be *, and then either the dimensions of the crop to use instead or "full" for the un-cropped image,
+// as in "300x300 400x400" or "150x* full". Blank lines and lines starting with # are ignored.
+func readRules(path string) ([]cropRule, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var rules []cropRule
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		rule, err := parseRule(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d of %s; %v", n, path, err)
+		}
+		rules = append(rules, rule)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+// parseRule parses a line of a rules file.
+func parseRule(line string) (cropRule, error) {
+	var rule cropRule
+	fields := strings.Fields(line)
+	if len(fields) != 2 {
+		return rule, fmt.Errorf("%q is not in the form WIDTHxHEIGHT TARGET", line)
+	}
+	x := strings.IndexByte(fields[0], 'x')
+	if x == -1 {
+		return rule, fmt.Errorf("%q is not in the form WIDTHxHEIGHT", fields[0])
+	}
+	var err error
+	if rule.width, err = parseRuleDimension(fields[0][:x]); err != nil {
+		return rule, err
+	}
+	if rule.height, err = parseRuleDimension(fields[0][x+1:]); err != nil {
+		return rule, err
+	}
+	if fields[1] != ruleFull {
+		to, err := parseDimensions(fields[1])
+		if err != nil {
+			return rule, err
+		}
+		rule.toWidth, rule.toHeight = to.width, to.height
+	}
+	return rule, nil
+}
+
+// parseRuleDimension parses a width or height of the crops a rule applies to, which is 0 if it's *.
+func parseRuleDimension(s string) (uint64, error) {
+	if s == "*" {
+		return 0, nil
+	}
+	n, err := strconv.ParseUint(s, 10, 64)
+	if err != nil || n == 0 {
+		return 0, fmt.Errorf("%q is not a valid dimension", s)
+	}
+	return n, nil
+}
+
+// matchRule returns the first of the rules that applies to the crop c, or nil if none does.
+func matchRule(rules []cropRule, c *crop) *cropRule {
+	for i := range rules {
+		r := &rules[i]
+		if (r.width == 0 || r.width == c.width) && (r.height == 0 || r.height == c.height) {
+			return r
+		}
+	}
+	return nil
+}
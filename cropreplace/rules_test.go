@@ -0,0 +1,119 @@
+package cropreplace
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func TestParseRule(t *testing.T) {
+	cases := []struct {
+		line string
+		rule cropRule
+		ok   bool
+	}{
+		{"300x300 400x400", cropRule{300, 300, 400, 400}, true},
+		{"150x150 full", cropRule{150, 150, 0, 0}, true},
+		{"150x*\tfull", cropRule{150, 0, 0, 0}, true},
+		{"*x200 600x200", cropRule{0, 200, 600, 200}, true},
+		{"*x* full", cropRule{0, 0, 0, 0}, true},
+		{"300x300", cropRule{}, false},
+		{"300x300 400x400 full", cropRule{}, false},
+		{"300 full", cropRule{}, false},
+		{"0x300 full", cropRule{}, false},
+		{"300x300 400", cropRule{}, false},
+		{"300x300 *x400", cropRule{}, false},
+		{"300x300 Full", cropRule{}, false},
+	}
+	for i, tc := range cases {
+		t.Run("case_"+strconv.Itoa(i), func(t *testing.T) {
+			rule, err := parseRule(tc.line)
+			if tc.ok != (err == nil) {
+				t.Fatalf("got error %v but expected ok to be %v", err, tc.ok)
+			}
+			if err == nil && rule != tc.rule {
+				t.Errorf("got %+v but expected %+v", rule, tc.rule)
+			}
+		})
+	}
+}
+
+func TestReadRules(t *testing.T) {
+	dir, err := ioutil.TempDir("", "crop-replace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "rules")
+	data := "# Thumbnails are too small to matter.\n\n150x150 full\n  300x300 400x400  \n"
+	if err := ioutil.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	rules, err := readRules(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []cropRule{{150, 150, 0, 0}, {300, 300, 400, 400}}
+	if !reflect.DeepEqual(rules, want) {
+		t.Errorf("got %+v but expected %+v", rules, want)
+	}
+
+	if err := ioutil.WriteFile(path, []byte("150x150 full\n300x300\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readRules(path); err == nil {
+		t.Error("got no error for a rule without a target")
+	}
+}
+
+func TestReplaceCropsRules(t *testing.T) {
+	r := newRunner(DefaultConfig())
+	r.cfg.GUIDPrefix = "https://example.com/uploads/"
+	atts := []attachment{
+		{
+			fileName: "/2018/photo.jpg", ext: ".jpg",
+			crops: []crop{
+				{"150x150", 150, 150, ""},
+				{"290x290", 290, 290, ""},
+				{"400x400", 400, 400, ""},
+				{"400x400@2x", 400, 400, ""},
+				{"1024x683", 1024, 683, ""},
+			},
+		},
+	}
+	r.cropRules = []cropRule{
+		{300, 300, 400, 400},
+		{155, 155, 0, 0},
+		{1000, 0, 1024, 683},
+		{800, 600, 800, 600},
+	}
+	cases := []struct {
+		placeholder string
+		original    string
+		desired     string
+	}{
+		// Rules apply only to missing crops.
+		{"", "/2018/photo-150x150.jpg /2018/photo-400x400.jpg", "/2018/photo-150x150.jpg /2018/photo-400x400.jpg"},
+		{"", "/2018/photo-300x300.jpg", "/2018/photo-400x400.jpg"},
+		{"", "/2018/photo-300x300@2x.jpg", "/2018/photo-400x400@2x.jpg"},
+		{"", "/2018/photo-155x155.jpg", "/2018/photo.jpg"},
+		{"https://example.com/blank.gif", "https://example.com/uploads/2018/photo-155x155.jpg",
+			"https://example.com/uploads/2018/photo.jpg"},
+		{"", "/2018/photo-1000x900.jpg", "/2018/photo-1024x683.jpg"},
+		{"", "<img srcset='/2018/photo-300x300.jpg 300w'>", "<img srcset='/2018/photo-400x400.jpg 400w'>"},
+		// Without the crop a rule calls for, or without a rule, the tolerances apply.
+		{"", "/2018/photo-800x600.jpg", "/2018/photo-1024x683.jpg"},
+		{"", "/2018/photo-295x295.jpg", "/2018/photo-290x290.jpg"},
+	}
+	for i, tc := range cases {
+		t.Run("case_"+strconv.Itoa(i), func(t *testing.T) {
+			r.cfg.Placeholder = tc.placeholder
+			if got := r.replaceCrops(tc.original, atts, tolerance{35, 100}); got != tc.desired {
+				t.Errorf("got %q but expected %q", got, tc.desired)
+			}
+		})
+	}
+}
@@ -0,0 +1,175 @@
+package cropreplace
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// newRunConfig returns a Config for a run with the objects of the given names in a local directory.
+func newRunConfig(t *testing.T, names ...string) (Config, func()) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "crop-replace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range names {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte("image"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c := DefaultConfig()
+	c.LocalDir = dir
+	c.DBPrefix = "wp_"
+	c.GUIDPrefix = "https://example.com/wp-content/uploads/"
+	c.BucketPrefix = "media"
+	return c, func() { os.RemoveAll(dir) }
+}
+
+func TestRun(t *testing.T) {
+	const content = `<img src="https://example.com/wp-content/uploads/2018/bcd-210x195.png">`
+	cases := []struct {
+		dryRun  bool
+		changed int
+		desired string
+	}{
+		{false, 1, `<img src="https://example.com/wp-content/uploads/2018/bcd-200x180.png">`},
+		{true, 1, content},
+	}
+	for i, tc := range cases {
+		t.Run("case_"+strconv.Itoa(i), func(t *testing.T) {
+			db, fake := newFakeDB(t,
+				fakePost{ID: 1, postType: "attachment", guid: "https://example.com/wp-content/uploads/2018/bcd.png",
+					mime: "image/png"},
+				fakePost{ID: 2, postType: "post", content: content},
+			)
+			defer db.Close()
+			c, cleanup := newRunConfig(t, "media/2018/bcd.png", "media/2018/bcd-200x180.png")
+			defer cleanup()
+			c.DB = db
+			c.DryRun = tc.dryRun
+
+			report, err := Run(context.Background(), c)
+			if err != nil {
+				t.Fatalf("got error: %v", err)
+			}
+			if report.Scanned != 1 || report.Changed != tc.changed || report.Replacements != 1 {
+				t.Errorf("got report %+v", report)
+			}
+			if got := fake.content(2); got != tc.desired {
+				t.Errorf("got content %q but expected %q", got, tc.desired)
+			}
+		})
+	}
+}
+
+func TestRunInvalidConfig(t *testing.T) {
+	db, _ := newFakeDB(t)
+	defer db.Close()
+
+	cases := []struct {
+		edit func(c *Config)
+		err  error
+	}{
+		{func(c *Config) { c.GUIDPrefix = "" }, ErrMissingConfig},
+		{func(c *Config) { c.DB = nil }, ErrMissingConfig},
+		{func(c *Config) { c.BatchSize = 0 }, ErrInvalidConfig},
+		{func(c *Config) { c.BucketPrefix = "media/" }, ErrInvalidConfig},
+	}
+	for i, tc := range cases {
+		t.Run("case_"+strconv.Itoa(i), func(t *testing.T) {
+			c, cleanup := newRunConfig(t)
+			defer cleanup()
+			c.DB = db
+			tc.edit(&c)
+			if _, err := Run(context.Background(), c); !errors.Is(err, tc.err) {
+				t.Errorf("got error %v but expected %v", err, tc.err)
+			}
+		})
+	}
+}
+
+// TestRunResetsState checks that the settings derived for one run are not used by the next.
+func TestRunResetsState(t *testing.T) {
+	const content = `<img src="https://example.com/wp-content/uploads/2018/bcd-210x195.png">`
+	db, _ := newFakeDB(t,
+		fakePost{ID: 1, postType: "attachment", guid: "https://example.com/wp-content/uploads/2018/bcd.png",
+			mime: "image/png"},
+		fakePost{ID: 2, postType: "post", content: content},
+		fakePost{ID: 3, postType: "post", content: content},
+	)
+	defer db.Close()
+	c, cleanup := newRunConfig(t, "media/2018/bcd.png", "media/2018/bcd-200x180.png")
+	defer cleanup()
+	c.DB = db
+	c.DryRun = true
+
+	c.IDs = "2"
+	if report, err := Run(context.Background(), c); err != nil || report.Scanned != 1 {
+		t.Fatalf("got report %+v and error %v with IDs set", report, err)
+	}
+	c.IDs = ""
+	if report, err := Run(context.Background(), c); err != nil || report.Scanned != 2 {
+		t.Errorf("got report %+v and error %v after a run with IDs set", report, err)
+	}
+}
+
+// TestRunConcurrent checks that runs taking place at the same time each keep to their own settings and print to
+// their own Out.
+func TestRunConcurrent(t *testing.T) {
+	const content = `<img src="https://example.com/wp-content/uploads/2018/bcd-210x195.png">`
+	cases := []struct {
+		dryRun  bool
+		printed string
+		desired string
+	}{
+		{false, "Updating 2", `<img src="https://example.com/wp-content/uploads/2018/bcd-200x180.png">`},
+		{true, "Would update 2", content},
+	}
+	fakes := make([]*fakeDB, len(cases))
+	outs := make([]bytes.Buffer, len(cases))
+	var wg sync.WaitGroup
+	for i, tc := range cases {
+		db, fake := newFakeDB(t,
+			fakePost{ID: 1, postType: "attachment", guid: "https://example.com/wp-content/uploads/2018/bcd.png",
+				mime: "image/png"},
+			fakePost{ID: 2, postType: "post", content: content},
+		)
+		defer db.Close()
+		fakes[i] = fake
+		c, cleanup := newRunConfig(t, "media/2018/bcd.png", "media/2018/bcd-200x180.png")
+		defer cleanup()
+		c.DB = db
+		c.DryRun = tc.dryRun
+		c.Out = &outs[i]
+
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if _, err := Run(context.Background(), c); err != nil {
+				t.Errorf("case %d: got error: %v", i, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	for i, tc := range cases {
+		if got := fakes[i].content(2); got != tc.desired {
+			t.Errorf("case %d: got content %q but expected %q", i, got, tc.desired)
+		}
+		if got := outs[i].String(); !strings.Contains(got, tc.printed) {
+			t.Errorf("case %d: got output %q but expected it to say %q", i, got, tc.printed)
+		}
+	}
+}
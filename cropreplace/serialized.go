@@ -0,0 +1,73 @@
+package cropreplace
+
+import (
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// serializedValue matches a value that looks like PHP-serialized data.
+var serializedValue = regexp.MustCompile(`(?s)^(?:[aO]:\d+:.*\}|s:\d+:".*";|[bid]:[^;]*;|N;)$`)
+
+var errMalformedSerialized = errors.New("malformed serialized data")
+
+// replaceSerialized applies replace to the payload of each string serialized in the PHP-serialized data and
+// rewrites the byte length recorded before each string to match its new payload, so that the data stays
+// valid. Payloads that are themselves serialized data are rewritten in the same way. The other parts of the
+// data are left as they are. If the lengths recorded do not fit the data, errMalformedSerialized is returned.
+func replaceSerialized(data string, replace func(string) string) (string, error) {
+	var b strings.Builder
+	b.Grow(len(data))
+	for i := 0; i < len(data); {
+		kind := data[i]
+		if (kind != 's' && kind != 'O') || !strings.HasPrefix(data[i+1:], ":") {
+			b.WriteByte(data[i])
+			i++
+			continue
+		}
+		// Both strings and objects begin like s:N:"...", with the length of what's between the quotes.
+		n, payloadStart, ok := serializedLen(data, i+2)
+		if !ok || payloadStart+n+1 > len(data) || data[payloadStart+n] != '"' {
+			return "", errMalformedSerialized
+		}
+		payload := data[payloadStart : payloadStart+n]
+		if kind == 'O' {
+			// The payload is the class name, which is left alone.
+			b.WriteString(data[i : payloadStart+n+1])
+			i = payloadStart + n + 1
+			continue
+		}
+		if payloadStart+n+2 > len(data) || data[payloadStart+n+1] != ';' {
+			return "", errMalformedSerialized
+		}
+		if serializedValue.MatchString(payload) {
+			nested, err := replaceSerialized(payload, replace)
+			if err != nil {
+				return "", err
+			}
+			payload = nested
+		} else {
+			payload = replace(payload)
+		}
+		b.WriteString(`s:` + strconv.Itoa(len(payload)) + `:"`)
+		b.WriteString(payload)
+		b.WriteString(`";`)
+		i = payloadStart + n + 2
+	}
+	return b.String(), nil
+}
+
+// serializedLen reads the length in data beginning at start, which is followed by `:"`, and returns it along
+// with the index of the payload after the opening quote.
+func serializedLen(data string, start int) (n, payloadStart int, ok bool) {
+	digits := digitsLen(data[start:])
+	if digits == 0 || !strings.HasPrefix(data[start+digits:], `:"`) {
+		return 0, 0, false
+	}
+	n, err := strconv.Atoi(data[start : start+digits])
+	if err != nil {
+		return 0, 0, false
+	}
+	return n, start + digits + 2, true
+}
@@ -0,0 +1,108 @@
+package cropreplace
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestSerializedValue(t *testing.T) {
+	cases := []struct {
+		value      string
+		serialized bool
+	}{
+		{`a:1:{i:0;s:21:"/2018/bcd-210x195.png";}`, true},
+		{`s:21:"/2018/bcd-210x195.png";`, true},
+		{`O:8:"stdClass":1:{s:3:"url";s:5:"a.png";}`, true},
+		{"a:1:{i:0;s:6:\"a\nb.png\";}", true},
+		{`i:5;`, true},
+		{`N;`, true},
+		{`/2018/bcd-210x195.png`, false},
+		{`{"url":"/2018/bcd-210x195.png"}`, false},
+		{`a:b`, false},
+	}
+	for i, tc := range cases {
+		t.Run("case_"+strconv.Itoa(i), func(t *testing.T) {
+			if got := serializedValue.MatchString(tc.value); got != tc.serialized {
+				t.Errorf("got %v for %q but expected %v", got, tc.value, tc.serialized)
+			}
+		})
+	}
+}
+
+func TestReplaceSerialized(t *testing.T) {
+	r := newRunner(DefaultConfig())
+	atts := []attachment{
+		{
+			fileName: "/2018/bcd.png", ext: ".png",
+			crops: []crop{
+				{"200x180", 200, 180, ""},
+				{"1024x768", 1024, 768, ""},
+			},
+		},
+	}
+	replace := func(s string) string { return r.replaceCrops(s, atts, tolerance{35, 100}) }
+	cases := []struct {
+		data, desired string
+	}{
+		{ // Same length
+			`a:1:{i:0;s:21:"/2018/bcd-210x195.png";}`,
+			`a:1:{i:0;s:21:"/2018/bcd-200x180.png";}`,
+		},
+		{ // Shorter
+			`a:2:{s:3:"url";s:19:"/2018/bcd-30x15.png";s:5:"width";i:30;}`,
+			`a:2:{s:3:"url";s:13:"/2018/bcd.png";s:5:"width";i:30;}`,
+		},
+		{ // Longer
+			`a:1:{s:3:"img";s:33:"<img src="/2018/bcd-990x740.png">";}`,
+			`a:1:{s:3:"img";s:34:"<img src="/2018/bcd-1024x768.png">";}`,
+		},
+		{ // Several strings of differing lengths
+			`a:3:{i:0;s:19:"/2018/bcd-30x15.png";i:1;s:21:"/2018/bcd-210x195.png";i:2;s:4:"text";}`,
+			`a:3:{i:0;s:13:"/2018/bcd.png";i:1;s:21:"/2018/bcd-200x180.png";i:2;s:4:"text";}`,
+		},
+		{ // An object
+			`O:8:"stdClass":1:{s:3:"src";s:19:"/2018/bcd-30x15.png";}`,
+			`O:8:"stdClass":1:{s:3:"src";s:13:"/2018/bcd.png";}`,
+		},
+		{ // Serialized data within a serialized string
+			`a:1:{i:0;s:27:"s:19:"/2018/bcd-30x15.png";";}`,
+			`a:1:{i:0;s:21:"s:13:"/2018/bcd.png";";}`,
+		},
+		{ // Multibyte characters are counted in bytes.
+			`s:25:"é /2018/bcd-30x15.png é";`,
+			`s:19:"é /2018/bcd.png é";`,
+		},
+		{ // Quotes and semicolons within a string
+			`a:1:{i:0;s:27:"a";s:1:"/2018/bcd-30x15.png";}`,
+			`a:1:{i:0;s:21:"a";s:1:"/2018/bcd.png";}`,
+		},
+	}
+	for i, tc := range cases {
+		t.Run("case_"+strconv.Itoa(i), func(t *testing.T) {
+			got, err := replaceSerialized(tc.data, replace)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tc.desired {
+				t.Errorf("got\n\t%s\nbut expected\n\t%s", got, tc.desired)
+			}
+		})
+	}
+}
+
+func TestReplaceSerializedMalformed(t *testing.T) {
+	for i, data := range []string{
+		`a:1:{i:0;s:99:"/2018/bcd-210x195.png";}`,
+		`a:1:{i:0;s:3:"/2018/bcd-210x195.png";}`,
+		`s:21:"/2018/bcd-210x195.png"`,
+		`a:1:{i:0;s:x:"a";}`,
+	} {
+		t.Run("case_"+strconv.Itoa(i), func(t *testing.T) {
+			got, err := replaceSerialized(data, strings.ToUpper)
+			if err != errMalformedSerialized {
+				t.Errorf("got %q and error %v but expected errMalformedSerialized", got, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,100 @@
+package cropreplace
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"golang.org/x/oauth2/google"
+)
+
+// A signFunc returns a signed URL for the object with the given name.
+type signFunc func(object string) (string, error)
+
+// newSigner returns a signFunc giving URLs to objects in the named GCS bucket signed with the service account
+// key in the JSON file at keyFile. The URLs expire after the given duration.
+func newSigner(keyFile, bucketName string, expiry time.Duration) (signFunc, error) {
+	data, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	conf, err := google.JWTConfigFromJSON(data)
+	if err != nil {
+		return nil, fmt.Errorf("reading the service account key; %v", err)
+	}
+	expires := time.Now().Add(expiry)
+	return func(object string) (string, error) {
+		return storage.SignedURL(bucketName, object, &storage.SignedURLOptions{
+			GoogleAccessID: conf.Email,
+			PrivateKey:     conf.PrivateKey,
+			Method:         "GET",
+			Expires:        expires,
+		})
+	}, nil
+}
+
+// findSignedReplacements returns the replacements that the files call for in content with the flag tolerance, signed
+// with sign unless it is nil. If LazyCheck is set, an error checking for a crop is returned.
+func (r *runner) findSignedReplacements(content string, files *fileIndex, sign signFunc) ([]replacement, error) {
+	reps := r.findReplacements(content, files, r.flagTolerance())
+	if err := r.lazy.failed(); err != nil {
+		return nil, err
+	}
+	if sign == nil {
+		return reps, nil
+	}
+	guidPrefixTrimmed := strings.TrimSuffix(r.primaryGUIDPrefix(), "/")
+	return reps, r.signReplacements(content, reps, guidPrefixTrimmed, r.objectName, sign)
+}
+
+// signReplacements makes each replacement in reps that changes a crop reference replace the whole URL, which
+// is the reference prefixed with the URL prefix of the attachment (or with urlPrefix if it has none) in any of
+// the forms that contentPrefixBefore accepts, with a signed URL to the object chosen. The name of the object is
+// given by object for the file name of the crop chosen or the un-cropped image. A query string or fragment after the
+// reference is replaced too. References without the URL prefix before them in content are left to be replaced as
+// usual.
+func (r *runner) signReplacements(content string, reps []replacement, urlPrefix string, object func(string) string,
+	sign signFunc) error {
+	for i := range reps {
+		rep := &reps[i]
+		if rep.kind != kindClose && rep.kind != kindFallback || rep.url {
+			continue
+		}
+		prefix := rep.file.urlPrefix(urlPrefix)
+		n := r.contentPrefixBefore(content[:rep.start], prefix)
+		if n == -1 {
+			continue
+		}
+		name := rep.newFileName(r.cfg.CropSeparator)
+		signed, err := sign(object(name))
+		if err != nil {
+			return fmt.Errorf("signing a URL for %s; %v", name, err)
+		}
+		// A query string or fragment following the reference would be appended to the query string of the signed
+		// URL, breaking the signature, so it's replaced along with the rest of the URL.
+		if rep.oldSuffix != "" {
+			rep.newSuffix = rep.newSuffix[queryLen(rep.oldSuffix):]
+		} else {
+			rest := content[rep.end():]
+			rep.old += rest[:queryLen(rest)]
+		}
+		rep.start -= n
+		rep.old = content[rep.start:rep.start+n] + rep.old
+		rep.new = signed
+		rep.url = true
+	}
+	return nil
+}
+
+// queryLen returns the length of the query string or fragment of a URL with which s starts, if it does.
+func queryLen(s string) int {
+	if s == "" || s[0] != '?' && s[0] != '#' {
+		return 0
+	}
+	if end := strings.IndexAny(s, " \t\r\n\"'<>)"); end != -1 {
+		return end
+	}
+	return len(s)
+}
@@ -0,0 +1,118 @@
+package cropreplace
+
+import (
+	"errors"
+	"strconv"
+	"testing"
+)
+
+// mockSign is a signFunc returning a fake signed URL for the object.
+func mockSign(object string) (string, error) {
+	return "https://storage.googleapis.com/media/" + object + "?Signature=abc", nil
+}
+
+func TestSignReplacements(t *testing.T) {
+	r := newRunner(DefaultConfig())
+	const urlPrefix = "https://example.com/wp-content/uploads"
+	atts := []attachment{
+		{
+			fileName: "/2018/bcd.png", ext: ".png",
+			crops: []crop{
+				{"200x180", 200, 180, ""},
+			},
+		},
+		{fileName: "/old.png", ext: ".png", refPrefix: "https://example.com"},
+		{
+			fileName: "/2019/cdn.png", ext: ".png", guidPrefix: "https://cdn.example.net/media",
+			crops: []crop{
+				{"200x180", 200, 180, ""},
+			},
+		},
+		{
+			fileName: "/2018/tom&jerry.jpg", ext: ".jpg",
+			crops: []crop{
+				{"300x200", 300, 200, ""},
+			},
+		},
+	}
+	cases := []struct {
+		original string
+		desired  string
+	}{
+		{
+			"<img src='https://example.com/wp-content/uploads/2018/bcd-210x195.png'>",
+			"<img src='https://storage.googleapis.com/media/uploads/2018/bcd-200x180.png?Signature=abc'>",
+		},
+		{
+			"<img src='https://example.com/wp-content/uploads/2018/bcd-30x15.png'>",
+			"<img src='https://storage.googleapis.com/media/uploads/2018/bcd.png?Signature=abc'>",
+		},
+		{ // Existing crops are left alone.
+			"<img src='https://example.com/wp-content/uploads/2018/bcd-200x180.png'>",
+			"<img src='https://example.com/wp-content/uploads/2018/bcd-200x180.png'>",
+		},
+		{ // Relative references are replaced as usual.
+			"<img src='/2018/bcd-210x195.png'>",
+			"<img src='/2018/bcd-200x180.png'>",
+		},
+		{
+			"<img srcset='https://example.com/wp-content/uploads/2018/bcd-210x195.png 210w'>",
+			"<img srcset='https://storage.googleapis.com/media/uploads/2018/bcd-200x180.png?Signature=abc 200w'>",
+		},
+		{
+			"<img src='https://example.com/old-300x200.png'>",
+			"<img src='https://storage.googleapis.com/media/uploads/old.png?Signature=abc'>",
+		},
+		{ // The attachment has the URL prefix of the second guid prefix.
+			"<img src='https://cdn.example.net/media/2019/cdn-210x195.png'>",
+			"<img src='https://storage.googleapis.com/media/uploads/2019/cdn-200x180.png?Signature=abc'>",
+		},
+		{ // The object signed is named with an ampersand, not the entity in the reference.
+			"<img src='https://example.com/wp-content/uploads/2018/tom&amp;jerry-310x210.jpg'>",
+			"<img src='https://storage.googleapis.com/media/uploads/2018/tom&jerry-300x200.jpg?Signature=abc'>",
+		},
+		{
+			"<img src='https://example.com/wp-content/uploads/2018/tom&#038;jerry-30x15.jpg'>",
+			"<img src='https://storage.googleapis.com/media/uploads/2018/tom&jerry.jpg?Signature=abc'>",
+		},
+		{ // The query string and fragment of the reference are replaced with the rest of the URL.
+			"<img src='https://example.com/wp-content/uploads/2018/bcd-210x195.png?ver=3#top'>",
+			"<img src='https://storage.googleapis.com/media/uploads/2018/bcd-200x180.png?Signature=abc'>",
+		},
+		{
+			"<img srcset='https://example.com/wp-content/uploads/2018/bcd-210x195.png?ver=3 210w, " +
+				"https://example.com/wp-content/uploads/2018/bcd-30x15.png?ver=3 30w'>",
+			"<img srcset='https://storage.googleapis.com/media/uploads/2018/bcd-200x180.png?Signature=abc 200w, " +
+				"https://storage.googleapis.com/media/uploads/2018/bcd.png?Signature=abc 30w'>",
+		},
+		{ // The content host is the CDN.
+			"<img src='https://cdn.example.com/wp-content/uploads/2018/bcd-210x195.png'>",
+			"<img src='https://storage.googleapis.com/media/uploads/2018/bcd-200x180.png?Signature=abc'>",
+		},
+	}
+	r.cfg.ContentHost = "cdn.example.com"
+	for i, tc := range cases {
+		t.Run("case_"+strconv.Itoa(i), func(t *testing.T) {
+			reps := r.findReplacements(tc.original, r.newFileIndex(atts), tolerance{35, 100})
+			if err := r.signReplacements(tc.original, reps, urlPrefix, func(name string) string {
+				return "uploads" + name
+			}, mockSign); err != nil {
+				t.Fatal(err)
+			}
+			if got := r.applyReplacements(tc.original, reps); got != tc.desired {
+				t.Errorf("got %q but expected %q", got, tc.desired)
+			}
+		})
+	}
+}
+
+func TestSignReplacementsError(t *testing.T) {
+	r := newRunner(DefaultConfig())
+	atts := []attachment{{fileName: "/2018/bcd.png", ext: ".png"}}
+	content := "https://example.com/2018/bcd-30x15.png"
+	reps := r.findReplacements(content, r.newFileIndex(atts), tolerance{35, 100})
+	fail := func(string) (string, error) { return "", errors.New("no key") }
+	if err := r.signReplacements(content, reps, "https://example.com", r.objectName, fail); err == nil {
+		t.Error("expected an error from the signer to be returned")
+	}
+}
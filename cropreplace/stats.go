@@ -0,0 +1,120 @@
+package cropreplace
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// A Report holds the counts accumulated over a run.
+type Report struct {
+	Scanned      int `json:"scanned"`      // posts whose content was scanned
+	Changed      int `json:"changed"`      // posts whose content was changed
+	Replacements int `json:"replacements"` // crop references replaced
+	Missing      int `json:"missing"`      // attachments whose file is missing from the bucket
+	NoCrops      int `json:"no_crops"`     // attachments in the bucket without crops, if counted
+	Skipped      int `json:"skipped"`      // attachments skipped, such as those without an extension
+	Oversized    int `json:"oversized"`    // posts not updated because the update would be too large
+	Unaudited    int `json:"unaudited"`    // posts not updated because their audit objects could not be uploaded
+	MetaScanned  int `json:"meta_scanned"` // meta values scanned
+	MetaChanged  int `json:"meta_changed"` // meta values changed
+	RolledBack   int `json:"rolled_back"`  // posts whose changes were rolled back after a failure, uncounted above
+
+	LastID int64 `json:"last_id"` // the ID of the last post scanned
+
+	// References counts the crop references found, keyed by the kind of replacement made for them.
+	References map[string]int `json:"references"`
+}
+
+// newReport returns a Report with all counts at zero.
+func newReport() *Report {
+	return &Report{References: make(map[string]int, 4)}
+}
+
+// rollBack takes back the changes counted since the counts were changed, replacements, and metaChanged, which
+// were made in a transaction that is rolled back, counting the posts changed as rolled back instead.
+func (st *Report) rollBack(changed, replacements, metaChanged int) {
+	st.RolledBack += st.Changed - changed
+	st.Changed, st.Replacements, st.MetaChanged = changed, replacements, metaChanged
+}
+
+// countReplacements adds to the counts the replacements made in a post.
+func (st *Report) countReplacements(reps []replacement) {
+	for i := range reps {
+		st.References[reps[i].kind.String()]++
+	}
+	st.Replacements += countChanges(reps)
+}
+
+// summary returns a line summarizing the counts, saying that posts would be updated if dryRun is true.
+func (st *Report) summary(dryRun bool) string {
+	updated := "updated"
+	if dryRun {
+		updated = "would update"
+	}
+	s := fmt.Sprintf("Scanned %d posts, %s %d, made %d replacements, %d attachments missing from bucket.",
+		st.Scanned, updated, st.Changed, st.Replacements, st.Missing)
+	if st.NoCrops > 0 {
+		s += fmt.Sprintf(" %d attachments have no crops.", st.NoCrops)
+	}
+	if st.MetaScanned > 0 {
+		s += fmt.Sprintf(" Scanned %d meta values, %s %d.", st.MetaScanned, updated, st.MetaChanged)
+	}
+	if st.Oversized > 0 {
+		s += fmt.Sprintf(" Skipped %d oversized updates.", st.Oversized)
+	}
+	if st.Unaudited > 0 {
+		s += fmt.Sprintf(" Skipped %d posts that could not be audited.", st.Unaudited)
+	}
+	if st.RolledBack > 0 {
+		s += fmt.Sprintf(" Rolled back the changes to %d posts after a failure.", st.RolledBack)
+	}
+	return s
+}
+
+// progress returns a line saying how many of the total posts have been scanned and changed so far, saying that
+// posts would be updated if dryRun is true.
+func (st *Report) progress(total int, dryRun bool) string {
+	updated := "updated"
+	if dryRun {
+		updated = "would update"
+	}
+	percent := 100.0
+	if total > 0 {
+		percent = float64(st.Scanned) / float64(total) * 100
+	}
+	return fmt.Sprintf("Scanned %d of %d posts (%.1f%%), %s %d so far.", st.Scanned, total, percent, updated, st.Changed)
+}
+
+// A runMetadata describes a run as a whole.
+type runMetadata struct {
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished"`
+	Duration float64   `json:"duration_seconds"`
+	Backend  string    `json:"backend"`
+	Bucket   string    `json:"bucket"`
+	PostType string    `json:"post_type"`
+	Error    string    `json:"error,omitempty"` // set if the run failed part way
+}
+
+// A statsReport is what is written to the file given by StatsOut.
+type statsReport struct {
+	Run   runMetadata `json:"run"`
+	Stats *Report     `json:"stats"`
+}
+
+// writeStats writes the metadata and the stats of a run as JSON to the file at path, replacing any existing file.
+func writeStats(path string, meta runMetadata, st *Report) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "\t")
+	if err := enc.Encode(statsReport{Run: meta, Stats: st}); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
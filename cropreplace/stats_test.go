@@ -0,0 +1,211 @@
+package cropreplace
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestWriteStats(t *testing.T) {
+	dir, err := ioutil.TempDir("", "crop-replace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "stats.json")
+
+	st := newReport()
+	st.Scanned = 3
+	st.Changed = 1
+	st.Missing = 2
+	st.countReplacements([]replacement{{kind: kindExact}, {kind: kindClose}, {kind: kindFallback}, {kind: kindClose}})
+	started := time.Date(2018, 11, 2, 10, 0, 0, 0, time.UTC)
+	meta := runMetadata{
+		Started:  started,
+		Finished: started.Add(90 * time.Second),
+		Duration: 90,
+		Backend:  backendGCS,
+		Bucket:   "media",
+		PostType: "post",
+		Error:    "could not update row 4",
+	}
+	if err := writeStats(path, meta, st); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got map[string]map[string]interface{}
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatalf("the stats file is not valid JSON: %v", err)
+	}
+	if len(got) != 2 {
+		t.Errorf("got %d top-level keys but expected run and stats", len(got))
+	}
+	checkKeys(t, "run", got["run"],
+		"backend", "bucket", "duration_seconds", "error", "finished", "post_type", "started")
+	checkKeys(t, "stats", got["stats"],
+		"changed", "last_id", "meta_changed", "meta_scanned", "missing", "no_crops", "oversized", "references",
+		"replacements", "rolled_back", "scanned", "skipped", "unaudited")
+
+	if got["run"]["started"] != "2018-11-02T10:00:00Z" || got["run"]["duration_seconds"] != 90.0 {
+		t.Errorf("got run metadata %v", got["run"])
+	}
+	if got["stats"]["replacements"] != 3.0 || got["stats"]["scanned"] != 3.0 {
+		t.Errorf("got stats %v", got["stats"])
+	}
+	refs, _ := got["stats"]["references"].(map[string]interface{})
+	if refs["exact"] != 1.0 || refs["close"] != 2.0 || refs["fallback"] != 1.0 {
+		t.Errorf("got references %v", refs)
+	}
+}
+
+// checkKeys checks that the object m, found under name, has exactly the given keys.
+func checkKeys(t *testing.T, name string, m map[string]interface{}, keys ...string) {
+	t.Helper()
+	got := make([]string, 0, len(m))
+	for k := range m {
+		got = append(got, k)
+	}
+	sort.Strings(got)
+	if len(got) != len(keys) {
+		t.Errorf("got keys %v in %s but expected %v", got, name, keys)
+		return
+	}
+	for i := range got {
+		if got[i] != keys[i] {
+			t.Errorf("got keys %v in %s but expected %v", got, name, keys)
+			return
+		}
+	}
+}
+
+func TestRunStatsSummary(t *testing.T) {
+	cases := []struct {
+		st      Report
+		dryRun  bool
+		summary string
+	}{
+		{
+			Report{Scanned: 4210, Changed: 318, Replacements: 742, Missing: 12},
+			false,
+			"Scanned 4210 posts, updated 318, made 742 replacements, 12 attachments missing from bucket.",
+		},
+		{
+			Report{Scanned: 10, Changed: 2, Replacements: 3},
+			true,
+			"Scanned 10 posts, would update 2, made 3 replacements, 0 attachments missing from bucket.",
+		},
+		{
+			Report{Scanned: 10, Changed: 2, Replacements: 5, MetaScanned: 7, MetaChanged: 1, Oversized: 1, Unaudited: 2},
+			false,
+			"Scanned 10 posts, updated 2, made 5 replacements, 0 attachments missing from bucket. " +
+				"Scanned 7 meta values, updated 1. Skipped 1 oversized updates. Skipped 2 posts that could not be audited.",
+		},
+		{
+			Report{Scanned: 10, Changed: 0, Replacements: 0, RolledBack: 3},
+			false,
+			"Scanned 10 posts, updated 0, made 0 replacements, 0 attachments missing from bucket. " +
+				"Rolled back the changes to 3 posts after a failure.",
+		},
+		{
+			Report{Scanned: 10, Changed: 2, Replacements: 3, Missing: 1, NoCrops: 4},
+			false,
+			"Scanned 10 posts, updated 2, made 3 replacements, 1 attachments missing from bucket. " +
+				"4 attachments have no crops.",
+		},
+	}
+	for i, tc := range cases {
+		t.Run("case_"+strconv.Itoa(i), func(t *testing.T) {
+			if got := tc.st.summary(tc.dryRun); got != tc.summary {
+				t.Errorf("got %q but expected %q", got, tc.summary)
+			}
+		})
+	}
+}
+
+func TestRunStatsProgress(t *testing.T) {
+	cases := []struct {
+		st       Report
+		total    int
+		dryRun   bool
+		progress string
+	}{
+		{Report{Scanned: 1000, Changed: 12}, 250000, false, "Scanned 1000 of 250000 posts (0.4%), updated 12 so far."},
+		{Report{Scanned: 500, Changed: 0}, 1000, true, "Scanned 500 of 1000 posts (50.0%), would update 0 so far."},
+		{Report{}, 0, false, "Scanned 0 of 0 posts (100.0%), updated 0 so far."},
+	}
+	for i, tc := range cases {
+		t.Run("case_"+strconv.Itoa(i), func(t *testing.T) {
+			if got := tc.st.progress(tc.total, tc.dryRun); got != tc.progress {
+				t.Errorf("got %q but expected %q", got, tc.progress)
+			}
+		})
+	}
+}
+
+func TestReplaceImageCropsCounts(t *testing.T) {
+	r := newRunner(DefaultConfig())
+	atts := []attachment{
+		{
+			fileName: "/2018/bcd.png", ext: ".png",
+			crops: []crop{
+				{"200x180", 200, 180, ""},
+			},
+		},
+	}
+	db, _ := newFakeDB(t,
+		fakePost{ID: 1, postType: "post", content: "<img src='/2018/bcd-210x195.png'><img src='/2018/bcd-20x18.png'>"},
+		fakePost{ID: 2, postType: "post", content: "<img src='/2018/bcd-200x180.png'>"},
+		fakePost{ID: 3, postType: "post", content: "text"},
+	)
+	defer db.Close()
+
+	st := newReport()
+	err := r.replaceImageCrops(context.Background(), sqlDB{db}, []string{"post"}, r.newFileIndex(atts), nil, nil, st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Report{
+		Scanned: 3, Changed: 1, Replacements: 2, LastID: 3,
+		References: map[string]int{"exact": 1, "close": 1, "fallback": 1},
+	}
+	if !reflect.DeepEqual(*st, want) {
+		t.Errorf("got stats %+v but expected %+v", *st, want)
+	}
+}
+
+func TestReplaceImageCropsCountsRolledBack(t *testing.T) {
+	r := newRunner(DefaultConfig())
+	r.cfg.MaxChanges = 1
+
+	atts := []attachment{{fileName: "/2018/bcd.png", ext: ".png", crops: []crop{{"200x180", 200, 180, ""}}}}
+	db, fdb := newFakeDB(t,
+		fakePost{ID: 1, postType: "post", content: "<img src='/2018/bcd-210x195.png'>"},
+		fakePost{ID: 2, postType: "post", content: "<img src='/2018/bcd-205x185.png'>"},
+	)
+	defer db.Close()
+
+	// The second post found exceeds maxchanges, so the update of the first is rolled back.
+	st := newReport()
+	if err := r.replaceImageCrops(context.Background(), sqlDB{db}, []string{"post"}, r.newFileIndex(atts), nil, nil,
+		st); err == nil {
+		t.Fatal("got no error exceeding maxchanges")
+	}
+	if fdb.rollbacks != 1 {
+		t.Errorf("got %d rollbacks but expected 1", fdb.rollbacks)
+	}
+	if st.Changed != 0 || st.Replacements != 0 || st.RolledBack != 1 {
+		t.Errorf("got %d changed, %d replacements, and %d rolled back but expected 0, 0, and 1", st.Changed,
+			st.Replacements, st.RolledBack)
+	}
+}
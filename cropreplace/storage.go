@@ -0,0 +1,303 @@
+package cropreplace
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"golang.org/x/net/http/httpproxy"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
+)
+
+// The storage backends that a bucket may be hosted on.
+const (
+	backendGCS = "gcs"
+	backendS3  = "s3"
+)
+
+// An objectStore gives the names of the objects in a storage bucket.
+type objectStore interface {
+	// ListWithPrefix returns the names of all objects whose names begin with prefix.
+	ListWithPrefix(ctx context.Context, prefix string) ([]string, error)
+}
+
+// newObjectStore creates an objectStore for the named bucket on the given backend, unless LocalDir is set, in which
+// case the objects are listed from that directory instead, or ListingFile is set, in which case the objects are those
+// that file lists.
+func (r *runner) newObjectStore(backend, bucketName string) (objectStore, error) {
+	if r.cfg.LocalDir != "" {
+		return &localStore{root: r.cfg.LocalDir}, nil
+	}
+	if r.cfg.ListingFile != "" {
+		return readListingFile(r.cfg.ListingFile)
+	}
+	httpClient, err := storageHTTPClient(r.cfg.HTTPProxy)
+	if err != nil {
+		return nil, err
+	}
+	if backend == backendS3 {
+		config := &aws.Config{Region: aws.String(r.cfg.Region)}
+		if httpClient != nil {
+			config.HTTPClient = httpClient
+		}
+		sess, err := session.NewSession(config)
+		if err != nil {
+			return nil, err
+		}
+		return &s3Store{client: s3.New(sess), bucket: bucketName}, nil
+	}
+	ctx := context.Background()
+	opts, err := gcsClientOptions(ctx, r.cfg.Credentials, httpClient)
+	if err != nil {
+		return nil, err
+	}
+	client, err := storage.NewClient(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &gcsStore{handle: client.Bucket(bucketName)}, nil
+}
+
+// gcsClientOptions returns the options of a read-only GCS client that authenticates with the service account
+// key in the file credentials or, if credentials is empty, without authentication, in which case all desired
+// objects must be public. If httpClient is not nil, requests are sent with it.
+func gcsClientOptions(ctx context.Context, credentials string, httpClient *http.Client) ([]option.ClientOption, error) {
+	opts := []option.ClientOption{option.WithScopes(storage.ScopeReadOnly)}
+	switch {
+	case credentials == "":
+		opts = append(opts, option.WithoutAuthentication())
+		if httpClient != nil {
+			opts = append(opts, option.WithHTTPClient(httpClient))
+		}
+	case httpClient == nil:
+		opts = append(opts, option.WithCredentialsFile(credentials))
+	default:
+		// The client given replaces the credentials, so it must itself authenticate, sending its requests and
+		// those for tokens through the proxy.
+		data, err := ioutil.ReadFile(credentials)
+		if err != nil {
+			return nil, err
+		}
+		ctx = context.WithValue(ctx, oauth2.HTTPClient, httpClient)
+		creds, err := google.CredentialsFromJSON(ctx, data, storage.ScopeReadOnly)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, option.WithHTTPClient(oauth2.NewClient(ctx, creds.TokenSource)))
+	}
+	return opts, nil
+}
+
+// storageHTTPClient returns an HTTP client that sends requests through the proxy at proxyURL, or nil if
+// proxyURL is empty. Without a proxy given, the storage clients use the HTTP_PROXY, HTTPS_PROXY, and NO_PROXY
+// environment variables as usual. With one given, it replaces HTTP_PROXY and HTTPS_PROXY but the hosts listed
+// in NO_PROXY are still reached directly. The database connection is plain TCP and never uses a proxy.
+func storageHTTPClient(proxyURL string) (*http.Client, error) {
+	if proxyURL == "" {
+		return nil, nil
+	}
+	if _, err := url.Parse(proxyURL); err != nil {
+		return nil, fmt.Errorf("invalid proxy URL %q; %v", proxyURL, err)
+	}
+	proxy := proxyFunc(proxyURL, getEnvAny("NO_PROXY", "no_proxy"))
+	transport := &http.Transport{
+		Proxy: func(req *http.Request) (*url.URL, error) {
+			return proxy(req.URL)
+		},
+		TLSHandshakeTimeout: 10 * time.Second,
+		IdleConnTimeout:     90 * time.Second,
+	}
+	return &http.Client{Transport: transport}, nil
+}
+
+// proxyFunc returns a function giving the proxy to use for each request URL: the one at proxyURL, unless the
+// host is matched by the comma-separated noProxy list.
+func proxyFunc(proxyURL, noProxy string) func(*url.URL) (*url.URL, error) {
+	config := &httpproxy.Config{
+		HTTPProxy:  proxyURL,
+		HTTPSProxy: proxyURL,
+		NoProxy:    noProxy,
+	}
+	return config.ProxyFunc()
+}
+
+// getEnvAny returns the value of the first of the named environment variables that is set.
+func getEnvAny(names ...string) string {
+	for _, name := range names {
+		if v := os.Getenv(name); v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// A gcsStore lists objects in a Google Cloud Storage bucket.
+type gcsStore struct {
+	handle *storage.BucketHandle
+}
+
+func (g *gcsStore) ListWithPrefix(ctx context.Context, prefix string) ([]string, error) {
+	var names []string
+	it := g.handle.Objects(ctx, &storage.Query{Prefix: prefix})
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		obj, err := it.Next()
+		if err == iterator.Done {
+			return names, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, obj.Name)
+	}
+}
+
+// An s3Lister is the part of the S3 API used by an s3Store.
+type s3Lister interface {
+	ListObjectsV2WithContext(aws.Context, *s3.ListObjectsV2Input, ...request.Option) (*s3.ListObjectsV2Output, error)
+}
+
+// An s3Store lists objects in an Amazon S3 bucket.
+type s3Store struct {
+	client s3Lister
+	bucket string
+}
+
+func (s *s3Store) ListWithPrefix(ctx context.Context, prefix string) ([]string, error) {
+	var names []string
+	input := &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucket),
+		Prefix: aws.String(prefix),
+	}
+	for {
+		out, err := s.client.ListObjectsV2WithContext(ctx, input)
+		if err != nil {
+			return nil, err
+		}
+		for _, obj := range out.Contents {
+			names = append(names, aws.StringValue(obj.Key))
+		}
+		if !aws.BoolValue(out.IsTruncated) {
+			return names, nil
+		}
+		input.ContinuationToken = out.NextContinuationToken
+	}
+}
+
+// A localStore lists files in a directory as if they were the objects of a bucket. The name of each object is
+// the slash-separated path of the file relative to root, just as it would be in the bucket.
+type localStore struct {
+	root string
+}
+
+func (l *localStore) ListWithPrefix(_ context.Context, prefix string) ([]string, error) {
+	// Only the directory that the prefix falls in can have matching files.
+	dir := prefix
+	if !strings.HasSuffix(dir, "/") {
+		dir = path.Dir(dir)
+	}
+	var names []string
+	err := filepath.Walk(filepath.Join(l.root, filepath.FromSlash(dir)), func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(l.root, p)
+		if err != nil {
+			return err
+		}
+		if name := filepath.ToSlash(rel); strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+		return nil
+	})
+	// Match the lexicographic order in which buckets list objects.
+	sort.Strings(names)
+	return names, err
+}
+
+// A listedStore answers ListWithPrefix from a single listing of all objects under a prefix, made when it is
+// created, rather than asking the bucket each time. Holding every name in memory costs roughly the length of
+// the names, which for a bucket of a million crops is on the order of a hundred megabytes, but it replaces a
+// request per attachment with one paginated listing.
+type listedStore struct {
+	names []string // sorted
+}
+
+// newListedStore lists all the objects of store whose names begin with prefix.
+func newListedStore(ctx context.Context, store objectStore, prefix string) (*listedStore, error) {
+	names, err := store.ListWithPrefix(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	return &listedStore{names: names}, nil
+}
+
+// readListingFile reads the object names listed one per line in the file at path, which may be compressed with
+// gzip. Blank lines are ignored.
+func readListingFile(path string) (*listedStore, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	br := bufio.NewReader(f)
+	var r io.Reader = br
+	if magic, _ := br.Peek(2); len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		r = gz
+	}
+	var names []string
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		if name := strings.TrimSuffix(sc.Text(), "\r"); name != "" {
+			names = append(names, name)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("reading %s; %v", path, err)
+	}
+	sort.Strings(names)
+	return &listedStore{names: names}, nil
+}
+
+func (l *listedStore) ListWithPrefix(_ context.Context, prefix string) ([]string, error) {
+	// The names with the prefix are together in sorted order.
+	i := sort.SearchStrings(l.names, prefix)
+	j := i
+	for j < len(l.names) && strings.HasPrefix(l.names[j], prefix) {
+		j++
+	}
+	return l.names[i:j:j], nil
+}
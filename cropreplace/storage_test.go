@@ -0,0 +1,617 @@
+package cropreplace
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"google.golang.org/api/option"
+)
+
+// A memStore is an objectStore holding the names of objects in memory.
+type memStore []string
+
+func (m memStore) ListWithPrefix(_ context.Context, prefix string) ([]string, error) {
+	var names []string
+	for _, name := range m {
+		if strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func TestCheckStorageObjects(t *testing.T) {
+	r := newRunner(DefaultConfig())
+	store := memStore{
+		"media/2018/abc.png",
+		"media/2018/abc-200x180.png",
+		"media/2018/abc-400x320.png",
+		"media/2018/abc-400x320.jpg",
+		"media/2018/abcdef.png",
+		"media/2018/rjj-600x450.jpeg",
+	}
+	atts := []attachment{
+		{fileName: "/2018/abc.png", ext: ".png"},
+		{fileName: "/2018/rjj.jpeg", ext: ".jpeg"},
+	}
+	if err := checkStorageObjectsWithPrefix(t, r, "media", store, atts); err != nil {
+		t.Fatal(err)
+	}
+	want := []attachment{
+		{
+			fileName: "/2018/abc.png", ext: ".png",
+			crops: []crop{
+				{"200x180", 200, 180, ""},
+				{"400x320", 400, 320, ""},
+			},
+		},
+		{
+			fileName: "/2018/rjj.jpeg", ext: ".jpeg", missing: true,
+			crops: []crop{
+				{"600x450", 600, 450, ""},
+			},
+		},
+	}
+	if !reflect.DeepEqual(atts, want) {
+		t.Errorf("got %+v but expected %+v", atts, want)
+	}
+}
+
+// checkStorageObjectsWithPrefix runs r.checkStorageObjects with the bucketPrefix flag set to prefix.
+func checkStorageObjectsWithPrefix(t *testing.T, r *runner, prefix string, store objectStore, atts []attachment) error {
+	t.Helper()
+	defer func(orig string) { r.cfg.BucketPrefix = orig }(r.cfg.BucketPrefix)
+	r.cfg.BucketPrefix = prefix
+	return r.checkStorageObjects(context.Background(), store, atts)
+}
+
+// manyAttachments returns n attachments and a store holding the file of each, along with some crops, except
+// that every seventh file is missing.
+func manyAttachments(n int) ([]attachment, memStore) {
+	atts := make([]attachment, n)
+	var store memStore
+	for i := range atts {
+		name := "/" + strconv.Itoa(i) + "/photo"
+		atts[i] = attachment{ID: int64(i), fileName: name + ".jpg", ext: ".jpg"}
+		if i%7 != 0 {
+			store = append(store, "media"+name+".jpg")
+		}
+		for j := 1; j <= i%4; j++ {
+			store = append(store, "media"+name+"-"+strconv.Itoa(j*100)+"x"+strconv.Itoa(j*50)+".jpg")
+		}
+	}
+	return atts, store
+}
+
+func TestCheckStorageObjectsConcurrency(t *testing.T) {
+	r := newRunner(DefaultConfig())
+
+	serial, store := manyAttachments(200)
+	r.cfg.Concurrency = 1
+	if err := checkStorageObjectsWithPrefix(t, r, "media", store, serial); err != nil {
+		t.Fatal(err)
+	}
+	for _, n := range []int{2, 8, 500} {
+		t.Run("concurrency_"+strconv.Itoa(n), func(t *testing.T) {
+			atts, _ := manyAttachments(200)
+			r.cfg.Concurrency = n
+			if err := checkStorageObjectsWithPrefix(t, r, "media", store, atts); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(atts, serial) {
+				t.Errorf("got attachments %+v but expected %+v", atts, serial)
+			}
+		})
+	}
+}
+
+// A failingStore is an objectStore that fails to list the objects with a given prefix.
+type failingStore struct {
+	memStore
+	prefix string
+}
+
+func (f failingStore) ListWithPrefix(ctx context.Context, prefix string) ([]string, error) {
+	if prefix == f.prefix {
+		return nil, errors.New("listing failed for " + prefix)
+	}
+	return f.memStore.ListWithPrefix(ctx, prefix)
+}
+
+func TestCheckStorageObjectsError(t *testing.T) {
+	r := newRunner(DefaultConfig())
+	for _, n := range []int{1, 8} {
+		t.Run("concurrency_"+strconv.Itoa(n), func(t *testing.T) {
+			r.cfg.Concurrency = n
+			atts, store := manyAttachments(50)
+			err := checkStorageObjectsWithPrefix(t, r, "media", failingStore{store, "media/20/photo"}, atts)
+			if err == nil || err.Error() != "listing failed for media/20/photo" {
+				t.Errorf("got error %v", err)
+			}
+		})
+	}
+}
+
+// A slowStore is an objectStore that takes some time to list objects, as a remote bucket does.
+type slowStore memStore
+
+func (s slowStore) ListWithPrefix(ctx context.Context, prefix string) ([]string, error) {
+	time.Sleep(100 * time.Microsecond)
+	return memStore(s).ListWithPrefix(ctx, prefix)
+}
+
+func BenchmarkCheckStorageObjects(b *testing.B) {
+	r := newRunner(DefaultConfig())
+	r.cfg.BucketPrefix = "media"
+	_, store := manyAttachments(500)
+	for i := 0; i < 500; i += 7 {
+		store = append(store, "media/"+strconv.Itoa(i)+"/photo.jpg") // so that no errors are printed
+	}
+	for _, n := range []int{1, 8, 32} {
+		b.Run("concurrency_"+strconv.Itoa(n), func(b *testing.B) {
+			r.cfg.Concurrency = n
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				atts, _ := manyAttachments(500)
+				b.StartTimer()
+				if err := r.checkStorageObjects(context.Background(), slowStore(store), atts); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// A pagedS3 is an s3Lister that returns the keys of each page in turn.
+type pagedS3 struct {
+	pages  [][]string
+	tokens []string // the continuation tokens received
+}
+
+func (p *pagedS3) ListObjectsV2WithContext(_ aws.Context, in *s3.ListObjectsV2Input,
+	_ ...request.Option) (*s3.ListObjectsV2Output, error) {
+	p.tokens = append(p.tokens, aws.StringValue(in.ContinuationToken))
+	page := len(p.tokens) - 1
+	out := &s3.ListObjectsV2Output{IsTruncated: aws.Bool(page < len(p.pages)-1)}
+	for _, key := range p.pages[page] {
+		out.Contents = append(out.Contents, &s3.Object{Key: aws.String(key)})
+	}
+	if *out.IsTruncated {
+		out.NextContinuationToken = aws.String("page" + strconv.Itoa(page+1))
+	}
+	return out, nil
+}
+
+func TestS3StorePagination(t *testing.T) {
+	lister := &pagedS3{pages: [][]string{{"a.png", "a-10x10.png"}, {"a-20x20.png"}, {"a-30x30.png"}}}
+	store := &s3Store{client: lister, bucket: "media"}
+	got, err := store.ListWithPrefix(context.Background(), "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"a.png", "a-10x10.png", "a-20x20.png", "a-30x30.png"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got names %v but expected %v", got, want)
+	}
+	if want := []string{"", "page1", "page2"}; !reflect.DeepEqual(lister.tokens, want) {
+		t.Errorf("got continuation tokens %v but expected %v", lister.tokens, want)
+	}
+}
+
+func TestLocalStore(t *testing.T) {
+	root, err := ioutil.TempDir("", "crop-replace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	for _, name := range []string{
+		"media/2018/abc.png",
+		"media/2018/abc-200x180.png",
+		"media/2018/abcdef/other.png",
+		"media/2018/bcd.png",
+		"media/2019/abc.png",
+	} {
+		p := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	store := &localStore{root: root}
+	cases := []struct {
+		prefix string
+		names  []string
+	}{
+		{"media/2018/abc", []string{"media/2018/abc-200x180.png", "media/2018/abc.png", "media/2018/abcdef/other.png"}},
+		{"media/2018/", []string{"media/2018/abc-200x180.png", "media/2018/abc.png", "media/2018/abcdef/other.png",
+			"media/2018/bcd.png"}},
+		{"media/2020/abc", nil},
+		{"nothing", nil},
+	}
+	for i, tc := range cases {
+		t.Run("case_"+strconv.Itoa(i), func(t *testing.T) {
+			got, err := store.ListWithPrefix(context.Background(), tc.prefix)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tc.names) {
+				t.Errorf("got %v but expected %v", got, tc.names)
+			}
+		})
+	}
+}
+
+func TestProxyFunc(t *testing.T) {
+	proxy := proxyFunc("http://proxy.internal:3128", "localhost,.corp.example.com")
+	cases := []struct {
+		target string
+		proxy  string
+	}{
+		{"https://storage.googleapis.com/storage/v1/b/media/o", "http://proxy.internal:3128"},
+		{"https://media.s3.amazonaws.com/?list-type=2", "http://proxy.internal:3128"},
+		{"http://localhost:9000/media", ""},
+		{"https://minio.corp.example.com/media", ""},
+	}
+	for i, tc := range cases {
+		t.Run("case_"+strconv.Itoa(i), func(t *testing.T) {
+			target, err := url.Parse(tc.target)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := proxy(target)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tc.proxy == "" {
+				if got != nil {
+					t.Errorf("got proxy %v but expected none", got)
+				}
+			} else if got == nil || got.String() != tc.proxy {
+				t.Errorf("got proxy %v but expected %v", got, tc.proxy)
+			}
+		})
+	}
+}
+
+func TestStorageHTTPClient(t *testing.T) {
+	if c, err := storageHTTPClient(""); c != nil || err != nil {
+		t.Errorf("got (%v, %v) without a proxy but expected neither a client nor an error", c, err)
+	}
+	c, err := storageHTTPClient("http://proxy.internal:3128")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c == nil || c.Transport.(*http.Transport).Proxy == nil {
+		t.Error("expected a client with a proxied transport")
+	}
+	if _, err := storageHTTPClient("http://bad host:3128"); err == nil {
+		t.Error("expected an error for an invalid proxy URL")
+	}
+}
+
+func TestCheckStorageObjectsMixedCase(t *testing.T) {
+	r := newRunner(DefaultConfig())
+	store := memStore{
+		"media/2018/photo.JPG",
+		"media/2018/photo-600x340.jpg",
+		"media/2018/photo-300x170.JPG",
+		"media/2018/photo-150x85.jpeg",
+	}
+	atts := []attachment{{fileName: "/2018/photo.JPG", ext: ".JPG"}}
+	if err := checkStorageObjectsWithPrefix(t, r, "media", store, atts); err != nil {
+		t.Fatal(err)
+	}
+	want := []crop{
+		{"300x170", 300, 170, ""},
+		{"600x340", 600, 340, ".jpg"},
+	}
+	if !reflect.DeepEqual(atts[0].crops, want) {
+		t.Errorf("got crops %v but expected %v", atts[0].crops, want)
+	}
+}
+
+func TestCheckStorageObjectsExtraVariants(t *testing.T) {
+	r := newRunner(DefaultConfig())
+	store := memStore{
+		"media/2018/photo.jpg",
+		"media/2018/photo-600x340.jpg",
+		"media/2018/photo-600x340.jpg.webp",
+		"media/2018/photo-300x170.webp",
+		"media/2018/photo-300x170.avif",
+		"media/2018/photo-150x85.png",
+	}
+	cases := []struct {
+		exts  []string
+		crops []crop
+	}{
+		{nil, []crop{{"600x340", 600, 340, ""}}},
+		{[]string{".webp"}, []crop{
+			{"300x170", 300, 170, ".webp"},
+			{"600x340", 600, 340, ""},
+			{"600x340", 600, 340, ".jpg.webp"},
+		}},
+		{[]string{".webp", ".avif"}, []crop{
+			{"300x170", 300, 170, ".avif"},
+			{"300x170", 300, 170, ".webp"},
+			{"600x340", 600, 340, ""},
+			{"600x340", 600, 340, ".jpg.webp"},
+		}},
+	}
+	for i, tc := range cases {
+		t.Run("case_"+strconv.Itoa(i), func(t *testing.T) {
+			r.variantExts = tc.exts
+			atts := []attachment{{fileName: "/2018/photo.jpg", ext: ".jpg"}}
+			if err := checkStorageObjectsWithPrefix(t, r, "media", store, atts); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(atts[0].crops, tc.crops) {
+				t.Errorf("got crops %v but expected %v", atts[0].crops, tc.crops)
+			}
+		})
+	}
+}
+
+func TestListedStore(t *testing.T) {
+	r := newRunner(DefaultConfig())
+	atts, store := manyAttachments(100)
+	store = append(store, "other/1/photo.jpg", "media/1/photograph.jpg", "media/10/photo-1x1.png")
+	listed, err := newListedStore(context.Background(), store, "media")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := checkStorageObjectsWithPrefix(t, r, "media", store, atts); err != nil {
+		t.Fatal(err)
+	}
+	got, _ := manyAttachments(100)
+	if err := checkStorageObjectsWithPrefix(t, r, "media", listed, got); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, atts) {
+		t.Errorf("got attachments %+v but expected %+v", got, atts)
+	}
+
+	for _, prefix := range []string{"media/1/photo", "media/99/photo", "media/5", "media/none", "other"} {
+		names, _ := listed.ListWithPrefix(context.Background(), prefix)
+		want, _ := store.ListWithPrefix(context.Background(), prefix)
+		if prefix == "other" {
+			want = nil // not under the prefix listed
+		}
+		if len(names) != len(want) || len(names) > 0 && !reflect.DeepEqual(names, want) {
+			t.Errorf("got names %q for prefix %q but expected %q", names, prefix, want)
+		}
+	}
+}
+
+func TestReadListingFile(t *testing.T) {
+	r := newRunner(DefaultConfig())
+	atts, store := manyAttachments(100)
+	if err := checkStorageObjectsWithPrefix(t, r, "media", store, atts); err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "crop-replace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The listing is written in another order, with Windows line endings and blank lines.
+	listing := strings.Join(store[len(store)/2:], "\r\n") + "\n\n" + strings.Join(store[:len(store)/2], "\n") + "\n"
+	var gzipped bytes.Buffer
+	gz := gzip.NewWriter(&gzipped)
+	gz.Write([]byte(listing))
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string][]byte{"listing.txt": []byte(listing), "listing.txt.gz": gzipped.Bytes()}
+	for name, data := range files {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(dir, name)
+			if err := ioutil.WriteFile(path, data, 0600); err != nil {
+				t.Fatal(err)
+			}
+			listed, err := readListingFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, _ := manyAttachments(100)
+			if err := checkStorageObjectsWithPrefix(t, r, "media", listed, got); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, atts) {
+				t.Errorf("got attachments %+v but expected %+v", got, atts)
+			}
+		})
+	}
+
+	if _, err := readListingFile(filepath.Join(dir, "missing.txt")); err == nil {
+		t.Error("got no error reading a missing file")
+	}
+}
+
+func TestCheckStorageObjectsCancelled(t *testing.T) {
+	r := newRunner(DefaultConfig())
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	atts, store := manyAttachments(20)
+	r.cfg.BucketPrefix = "media"
+	if err := r.checkStorageObjects(ctx, store, atts); err != context.Canceled {
+		t.Errorf("got error %v but expected %v", err, context.Canceled)
+	}
+	for i := range atts {
+		if atts[i].crops != nil || atts[i].missing {
+			t.Errorf("attachment %d was checked", i)
+		}
+	}
+}
+
+func TestGCSClientOptions(t *testing.T) {
+	proxied := &http.Client{}
+	cases := []struct {
+		credentials string
+		httpClient  *http.Client
+		opts        []option.ClientOption
+	}{
+		{"", nil, []option.ClientOption{
+			option.WithScopes(storage.ScopeReadOnly),
+			option.WithoutAuthentication(),
+		}},
+		{"", proxied, []option.ClientOption{
+			option.WithScopes(storage.ScopeReadOnly),
+			option.WithoutAuthentication(),
+			option.WithHTTPClient(proxied),
+		}},
+		{"key.json", nil, []option.ClientOption{
+			option.WithScopes(storage.ScopeReadOnly),
+			option.WithCredentialsFile("key.json"),
+		}},
+	}
+	for i, tc := range cases {
+		t.Run("case_"+strconv.Itoa(i), func(t *testing.T) {
+			opts, err := gcsClientOptions(context.Background(), tc.credentials, tc.httpClient)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(opts, tc.opts) {
+				t.Errorf("got options %#v but expected %#v", opts, tc.opts)
+			}
+		})
+	}
+}
+
+func TestGCSClientOptionsProxied(t *testing.T) {
+	dir, err := ioutil.TempDir("", "crop-replace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	key := filepath.Join(dir, "key.json")
+	data := `{"type": "authorized_user", "client_id": "id", "client_secret": "secret", "refresh_token": "token"}`
+	if err := ioutil.WriteFile(key, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	opts, err := gcsClientOptions(context.Background(), key, &http.Client{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The credentials are in the HTTP client given instead of in an option of their own.
+	if len(opts) != 2 || reflect.TypeOf(opts[1]) != reflect.TypeOf(option.WithHTTPClient(nil)) {
+		t.Errorf("got options %#v", opts)
+	}
+
+	if _, err := gcsClientOptions(context.Background(), filepath.Join(dir, "none.json"), &http.Client{}); err == nil {
+		t.Error("expected an error for a missing key file")
+	}
+}
+
+func TestCheckStorageObjectsTemplate(t *testing.T) {
+	r := newRunner(DefaultConfig())
+	r.cfg.ObjectTemplate = "{year}-{month}/{name}"
+	store := memStore{
+		"media/2018-08/photo.jpg",
+		"media/2018-08/photo-300x200.jpg",
+		"media/2018/08/photo-600x400.jpg",
+	}
+	atts := []attachment{{fileName: "/2018/08/photo.jpg", ext: ".jpg"}}
+	if err := checkStorageObjectsWithPrefix(t, r, "media", store, atts); err != nil {
+		t.Fatal(err)
+	}
+	want := []attachment{{fileName: "/2018/08/photo.jpg", ext: ".jpg", crops: []crop{{"300x200", 300, 200, ""}}}}
+	if !reflect.DeepEqual(atts, want) {
+		t.Errorf("got %+v but expected %+v", atts, want)
+	}
+}
+
+func TestCheckStorageObjectsNoCrops(t *testing.T) {
+	r := newRunner(DefaultConfig())
+	r.cfg.WarnNoCrops = true
+	var out bytes.Buffer
+	r.out = &out
+
+	store := memStore{
+		"media/2018/abc.png",
+		"media/2018/abc-200x180.png",
+		"media/2018/bare.jpg",
+	}
+	atts := []attachment{
+		{ID: 3, fileName: "/2018/abc.png", ext: ".png"},
+		{ID: 5, fileName: "/2018/bare.jpg", ext: ".jpg"},
+		{ID: 8, fileName: "/2018/gone.jpg", ext: ".jpg"},
+	}
+	if err := checkStorageObjectsWithPrefix(t, r, "media", store, atts); err != nil {
+		t.Fatal(err)
+	}
+	if n := countNoCrops(atts); n != 1 {
+		t.Errorf("got %d attachments without crops but expected 1", n)
+	}
+	if got := out.String(); !strings.Contains(got, "Attachment 5 has no crops of /2018/bare.jpg") ||
+		strings.Contains(got, "Attachment 3 ") || strings.Contains(got, "Attachment 8 ") {
+		t.Errorf("got output %q but expected a warning about only attachment 5", got)
+	}
+}
+
+func TestCheckStorageObjectsUnderscore(t *testing.T) {
+	r := newRunner(DefaultConfig())
+	r.cfg.CropSeparator = "_"
+	store := memStore{
+		"media/2018/photo.jpg",
+		"media/2018/photo_300x200.jpg",
+		"media/2018/photo-600x400.jpg",
+		"media/2018/photo_big_600x400.jpg",
+	}
+	atts := []attachment{{fileName: "/2018/photo.jpg", ext: ".jpg"}}
+	if err := checkStorageObjectsWithPrefix(t, r, "media", store, atts); err != nil {
+		t.Fatal(err)
+	}
+	want := []attachment{{fileName: "/2018/photo.jpg", ext: ".jpg", crops: []crop{{"300x200", 300, 200, ""}}}}
+	if !reflect.DeepEqual(atts, want) {
+		t.Errorf("got %+v but expected %+v", atts, want)
+	}
+}
+
+func TestCheckStorageObjectsLookalikes(t *testing.T) {
+	r := newRunner(DefaultConfig())
+	store := memStore{
+		"media/2018/photo.jpg",
+		"media/2018/photo-300x200.jpg",
+		"media/2018/photo-1920x1080.jpg",
+		"media/2018/photo-1920x1080-600x340.jpg",
+	}
+	atts := []attachment{
+		{fileName: "/2018/photo.jpg", ext: ".jpg"},
+		{fileName: "/2018/photo-1920x1080.jpg", ext: ".jpg"},
+	}
+	r.findLookalikes(atts)
+	if err := checkStorageObjectsWithPrefix(t, r, "media", store, atts); err != nil {
+		t.Fatal(err)
+	}
+	want := []attachment{
+		{
+			fileName: "/2018/photo.jpg", ext: ".jpg", crops: []crop{{"300x200", 300, 200, ""}},
+			lookalikes: []string{"/2018/photo-1920x1080.jpg"},
+		},
+		{fileName: "/2018/photo-1920x1080.jpg", ext: ".jpg", crops: []crop{{"600x340", 600, 340, ""}}},
+	}
+	if !reflect.DeepEqual(atts, want) {
+		t.Errorf("got %+v but expected %+v", atts, want)
+	}
+}
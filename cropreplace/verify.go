@@ -0,0 +1,170 @@
+package cropreplace
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// A verification groups the crop references found in some content by what it would take to fix them.
+type verification struct {
+	fine      []string // references to crops that exist in the bucket
+	closeCrop []string // references fixable with a close variant
+	fallback  []string // references fixable only with the un-cropped image
+	kept      []string // references without a close variant that NoFallback leaves broken
+	narrow    []string // references to crops without a close variant that are narrower than MinReplaceWidth
+	unfixable []string // references to unknown attachments or to attachments missing from the bucket
+}
+
+// add appends the references in v2 to those in v.
+func (v *verification) add(v2 *verification) {
+	v.fine = append(v.fine, v2.fine...)
+	v.closeCrop = append(v.closeCrop, v2.closeCrop...)
+	v.fallback = append(v.fallback, v2.fallback...)
+	v.kept = append(v.kept, v2.kept...)
+	v.narrow = append(v.narrow, v2.narrow...)
+	v.unfixable = append(v.unfixable, v2.unfixable...)
+}
+
+// verifyContent categorizes each crop reference in content. References to crops of the files are categorized
+// by how replaceCrops would handle them with the given width tolerance, and any other crop referenced under one
+// of guidPrefixes (which must have trailing slashes) is unfixable because no attachment matches it.
+func (r *runner) verifyContent(content string, files *fileIndex, guidPrefixes []string, tol tolerance) verification {
+	var v verification
+	reps := r.findReplacements(content, files, tol)
+	r.applyReplacements(content, reps)
+	for i := range reps {
+		rep := &reps[i]
+		switch {
+		case rep.kind == kindSkipped:
+		case rep.kind == kindExact:
+			v.fine = append(v.fine, rep.old)
+		case rep.kind == kindClose, rep.kind == kindDuplicate:
+			v.closeCrop = append(v.closeCrop, rep.old)
+		case rep.file.missing:
+			// The un-cropped image does not exist either.
+			v.unfixable = append(v.unfixable, rep.old)
+		case rep.kind == kindKept:
+			v.kept = append(v.kept, rep.old)
+		case rep.kind == kindNarrow:
+			v.narrow = append(v.narrow, rep.old)
+		default:
+			v.fallback = append(v.fallback, rep.old)
+		}
+	}
+	for _, guidPrefix := range guidPrefixes {
+		trimmedLen := len(guidPrefix) - 1
+		for _, indx := range stringIndexes(content, guidPrefix) {
+			start := indx + trimmedLen
+			ref := content[start:]
+			if end := strings.IndexAny(ref, "\"' \t\r\n<>()?#,"); end != -1 {
+				ref = ref[:end]
+			}
+			if !replacedAt(reps, start) && r.isCropReference(ref) {
+				v.unfixable = append(v.unfixable, ref)
+			}
+		}
+	}
+	return v
+}
+
+// replacedAt says whether the text at offset i is part of one of the replacements, which may begin before the
+// reference at i, as those of whole URLs do.
+func replacedAt(reps []replacement, i int) bool {
+	for j := range reps {
+		if reps[j].start <= i && i < reps[j].end() {
+			return true
+		}
+	}
+	return false
+}
+
+// isCropReference says whether the path ref names a cropped variant of some image.
+func (r *runner) isCropReference(ref string) bool {
+	ext := path.Ext(ref)
+	if ext == "" {
+		return false
+	}
+	sep := strings.LastIndexByte(ref[:len(ref)-len(ext)], (r.cfg.CropSeparator)[0])
+	return sep != -1 && r.getCropVariant(ref[sep:], ext) != nil
+}
+
+// needsFixing says whether any of the references in v are not fine.
+func (v *verification) needsFixing() bool {
+	return len(v.closeCrop)+len(v.fallback)+len(v.kept)+len(v.narrow)+len(v.unfixable) > 0
+}
+
+// verifyCrops reports, without modifying anything, how each crop reference in the posts with one of the postTypes
+// would be handled, and then prints the totals in each category. The references in the extra columns of postColumns
+// are verified along with those in the content and, if ScanMeta is set, so are those in the meta values of the posts.
+func (r *runner) verifyCrops(db queryer, postTypes []string, files *fileIndex) error {
+	posts, err := r.queryPosts(db, postTypes)
+	if err != nil {
+		return err
+	}
+	prefixes, tol := r.guidPrefixes(), r.flagTolerance()
+	var total verification
+	for i := range posts {
+		v := r.verifyContent(posts[i].content, files, prefixes, tol)
+		for j := range r.postColumns {
+			extra := r.verifyContent(posts[i].extra[j], files, prefixes, tol)
+			v.add(&extra)
+		}
+		if v.needsFixing() {
+			r.printVerification("post", posts[i].ID, &v)
+		}
+		total.add(&v)
+	}
+	scanned := fmt.Sprintf("%d posts", len(posts))
+	fields := logFields{"posts": len(posts)}
+	if r.cfg.ScanMeta {
+		metas, err := r.queryMeta(db, postTypes)
+		if err != nil {
+			return err
+		}
+		for i := range metas {
+			v := r.verifyContent(metas[i].value, files, prefixes, tol)
+			if v.needsFixing() {
+				r.printVerification("meta", metas[i].ID, &v)
+			}
+			total.add(&v)
+		}
+		scanned += fmt.Sprintf(" and %d meta values", len(metas))
+		fields["meta"] = len(metas)
+	}
+	fields["fine"], fields["close"], fields["fallback"] = len(total.fine), len(total.closeCrop), len(total.fallback)
+	fields["kept"], fields["narrow"], fields["unfixable"] = len(total.kept), len(total.narrow), len(total.unfixable)
+	r.logWith(levelNotice, fields, "Verified %s: %d fine, %d fixable by close variant, %d fixable only by un-cropped "+
+		"fallback, %d kept without a fallback, %d too narrow to replace, %d unfixable.", scanned, len(total.fine),
+		len(total.closeCrop), len(total.fallback), len(total.kept), len(total.narrow), len(total.unfixable))
+	return nil
+}
+
+// printVerification prints by category the references found in the row of the given kind, post or meta, having the
+// given ID. In JSON log format, each category is a field of a single JSON line.
+func (r *runner) printVerification(kind string, id int64, v *verification) {
+	if r.cfg.LogFormat == logFormatJSON {
+		r.logWith(levelNotice, logFields{kind + "_id": id, "fine": v.fine, "close": v.closeCrop,
+			"fallback": v.fallback, "kept": v.kept, "narrow": v.narrow, "unfixable": v.unfixable}, "Verified %s %d",
+			kind, id)
+		return
+	}
+	fmt.Fprintf(r.out, "%s %d:\n", strings.ToUpper(kind[:1])+kind[1:], id)
+	r.printReferences("fine", v.fine)
+	r.printReferences("fixable by close variant", v.closeCrop)
+	r.printReferences("fixable only by un-cropped fallback", v.fallback)
+	r.printReferences("kept without a fallback", v.kept)
+	r.printReferences("too narrow to replace", v.narrow)
+	r.printReferences("unfixable", v.unfixable)
+}
+
+// printReferences prints the references in a category, if there are any.
+func (r *runner) printReferences(category string, refs []string) {
+	if len(refs) == 0 {
+		return
+	}
+	fmt.Fprintf(r.out, "\t%s (%d):\n", category, len(refs))
+	for _, ref := range refs {
+		fmt.Fprintf(r.out, "\t\t%s\n", ref)
+	}
+}
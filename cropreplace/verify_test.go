@@ -0,0 +1,200 @@
+package cropreplace
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func TestVerifyContent(t *testing.T) {
+	r := newRunner(DefaultConfig())
+	const (
+		prefix    = "https://example.com/uploads/"
+		cdnPrefix = "https://cdn.example.net/media/"
+	)
+	atts := []attachment{
+		{
+			fileName: "/2018/bcd.png", ext: ".png",
+			crops: []crop{
+				{"200x180", 200, 180, ""},
+			},
+		},
+		{fileName: "/2018/gone.jpg", ext: ".jpg", missing: true},
+	}
+	cases := []struct {
+		content string
+		want    verification
+	}{
+		{"no images here", verification{}},
+		{
+			"<img src='" + prefix + "2018/bcd-200x180.png'>",
+			verification{fine: []string{"/2018/bcd-200x180.png"}},
+		},
+		{
+			prefix + "2018/bcd-210x190.png " + prefix + "2018/bcd-30x20.png",
+			verification{closeCrop: []string{"/2018/bcd-210x190.png"}, fallback: []string{"/2018/bcd-30x20.png"}},
+		},
+		{
+			"<img src=\"" + prefix + "2018/gone-300x200.jpg\"> " + prefix + "2018/other-300x200.jpg?ver=2",
+			verification{unfixable: []string{"/2018/gone-300x200.jpg", "/2018/other-300x200.jpg"}},
+		},
+		{
+			prefix + "2018/other.jpg " + prefix + "2018/other-photo.jpg",
+			verification{},
+		},
+		{ // Unknown crops are found under every guid prefix.
+			cdnPrefix + "2018/bcd-200x180.png " + cdnPrefix + "2018/other-300x200.jpg",
+			verification{fine: []string{"/2018/bcd-200x180.png"}, unfixable: []string{"/2018/other-300x200.jpg"}},
+		},
+	}
+	for i, tc := range cases {
+		t.Run("case_"+strconv.Itoa(i), func(t *testing.T) {
+			got := r.verifyContent(tc.content, r.newFileIndex(atts), []string{prefix, cdnPrefix}, tolerance{35, 100})
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got %+v but expected %+v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestVerifyContentNoFallback(t *testing.T) {
+	r := newRunner(DefaultConfig())
+	const prefix = "https://example.com/uploads/"
+	atts := []attachment{
+		{
+			fileName: "/2018/bcd.png", ext: ".png",
+			crops: []crop{
+				{"200x180", 200, 180, ""},
+			},
+		},
+		{fileName: "/2018/gone.jpg", ext: ".jpg", missing: true},
+	}
+	content := prefix + "2018/bcd-210x190.png " + prefix + "2018/bcd-30x20.png " + prefix + "2018/gone-300x200.jpg"
+	cases := []struct {
+		noFallback bool
+		want       verification
+	}{
+		{false, verification{closeCrop: []string{"/2018/bcd-210x190.png"}, fallback: []string{"/2018/bcd-30x20.png"},
+			unfixable: []string{"/2018/gone-300x200.jpg"}}},
+		{true, verification{closeCrop: []string{"/2018/bcd-210x190.png"}, kept: []string{"/2018/bcd-30x20.png"},
+			unfixable: []string{"/2018/gone-300x200.jpg"}}},
+	}
+	for i, tc := range cases {
+		t.Run("case_"+strconv.Itoa(i), func(t *testing.T) {
+			r.cfg.NoFallback = tc.noFallback
+			got := r.verifyContent(content, r.newFileIndex(atts), []string{prefix}, tolerance{35, 100})
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got %+v but expected %+v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestVerifyContentMinReplaceWidth(t *testing.T) {
+	r := newRunner(DefaultConfig())
+	const prefix = "https://example.com/uploads/"
+	r.cfg.GUIDPrefix = prefix
+	atts := []attachment{
+		{
+			fileName: "/2018/bcd.png", ext: ".png",
+			crops: []crop{
+				{"200x180", 200, 180, ""},
+			},
+		},
+	}
+	content := prefix + "2018/bcd-10x10.png " + prefix + "2018/bcd-600x400.png"
+	cases := []struct {
+		minWidth    int
+		placeholder string
+		want        verification
+	}{
+		{0, "", verification{fallback: []string{"/2018/bcd-10x10.png", "/2018/bcd-600x400.png"}}},
+		{50, "", verification{fallback: []string{"/2018/bcd-600x400.png"}, narrow: []string{"/2018/bcd-10x10.png"}}},
+		{50, "https://example.com/blank.gif", verification{fallback: []string{prefix + "2018/bcd-600x400.png"},
+			narrow: []string{"/2018/bcd-10x10.png"}}},
+	}
+	for i, tc := range cases {
+		t.Run("case_"+strconv.Itoa(i), func(t *testing.T) {
+			r.cfg.MinReplaceWidth = tc.minWidth
+			r.cfg.Placeholder = tc.placeholder
+			got := r.verifyContent(content, r.newFileIndex(atts), []string{prefix}, tolerance{35, 100})
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got %+v but expected %+v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestVerifyCrops(t *testing.T) {
+	r := newRunner(DefaultConfig())
+	r.postColumns = []string{"post_excerpt"}
+	r.cfg.GUIDPrefix = "https://example.com/uploads/"
+	r.cfg.LogFormat = logFormatJSON
+
+	atts := []attachment{
+		{
+			fileName: "/2018/bcd.png", ext: ".png",
+			crops: []crop{
+				{"200x180", 200, 180, ""},
+			},
+		},
+	}
+	db, fdb := newFakeDB(t,
+		fakePost{ID: 1, postType: "post", content: "/2018/bcd-200x180.png",
+			extra: map[string]string{"post_excerpt": "/2018/bcd-210x190.png"}},
+		fakePost{ID: 2, postType: "post", content: "text", extra: map[string]string{"post_excerpt": "text"}},
+	)
+	defer db.Close()
+	fdb.addMeta(
+		fakeMeta{ID: 10, postID: 2, value: `a:1:{s:3:"src";s:19:"/2018/bcd-30x15.png";}`},
+		fakeMeta{ID: 11, postID: 2, value: "/2018/bcd-200x180.png"},
+	)
+
+	cases := []struct {
+		scanMeta bool
+		lines    []map[string]interface{} // the fields of each line expected
+	}{
+		{false, []map[string]interface{}{
+			{"post_id": 1.0, "fine": []interface{}{"/2018/bcd-200x180.png"},
+				"close": []interface{}{"/2018/bcd-210x190.png"}},
+			{"posts": 2.0, "fine": 1.0, "close": 1.0, "fallback": 0.0},
+		}},
+		{true, []map[string]interface{}{
+			{"post_id": 1.0, "close": []interface{}{"/2018/bcd-210x190.png"}},
+			{"meta_id": 10.0, "fallback": []interface{}{"/2018/bcd-30x15.png"}},
+			{"posts": 2.0, "meta": 2.0, "fine": 2.0, "close": 1.0, "fallback": 1.0},
+		}},
+	}
+	for i, tc := range cases {
+		t.Run("case_"+strconv.Itoa(i), func(t *testing.T) {
+			r.cfg.ScanMeta = tc.scanMeta
+			var out bytes.Buffer
+			r.out = &out
+			if err := r.verifyCrops(db, []string{"post"}, r.newFileIndex(atts)); err != nil {
+				t.Fatal(err)
+			}
+			var lines []map[string]interface{}
+			sc := bufio.NewScanner(&out)
+			for sc.Scan() {
+				var line map[string]interface{}
+				if err := json.Unmarshal(sc.Bytes(), &line); err != nil {
+					t.Fatal(err)
+				}
+				lines = append(lines, line)
+			}
+			if len(lines) != len(tc.lines) {
+				t.Fatalf("got %d lines in %q but expected %d", len(lines), out.String(), len(tc.lines))
+			}
+			for j, fields := range tc.lines {
+				for k, want := range fields {
+					if !reflect.DeepEqual(lines[j][k], want) {
+						t.Errorf("got %s %v in line %d but expected %v", k, lines[j][k], j, want)
+					}
+				}
+			}
+		})
+	}
+}
@@ -2,13 +2,15 @@ module github.com/dchenk/crop-replace
 
 require (
 	cloud.google.com/go v0.32.0
+	github.com/aws/aws-sdk-go v1.15.69
 	github.com/go-sql-driver/mysql v1.4.1-0.20181031140716-fd197cdcfae0
 	github.com/google/martian v2.1.0+incompatible // indirect
 	github.com/googleapis/gax-go v2.0.0+incompatible // indirect
+	github.com/jmespath/go-jmespath v0.0.0-20160202185014-0b12d6b521d8 // indirect
 	github.com/ttacon/chalk v0.0.0-20160626202418-22c06c80ed31
 	go.opencensus.io v0.18.0 // indirect
-	golang.org/x/net v0.0.0-20181102091132-c10e9556a7bc // indirect
-	golang.org/x/oauth2 v0.0.0-20181102170140-232e45548389 // indirect
+	golang.org/x/net v0.0.0-20181102091132-c10e9556a7bc
+	golang.org/x/oauth2 v0.0.0-20181102170140-232e45548389
 	google.golang.org/api v0.0.0-20181102150758-04bb50b6b83d
 	google.golang.org/genproto v0.0.0-20181101192439-c830210a61df // indirect
 	google.golang.org/grpc v1.16.0 // indirect
@@ -1,515 +1,300 @@
-// This program loops over each post and replaces occurrences of cropped media attachment URLs that do not
-// exist with URLs of (similar) crops that exist in the GCS bucket being used.
-//
-// It is assumed that the post_content column for the transformed posts is simply text (or HTML) and not
-// a data structure encoded as JSON or serialized by PHP.
-//
-// Before you run this tool, you must first make sure that the "guid" column for all "attachment" posts
-// begins the same way--with a site address.
+// Command crop-replace replaces occurrences of cropped media attachment URLs that do not exist with URLs of
+// (similar) crops that exist in the GCS or S3 bucket being used. It sets each field of a cropreplace.Config with
+// the flag of the same name in lowercase and runs cropreplace.Run with it.
 package main
 
 import (
 	"context"
-	"database/sql"
-	"errors"
 	"flag"
 	"fmt"
-	"math"
 	"os"
-	"path/filepath"
-	"strconv"
-	"strings"
-	"time"
-
-	"cloud.google.com/go/storage"
-	"github.com/go-sql-driver/mysql"
-	"github.com/ttacon/chalk"
-	"google.golang.org/api/iterator"
-	"google.golang.org/api/option"
+	"os/signal"
+
+	"github.com/dchenk/crop-replace/cropreplace"
 )
 
-var (
-	bucket = flag.String("bucket", "", "the bucket name")
+// exitBudgetExhausted is the exit code of a run that stops early because its maxruntime budget is exhausted,
+// telling a scheduler that the program should be run again.
+const exitBudgetExhausted = 3
 
-	dbHost   = flag.String("dbhost", "", "the database host")
-	dbName   = flag.String("dbname", "", "the database name")
-	dbUser   = flag.String("dbuser", "", "the database user")
-	dbPass   = flag.String("dbpass", "", "the database password")
-	dbPrefix = flag.String("dbprefix", "", "the WP database table prefix")
+func main() {
+	c := cropreplace.DefaultConfig()
+	bindFlags(&c)
+	flag.Parse()
 
-	guidPrefix = flag.String("guidprefix", "",
-		"the start of each 'guid' in the attachments, with a trailing slash")
-	bucketPrefix = flag.String("bucketprefix", "",
-		"the prefix that all objects in the bucket have, without a trailing slash")
-	noBucketPrefix = flag.Bool("nobucketprefix", false, "if true, then no bucket prefix is expected")
+	// The context is cancelled on an interrupt, after which no more storage requests are made and the transaction
+	// is rolled back.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cancelOnInterrupt(cancel)
 
-	postType = flag.String("posttype", "post", "the post_type to transform")
+	report, err := cropreplace.Run(ctx, c)
+	if err == cropreplace.ErrMissingConfig {
+		if c.LogFormat != "json" {
+			fmt.Println("Flags defined:")
+		}
+		flag.PrintDefaults()
+	}
+	switch {
+	case err == cropreplace.ErrBudgetExhausted:
+		os.Exit(exitBudgetExhausted)
+	case c.Check:
+		if code := checkExitCode(&report, err); code != 0 {
+			os.Exit(code)
+		}
+	}
+}
 
-	widthDiffTolerance = flag.Float64("widthtolerance", 35.0, "the maximum tolerated difference in width between replaced images")
+// bindFlags defines a flag setting each field of c, with the value in c as its default.
+func bindFlags(c *cropreplace.Config) {
+	flag.StringVar(&c.Bucket, "bucket", c.Bucket, "the bucket name")
+	flag.StringVar(&c.Backend, "backend", c.Backend, "the storage service hosting the bucket: gcs or s3")
+	flag.StringVar(&c.Region, "region", c.Region, "the region of the bucket (for S3)")
+
+	flag.StringVar(&c.HTTPProxy, "httpproxy", c.HTTPProxy, "the URL of an HTTP proxy to send storage requests through")
+
+	flag.StringVar(&c.Credentials, "credentials", c.Credentials, "the JSON key file of a service account to read a "+
+		"private GCS bucket with (by default, objects must be public)")
+
+	flag.StringVar(&c.LocalDir, "localdir", c.LocalDir, "a directory holding a copy of the bucket's objects to use "+
+		"instead of the bucket")
+	flag.StringVar(&c.ListingFile, "listingfile", c.ListingFile, "a file, which may be gzipped, listing the names of "+
+		"the bucket's objects one per line to use instead of the bucket")
+
+	flag.BoolVar(&c.LazyCheck, "lazycheck", c.LazyCheck, "instead of listing the crops of every attachment up front, "+
+		"check for each crop in the bucket when a reference to it is first found; since only the crops referenced "+
+		"are known, a missing crop is replaced with another one only if that one is referenced too")
+
+	flag.BoolVar(&c.Precheck, "precheck", c.Precheck, "before listing the crops of every attachment, check that the "+
+		"files of some attachments are in the bucket, and stop if none are")
+
+	flag.StringVar(&c.DBHost, "dbhost", c.DBHost, "the database host, which may have a port that overrides dbport")
+	flag.IntVar(&c.DBPort, "dbport", c.DBPort, "the database port")
+	flag.StringVar(&c.DBName, "dbname", c.DBName, "the database name")
+	flag.StringVar(&c.DBUser, "dbuser", c.DBUser, "the database user")
+	flag.StringVar(&c.DBPass, "dbpass", c.DBPass, "the database password")
+	flag.StringVar(&c.DBPrefix, "dbprefix", c.DBPrefix, "the WP database table prefix")
+	flag.IntVar(&c.BlogID, "blogid", c.BlogID, "the ID of the site of a multisite network whose posts to transform")
+
+	flag.StringVar(&c.TableSuffix, "tablesuffix", c.TableSuffix, "the name of the posts table after the table prefix")
+	flag.StringVar(&c.ContentColumn, "contentcolumn", c.ContentColumn,
+		"the column of the posts table holding the content")
+
+	flag.StringVar(&c.DBPassFile, "dbpassfile", c.DBPassFile, "a file holding the database password, used if dbpass "+
+		"is not set; if neither is set, the password is taken from the DB_PASSWORD environment variable")
 
-	verbose = flag.Bool("verbose", false, "verbose mode")
-)
+	flag.StringVar(&c.DBCharset, "dbcharset", c.DBCharset, "the character set of the database connection, or empty to "+
+		"use the server's default; other connection parameters may be set with dsn")
 
-func init() {
-	flag.Parse()
-}
+	flag.StringVar(&c.DSN, "dsn", c.DSN, "a data source name for the MySQL driver, used as it is instead of the other "+
+		"db flags except dbprefix and blogid, for connection parameters that have no flag of their own")
 
-func main() {
-	switch {
-	case *bucket == "",
-		*dbHost == "", *dbName == "", *dbUser == "", *dbPass == "", *dbPrefix == "",
-		*guidPrefix == "", *bucketPrefix == "" && !*noBucketPrefix:
-		fmt.Println(chalk.Red.Color("All command line arguments must be set."))
-		fmt.Println("Currently got:")
-		for k, v := range map[string]*string{
-			"bucket":       bucket,
-			"dbhost":       dbHost,
-			"dbname":       dbName,
-			"dbuser":       dbUser,
-			"dbpass":       dbPass,
-			"dbprefix":     dbPrefix,
-			"guidprefix":   guidPrefix,
-			"bucketprefix": bucketPrefix,
-		} {
-			fmt.Printf("\t%v %q\n", k, *v)
-		}
-		fmt.Printf("\t%v %v\n", "nobucketprefix", *noBucketPrefix)
-		fmt.Println("Flags defined:")
-		flag.PrintDefaults()
-		return
-	}
+	flag.IntVar(&c.DBMaxOpen, "dbmaxopen", c.DBMaxOpen, "the most connections to the database open at once, or 0 for "+
+		"no limit")
+	flag.IntVar(&c.DBMaxIdle, "dbmaxidle", c.DBMaxIdle, "the most idle connections to the database kept open")
+	flag.DurationVar(&c.DBConnLifetime, "dbconnlifetime", c.DBConnLifetime, "the longest a connection to the database "+
+		"is reused, or 0 to reuse connections indefinitely")
 
-	if !strings.HasSuffix(*guidPrefix, "/") {
-		printErr(fmt.Sprintf("The given guidprefix argument %q does not have a trailing slash, which indicates "+
-			"that it might not be what it should be", *guidPrefix), errInvalidCommand)
-		return
-	}
+	flag.StringVar(&c.DBTLS, "dbtls", c.DBTLS, "whether to use TLS for the database connection: false, true, "+
+		"skip-verify, or preferred")
+	flag.StringVar(&c.DBCA, "dbca", c.DBCA, "a PEM file with the CA certificates to verify the database server with "+
+		"(implies -dbtls=true)")
 
-	if strings.HasSuffix(*bucketPrefix, "/") {
-		printErr(fmt.Sprintf("The given bucketprefix argument %q has a trailing slash but it must not", *bucketPrefix),
-			errInvalidCommand)
-		return
-	}
+	flag.StringVar(&c.GUIDPrefix, "guidprefix", c.GUIDPrefix, "the start of each 'guid' in the attachments, with a "+
+		"trailing slash; a comma-separated list is tried in order, and the first prefix is the one that content "+
+		"links to files with")
+	flag.StringVar(&c.AltGUIDPrefix, "altguidprefix", c.AltGUIDPrefix, "another start, with a trailing slash, that "+
+		"the 'guid' of legacy attachments may have instead of guidprefix")
+	flag.StringVar(&c.BucketPrefix, "bucketprefix", c.BucketPrefix, "the prefix that all objects in the bucket have, "+
+		"without a trailing slash")
+	flag.BoolVar(&c.NoBucketPrefix, "nobucketprefix", c.NoBucketPrefix, "if true, then no bucket prefix is expected")
 
-	switch *postType {
-	case "post", "page":
-	default:
-		printErr("The posttype argument must be either post or page", errInvalidCommand)
-		return
-	}
+	flag.BoolVar(&c.StrictGUID, "strictguid", c.StrictGUID, "stop if the guid of any attachment does not have a guid "+
+		"prefix, instead of skipping the attachment")
 
-	db := makeConn(*dbHost, *dbName, *dbUser, *dbPass)
-	defer db.Close()
+	flag.StringVar(&c.ContentHost, "contenthost", c.ContentHost, "another host, such as a CDN, that content may link "+
+		"to attachments at, which replaces the host of the guid prefixes")
 
-	attachments := getAttachments(db)
-	if len(attachments) == 0 {
-		fmt.Println("There aren't any attachments to sync up.")
-		return
-	}
-	fmt.Println("Retrieved", len(attachments), "attachment posts.")
-
-	client, err := storage.NewClient(context.Background(),
-		option.WithScopes(storage.ScopeReadOnly),
-		option.WithoutAuthentication(), // All desired objects must be public.
-	)
-	if err != nil {
-		printErr("creating a storage client", err)
-		return
-	}
+	flag.StringVar(&c.ObjectTemplate, "objecttemplate", c.ObjectTemplate, "how the name of each object after the "+
+		"bucket prefix is made from the file name in the guid, such as {year}/{month}/{name}, with the placeholders "+
+		"{year}, {month}, {dir}, {name}, and {path} (by default, the file name is used as it is)")
 
-	bucketHandle := client.Bucket(*bucket)
-	if err := checkStorageObjects(bucketHandle, attachments); err != nil {
-		printErr("could not check for storage objects", err)
-		return
-	}
+	flag.BoolVar(&c.ListAll, "listall", c.ListAll, "list all objects under the bucket prefix at once and keep their "+
+		"names in memory instead of listing the objects of each attachment")
 
-	fmt.Println("Finished listing crop variants in bucket.")
+	flag.IntVar(&c.MaxRetries, "maxretries", c.MaxRetries, "the number of times to retry listing objects after a "+
+		"transient error")
+	flag.DurationVar(&c.RetryBase, "retrybase", c.RetryBase, "how long to wait before the first retry of a listing, "+
+		"after which the wait doubles with each retry")
 
-	err = replaceImageCrops(db, *postType, attachments)
-	if err != nil {
-		printErr("replacing images", err)
-	}
+	flag.IntVar(&c.Concurrency, "concurrency", c.Concurrency, "the maximum number of attachments whose objects are "+
+		"listed at once")
 
-}
+	flag.StringVar(&c.MimeFilter, "mimefilter", c.MimeFilter, "the start of the post_mime_type of the attachments "+
+		"whose crops are replaced (empty means all attachments)")
 
-var errInvalidCommand = errors.New("invalid command line arguments")
+	flag.StringVar(&c.IncludeFiles, "includefiles", c.IncludeFiles, "a comma-separated list of glob patterns, such as "+
+		"/2018/*/*.png or photo-*.jpg, matching the file names of the only attachments whose crops are replaced; a "+
+		"pattern without a slash is matched against the base name")
+	flag.StringVar(&c.ExcludeFiles, "excludefiles", c.ExcludeFiles, "a comma-separated list of glob patterns like "+
+		"those of includefiles matching the file names of attachments to leave alone; exclusion wins over inclusion")
 
-// An attachment contains the fields retrieved for our purposes for each post representing an attachment
-// along with a list of all of its cropped variants contained in the storage bucket.
-type attachment struct {
-	ID       int64
-	fileName string
-	ext      string
-	crops    []crop
-}
+	flag.IntVar(&c.AttachmentLimit, "attachmentlimit", c.AttachmentLimit, "the maximum number of attachments to load, "+
+		"in order of ID (0 means no limit)")
 
-type crop struct {
-	str           string // str contains the dimensions in the form "600x600" or "600x340"
-	width, height uint64
-}
+	flag.StringVar(&c.PostType, "posttype", c.PostType, "a comma-separated list of the post_type values to transform")
+	flag.StringVar(&c.PostStatus, "poststatus", c.PostStatus, "a comma-separated list of the post_status values to "+
+		"transform")
+	flag.StringVar(&c.ScanOrder, "scanorder", c.ScanOrder, "the order in which posts are updated: id or random")
 
-// getAttachments retrieves all of the attachment posts from the database table specified.
-func getAttachments(db *sql.DB) []attachment {
-	var attachmentsCount int64
-	if err := db.QueryRow(fmt.Sprintf("SELECT COUNT(*) FROM `%s` WHERE post_type = 'attachment'", tableName())).
-		Scan(&attachmentsCount); err != nil {
-		printErr("counting attachment rows", err)
-		return nil
-	}
-	if attachmentsCount == 0 {
-		return nil
-	}
+	flag.StringVar(&c.Since, "since", c.Since, "an RFC 3339 time, such as 2018-11-05T00:00:00Z; posts dated before "+
+		"it are left alone")
+	flag.StringVar(&c.Until, "until", c.Until, "an RFC 3339 time; posts dated after it are left alone")
+	flag.BoolVar(&c.UseGMT, "usegmt", c.UseGMT, "compare the since and until times in UTC with post_date_gmt "+
+		"rather than as written with post_date, which holds the site's local time")
 
-	// guidPrefixTrimmed is the guid prefix without the trailing slash.
-	guidPrefixTrimmed := (*guidPrefix)[:len(*guidPrefix)-1]
+	flag.StringVar(&c.IDs, "ids", c.IDs, "a comma-separated list of the IDs of the only posts to transform")
 
-	attachments := make([]attachment, 0, attachmentsCount)
+	flag.StringVar(&c.ContentLike, "contentlike", c.ContentLike, "a SQL LIKE pattern, such as %-___x___.%, that the "+
+		"content or an extra column of posts must match to be scanned; a pattern too narrow may miss some crops")
 
-	rows, err := db.Query(fmt.Sprintf("SELECT ID, guid from `%s` WHERE post_type = 'attachment' ORDER BY ID", tableName()))
-	if err != nil {
-		printErr("getting attachment rows", err)
-		return nil
-	}
-	defer rows.Close()
-	for rows.Next() {
-		var att attachment
-		var guid string
-		if err := rows.Scan(&att.ID, &guid); err != nil {
-			printErr("scanning an attachment row", err)
-			return nil
-		}
+	flag.Float64Var(&c.WidthTolerance, "widthtolerance", c.WidthTolerance, "the maximum tolerated difference "+
+		"in width between replaced images")
+	flag.Float64Var(&c.HeightTolerance, "heighttolerance", c.HeightTolerance,
+		"the maximum tolerated difference in height between replaced images (100 means no limit)")
 
-		// Extract the extension, including the leading dot.
-		att.ext = filepath.Ext(guid)
-		if att.ext == "" {
-			// If there is no extension, it's not likely that we're dealing with an image.
-			fmt.Println(chalk.Cyan.Color(fmt.Sprintf("Skipping file without extension: %v", att.fileName)))
-			continue
-		}
+	flag.StringVar(&c.Prefer, "prefer", c.Prefer, "which crop within the tolerances to use in place of a "+
+		"missing one: closest, larger (the closest at least as wide), or smaller (the closest at most as wide)")
 
-		if !strings.HasPrefix(guid, *guidPrefix) {
-			printErr(fmt.Sprintf("The row with ID %d has the guid %q but all attachments must have the same prefix.", att.ID, guid),
-				errors.New("unexpected value for the 'guid' column"))
-			return nil
-		}
+	flag.IntVar(&c.MinReplaceWidth, "minreplacewidth", c.MinReplaceWidth, "the width of a missing crop below which "+
+		"it's left alone, rather than replaced with the un-cropped image or the placeholder, if no crop is within the "+
+		"tolerances")
+	flag.BoolVar(&c.NoFallback, "nofallback", c.NoFallback, "leave alone each missing crop for which no crop is "+
+		"within the tolerances, rather than replacing it with the un-cropped image, and list it in the report")
 
-		// fileName will have guidPrefix removed but will have a leading slash.
-		att.fileName = strings.TrimPrefix(guid, guidPrefixTrimmed)
+	flag.IntVar(&c.MaxChanges, "maxchanges", c.MaxChanges, "the most crop references that may be replaced in a run, "+
+		"beyond which the transaction is rolled back and nothing is changed (0 means no limit)")
 
-		attachments = append(attachments, att)
-	}
-	if err := rows.Err(); err != nil {
-		printErr("looping over query rows", err)
-	}
+	flag.StringVar(&c.Canonical, "canonical", c.Canonical, "dimensions, such as 300x200, of a crop to which every "+
+		"crop reference is rewritten, even one to a crop that exists, if the attachment has a crop of that size")
 
-	return attachments
-}
+	flag.StringVar(&c.Placeholder, "placeholder", c.Placeholder, "the URL of an image to use in place of a missing "+
+		"crop for which no crop is within the tolerances, instead of the un-cropped image")
 
-// checkStorageObjects checks to make sure that all attachments have a corresponding file in the bucket and
-// populates the crops field of each attachment element.
-func checkStorageObjects(handle *storage.BucketHandle, atts []attachment) error {
-	var (
-		err   error
-		obj   *storage.ObjectAttrs
-		query storage.Query
-	)
+	flag.StringVar(&c.ExtraVariants, "extravariants", c.ExtraVariants, "a comma-separated list of extensions, such as "+
+		".webp,.avif, of other variants of each crop in the bucket")
 
-	for i := range atts {
-		att := &atts[i]
+	flag.StringVar(&c.CropSeparator, "cropseparator", c.CropSeparator, "the character between the file name and the "+
+		"dimensions of each crop, either - (as in photo-600x400.jpg) or _ (as in photo_600x400.jpg)")
 
-		if att.ext == "" {
-			continue // Must be checked already, so this is just in case.
-		}
+	flag.BoolVar(&c.SquareShorthand, "squareshorthand", c.SquareShorthand, "take a reference with a single dimension, "+
+		"such as photo-150.jpg, for a square crop, such as photo-150x150.jpg")
 
-		fileName := *bucketPrefix + att.fileName
+	flag.BoolVar(&c.ThreePart, "threepart", c.ThreePart, "take a third number following the dimensions, such as 80 in "+
+		"photo-600x340x80.jpg, for a quality of the crop, which is ignored when crops are matched")
 
-		// Trim out the extension.
-		query.Prefix = fileName[:len(fileName)-len(att.ext)]
+	flag.BoolVar(&c.FixDupeDims, "fixdupedims", c.FixDupeDims, "collapse crop references with duplicated dimensions, "+
+		"such as photo-300x200-300x200.jpg, to a single crop")
 
-		var exists bool
+	flag.IntVar(&c.ProgressEvery, "progressevery", c.ProgressEvery, "print how many posts have been scanned and "+
+		"updated after every this many posts (0 means never)")
 
-		it := handle.Objects(context.Background(), &query)
-		for {
-			obj, err = it.Next()
-			if err == iterator.Done {
-				break
-			}
-			if err != nil {
-				return err
-			}
+	flag.BoolVar(&c.Verbose, "verbose", c.Verbose, "verbose mode, printing each replacement made")
+	flag.BoolVar(&c.Quiet, "quiet", c.Quiet, "print only warnings, errors, and the summary of the run")
 
-			if fileName == obj.Name {
-				exists = true
-				continue
-			}
+	flag.StringVar(&c.LogFormat, "logformat", c.LogFormat, "the format of the messages printed: text or json, which "+
+		"writes each message as a JSON object on a line of its own")
 
-			if dimensions := getCropVariant(strings.TrimPrefix(obj.Name, query.Prefix), att.ext); dimensions != nil {
-				att.crops = append(att.crops, *dimensions)
-			}
-		}
+	flag.BoolVar(&c.Explain, "explain", c.Explain, "print how each crop reference in a sample of posts is handled")
+	flag.IntVar(&c.ExplainSample, "explainsample", c.ExplainSample, "the maximum number of posts with crop references "+
+		"to explain")
 
-		if !exists {
-			printErr(fmt.Sprintf("there is no file named %v", fileName), errMissingFile)
-		}
-	}
-	return nil
-}
+	flag.BoolVar(&c.ShowDiff, "showdiff", c.ShowDiff, "print for each post changed the parts of its content around "+
+		"each change, with the text replaced marked as [-old-]{+new+}")
 
-var errMissingFile = errors.New("missing file for an attachment")
+	flag.IntVar(&c.BatchSize, "batchsize", c.BatchSize, "the number of posts to update together with each UPDATE "+
+		"statement")
 
-// getCropVariant says whether the object with the name ending in fileNameEnd is a variant crop of an object
-// whose name without .ext has been trimmed out of fileNameEnd.
-// If the file name gives a crop variant, this function returns the dimensions of the crop, but otherwise it
-// returns nil.
-func getCropVariant(fileNameEnd, ext string) *crop {
-	if fileNameEnd == "" || fileNameEnd[0] != '-' {
-		return nil
-	}
-	var wBytes, hBytes []byte
-	var wSet, hSet bool
-charLoop:
-	for i := 1; i < len(fileNameEnd); i++ {
-		c := fileNameEnd[i]
-		switch {
-		case wSet && hSet:
-			break charLoop
-		case c >= '0' && c <= '9':
-			if !wSet {
-				wBytes = append(wBytes, c)
-			} else if !hSet {
-				hBytes = append(hBytes, c)
-			} else {
-				return nil // We have "###x###.###" or "###x###x###"
-			}
-		case c == 'x':
-			wSet = true
-		case c == '.':
-			hSet = true
-		default:
-			return nil
-		}
-	}
-	if len(wBytes) == 0 || len(hBytes) == 0 {
-		return nil
-	}
-	w, h := string(wBytes), string(hBytes)
-	if !strings.HasPrefix(fileNameEnd, "-"+w+"x"+h+ext) {
-		// If the string does not have this prefix, then it cannot be a variant crop.
-		// It could have some other extension, or it could have something else in its name following
-		// whatever wxh string it has after fileNameEnd.
-		return nil
-	}
-	width, err := strconv.ParseUint(w, 10, 64)
-	if err != nil {
-		fmt.Printf("Expecting to be able to parse a number out of %q; %v\n", w, err)
-		return nil
-	}
-	height, err := strconv.ParseUint(h, 10, 64)
-	if err != nil {
-		fmt.Printf("Expecting to be able to parse a number out of %q; %v\n", h, err)
-		return nil
-	}
-	return &crop{str: w + "x" + h, width: width, height: height}
-}
+	flag.BoolVar(&c.DryRun, "dryrun", c.DryRun, "print the changes that would be made without modifying the database")
 
-// replaceImageCrops loops through each post with post_type = postType and replaces occurrences of usage of each
-// non-existent image crop with an existing variant of the image.
-func replaceImageCrops(db *sql.DB, postType string, files []attachment) error {
-	var rows *sql.Rows
-	var update *sql.Stmt
-	rollback := func(tx *sql.Tx) {
-		if update != nil {
-			if err := update.Close(); err != nil {
-				printErr("closing prepared statement before rollback", err)
-			}
-		}
-		if rows != nil {
-			if err := rows.Close(); err != nil {
-				printErr("closing rows before rollback", err)
-			}
-		}
-		if err := tx.Rollback(); err != nil {
-			printErr("rolling back after failure", err)
-		}
-	}
-	tx, err := db.Begin()
-	if err != nil {
-		return fmt.Errorf("could not begin transaction; %v", err)
-	}
-	var count int64
-	if err := tx.QueryRow(
-		fmt.Sprintf("SELECT COUNT(*) FROM `%s` WHERE post_type = ?", tableName()), postType).
-		Scan(&count); err != nil {
-		rollback(tx)
-		return fmt.Errorf("counting rows; %v", err)
-	}
-	type post struct {
-		ID      int64
-		content string
-	}
-	posts := make([]post, 0, count)
-	{
-		rows, err = tx.Query(fmt.Sprintf("SELECT ID, post_content FROM `%s` WHERE post_type = ? ORDER BY ID", tableName()),
-			postType)
-		if err != nil {
-			rollback(tx)
-			return fmt.Errorf("could not query for rows; %v", err)
-		}
-		var p post
-		for rows.Next() {
-			if err := rows.Scan(&p.ID, &p.content); err != nil {
-				rollback(tx)
-				return err
-			}
-			posts = append(posts, p)
-		}
-		if err := rows.Err(); err != nil {
-			rollback(tx)
-			return err
-		}
-		if err := rows.Close(); err != nil {
-			printErr("closing rows before commit", err)
-		}
-	}
-	update, err = tx.Prepare(fmt.Sprintf("UPDATE `%s` SET post_content = ? WHERE ID = ?", tableName()))
-	if err != nil {
-		rollback(tx)
-		return fmt.Errorf("could not prepare update statement; %v", err)
-	}
-	for i := range posts {
-		got := replaceCrops(posts[i].content, files)
-		if got != posts[i].content {
-			fmt.Println("Updating", posts[i].ID)
-			res, err := update.Exec(got, posts[i].ID)
-			if err != nil {
-				rollback(tx)
-				return fmt.Errorf("could not update row %d; %v", posts[i].ID, err)
-			}
-			affected, err := res.RowsAffected()
-			if err != nil {
-				rollback(tx)
-				return fmt.Errorf("could not check for rows affected; %v", err)
-			}
-			if affected != 1 {
-				rollback(tx)
-				return fmt.Errorf("after update results say %d rows affected", affected)
-			}
-		}
-	}
-	fmt.Println("Committing database modifications.")
-	return tx.Commit()
-}
+	flag.BoolVar(&c.Check, "check", c.Check, "like dryrun, but exit with the code 1 if any crop reference "+
+		"needs to be replaced, or 2 if the run fails")
 
-func replaceCrops(content string, files []attachment) string {
-	for i := range files {
-		content = replaceContentSingle(content, &files[i])
-	}
-	return content
-}
+	flag.BoolVar(&c.SkipOversizedPackets, "skipoversizedpackets", c.SkipOversizedPackets, "skip posts whose updated "+
+		"content would exceed the server's max_allowed_packet instead of failing")
 
-func replaceContentSingle(content string, file *attachment) string {
-	trimmed := file.fileName[:len(file.fileName)-len(file.ext)] // removes the trailing dot and extension
-	lenTrimmed := len(trimmed)
-	replacements := make(map[string]string, 4)
-	for _, indx := range stringIndexes(content, trimmed) {
-		crop := getCropVariant(content[indx+lenTrimmed:], file.ext)
-		if crop != nil {
-			good, okDiff := findSuitableCrop(crop, file.crops)
-			if !good {
-				old := trimmed + "-" + crop.str + file.ext
-				if okDiff > -1 {
-					fmt.Printf("Using width %v instead of %v for %s\n", file.crops[okDiff].width, crop.width, file.fileName)
-					replacements[old] = trimmed + "-" + file.crops[okDiff].str + file.ext
-				} else {
-					// If there is no crop that's within the tolerated range, use the un-cropped variant.
-					replacements[old] = file.fileName
-				}
-			}
-		}
-	}
-	for origFile, newFile := range replacements {
-		fmt.Printf("Replacing %q with %q\n", origFile, newFile)
-		content = strings.Replace(content, origFile, newFile, -1)
-	}
-	return content
-}
+	flag.BoolVar(&c.WarnNoCrops, "warnnocrops", c.WarnNoCrops, "warn about each attachment whose file is in the "+
+		"bucket but that has no crops there")
 
-// findSuitableCrop checks if there is a suitable crop in the bucket for the crop found in a post.
-// If the crop in the post is already in the bucket, a true is returned. If it isn't, then okDiff is an index
-// to a close variant in the haveInBucket slice if there is a close variant; otherwise the int returned is -1.
-func findSuitableCrop(inPost *crop, haveInBucket []crop) (good bool, okDiff int) {
-	okDiff = -1
-	type variant struct {
-		diff float64
-		indx int
-	}
-	var okVariants []variant
-	for i := range haveInBucket {
-		existing := &haveInBucket[i]
-		if inPost.width == existing.width && inPost.height == existing.height {
-			good = true
-			return
-		}
-		diff := math.Abs(float64(inPost.width)-float64(existing.width)) / float64(inPost.width) * 100.0
-		if diff <= *widthDiffTolerance {
-			okVariants = append(okVariants, variant{diff: diff, indx: i})
-		}
-	}
-	// At this point, good == false and okDiff = -1.
-	if len(okVariants) > 0 {
-		// Find the closest variant.
-		okDiff = okVariants[0].indx
-		diff := okVariants[0].diff
-		for _, variant := range okVariants[1:] {
-			if variant.diff < diff {
-				okDiff = variant.indx
-				diff = variant.diff
-			}
-		}
-	}
-	return
-}
+	flag.StringVar(&c.MissingOut, "missingout", c.MissingOut, "a file to write a CSV list of the attachments whose "+
+		"file is missing from the bucket to")
 
-// stringIndexes returns the indexes of s at which there is substr.
-func stringIndexes(s, substr string) (indexes []int) {
-	offset := 0
-	for {
-		i := strings.Index(s, substr)
-		if i == -1 {
-			return
-		}
-		indexes = append(indexes, offset+i)
-		move := i + len(substr)
-		offset += move
-		s = s[move:]
-	}
-	return
-}
+	flag.StringVar(&c.Inventory, "inventory", c.Inventory, "a file to write a CSV list of the crops in the "+
+		"bucket of each attachment to")
 
-// printErr prints the message msg with the non-nil error.
-func printErr(msg string, err error) {
-	fmt.Println(chalk.Red.Color(fmt.Sprintf("ERROR %v: %v", msg, err)))
-}
+	flag.StringVar(&c.Rules, "rules", c.Rules, "a file of rules, one per line, each giving the dimensions of missing "+
+		"crops, such as 300x300 or 150x*, and the dimensions of the crop to use instead or full for the un-cropped "+
+		"image")
 
-// makeConn creates a sql.DB object to use with connections to the database.
-// The program will terminate if a connection cannot be established.
-func makeConn(host, dbName, user, pass string) *sql.DB {
-	config := mysql.NewConfig()
-	config.Net = "tcp"
-	config.Addr = host
-	config.DBName = dbName
-	config.User = user
-	config.Passwd = pass
-	db, err := sql.Open("mysql", config.FormatDSN())
-	if err != nil {
-		printErr("connecting to database", err)
-		os.Exit(1)
-	}
-	db.SetConnMaxLifetime(time.Minute * 15)
-	return db
+	flag.StringVar(&c.Checkpoint, "checkpoint", c.Checkpoint, "a file recording the highest ID of the posts "+
+		"committed, which are committed in chunks, so that a run can be resumed after that ID with the same file; "+
+		"with scanorder random, the file records the ID of every post committed")
+	flag.IntVar(&c.CheckpointEvery, "checkpointevery", c.CheckpointEvery, "the number of posts committed in each "+
+		"chunk with checkpoint")
+
+	flag.StringVar(&c.Report, "report", c.Report, "a file to write a JSON report of the replacements made in "+
+		"each post to")
+
+	flag.StringVar(&c.Restore, "restore", c.Restore, "instead of replacing crops, set the posts in this "+
+		"backup file, written with the backup argument, back to the values backed up")
+
+	flag.StringVar(&c.Backup, "backup", c.Backup, "a file to append the original values of the columns "+
+		"changed in each post to as JSON, before the updates are committed")
+
+	flag.StringVar(&c.AuditBucket, "auditbucket", c.AuditBucket, "a bucket on the same backend to upload the content "+
+		"of each changed post to, before and after the change")
+	flag.StringVar(&c.AuditPrefix, "auditprefix", c.AuditPrefix, "the prefix of the names of the objects in the audit "+
+		"bucket")
+	flag.BoolVar(&c.AuditContinue, "auditcontinue", c.AuditContinue, "update posts even if their content could not be "+
+		"uploaded to the audit bucket")
+
+	flag.BoolVar(&c.Verify, "verify", c.Verify, "report what would be needed to fix each post without modifying the "+
+		"database")
+
+	flag.StringVar(&c.ExtraColumns, "extracolumns", c.ExtraColumns, "a comma-separated list of other columns of the "+
+		"posts table, such as post_excerpt, to replace crops in")
+
+	flag.BoolVar(&c.SignURLs, "signurls", c.SignURLs, "replace crop references with signed URLs to the objects chosen "+
+		"(GCS only)")
+	flag.StringVar(&c.SignKey, "signkey", c.SignKey, "the JSON key file of the service account to sign URLs with")
+	flag.DurationVar(&c.SignExpiry, "signexpiry", c.SignExpiry, "how long after the run signed URLs expire")
+
+	flag.StringVar(&c.EdgeMap, "edgemap", c.EdgeMap, "instead of modifying the database, write a JSON map of missing "+
+		"crop URLs to replacement URLs to this file")
+
+	flag.BoolVar(&c.ScanMeta, "scanmeta", c.ScanMeta, "also replace crops in the meta values of the posts transformed")
+
+	flag.StringVar(&c.StatsOut, "statsout", c.StatsOut, "a file to write the counts and metadata of the run to as JSON")
+
+	flag.DurationVar(&c.Timeout, "timeout", c.Timeout, "how long the run may take before it's cancelled and the "+
+		"transaction is rolled back (0 means no limit)")
+
+	flag.DurationVar(&c.MaxRuntime, "maxruntime", c.MaxRuntime, "how long the run may take, after which the posts "+
+		"updated are committed and the program exits with the code 3 so it can be run again (0 means no limit)")
+
+	flag.BoolVar(&c.DumpSQL, "dumpsql", c.DumpSQL, "print each UPDATE statement with its arguments, long values "+
+		"truncated, just before it's executed")
 }
 
-// tableName returns the name of the "wp_posts" database table.
-func tableName() string {
-	return *dbPrefix + "posts"
+// cancelOnInterrupt calls cancel when the program receives an interrupt signal. A second interrupt terminates
+// the program as usual.
+func cancelOnInterrupt(cancel context.CancelFunc) {
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	go func() {
+		<-interrupt
+		signal.Stop(interrupt)
+		fmt.Fprintln(os.Stderr, "Interrupted, so stopping and rolling back.")
+		cancel()
+	}()
 }